@@ -7,9 +7,25 @@ import (
 	"log"
 	"net/http"
 	"os/signal"
+	"sort"
+	"strings"
 	appstore "subscription-server/internal/applestore"
+	"subscription-server/internal/appstoreapi"
+	"subscription-server/internal/archive"
+	"subscription-server/internal/config"
+	"subscription-server/internal/consumption"
+	"subscription-server/internal/credits"
+	"subscription-server/internal/deadletter"
 	"subscription-server/internal/deps"
-	"subscription-server/internal/logger"
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/expiry"
+	"subscription-server/internal/extensions"
+	"subscription-server/internal/ingest"
+	loggerPkg "subscription-server/internal/logger"
+	"subscription-server/internal/offers"
+	"subscription-server/internal/projection"
+	"subscription-server/internal/refunds"
+	"subscription-server/internal/signing"
 	"subscription-server/internal/storage"
 	httpTransport "subscription-server/internal/transport/http"
 	"syscall"
@@ -18,7 +34,58 @@ import (
 
 func main() {
 
-	localStorage := storage.NewMemoryStorage()
+	cfg := config.Load()
+
+	localStorage, err := newStorage(cfg)
+	if err != nil {
+		log.Fatalf("failed to init storage: %v", err)
+	}
+	if err := checkStores(cfg, localStorage); err != nil {
+		log.Fatalf("failed to init storage: %v", err)
+	}
+	events, ok := localStorage.(storage.EventStore)
+	if !ok {
+		events = storage.NewMemoryEventStore()
+	}
+	deadLetters, ok := localStorage.(storage.DeadLetterStore)
+	if !ok {
+		deadLetters = storage.NewMemoryDeadLetterStore()
+	}
+	purchases, ok := localStorage.(storage.PurchaseStore)
+	if !ok {
+		purchases = storage.NewMemoryPurchaseStore()
+	}
+	apiCalls, ok := localStorage.(storage.APICallLog)
+	if !ok {
+		apiCalls = storage.NewMemoryAPICallLog()
+	}
+	renewalExtensions, ok := localStorage.(storage.ExtensionStore)
+	if !ok {
+		renewalExtensions = storage.NewMemoryExtensionStore()
+	}
+	refundHistory, ok := localStorage.(storage.RefundStore)
+	if !ok {
+		refundHistory = storage.NewMemoryRefundStore()
+	}
+	notifications, durableQueue := localStorage.(storage.NotificationQueue)
+	requestArchive, err := newRequestArchive(cfg, localStorage)
+	if err != nil {
+		log.Fatalf("failed to init request archive: %v", err)
+	}
+
+	logger, err := loggerPkg.NewLogger()
+	if err != nil {
+		// Panic
+		log.Panicf("failed to create logger: %v", err)
+	}
+
+	if cfg.CacheMaxEntries > 0 {
+		localStorage = storage.NewCachedStorage(localStorage, storage.CacheOptions{
+			MaxEntries: cfg.CacheMaxEntries,
+			TTL:        cfg.CacheTTL,
+			Logger:     logger,
+		})
+	}
 
 	port := ":443"
 
@@ -36,21 +103,136 @@ func main() {
 		MinVersion:   tls.VersionTLS12,
 	}
 
-	logger, err := logger.NewLogger()
-	if err != nil {
-		// Panic
-		log.Panicf("failed to create logger: %v", err)
-	}
-
 	validator := appstore.NewAppleJWSValidator()
 	decoder := appstore.NewAppleDecoder(validator)
 	parser := appstore.NewAppleParser(decoder)
 
+	// ctx lives as long as the server; background work stops with it.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	dlq := deadletter.NewQueue(deadLetters, logger, deadletter.Options{MaxEntries: cfg.DeadLetterMax})
+	entitlements := entitlement.NewEngine(entitlement.Policy{
+		HonourGracePeriod:  cfg.GracePeriodAccess,
+		BillingRetryAccess: cfg.BillingRetryAccess,
+		Environments:       cfg.Environments,
+		FamilySharing:      cfg.FamilySharing,
+		FamilyProducts:     cfg.FamilyProducts,
+		MaxRefunds:         cfg.MaxRefunds,
+		MaxRefundRate:      cfg.MaxRefundRate,
+	})
+	refundTracker := refunds.NewTracker(refundHistory, events, entitlements)
+	appleOpts := []appstore.Option{
+		appstore.WithEventStore(events),
+		appstore.WithPurchases(purchases),
+		appstore.WithNonRenewingPeriods(cfg.NonRenewingPeriods),
+		appstore.WithCreditProducts(cfg.CreditProducts),
+		appstore.WithSubscriptionGroups(cfg.SubscriptionGroups),
+		appstore.WithRenewalExtensions(renewalExtensions),
+		appstore.WithRefunds(refundHistory),
+		appstore.WithReceiptVerifier(appstore.NewReceiptVerifier(appstore.ReceiptOptions{
+			VerifyURL:    cfg.VerifyReceiptURL,
+			SandboxURL:   cfg.ReceiptSandboxURL,
+			SharedSecret: cfg.AppleSharedSecret,
+		})),
+		appstore.WithLegacyPurchasers(appstore.LegacyPurchasers{
+			ProductID: cfg.LegacyProductID,
+			Version:   cfg.LegacyAppVersion,
+			Before:    cfg.LegacyBefore,
+		}),
+		appstore.WithEntitlements(entitlements),
+		appstore.WithDeadLetters(dlq),
+		appstore.WithBundleIDs(cfg.AppleBundleIDs...),
+	}
+
+	// The App Store Connect key signs offers and App Store Server API calls.
+	var (
+		offerSigner offers.Signer
+		extender    extensions.Extender
+		reports     consumption.BackgroundReporter
+	)
+	if cfg.AppleKeyPath != "" {
+		key, err := signing.LoadKey(cfg.AppleKeyID, cfg.AppleKeyPath)
+		if err != nil {
+			log.Fatalf("failed to load App Store Connect key: %v", err)
+		}
+		offerSigner = offers.NewSigner(key, localStorage, entitlements, offers.Options{
+			BundleIDs: cfg.AppleBundleIDs,
+			IssuerID:  cfg.AppleIssuerID,
+			Groups:    cfg.SubscriptionGroups,
+			Rules:     cfg.OfferRules,
+			Customers: parser,
+			Claims:    purchases,
+			Refunds:   refundTracker,
+		})
+		if cfg.AppleIssuerID != "" && len(cfg.AppleBundleIDs) > 0 {
+			// API tokens name one bundle, and nothing stored tells which
+			// app a subscription belongs to.
+			if len(cfg.AppleBundleIDs) > 1 {
+				log.Fatalf("the App Store Server API needs exactly one bundle in APPLE_BUNDLE_IDS, got %d", len(cfg.AppleBundleIDs))
+			}
+			apiClient := appstoreapi.NewClient(appstoreapi.Options{
+				Key:      key,
+				IssuerID: cfg.AppleIssuerID,
+				BundleID: cfg.AppleBundleIDs[0],
+			})
+			reporter := consumption.NewReporter(apiClient, events, purchases, apiCalls, consumption.Options{
+				CustomerConsented:     cfg.ConsumptionConsent,
+				SampleContentProvided: cfg.ConsumptionSamples,
+				RefundPreference:      cfg.RefundPreference,
+				USDRates:              cfg.ConsumptionRates,
+			})
+			// Reports retry with backoff, so they run outside notification
+			// handling.
+			reports = consumption.NewBackgroundReporter(ctx, reporter, dlq, logger)
+			appleOpts = append(appleOpts, appstore.WithConsumptionReporter(reports))
+			extender = extensions.NewExtender(apiClient, localStorage, renewalExtensions, apiCalls, extensions.Options{})
+		}
+	}
+	var ingestor ingest.Ingestor
+	switch cfg.IngestMode {
+	case "sync":
+	case "async":
+		// Async mode answers Apple before processing, so a notification
+		// only kept in memory would be lost on restart.
+		if !durableQueue {
+			log.Fatalf("INGEST_MODE=async needs a storage driver with a durable notification queue, %q has none", cfg.StorageDriver)
+		}
+		ingestor = ingest.NewIngestor(notifications, dlq, logger, ingest.Options{
+			Workers:   cfg.IngestWorkers,
+			QueueSize: cfg.IngestQueueSize,
+			Lease:     cfg.IngestLease,
+		})
+		appleOpts = append(appleOpts, appstore.WithIngestor(ingestor))
+	default:
+		log.Fatalf("unknown ingest mode: %q", cfg.IngestMode)
+	}
+	appleService := appstore.NewAppleStoreService(localStorage, logger, parser, appleOpts...)
+	dlq.Register(storage.EventSourceAppleServer, appleService.ProcessProviderPayload)
+	if ingestor != nil {
+		ingestor.Register(storage.EventSourceAppleServer, appleService.ProcessProviderPayload)
+	}
+
+	replayer := appstore.NewAppleReplayer(cfg.AppleBundleIDs...)
+	replayer.SetSubscriptionGroups(cfg.SubscriptionGroups)
+
 	// Init dependencies
 	deps := &deps.Deps{
 		Storage:      localStorage,
+		Events:       events,
+		Archive:      requestArchive,
 		Logger:       logger,
-		AppleService: appstore.NewAppleStoreService(localStorage, logger, parser),
+		AppleService: appleService,
+		Purchases:    purchases,
+		Credits:      credits.NewLedger(purchases, credits.Options{}),
+		Projection:   projection.NewEngine(events, localStorage, replayer, logger),
+		DeadLetters:  dlq,
+		Entitlements: entitlements,
+		AdminToken:   cfg.AdminToken,
+		APICalls:     apiCalls,
+		Offers:       offerSigner,
+		Extensions:   extender,
+		Refunds:      refundTracker,
 	}
 
 	// HTTP server
@@ -60,8 +242,18 @@ func main() {
 		TLSConfig: tlsConfig,
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	if requestArchive != nil {
+		go archive.RunRetention(ctx, requestArchive, logger, cfg.ArchiveRetention, time.Hour)
+	}
+	if cfg.ExpirySweepEvery > 0 {
+		sweeper := expiry.NewSweeper(localStorage, events, logger, expiry.Options{})
+		go sweeper.Run(ctx, cfg.ExpirySweepEvery)
+	}
+	if ingestor != nil {
+		if err := ingestor.Start(ctx); err != nil {
+			log.Fatalf("failed to start ingestor: %v", err)
+		}
+	}
 
 	fmt.Println("Starting server on https://localhost" + port)
 	go func() {
@@ -75,7 +267,104 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("server shutdown failed: %v", err)
 	}
+	if ingestor != nil {
+		ingestor.Wait()
+	}
+	if reports != nil {
+		reports.Wait()
+	}
 	fmt.Println("Server exited properly")
+	if cached, ok := localStorage.(storage.CachedStorage); ok {
+		stats := cached.Stats()
+		logger.Log(loggerPkg.LogMessage{
+			Time:    time.Now(),
+			Level:   "INFO",
+			Sender:  "storage",
+			Message: fmt.Sprintf("cache stats: hits=%d misses=%d evictions=%d invalidations=%d", stats.Hits, stats.Misses, stats.Evictions, stats.Invalidations),
+		})
+	}
+	localStorage.Close()
 	logger.Close()
 
 }
+
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch cfg.StorageDriver {
+	case "memory":
+		return storage.NewMemoryStorage(), nil
+	case "sqlite":
+		return storage.NewSQLiteStorage(ctx, cfg.SQLitePath)
+	case "redis":
+		return storage.NewRedisStorage(ctx, storage.RedisOptions{
+			Addr:      cfg.RedisAddr,
+			Password:  cfg.RedisPassword,
+			DB:        cfg.RedisDB,
+			KeyPrefix: cfg.RedisKeyPrefix,
+		})
+	case "postgres":
+		return storage.NewPostgresStorage(ctx, cfg.DatabaseURL, storage.PostgresOptions{
+			MaxOpenConns:    cfg.DBMaxOpenConns,
+			MaxIdleConns:    cfg.DBMaxIdleConns,
+			ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %q", cfg.StorageDriver)
+	}
+}
+
+// checkStores makes sure a persistent storage driver keeps every store, so
+// that none of them falls back to memory. Only the memory driver uses the
+// memory stores.
+func checkStores(cfg *config.Config, st storage.Storage) error {
+	if cfg.StorageDriver == "memory" {
+		return nil
+	}
+	var missing []string
+	for name, ok := range map[string]bool{
+		"events":          implements[storage.EventStore](st),
+		"dead letters":    implements[storage.DeadLetterStore](st),
+		"purchases":       implements[storage.PurchaseStore](st),
+		"api calls":       implements[storage.APICallLog](st),
+		"extensions":      implements[storage.ExtensionStore](st),
+		"refunds":         implements[storage.RefundStore](st),
+		"request archive": implements[storage.RequestArchive](st),
+	} {
+		if !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("storage driver %q does not store %s", cfg.StorageDriver, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func implements[T any](st storage.Storage) bool {
+	_, ok := st.(T)
+	return ok
+}
+
+// newRequestArchive returns nil when archival is disabled. The "storage" driver
+// keeps requests in the storage backend, in memory only for the memory driver.
+func newRequestArchive(cfg *config.Config, st storage.Storage) (storage.RequestArchive, error) {
+	switch cfg.ArchiveDriver {
+	case "none":
+		return nil, nil
+	case "file":
+		return archive.NewFileArchive(cfg.ArchiveDir)
+	case "storage":
+		if a, ok := st.(storage.RequestArchive); ok {
+			return a, nil
+		}
+		if cfg.StorageDriver != "memory" {
+			return nil, fmt.Errorf("storage driver %q has no request archive", cfg.StorageDriver)
+		}
+		return storage.NewMemoryRequestArchive(), nil
+	default:
+		return nil, fmt.Errorf("unknown archive driver: %q", cfg.ArchiveDriver)
+	}
+}
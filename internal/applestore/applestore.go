@@ -1,31 +1,186 @@
 package applestore
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"subscription-server/internal/archive"
 	"subscription-server/internal/contracts"
-	tools "subscription-server/internal/helpers"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/ingest"
 	"subscription-server/internal/logger"
 	"subscription-server/internal/storage"
 	"time"
 )
 
+const maxNotificationSize = 1 << 20
+
 type appleStoreService struct {
 	storage storage.Storage
 	logger  logger.Logger
 	parser  *appleParser
+	machine *appleStateMachine
+	events  storage.EventStore
+	dlq     deadletter.Queue
+	ingest  ingest.Ingestor
+	policy  entitlement.Engine
+	// purchases keeps everything but auto-renewable subscriptions.
+	purchases storage.PurchaseStore
+	// consumption answers CONSUMPTION_REQUEST notifications, if set.
+	consumption ConsumptionReporter
+	// extensions tracks mass renewal extensions, if set.
+	extensions storage.ExtensionStore
+	// refunds keeps the refund history, if set.
+	refunds storage.RefundStore
+	// receipts validates StoreKit 1 app receipts.
+	receipts ReceiptVerifier
+	// legacy grants paid-app customers their entitlement, if enabled.
+	legacy LegacyPurchasers
+}
+
+// ConsumptionReporter sends Apple the consumption information it asks for
+// in a CONSUMPTION_REQUEST notification, see the consumption package. It is
+// called while the notification is handled, so it should not wait on Apple;
+// an error sends the notification to the dead-letter queue.
+type ConsumptionReporter interface {
+	ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error
+}
+
+type Option func(*appleStoreService)
+
+// WithEventStore records every processed notification in ev.
+func WithEventStore(ev storage.EventStore) Option {
+	return func(s *appleStoreService) {
+		s.events = ev
+	}
+}
+
+// WithPurchases stores one-off purchases (non-consumables, consumables and
+// non-renewing subscriptions) in ps. Without it they are kept in memory.
+func WithPurchases(ps storage.PurchaseStore) Option {
+	return func(s *appleStoreService) {
+		s.purchases = ps
+	}
+}
+
+// WithNonRenewingPeriods sets the period granted by each non-renewing
+// subscription product. Purchases of other non-renewing products fail.
+func WithNonRenewingPeriods(periods map[string]time.Duration) Option {
+	return func(s *appleStoreService) {
+		s.machine.setPeriods(periods)
+	}
+}
+
+// WithCreditProducts makes the listed consumables credit credits.Account with
+// the given number of credits per unit.
+func WithCreditProducts(amounts map[string]int64) Option {
+	return func(s *appleStoreService) {
+		s.machine.setCredits(amounts)
+	}
+}
+
+// WithSubscriptionGroups declares the products of each subscription group by
+// level, highest level of service first, so that plan changes are applied
+// when the user actually gets the new product.
+func WithSubscriptionGroups(groups map[string][]string) Option {
+	return func(s *appleStoreService) {
+		s.machine.SetSubscriptionGroups(groups)
+	}
+}
+
+// WithConsumptionReporter answers CONSUMPTION_REQUEST notifications through
+// r. A failed report fails the notification.
+func WithConsumptionReporter(r ConsumptionReporter) Option {
+	return func(s *appleStoreService) {
+		s.consumption = r
+	}
+}
+
+// WithRenewalExtensions completes the mass renewal extensions in ext when
+// Apple reports their summary.
+func WithRenewalExtensions(ext storage.ExtensionStore) Option {
+	return func(s *appleStoreService) {
+		s.extensions = ext
+	}
+}
+
+// WithRefunds records every refund, reversed refund and declined refund
+// request in rs.
+func WithRefunds(rs storage.RefundStore) Option {
+	return func(s *appleStoreService) {
+		s.refunds = rs
+	}
+}
+
+// WithReceiptVerifier validates StoreKit 1 app receipts with v. Without it
+// receipts are validated locally only.
+func WithReceiptVerifier(v ReceiptVerifier) Option {
+	return func(s *appleStoreService) {
+		s.receipts = v
+	}
+}
+
+// WithDeadLetters puts server notifications that fail processing into q.
+func WithDeadLetters(q deadletter.Queue) Option {
+	return func(s *appleStoreService) {
+		s.dlq = q
+	}
 }
 
-func NewAppleStoreService(st storage.Storage, l logger.Logger, p *appleParser) contracts.Service {
-	return &appleStoreService{
+// WithIngestor switches server notifications to asynchronous processing:
+// they are validated, queued in in and acknowledged right away.
+func WithIngestor(in ingest.Ingestor) Option {
+	return func(s *appleStoreService) {
+		s.ingest = in
+	}
+}
+
+// WithEntitlements decides at read time whether a stored status grants
+// access. Without it entitlement.DefaultPolicy applies.
+func WithEntitlements(e entitlement.Engine) Option {
+	return func(s *appleStoreService) {
+		s.policy = e
+	}
+}
+
+// WithBundleIDs rejects server notifications for any other bundle.
+func WithBundleIDs(ids ...string) Option {
+	return func(s *appleStoreService) {
+		s.machine.allowBundles(ids...)
+	}
+}
+
+func NewAppleStoreService(st storage.Storage, l logger.Logger, p *appleParser, opts ...Option) contracts.Service {
+	s := &appleStoreService{
 		storage: st,
 		parser:  p,
+		machine: NewAppleStateMachine(p),
 		logger:  l,
+		policy:  entitlement.NewEngine(entitlement.DefaultPolicy()),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.purchases == nil {
+		s.purchases = storage.NewMemoryPurchaseStore()
+	}
+	if s.receipts == nil {
+		s.receipts = NewReceiptVerifier(ReceiptOptions{})
+	}
+	return s
 }
 
 func (s *appleStoreService) HandleProviderNotification(w http.ResponseWriter, r *http.Request) {
 
+	if s.ingest != nil {
+		s.handleProviderNotificationAsync(w, r)
+		return
+	}
+
 	if err := s.ProcessProviderNotification(r); err != nil {
 		http.Error(w, fmt.Sprintf("failed to process notification: %v", err), http.StatusInternalServerError)
 		return
@@ -35,135 +190,335 @@ func (s *appleStoreService) HandleProviderNotification(w http.ResponseWriter, r
 }
 
 func (s *appleStoreService) processIOSClientNotification(r *http.Request) error {
-	parsedClientNotification, err := s.parser.ParseClientNotification(r.Body)
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
 	if err != nil {
-		return fmt.Errorf("failed to parse client notification: %w", err)
-
+		return fmt.Errorf("failed to read client notification: %w", err)
 	}
 
-	signedTx := parsedClientNotification.SignedTransactionInfo
-	parsedClientTx, err := s.parser.ParseTransaction(signedTx)
+	u, err := s.machine.clientUpdate(body, time.Now().UTC())
 	if err != nil {
-		return fmt.Errorf("failed to parse client transaction: %w", err)
-	}
-	user := parsedClientNotification.AppAccountToken
-	if user == "" {
-		user = "tx:" + parsedClientTx.OriginalTransactionID
-	}
-	expiresAt := tools.MsToTime(parsedClientTx.ExpiresDateMS)
-	now := time.Now().UTC()
-	isActive := !expiresAt.IsZero() && now.Before(expiresAt)
-	if parsedClientTx.RevocationDateMS != nil && *parsedClientTx.RevocationDateMS > 0 {
-		isActive = false
+		return err
 	}
 
-	status := &storage.SubscriptionStatus{
-		ExpiresAt:             expiresAt,
-		UserToken:             user,
-		ProductID:             parsedClientTx.ProductID,
-		OriginalTransactionID: parsedClientTx.OriginalTransactionID,
-		IsActive:              isActive,
-	}
-	if err := s.storage.SetSubscriptionStatus(r.Context(), status); err != nil {
-		return fmt.Errorf("failed to set subscription status: %w", err)
-	}
-
-	return nil
+	return s.apply(r.Context(), u)
 }
 
 func (s *appleStoreService) HandleClientNotification(w http.ResponseWriter, r *http.Request) {
 
 	if err := s.processIOSClientNotification(r); err != nil {
-		http.Error(w, fmt.Sprintf("failed to process iOS client notification: %v", err), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUserTokenMismatch) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, fmt.Sprintf("failed to process iOS client notification: %v", err), status)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// Entitlement is what the status endpoints tell the app: the resolved
+// access and the renewal state it shows to the user. Transaction IDs and the
+// other stored details stay on the server.
+type Entitlement struct {
+	UserToken            string    `json:"userToken"`
+	ProductID            string    `json:"productId,omitempty"`
+	IsActive             bool      `json:"isActive"`
+	ExpiresAt            time.Time `json:"expiresAt,omitzero"`
+	GracePeriodExpiresAt time.Time `json:"gracePeriodExpiresAt,omitzero"`
+	InBillingRetry       bool      `json:"inBillingRetry,omitempty"`
+	AutoRenewEnabled     *bool     `json:"autoRenewEnabled,omitempty"`
+	PendingProductID     string    `json:"pendingProductId,omitempty"`
+}
+
 func (s *appleStoreService) HandleClientRequest(w http.ResponseWriter, r *http.Request) {
 	// Handle Client requests
-	if err := s.processClientRequest(r); err != nil {
+	result, err := s.processClientRequest(r.Context(), r.URL.Query().Get("userToken"))
+	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to process client request: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(result)
 }
 
-func (s *appleStoreService) ProcessProviderNotification(r *http.Request) error {
+// ClientReceipt is the body of a StoreKit 1 receipt submission.
+type ClientReceipt struct {
+	UserToken   string `json:"userToken"`
+	ReceiptData string `json:"receiptData"`
+}
 
-	parsedNotification, err := s.parser.ParseAppStoreNotification(r.Body)
-	if err != nil {
-		return fmt.Errorf("failed to parse notification: %w", err)
+// HandleClientReceipt validates the app receipt an older app version sends
+// and answers the subscription status it proves.
+func (s *appleStoreService) HandleClientReceipt(w http.ResponseWriter, r *http.Request) {
+	var req ClientReceipt
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxNotificationSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.UserToken == "" || req.ReceiptData == "" {
+		http.Error(w, "userToken and receiptData are required", http.StatusBadRequest)
+		return
 	}
 
-	parsedTx, err := s.parser.ParseTransaction(parsedNotification.Data.SignedTransactionInfo)
+	result, err := s.processClientReceipt(r.Context(), &req)
+	switch {
+	case errors.Is(err, ErrInvalidReceipt), errors.Is(err, ErrUnknownBundle):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrNoReceiptSubscription):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrReceiptClaimed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to process client receipt: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *appleStoreService) processClientReceipt(ctx context.Context, req *ClientReceipt) (*Entitlement, error) {
+	receipt, err := s.receipts.VerifyReceipt(ctx, req.ReceiptData)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(receiptPayload{UserToken: req.UserToken, Receipt: receipt})
 	if err != nil {
-		return fmt.Errorf("failed to parse transaction: %w", err)
+		return nil, fmt.Errorf("failed to marshal receipt payload: %w", err)
 	}
+	u, err := s.machine.receiptUpdate(body, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	// The first user to present the subscription keeps it, so one receipt
+	// cannot unlock any number of accounts.
+	owner, err := s.purchases.ClaimOriginalTransaction(ctx, u.status.OriginalTransactionID, req.UserToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim receipt subscription: %w", err)
+	}
+	if owner != req.UserToken {
+		return nil, ErrReceiptClaimed
+	}
+	if err := s.apply(ctx, u); err != nil {
+		return nil, err
+	}
+	return s.processClientRequest(ctx, req.UserToken)
+}
 
-	parsedRenewalInfo, err := s.parser.ParseRenewalInfo(parsedNotification.Data.SignedRenewalInfo)
+func (s *appleStoreService) ProcessProviderNotification(r *http.Request) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
 	if err != nil {
-		return fmt.Errorf("failed to parse renewal info: %w", err)
+		return fmt.Errorf("failed to read notification: %w", err)
 	}
 
-	user := parsedNotification.Data.AppAccountToken
-	if user == "" {
-		user = "tx:" + parsedTx.OriginalTransactionID
+	if err := s.ProcessProviderPayload(r.Context(), body); err != nil {
+		return s.deadLetter(r.Context(), body, err)
 	}
 
-	expiresAt := tools.MsToTime(parsedTx.ExpiresDateMS)
+	return nil
+}
 
-	var grace time.Time
+// deadLetter puts a failed server notification into the dead-letter queue and
+// returns cause. Notifications that failed before their signed transaction
+// was verified are not kept: anyone can post to the endpoint.
+func (s *appleStoreService) deadLetter(ctx context.Context, body []byte, cause error) error {
+	if s.dlq == nil || errors.Is(cause, ErrUnverifiedNotification) {
+		return cause
+	}
+	if err := s.dlq.Record(ctx, storage.EventSourceAppleServer, body, cause); err != nil {
+		return fmt.Errorf("%w (dead-letter failed: %v)", cause, err)
+	}
+	return cause
+}
 
-	if parsedRenewalInfo != nil {
-		if t := tools.MsToTime(parsedRenewalInfo.GracePeriodExpiresDateMS); !t.IsZero() {
-			grace = t
-		}
+// handleProviderNotificationAsync verifies the notification and queues it.
+// A full queue answers 503 so that Apple redelivers later.
+func (s *appleStoreService) handleProviderNotificationAsync(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read notification: %v", err), http.StatusInternalServerError)
+		return
 	}
 
-	activeUntil := expiresAt
-	if grace.After(expiresAt) {
-		activeUntil = grace
+	u, err := s.machine.providerUpdate(body, time.Now().UTC())
+	if err != nil {
+		err = s.deadLetter(r.Context(), body, err)
+		http.Error(w, fmt.Sprintf("failed to process notification: %v", err), http.StatusInternalServerError)
+		return
 	}
 
-	now := time.Now().UTC()
+	err = s.ingest.Enqueue(r.Context(), storage.EventSourceAppleServer, u.event.UserToken, body)
+	switch {
+	case errors.Is(err, ingest.ErrBackpressure):
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to queue notification: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	isActive := !activeUntil.IsZero() && now.Before(activeUntil)
+	w.WriteHeader(http.StatusOK)
+}
 
-	if parsedTx.RevocationDateMS != nil && *parsedTx.RevocationDateMS > 0 {
-		isActive = false
+func (s *appleStoreService) ProcessProviderPayload(ctx context.Context, payload []byte) error {
+	u, err := s.machine.providerUpdate(payload, time.Now().UTC())
+	if err != nil {
+		return err
 	}
-	if parsedNotification.NotificationType == "EXPIRED" {
-		isActive = false
+	if err := s.apply(ctx, u); err != nil {
+		return err
 	}
 
-	status := &storage.SubscriptionStatus{
-		ExpiresAt:             activeUntil,
-		UserToken:             user,
-		ProductID:             parsedTx.ProductID,
-		OriginalTransactionID: parsedTx.OriginalTransactionID,
-		IsActive:              isActive,
+	if u.event.Type == "CONSUMPTION_REQUEST" && s.consumption != nil {
+		return s.consumption.ReportConsumption(ctx, u.event)
 	}
+	return nil
+}
 
-	if err := s.storage.SetSubscriptionStatus(r.Context(), status); err != nil {
-		return fmt.Errorf("failed to set subscription status: %w", err)
+// apply persists the new status or purchase and records the event that
+// produced it.
+func (s *appleStoreService) apply(ctx context.Context, u *update) error {
+	switch {
+	case u.status != nil:
+		// Only family sharing and merged transactions depend on the stored
+		// record.
+		var stored *storage.SubscriptionStatus
+		if u.merge || u.status.OwnershipType == storage.OwnershipFamilyShared {
+			current, err := s.storage.GetSubscriptionStatus(ctx, u.status.UserToken)
+			if err != nil && !errors.Is(err, storage.ErrSubscriptionNotFound) {
+				return fmt.Errorf("failed to get subscription status: %w", err)
+			}
+			stored = current
+		}
+		status := foldStatus(stored, u, time.Now().UTC())
+		if status == stored {
+			break
+		}
+		if err := s.storage.SetSubscriptionStatus(ctx, status); err != nil {
+			return fmt.Errorf("failed to set subscription status: %w", err)
+		}
+	case u.purchase != nil:
+		if err := s.purchases.SavePurchase(ctx, u.purchase); err != nil {
+			return fmt.Errorf("failed to save purchase: %w", err)
+		}
+	case u.credit != nil:
+		if _, err := s.purchases.AppendLedgerEntry(ctx, u.credit); err != nil {
+			return fmt.Errorf("failed to credit purchase: %w", err)
+		}
+	case u.clawback != "":
+		if err := s.clawBack(ctx, u.clawback, u.event.RecordedAt); err != nil {
+			return err
+		}
+	case u.extension != nil:
+		// The summary concerns no single user, so there is no event to
+		// record.
+		return s.completeExtension(ctx, u.extension)
 	}
 
+	if u.refund != nil && s.refunds != nil {
+		refund := *u.refund
+		if refund.OccurredAt.IsZero() {
+			refund.OccurredAt = u.event.RecordedAt
+		}
+		if err := s.refunds.RecordRefund(ctx, &refund); err != nil {
+			return fmt.Errorf("failed to record refund: %w", err)
+		}
+	}
+
+	if s.events == nil {
+		return nil
+	}
+	event := u.event
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = event.RecordedAt
+	}
+	event.ArchiveID = archive.RequestID(ctx)
+	if err := s.events.AppendEvent(ctx, event); err != nil {
+		return fmt.Errorf("failed to record subscription event: %w", err)
+	}
 	return nil
 }
 
-func (s *appleStoreService) processClientRequest(r *http.Request) error {
-	// Process Client requests
-	ctx := r.Context()
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
+// completeExtension records the outcome of a mass renewal extension. One
+// started elsewhere, e.g. in App Store Connect, is recorded as reported.
+func (s *appleStoreService) completeExtension(ctx context.Context, summary *storage.RenewalExtension) error {
+	if s.extensions == nil {
+		return nil
+	}
+	ext, err := s.extensions.GetRenewalExtension(ctx, summary.RequestID)
+	switch {
+	case errors.Is(err, storage.ErrRenewalExtensionNotFound):
+		ext = summary
+	case err != nil:
+		return fmt.Errorf("failed to get renewal extension: %w", err)
 	default:
-		return s.storage.SetSubscriptionStatus(r.Context(), &storage.SubscriptionStatus{
-			UserToken: "client_request",
-			IsActive:  true,
-		})
+		ext.Status = summary.Status
+		ext.SucceededCount = summary.SucceededCount
+		ext.FailedCount = summary.FailedCount
+		ext.CompletedAt = summary.CompletedAt
+	}
+	if err := s.extensions.SaveRenewalExtension(ctx, ext); err != nil {
+		return fmt.Errorf("failed to save renewal extension: %w", err)
+	}
+	return nil
+}
+
+// clawBack reverses the credit creditID, even if that leaves the balance
+// negative. A refund of a transaction that was never credited does nothing.
+func (s *appleStoreService) clawBack(ctx context.Context, creditID string, now time.Time) error {
+	credit, err := s.purchases.GetLedgerEntry(ctx, creditID)
+	if errors.Is(err, storage.ErrLedgerEntryNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up credit: %w", err)
+	}
+
+	_, err = s.purchases.AppendLedgerEntry(ctx, &storage.LedgerEntry{
+		ID:            creditID + ":clawback",
+		UserToken:     credit.UserToken,
+		Account:       credit.Account,
+		Amount:        -credit.Amount,
+		Reason:        storage.LedgerReasonClawback,
+		TransactionID: credit.TransactionID,
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to claw back credit: %w", err)
+	}
+	return nil
+}
+
+// processClientRequest returns the entitlement of userToken, evaluated by
+// the entitlement policy. Unknown users, like a missing token, are not
+// entitled, so the answer doesn't reveal which tokens exist.
+func (s *appleStoreService) processClientRequest(ctx context.Context, userToken string) (*Entitlement, error) {
+	result := &Entitlement{UserToken: userToken}
+	if userToken == "" {
+		return result, nil
+	}
+	status, err := s.storage.GetSubscriptionStatus(ctx, userToken)
+	if errors.Is(err, storage.ErrSubscriptionNotFound) || err == nil && status == nil {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	status = s.policy.Resolve(status, time.Now().UTC())
+	result.ProductID = status.ProductID
+	result.IsActive = status.IsActive
+	result.ExpiresAt = status.ExpiresAt
+	result.GracePeriodExpiresAt = status.GracePeriodExpiresAt
+	result.InBillingRetry = status.InBillingRetry
+	result.AutoRenewEnabled = status.AutoRenewEnabled
+	result.PendingProductID = status.PendingProductID
+	return result, nil
 }
@@ -0,0 +1,259 @@
+package applestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	tools "subscription-server/internal/helpers"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+var (
+	ErrInvalidAppTransaction = errors.New("invalid app transaction")
+	ErrDeviceMismatch        = errors.New("app transaction belongs to another device")
+	// ErrAppTransactionClaimed means the legacy purchaser entitlement of the
+	// app transaction was already granted to another user.
+	ErrAppTransactionClaimed = errors.New("app transaction already granted to another user")
+)
+
+// LegacyPurchasers grandfathers customers who bought the app before it moved
+// to in-app purchases: they are granted ProductID as a non-consumable. A
+// customer qualifies when their original application version is older than
+// Version, or their original purchase older than Before; a zero rule is
+// ignored.
+type LegacyPurchasers struct {
+	ProductID string
+	// Version is compared with the originalApplicationVersion, which is the
+	// CFBundleVersion on iOS, by dot-separated numeric components.
+	Version string
+	Before  time.Time
+}
+
+func (l LegacyPurchasers) enabled() bool {
+	return l.ProductID != "" && (l.Version != "" || !l.Before.IsZero())
+}
+
+func (l LegacyPurchasers) qualifies(tx *AppTransaction) bool {
+	if l.Version != "" && tx.OriginalApplicationVersion != "" && compareVersions(tx.OriginalApplicationVersion, l.Version) < 0 {
+		return true
+	}
+	purchased := tools.MsToTime(tx.OriginalPurchaseDateMS)
+	return !l.Before.IsZero() && !purchased.IsZero() && purchased.Before(l.Before)
+}
+
+// WithLegacyPurchasers enables the app transaction endpoint, which grants
+// legacy purchasers their entitlement.
+func WithLegacyPurchasers(l LegacyPurchasers) Option {
+	return func(s *appleStoreService) {
+		s.legacy = l
+	}
+}
+
+// ClientAppTransaction is the body of an app transaction submission. The app
+// sends AppTransaction.shared's jwsRepresentation, its identifierForVendor
+// and the deviceVerificationNonce of the app transaction.
+type ClientAppTransaction struct {
+	UserToken            string `json:"userToken"`
+	SignedAppTransaction string `json:"signedAppTransaction"`
+	DeviceID             string `json:"deviceId"`
+	Nonce                string `json:"nonce"`
+}
+
+// AppTransactionResult tells the app whether the customer is a legacy
+// purchaser, and the purchase granted if so.
+type AppTransactionResult struct {
+	UserToken                  string            `json:"userToken"`
+	OriginalApplicationVersion string            `json:"originalApplicationVersion"`
+	OriginalPurchaseDate       time.Time         `json:"originalPurchaseDate,omitzero"`
+	LegacyPurchaser            bool              `json:"legacyPurchaser"`
+	Purchase                   *storage.Purchase `json:"purchase,omitempty"`
+}
+
+// HandleAppTransaction verifies a signed AppTransaction and grants the
+// legacy purchaser entitlement to a customer who qualifies.
+func (s *appleStoreService) HandleAppTransaction(w http.ResponseWriter, r *http.Request) {
+	if !s.legacy.enabled() {
+		http.Error(w, "legacy purchasers are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req ClientAppTransaction
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxNotificationSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.UserToken == "" || req.SignedAppTransaction == "" || req.DeviceID == "" || req.Nonce == "" {
+		http.Error(w, "userToken, signedAppTransaction, deviceId and nonce are required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.processAppTransaction(r.Context(), &req)
+	switch {
+	case errors.Is(err, ErrInvalidAppTransaction), errors.Is(err, ErrUnknownBundle):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrDeviceMismatch):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, ErrAppTransactionClaimed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to process app transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *appleStoreService) processAppTransaction(ctx context.Context, req *ClientAppTransaction) (*AppTransactionResult, error) {
+	tx, err := s.parser.ParseAppTransaction(req.SignedAppTransaction)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAppTransaction, err)
+	}
+	if bundle := tx.BundleID; len(s.machine.bundleIDs) > 0 && !s.machine.bundleIDs[bundle] {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBundle, bundle)
+	}
+	if err := verifyDevice(tx, req.DeviceID, req.Nonce); err != nil {
+		return nil, err
+	}
+
+	result := &AppTransactionResult{
+		UserToken:                  req.UserToken,
+		OriginalApplicationVersion: tx.OriginalApplicationVersion,
+		OriginalPurchaseDate:       tools.MsToTime(tx.OriginalPurchaseDateMS),
+	}
+	if !s.legacy.qualifies(tx) {
+		return result, nil
+	}
+
+	u, err := s.legacyUpdate(tx, req.UserToken, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	// The first user to present the app transaction keeps the grant, so one
+	// purchase of the app cannot unlock any number of accounts.
+	stored, err := s.purchases.InsertPurchase(ctx, u.purchase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save purchase: %w", err)
+	}
+	if stored.UserToken != req.UserToken {
+		return nil, ErrAppTransactionClaimed
+	}
+	u.purchase = stored
+	if err := s.apply(ctx, u); err != nil {
+		return nil, err
+	}
+	resolved := s.policy.ResolvePurchases([]storage.Purchase{*stored}, time.Now().UTC())
+	result.LegacyPurchaser = true
+	result.Purchase = &resolved[0]
+	return result, nil
+}
+
+// legacyUpdate grants the legacy purchaser product to user. The grant is one
+// per app transaction, i.e. per Apple Account that bought the app, however
+// often the app sends it.
+func (s *appleStoreService) legacyUpdate(tx *AppTransaction, user string, now time.Time) (*update, error) {
+	if tx.AppTransactionID == "" {
+		return nil, fmt.Errorf("%w: missing appTransactionId", ErrInvalidAppTransaction)
+	}
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal app transaction: %w", err)
+	}
+	purchasedAt := tools.MsToTime(tx.OriginalPurchaseDateMS)
+	if purchasedAt.IsZero() {
+		purchasedAt = now
+	}
+	environment := tx.ReceiptType
+	if environment != "Production" {
+		environment = "Sandbox"
+	}
+	id := "legacy:" + tx.AppTransactionID
+
+	purchase := &storage.Purchase{
+		TransactionID:         id,
+		OriginalTransactionID: tx.AppTransactionID,
+		UserToken:             user,
+		ProductID:             s.legacy.ProductID,
+		ProductType:           storage.ProductTypeNonConsumable,
+		PurchasedAt:           purchasedAt,
+		Environment:           environment,
+		OwnershipType:         "PURCHASED",
+	}
+	event := &storage.SubscriptionEvent{
+		ID:                    id,
+		UserToken:             user,
+		Source:                storage.EventSourceAppTransaction,
+		Type:                  "APP_TRANSACTION",
+		TransactionID:         id,
+		OriginalTransactionID: tx.AppTransactionID,
+		ProductID:             s.legacy.ProductID,
+		OccurredAt:            now,
+		RecordedAt:            now,
+		RawPayload:            string(payload),
+		TransactionType:       storage.ProductTypeNonConsumable,
+		OwnershipType:         "PURCHASED",
+		Environment:           environment,
+		PurchaseDate:          purchasedAt,
+	}
+	return &update{purchase: purchase, event: event}, nil
+}
+
+// verifyDevice checks that the app transaction was issued to the device
+// whose identifierForVendor is deviceID: deviceVerification is the SHA-384
+// hash of the lowercase nonce followed by the lowercase device UUID.
+func verifyDevice(tx *AppTransaction, deviceID, nonce string) error {
+	if !strings.EqualFold(tx.DeviceVerificationNonce, nonce) {
+		return fmt.Errorf("%w: nonce mismatch", ErrDeviceMismatch)
+	}
+	want, err := base64.StdEncoding.DecodeString(tx.DeviceVerification)
+	if err != nil || len(want) == 0 {
+		return fmt.Errorf("%w: missing device verification", ErrInvalidAppTransaction)
+	}
+	got := sha512.Sum384([]byte(strings.ToLower(nonce) + strings.ToLower(deviceID)))
+	if !bytes.Equal(got[:], want) {
+		return fmt.Errorf("%w: device verification mismatch", ErrDeviceMismatch)
+	}
+	return nil
+}
+
+// compareVersions compares dot-separated versions component by component,
+// numerically where both components are numbers. Missing components count
+// as 0, so "1.0" equals "1".
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = strings.TrimSpace(as[i])
+		}
+		if i < len(bs) {
+			y = strings.TrimSpace(bs[i])
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
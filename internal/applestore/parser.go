@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"subscription-server/internal/offers"
 )
 
 type appleParser struct {
@@ -37,6 +38,20 @@ type AppStoreNotification struct {
 		SignedTransactionInfo string `json:"signedTransactionInfo"`
 		SignedRenewalInfo     string `json:"signedRenewalInfo,omitempty"`
 	} `json:"data"`
+	// Summary replaces Data in RENEWAL_EXTENSION notifications with the
+	// SUMMARY subtype.
+	Summary *RenewalExtensionSummary `json:"summary,omitempty"`
+}
+
+// RenewalExtensionSummary reports a completed mass renewal extension.
+type RenewalExtensionSummary struct {
+	RequestIdentifier      string   `json:"requestIdentifier"`
+	Environment            string   `json:"environment"`
+	BundleID               string   `json:"bundleId"`
+	ProductID              string   `json:"productId"`
+	StorefrontCountryCodes []string `json:"storefrontCountryCodes,omitempty"`
+	SucceededCount         int64    `json:"succeededCount"`
+	FailedCount            int64    `json:"failedCount"`
 }
 
 type ClientNotification struct {
@@ -46,22 +61,60 @@ type ClientNotification struct {
 }
 
 /*
-Transaction fields:
+Transaction fields (JWSTransactionDecodedPayload):
 	ExpiresDateMS - 	ms since epoch The UNIX time, in milliseconds, an auto-renewable subscription purchase expires or renews.
+	Price - 			The price, in milliunits, of the in-app purchase or subscription offer.
+	Currency - 			The three-letter ISO 4217 currency code for the price.
 	RevocationDateMS - 	ms since epoch The UNIX time, in milliseconds, that the App Store refunded the transaction or revoked
 						it from Family Sharing.
 	RevocationReason - 	The reason the transaction was revoked:
 			0 The App Store refunded the transaction on behalf of the customer for other reasons, for example, an accidental purchase.
 			1 The App Store refunded the transaction on behalf of the customer due to an actual or perceived issue within your app.
+	PurchaseDateMS - 	ms since epoch The UNIX time, in milliseconds, the App Store charged the customer for this transaction.
+	OriginalPurchaseDateMS - ms since epoch The purchase date of the original transaction.
+	Type - 				Auto-Renewable Subscription, Non-Consumable, Consumable or Non-Renewing Subscription.
+	InAppOwnershipType - PURCHASED, or FAMILY_SHARED when the customer has access through Family Sharing.
+	SubscriptionGroupIdentifier - The identifier of the subscription group the subscription belongs to.
+	OfferType - 		1 introductory offer, 2 promotional offer, 3 offer code, 4 win-back offer.
+	OfferIdentifier - 	The identifier of the promotional offer, offer code or win-back offer.
+	OfferDiscountType - FREE_TRIAL, PAY_AS_YOU_GO or PAY_UP_FRONT.
+	Storefront - 		The three-letter code of the App Store storefront country or region.
+	Environment - 		Sandbox or Production.
+	AppAccountToken - 	The UUID the app set on the purchase, used as the user token when present.
+	WebOrderLineItemID - The identifier of subscription purchase events across devices.
+	IsUpgraded - 		Whether the customer upgraded to another subscription; this transaction no longer grants access.
+	Quantity - 			The number of consumable products purchased.
+	TransactionReason - PURCHASE or RENEWAL.
+	SignedDateMS - 		ms since epoch The UNIX time, in milliseconds, the App Store signed the payload.
 */
 
 type Transaction struct {
-	OriginalTransactionID string `json:"originalTransactionId"`
-	TransactionID         string `json:"transactionId"`
-	ProductID             string `json:"productId"`
-	ExpiresDateMS         *int64 `json:"expiresDate,omitempty"`
-	RevocationDateMS      *int64 `json:"revocationDate,omitempty"`
-	RevocationReason      *int   `json:"revocationReason,omitempty"`
+	OriginalTransactionID       string `json:"originalTransactionId"`
+	TransactionID               string `json:"transactionId"`
+	ProductID                   string `json:"productId"`
+	BundleID                    string `json:"bundleId,omitempty"`
+	ExpiresDateMS               *int64 `json:"expiresDate,omitempty"`
+	RevocationDateMS            *int64 `json:"revocationDate,omitempty"`
+	RevocationReason            *int   `json:"revocationReason,omitempty"`
+	Price                       *int64 `json:"price,omitempty"`
+	Currency                    string `json:"currency,omitempty"`
+	PurchaseDateMS              *int64 `json:"purchaseDate,omitempty"`
+	OriginalPurchaseDateMS      *int64 `json:"originalPurchaseDate,omitempty"`
+	Type                        string `json:"type,omitempty"`
+	InAppOwnershipType          string `json:"inAppOwnershipType,omitempty"`
+	SubscriptionGroupIdentifier string `json:"subscriptionGroupIdentifier,omitempty"`
+	OfferType                   *int   `json:"offerType,omitempty"`
+	OfferIdentifier             string `json:"offerIdentifier,omitempty"`
+	OfferDiscountType           string `json:"offerDiscountType,omitempty"`
+	Storefront                  string `json:"storefront,omitempty"`
+	StorefrontID                string `json:"storefrontId,omitempty"`
+	Environment                 string `json:"environment,omitempty"`
+	AppAccountToken             string `json:"appAccountToken,omitempty"`
+	WebOrderLineItemID          string `json:"webOrderLineItemId,omitempty"`
+	IsUpgraded                  bool   `json:"isUpgraded,omitempty"`
+	Quantity                    int    `json:"quantity,omitempty"`
+	TransactionReason           string `json:"transactionReason,omitempty"`
+	SignedDateMS                *int64 `json:"signedDate,omitempty"`
 }
 
 /*
@@ -80,6 +133,9 @@ RenewalInfo fields:
 			offer conversions.
 		4 The product wasn’t available for purchase at the time of renewal.
 		5 The subscription expired for some other reason.
+	AutoRenewProductID - The product identifier of the product that renews at the next billing period.
+	RenewalPrice - 		The renewal price, in milliunits, of the auto-renewable subscription that renews at the next billing period.
+	Currency - 			The three-letter ISO 4217 currency code for the renewal price.
 */
 
 type RenewalInfo struct {
@@ -87,6 +143,9 @@ type RenewalInfo struct {
 	ExpirationIntent         *int   `json:"expirationIntent,omitempty"`
 	IsInBillingRetryPeriod   *bool  `json:"isInBillingRetryPeriod,omitempty"`
 	GracePeriodExpiresDateMS *int64 `json:"gracePeriodExpiresDate,omitempty"`
+	AutoRenewProductID       string `json:"autoRenewProductId,omitempty"`
+	RenewalPrice             *int64 `json:"renewalPrice,omitempty"`
+	Currency                 string `json:"currency,omitempty"`
 }
 
 func (p *appleParser) ParseTransaction(signedTransaction string) (*Transaction, error) {
@@ -102,6 +161,44 @@ func (p *appleParser) ParseTransaction(signedTransaction string) (*Transaction,
 	return &transaction, nil
 }
 
+/*
+AppTransaction fields (JWSAppTransactionDecodedPayload):
+	OriginalApplicationVersion - The app version the customer originally purchased or downloaded: CFBundleVersion on iOS.
+	OriginalPurchaseDateMS - ms since epoch The time the customer originally purchased or downloaded the app.
+	ReceiptType - 		Production, Sandbox or Xcode.
+	DeviceVerification - The base64 SHA-384 hash of DeviceVerificationNonce followed by the device's identifierForVendor.
+	DeviceVerificationNonce - The UUID used to compute DeviceVerification.
+	AppTransactionID - 	The unique identifier of the app download, the same across devices of an Apple Account.
+*/
+
+type AppTransaction struct {
+	BundleID                   string `json:"bundleId"`
+	AppAppleID                 int64  `json:"appAppleId,omitempty"`
+	ApplicationVersion         string `json:"applicationVersion"`
+	OriginalApplicationVersion string `json:"originalApplicationVersion"`
+	OriginalPurchaseDateMS     *int64 `json:"originalPurchaseDate,omitempty"`
+	PreorderDateMS             *int64 `json:"preorderDate,omitempty"`
+	ReceiptType                string `json:"receiptType"`
+	DeviceVerification         string `json:"deviceVerification"`
+	DeviceVerificationNonce    string `json:"deviceVerificationNonce"`
+	AppTransactionID           string `json:"appTransactionId,omitempty"`
+	OriginalPlatform           string `json:"originalPlatform,omitempty"`
+	SignedDateMS               *int64 `json:"signedDate,omitempty"`
+}
+
+func (p *appleParser) ParseAppTransaction(signedAppTransaction string) (*AppTransaction, error) {
+
+	payloadBytes, err := p.decoder.DecodeSignedJWS(signedAppTransaction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode app transaction: %w", err)
+	}
+	var appTransaction AppTransaction
+	if err := json.Unmarshal(payloadBytes, &appTransaction); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal app transaction: %w", err)
+	}
+	return &appTransaction, nil
+}
+
 func (p *appleParser) ParseRenewalInfo(signedRenewalInfo string) (*RenewalInfo, error) {
 
 	riPayloadBytes, err := p.decoder.DecodeSignedJWS(signedRenewalInfo)
@@ -148,3 +245,36 @@ func (p *appleParser) ParseClientNotification(body io.Reader) (*ClientNotificati
 
 	return &clientNotification, nil
 }
+
+// TransactionOwner verifies signedTransaction and returns its bundle, the
+// user its subscription is stored under and its transaction and original
+// transaction IDs.
+func (p *appleParser) TransactionOwner(signedTransaction string) (*offers.Customer, error) {
+	tx, err := p.ParseTransaction(signedTransaction)
+	if err != nil {
+		return nil, err
+	}
+	if tx.OriginalTransactionID == "" && tx.AppAccountToken == "" {
+		return nil, fmt.Errorf("transaction has no owner")
+	}
+	c := &offers.Customer{BundleID: tx.BundleID, UserToken: userToken("", tx)}
+	for _, id := range []string{tx.TransactionID, tx.OriginalTransactionID} {
+		if id != "" {
+			c.TransactionIDs = append(c.TransactionIDs, id)
+		}
+	}
+	return c, nil
+}
+
+// AppTransactionOwner verifies signedAppTransaction and returns its bundle
+// and app transaction ID. App transactions name no user.
+func (p *appleParser) AppTransactionOwner(signedAppTransaction string) (*offers.Customer, error) {
+	tx, err := p.ParseAppTransaction(signedAppTransaction)
+	if err != nil {
+		return nil, err
+	}
+	if tx.AppTransactionID == "" {
+		return nil, fmt.Errorf("app transaction has no appTransactionId")
+	}
+	return &offers.Customer{BundleID: tx.BundleID, TransactionIDs: []string{tx.AppTransactionID}}, nil
+}
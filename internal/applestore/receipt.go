@@ -0,0 +1,568 @@
+package applestore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidReceipt        = errors.New("invalid app receipt")
+	ErrNoReceiptSubscription = errors.New("no auto-renewable subscription in app receipt")
+	// ErrReceiptClaimed means the subscription of the receipt was already
+	// presented by another user.
+	ErrReceiptClaimed = errors.New("receipt subscription belongs to another user")
+)
+
+// DefaultReceiptSandboxURL is Apple's verifyReceipt endpoint for sandbox
+// receipts.
+const DefaultReceiptSandboxURL = "https://sandbox.itunes.apple.com/verifyReceipt"
+
+const maxReceiptSize = 1 << 20
+
+// verifyReceipt status codes, see Apple's verifyReceipt documentation.
+const (
+	receiptStatusOK = 0
+	// receiptStatusExpired is answered for a valid receipt of an expired
+	// iOS 6 style subscription.
+	receiptStatusExpired = 21006
+	// receiptStatusSandbox is answered by the production endpoint for a
+	// sandbox receipt.
+	receiptStatusSandbox = 21007
+)
+
+// VerifiedReceipt is a StoreKit 1 app receipt whose signature was checked,
+// in the shape of a verifyReceipt response. A receipt validated locally
+// carries its in-app purchases as LatestReceiptInfo and no renewal info.
+type VerifiedReceipt struct {
+	// Environment is "Production" or "Sandbox".
+	Environment        string               `json:"environment"`
+	Receipt            Receipt              `json:"receipt"`
+	LatestReceiptInfo  []ReceiptTransaction `json:"latest_receipt_info,omitempty"`
+	PendingRenewalInfo []ReceiptRenewal     `json:"pending_renewal_info,omitempty"`
+}
+
+type Receipt struct {
+	BundleID                   string               `json:"bundle_id"`
+	ApplicationVersion         string               `json:"application_version"`
+	OriginalApplicationVersion string               `json:"original_application_version"`
+	ReceiptCreationDateMS      string               `json:"receipt_creation_date_ms"`
+	InApp                      []ReceiptTransaction `json:"in_app,omitempty"`
+}
+
+// ReceiptTransaction is an in-app purchase of a receipt. As in verifyReceipt
+// responses every field is a string, dates in milliseconds since the epoch.
+type ReceiptTransaction struct {
+	Quantity                    string `json:"quantity"`
+	ProductID                   string `json:"product_id"`
+	TransactionID               string `json:"transaction_id"`
+	OriginalTransactionID       string `json:"original_transaction_id"`
+	PurchaseDateMS              string `json:"purchase_date_ms"`
+	OriginalPurchaseDateMS      string `json:"original_purchase_date_ms"`
+	ExpiresDateMS               string `json:"expires_date_ms,omitempty"`
+	CancellationDateMS          string `json:"cancellation_date_ms,omitempty"`
+	WebOrderLineItemID          string `json:"web_order_line_item_id,omitempty"`
+	IsTrialPeriod               string `json:"is_trial_period,omitempty"`
+	IsInIntroOfferPeriod        string `json:"is_in_intro_offer_period,omitempty"`
+	PromotionalOfferID          string `json:"promotional_offer_id,omitempty"`
+	InAppOwnershipType          string `json:"in_app_ownership_type,omitempty"`
+	SubscriptionGroupIdentifier string `json:"subscription_group_identifier,omitempty"`
+}
+
+// ReceiptRenewal is an entry of verifyReceipt's pending_renewal_info.
+type ReceiptRenewal struct {
+	OriginalTransactionID    string `json:"original_transaction_id"`
+	ProductID                string `json:"product_id"`
+	AutoRenewProductID       string `json:"auto_renew_product_id"`
+	AutoRenewStatus          string `json:"auto_renew_status"`
+	ExpirationIntent         string `json:"expiration_intent,omitempty"`
+	IsInBillingRetryPeriod   string `json:"is_in_billing_retry_period,omitempty"`
+	GracePeriodExpiresDateMS string `json:"grace_period_expires_date_ms,omitempty"`
+}
+
+// ReceiptVerifier validates base64 StoreKit 1 app receipts.
+type ReceiptVerifier interface {
+	VerifyReceipt(ctx context.Context, receiptData string) (*VerifiedReceipt, error)
+}
+
+type ReceiptOptions struct {
+	// VerifyURL enables the verifyReceipt fallback for receipts that fail
+	// local validation. Sandbox receipts are sent again to SandboxURL,
+	// DefaultReceiptSandboxURL by default.
+	VerifyURL  string
+	SandboxURL string
+	// SharedSecret is the app-specific shared secret verifyReceipt needs for
+	// auto-renewable subscriptions.
+	SharedSecret string
+	HTTPClient   *http.Client
+	// Roots replaces the Apple root certificate, for tests.
+	Roots *x509.CertPool
+}
+
+type receiptVerifier struct {
+	opts ReceiptOptions
+}
+
+// NewReceiptVerifier validates receipts locally: it parses the PKCS#7
+// container, checks its signature and the chain of the signing certificate
+// to the Apple root, then decodes the ASN.1 receipt fields.
+func NewReceiptVerifier(opts ReceiptOptions) ReceiptVerifier {
+	if opts.Roots == nil {
+		opts.Roots = x509.NewCertPool()
+		opts.Roots.AppendCertsFromPEM([]byte(appleRootCA))
+	}
+	if opts.SandboxURL == "" {
+		opts.SandboxURL = DefaultReceiptSandboxURL
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &receiptVerifier{opts: opts}
+}
+
+func (v *receiptVerifier) VerifyReceipt(ctx context.Context, receiptData string) (*VerifiedReceipt, error) {
+	der, err := base64.StdEncoding.DecodeString(receiptData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode receipt: %v", ErrInvalidReceipt, err)
+	}
+	receipt, err := v.verifyLocally(der)
+	if err == nil {
+		return receipt, nil
+	}
+	if v.opts.VerifyURL == "" {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+	return v.verifyRemotely(ctx, receiptData)
+}
+
+// PKCS#7 structures, see RFC 2315.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	// Apple marks the receipt signing certificate and the WWDR
+	// intermediate that issues it with these extensions.
+	oidReceiptSigner    = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	oidWWDRIntermediate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+// receiptSignerName is the common name of Apple's receipt signing
+// certificate.
+const receiptSignerName = "Mac App Store and iTunes Store Receipt Signing"
+
+// verifyLocally checks the signature of a DER receipt and decodes it.
+func (v *receiptVerifier) verifyLocally(der []byte) (*VerifiedReceipt, error) {
+	var outer contentInfo
+	if _, err := asn1.Unmarshal(der, &outer); err != nil {
+		return nil, fmt.Errorf("parse PKCS#7 container: %w", err)
+	}
+	if !outer.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("PKCS#7 content is not signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(outer.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("parse signed data: %w", err)
+	}
+	var payload []byte
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &payload); err != nil {
+		return nil, fmt.Errorf("parse receipt payload: %w", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificates: %w", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, got %d", len(sd.SignerInfos))
+	}
+	signer := sd.SignerInfos[0]
+	leaf, intermediates := signerCertificate(certs, &signer.IssuerAndSerialNumber)
+	if leaf == nil {
+		return nil, fmt.Errorf("signing certificate not found")
+	}
+	if err := verifySignerInfo(leaf, &signer, payload); err != nil {
+		return nil, err
+	}
+
+	if err := verifyReceiptSigner(leaf, intermediates, v.opts.Roots); err != nil {
+		return nil, err
+	}
+	return parseReceipt(payload)
+}
+
+// verifyReceiptSigner checks that leaf is Apple's receipt signing
+// certificate, issued by the Apple Worldwide Developer Relations CA under
+// the Apple root. Any other certificate Apple issued, e.g. a developer's,
+// would otherwise sign receipts too. The chain is checked as of now: the
+// receipt's own dates are signed by the very certificate in question.
+func verifyReceiptSigner(leaf *x509.Certificate, intermediates, roots *x509.CertPool) error {
+	if leaf.Subject.CommonName != receiptSignerName || !hasExtension(leaf, oidReceiptSigner) {
+		return fmt.Errorf("%q is not the receipt signing certificate", leaf.Subject.CommonName)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("verify certificate chain: %w", err)
+	}
+	for _, chain := range chains {
+		if len(chain) == 3 && hasExtension(chain[1], oidWWDRIntermediate) {
+			return nil
+		}
+	}
+	return fmt.Errorf("receipt signing certificate is not issued by the Apple WWDR CA")
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// signerCertificate returns the certificate identified by id and a pool of
+// the other certificates.
+func signerCertificate(certs []*x509.Certificate, id *issuerAndSerial) (*x509.Certificate, *x509.CertPool) {
+	var leaf *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if leaf == nil && id.SerialNumber != nil && c.SerialNumber.Cmp(id.SerialNumber) == 0 &&
+			bytes.Equal(c.RawIssuer, id.Issuer.FullBytes) {
+			leaf = c
+			continue
+		}
+		intermediates.AddCert(c)
+	}
+	return leaf, intermediates
+}
+
+// verifySignerInfo checks the RSA signature over content, or over the
+// authenticated attributes when there are some.
+func verifySignerInfo(cert *x509.Certificate, signer *signerInfo, content []byte) error {
+	var hash crypto.Hash
+	switch {
+	case signer.DigestAlgorithm.Algorithm.Equal(oidSHA1):
+		hash = crypto.SHA1
+	case signer.DigestAlgorithm.Algorithm.Equal(oidSHA256):
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported digest algorithm %v", signer.DigestAlgorithm.Algorithm)
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("not an RSA public key")
+	}
+
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+	if len(signer.AuthenticatedAttributes.FullBytes) > 0 {
+		attrDigest, err := messageDigest(signer.AuthenticatedAttributes.Bytes)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(attrDigest, digest) {
+			return fmt.Errorf("message digest mismatch")
+		}
+		// The attributes are signed with their universal SET tag instead of
+		// the implicit [0].
+		signed := append([]byte{0x31}, signer.AuthenticatedAttributes.FullBytes[1:]...)
+		h = hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, hash, digest, signer.EncryptedDigest); err != nil {
+		return fmt.Errorf("invalid receipt signature: %w", err)
+	}
+	return nil
+}
+
+func messageDigest(attrs []byte) ([]byte, error) {
+	for rest := attrs; len(rest) > 0; {
+		var attr pkcs7Attribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, fmt.Errorf("parse authenticated attributes: %w", err)
+		}
+		if !attr.Type.Equal(oidMessageDigest) {
+			continue
+		}
+		var digest []byte
+		if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+			return nil, fmt.Errorf("parse message digest: %w", err)
+		}
+		return digest, nil
+	}
+	return nil, fmt.Errorf("missing message digest attribute")
+}
+
+// receiptAttribute is an entry of the receipt payload, a SET of them. Value
+// holds the DER encoding of the field.
+type receiptAttribute struct {
+	Type    int
+	Version int
+	Value   []byte
+}
+
+// Receipt and in-app purchase field types, see Apple's "Receipt Fields".
+const (
+	receiptFieldType            = 0
+	receiptFieldBundleID        = 2
+	receiptFieldAppVersion      = 3
+	receiptFieldCreationDate    = 12
+	receiptFieldInApp           = 17
+	receiptFieldOriginalVersion = 19
+
+	inAppQuantity              = 1701
+	inAppProductID             = 1702
+	inAppTransactionID         = 1703
+	inAppPurchaseDate          = 1704
+	inAppOriginalTransactionID = 1705
+	inAppOriginalPurchaseDate  = 1706
+	inAppExpiresDate           = 1708
+	inAppWebOrderLineItemID    = 1711
+	inAppCancellationDate      = 1712
+	inAppIsTrialPeriod         = 1713
+	inAppIsInIntroOfferPeriod  = 1719
+	inAppPromotionalOfferID    = 1721
+)
+
+func parseReceipt(payload []byte) (*VerifiedReceipt, error) {
+	attrs, err := receiptAttributes(payload)
+	if err != nil {
+		return nil, fmt.Errorf("parse receipt: %w", err)
+	}
+	receipt := &VerifiedReceipt{Environment: "Production"}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case receiptFieldType:
+			// Xcode and sandbox receipts are "ProductionSandbox" or
+			// "Xcode".
+			if t := asn1String(attr.Value); t != "" && t != "Production" {
+				receipt.Environment = "Sandbox"
+			}
+		case receiptFieldBundleID:
+			receipt.Receipt.BundleID = asn1String(attr.Value)
+		case receiptFieldAppVersion:
+			receipt.Receipt.ApplicationVersion = asn1String(attr.Value)
+		case receiptFieldOriginalVersion:
+			receipt.Receipt.OriginalApplicationVersion = asn1String(attr.Value)
+		case receiptFieldCreationDate:
+			receipt.Receipt.ReceiptCreationDateMS = asn1Date(attr.Value)
+		case receiptFieldInApp:
+			tx, err := parseInApp(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			receipt.Receipt.InApp = append(receipt.Receipt.InApp, *tx)
+		}
+	}
+	receipt.LatestReceiptInfo = receipt.Receipt.InApp
+	return receipt, nil
+}
+
+func parseInApp(payload []byte) (*ReceiptTransaction, error) {
+	attrs, err := receiptAttributes(payload)
+	if err != nil {
+		return nil, fmt.Errorf("parse in-app purchase: %w", err)
+	}
+	tx := &ReceiptTransaction{}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case inAppQuantity:
+			tx.Quantity = asn1Int(attr.Value)
+		case inAppProductID:
+			tx.ProductID = asn1String(attr.Value)
+		case inAppTransactionID:
+			tx.TransactionID = asn1String(attr.Value)
+		case inAppOriginalTransactionID:
+			tx.OriginalTransactionID = asn1String(attr.Value)
+		case inAppPurchaseDate:
+			tx.PurchaseDateMS = asn1Date(attr.Value)
+		case inAppOriginalPurchaseDate:
+			tx.OriginalPurchaseDateMS = asn1Date(attr.Value)
+		case inAppExpiresDate:
+			tx.ExpiresDateMS = asn1Date(attr.Value)
+		case inAppCancellationDate:
+			tx.CancellationDateMS = asn1Date(attr.Value)
+		case inAppWebOrderLineItemID:
+			tx.WebOrderLineItemID = asn1Int(attr.Value)
+		case inAppIsTrialPeriod:
+			tx.IsTrialPeriod = asn1Bool(attr.Value)
+		case inAppIsInIntroOfferPeriod:
+			tx.IsInIntroOfferPeriod = asn1Bool(attr.Value)
+		case inAppPromotionalOfferID:
+			tx.PromotionalOfferID = asn1String(attr.Value)
+		}
+	}
+	return tx, nil
+}
+
+func receiptAttributes(payload []byte) ([]receiptAttribute, error) {
+	var attrs []receiptAttribute
+	rest, err := asn1.UnmarshalWithParams(payload, &attrs, "set")
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after attributes")
+	}
+	return attrs, nil
+}
+
+// asn1String decodes a UTF8String or IA5String field, "" when malformed.
+func asn1String(der []byte) string {
+	var s string
+	if _, err := asn1.Unmarshal(der, &s); err != nil {
+		return ""
+	}
+	return s
+}
+
+func asn1Int(der []byte) string {
+	var n int64
+	if _, err := asn1.Unmarshal(der, &n); err != nil {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func asn1Bool(der []byte) string {
+	if asn1Int(der) == "1" {
+		return "true"
+	}
+	return "false"
+}
+
+// asn1Date converts an RFC 3339 date field to milliseconds since the epoch,
+// "" when the date is empty or malformed.
+func asn1Date(der []byte) string {
+	t, err := time.Parse(time.RFC3339, asn1String(der))
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// msTime parses a verifyReceipt date, the zero time when it is empty.
+func msTime(ms string) time.Time {
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || n == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(n).UTC()
+}
+
+type verifyReceiptRequest struct {
+	ReceiptData            string `json:"receipt-data"`
+	Password               string `json:"password,omitempty"`
+	ExcludeOldTransactions bool   `json:"exclude-old-transactions"`
+}
+
+type verifyReceiptResponse struct {
+	Status int `json:"status"`
+	VerifiedReceipt
+}
+
+// verifyRemotely asks verifyReceipt, sending sandbox receipts to the sandbox
+// endpoint as Apple requires.
+func (v *receiptVerifier) verifyRemotely(ctx context.Context, receiptData string) (*VerifiedReceipt, error) {
+	resp, err := v.post(ctx, v.opts.VerifyURL, receiptData)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == receiptStatusSandbox {
+		if resp, err = v.post(ctx, v.opts.SandboxURL, receiptData); err != nil {
+			return nil, err
+		}
+	}
+	switch resp.Status {
+	case receiptStatusOK, receiptStatusExpired:
+	default:
+		return nil, fmt.Errorf("%w: verifyReceipt status %d", ErrInvalidReceipt, resp.Status)
+	}
+	if len(resp.LatestReceiptInfo) == 0 {
+		resp.LatestReceiptInfo = resp.Receipt.InApp
+	}
+	return &resp.VerifiedReceipt, nil
+}
+
+func (v *receiptVerifier) post(ctx context.Context, url, receiptData string) (*verifyReceiptResponse, error) {
+	body, err := json.Marshal(verifyReceiptRequest{
+		ReceiptData:            receiptData,
+		Password:               v.opts.SharedSecret,
+		ExcludeOldTransactions: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal verifyReceipt request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create verifyReceipt request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("verifyReceipt: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("verifyReceipt: unexpected status %d", resp.StatusCode)
+	}
+	var out verifyReceiptResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReceiptSize)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode verifyReceipt response: %w", err)
+	}
+	return &out, nil
+}
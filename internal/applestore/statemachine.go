@@ -0,0 +1,759 @@
+package applestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"subscription-server/internal/credits"
+	tools "subscription-server/internal/helpers"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+var (
+	ErrUnknownBundle = errors.New("unknown bundle")
+	ErrUnknownPeriod = errors.New("no period configured for non-renewing product")
+	// ErrUnverifiedNotification means a server notification failed before
+	// its signed transaction was verified, so it may not come from Apple.
+	ErrUnverifiedNotification = errors.New("unverified notification")
+	// ErrUserTokenMismatch means a client notification names a different
+	// user than the appAccountToken of its signed transaction.
+	ErrUserTokenMismatch = errors.New("appAccountToken does not match the transaction")
+)
+
+// appleStateMachine derives subscription state from raw Apple payloads. It has
+// no side effects, so the same code serves live traffic and event replay.
+type appleStateMachine struct {
+	parser *appleParser
+	// bundleIDs, when not empty, lists the only accepted bundles.
+	bundleIDs map[string]bool
+	// periods is the period granted by each non-renewing subscription
+	// product; Apple leaves it to the server.
+	periods map[string]time.Duration
+	// credits is the number of credits each consumable product is worth.
+	credits map[string]int64
+	// levels places each grouped subscription product in its group.
+	levels map[string]productLevel
+}
+
+// productLevel is the position of a product in its subscription group. As in
+// App Store Connect, level 1 is the highest level of service.
+type productLevel struct {
+	group string
+	level int
+}
+
+// Plan changes within a subscription group, named after the subtypes of
+// DID_CHANGE_RENEWAL_PREF.
+const (
+	planUpgrade    = "UPGRADE"
+	planDowngrade  = "DOWNGRADE"
+	planCrossgrade = "CROSSGRADE"
+)
+
+// update is everything a single Apple payload changes. At most one of
+// status, purchase, credit, clawback and extension is set.
+type update struct {
+	status *storage.SubscriptionStatus
+	// merge marks a status that only knows the signed transaction. It is
+	// merged into the stored record with mergeTransaction.
+	merge    bool
+	purchase *storage.Purchase
+	credit   *storage.LedgerEntry
+	// clawback is the ID of a credit to reverse, if it was ever granted.
+	clawback string
+	// extension is a completed mass renewal extension. Its event belongs to
+	// no user.
+	extension *storage.RenewalExtension
+	event     *storage.SubscriptionEvent
+	// refund is the refund decision a refund notification reports, in
+	// addition to whatever else it changes.
+	refund *storage.Refund
+}
+
+func NewAppleStateMachine(p *appleParser, bundleIDs ...string) *appleStateMachine {
+	m := &appleStateMachine{
+		parser: p,
+	}
+	m.allowBundles(bundleIDs...)
+	return m
+}
+
+// NewAppleReplayer returns a state machine for stored events. Their
+// signatures were verified when the events were recorded and are not checked
+// again: the certificates that signed old events expire.
+func NewAppleReplayer(bundleIDs ...string) *appleStateMachine {
+	return NewAppleStateMachine(NewAppleParser(NewAppleDecoder(recordedJWSValidator{})), bundleIDs...)
+}
+
+func (m *appleStateMachine) setPeriods(periods map[string]time.Duration) {
+	if m.periods == nil {
+		m.periods = make(map[string]time.Duration)
+	}
+	for product, d := range periods {
+		m.periods[product] = d
+	}
+}
+
+func (m *appleStateMachine) setCredits(credits map[string]int64) {
+	if m.credits == nil {
+		m.credits = make(map[string]int64)
+	}
+	for product, amount := range credits {
+		m.credits[product] = amount
+	}
+}
+
+// SetSubscriptionGroups declares the products of each subscription group by
+// level, highest level of service first. Plan changes whose notification
+// carries no subtype are classified with these levels.
+func (m *appleStateMachine) SetSubscriptionGroups(groups map[string][]string) {
+	if m.levels == nil {
+		m.levels = make(map[string]productLevel)
+	}
+	for group, products := range groups {
+		for i, product := range products {
+			m.levels[product] = productLevel{group: group, level: i + 1}
+		}
+	}
+}
+
+func (m *appleStateMachine) allowBundles(ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+	if m.bundleIDs == nil {
+		m.bundleIDs = make(map[string]bool)
+	}
+	for _, id := range ids {
+		m.bundleIDs[id] = true
+	}
+}
+
+// Replay applies a stored event to current, the status replayed from the
+// earlier events of the user, as of now, the way live traffic applies it to
+// the stored record. Events of one-off purchases leave current alone.
+func (m *appleStateMachine) Replay(current *storage.SubscriptionStatus, event storage.SubscriptionEvent, now time.Time) (*storage.SubscriptionStatus, error) {
+	if isOneOff(event.TransactionType) {
+		return current, nil
+	}
+
+	var (
+		u   *update
+		err error
+	)
+	switch event.Source {
+	case storage.EventSourceAppleServer:
+		u, err = m.providerUpdate([]byte(event.RawPayload), now)
+	case storage.EventSourceAppleClient:
+		u, err = m.clientUpdate([]byte(event.RawPayload), now)
+	case storage.EventSourceAppleReceipt:
+		u, err = m.receiptUpdate([]byte(event.RawPayload), now)
+	case storage.EventSourceExpiry:
+		return replayExpiry(current, event), nil
+	default:
+		return nil, fmt.Errorf("unsupported event source: %q", event.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return foldStatus(current, u, now), nil
+}
+
+// replayExpiry deactivates current the way the expiry sweeper did: only if
+// its access still ends when the swept record's did. A status renewed since
+// is left alone.
+func replayExpiry(current *storage.SubscriptionStatus, event storage.SubscriptionEvent) *storage.SubscriptionStatus {
+	if current == nil || !current.IsActive ||
+		!current.ExpiresAt.Equal(event.ExpiresAt) || !current.AccessEndsAt().Equal(event.OccurredAt) {
+		return current
+	}
+	expired := *current
+	expired.IsActive = false
+	return &expired
+}
+
+// foldStatus returns the status of a user once u is applied to current, their
+// stored status or nil. It returns current itself when u leaves it alone: u
+// changes no status, current is preferred over it (see
+// storage.SubscriptionStatus.PreferredOver) or u is a late transaction.
+func foldStatus(current *storage.SubscriptionStatus, u *update, now time.Time) *storage.SubscriptionStatus {
+	switch {
+	case u.status == nil:
+		return current
+	case current != nil && current.PreferredOver(u.status, now):
+		return current
+	case u.merge:
+		return mergeTransaction(current, u.status)
+	default:
+		return u.status
+	}
+}
+
+// clientUpdate turns an iOS client notification body into the update it
+// causes, as of now.
+func (m *appleStateMachine) clientUpdate(body []byte, now time.Time) (*update, error) {
+	parsedClientNotification, err := m.parser.ParseClientNotification(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client notification: %w", err)
+	}
+
+	signedTx := parsedClientNotification.SignedTransactionInfo
+	parsedClientTx, err := m.parser.ParseTransaction(signedTx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client transaction: %w", err)
+	}
+	bodyToken := parsedClientNotification.AppAccountToken
+	if bodyToken != "" && parsedClientTx.AppAccountToken != "" && bodyToken != parsedClientTx.AppAccountToken {
+		return nil, fmt.Errorf("%w: transaction %s", ErrUserTokenMismatch, parsedClientTx.TransactionID)
+	}
+	user := userToken(bodyToken, parsedClientTx)
+	expiresAt := tools.MsToTime(parsedClientTx.ExpiresDateMS)
+	isActive := !expiresAt.IsZero() && now.Before(expiresAt)
+	var revokedAt time.Time
+	if parsedClientTx.RevocationDateMS != nil && *parsedClientTx.RevocationDateMS > 0 {
+		isActive = false
+		revokedAt = tools.MsToTime(parsedClientTx.RevocationDateMS)
+	}
+
+	status := &storage.SubscriptionStatus{
+		ExpiresAt:             expiresAt,
+		UserToken:             user,
+		ProductID:             parsedClientTx.ProductID,
+		OriginalTransactionID: parsedClientTx.OriginalTransactionID,
+		IsActive:              isActive,
+		RevokedAt:             revokedAt,
+	}
+
+	event := &storage.SubscriptionEvent{
+		ID:                    "client:" + parsedClientTx.TransactionID,
+		UserToken:             user,
+		Source:                storage.EventSourceAppleClient,
+		Type:                  "CLIENT_TRANSACTION",
+		TransactionID:         parsedClientTx.TransactionID,
+		OriginalTransactionID: parsedClientTx.OriginalTransactionID,
+		ProductID:             parsedClientTx.ProductID,
+		Price:                 parsedClientTx.Price,
+		Currency:              parsedClientTx.Currency,
+		ExpiresAt:             expiresAt,
+		OccurredAt:            now,
+		RecordedAt:            now,
+		RawPayload:            string(body),
+	}
+	if signed := tools.MsToTime(parsedClientTx.SignedDateMS); !signed.IsZero() {
+		event.OccurredAt = signed
+	}
+	if isOneOff(parsedClientTx.Type) {
+		return m.oneOffUpdate(parsedClientTx, user, "", event, now)
+	}
+	describeTransaction(parsedClientTx, status, event)
+	if parsedClientTx.IsUpgraded {
+		return &update{event: event}, nil
+	}
+
+	return &update{status: status, merge: true, event: event}, nil
+}
+
+// mergeTransaction folds next, the status a client transaction or receipt
+// describes, into stored, the record of the same user. The renewal state
+// from server notifications survives. A transaction of the same
+// subscription that ends before the stored record, e.g. one the app sends
+// late, changes nothing.
+func mergeTransaction(stored, next *storage.SubscriptionStatus) *storage.SubscriptionStatus {
+	if stored == nil || stored.OriginalTransactionID != next.OriginalTransactionID {
+		return next
+	}
+	if stored.ExpiresAt.After(next.ExpiresAt) {
+		return stored
+	}
+
+	merged := *next
+	// Renewal info of next, from a receipt, only stands in for what no
+	// server notification told.
+	keepRenewal := stored.AutoRenewEnabled != nil || next.AutoRenewEnabled == nil
+	if keepRenewal {
+		merged.AutoRenewEnabled = stored.AutoRenewEnabled
+		merged.AutoRenewProductID = stored.AutoRenewProductID
+		merged.RenewalPrice = stored.RenewalPrice
+		merged.RenewalCurrency = stored.RenewalCurrency
+	}
+	if stored.PendingProductID != next.ProductID {
+		merged.PendingProductID = stored.PendingProductID
+	}
+	if merged.Environment == "" {
+		merged.Environment = stored.Environment
+	}
+	// A later expiry means the subscription renewed, which ends any billing
+	// retry. Within the same period the stored billing state stands.
+	if next.ExpiresAt.Equal(stored.ExpiresAt) {
+		if keepRenewal {
+			merged.ExpirationIntent = stored.ExpirationIntent
+			merged.GracePeriodExpiresAt = stored.GracePeriodExpiresAt
+			merged.InBillingRetry = stored.InBillingRetry
+		}
+		if merged.RevokedAt.IsZero() && !stored.RevokedAt.IsZero() {
+			merged.RevokedAt = stored.RevokedAt
+			merged.IsActive = false
+		}
+	}
+	return &merged
+}
+
+// receiptPayload is the raw payload of receipt events. It holds the receipt
+// as verified, so that replay needs neither its signature nor Apple.
+type receiptPayload struct {
+	UserToken string           `json:"userToken"`
+	Receipt   *VerifiedReceipt `json:"receipt"`
+}
+
+// receiptUpdate turns a verified StoreKit 1 receipt into the update it
+// causes, as of now. The subscription is the one of the latest expiring
+// transaction; other in-app purchases are left to StoreKit 2.
+func (m *appleStateMachine) receiptUpdate(body []byte, now time.Time) (*update, error) {
+	var payload receiptPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse receipt payload: %w", err)
+	}
+	receipt := payload.Receipt
+	if receipt == nil {
+		return nil, fmt.Errorf("receipt payload without receipt")
+	}
+	if bundle := receipt.Receipt.BundleID; len(m.bundleIDs) > 0 && !m.bundleIDs[bundle] {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBundle, bundle)
+	}
+	tx := latestSubscription(receipt.LatestReceiptInfo)
+	if tx == nil {
+		return nil, ErrNoReceiptSubscription
+	}
+
+	status := &storage.SubscriptionStatus{
+		ExpiresAt:             msTime(tx.ExpiresDateMS),
+		UserToken:             payload.UserToken,
+		ProductID:             tx.ProductID,
+		OriginalTransactionID: tx.OriginalTransactionID,
+		Environment:           receipt.Environment,
+		OriginalPurchaseDate:  msTime(tx.OriginalPurchaseDateMS),
+		OwnershipType:         tx.InAppOwnershipType,
+		SubscriptionGroupID:   tx.SubscriptionGroupIdentifier,
+		OfferID:               tx.PromotionalOfferID,
+	}
+	switch {
+	case tx.IsTrialPeriod == "true" || tx.IsInIntroOfferPeriod == "true":
+		status.OfferType = 1
+	case tx.PromotionalOfferID != "":
+		status.OfferType = 2
+	}
+	for _, renewal := range receipt.PendingRenewalInfo {
+		if renewal.OriginalTransactionID != tx.OriginalTransactionID {
+			continue
+		}
+		if renewal.AutoRenewStatus != "" {
+			enabled := renewal.AutoRenewStatus == "1"
+			status.AutoRenewEnabled = &enabled
+		}
+		status.ExpirationIntent, _ = strconv.Atoi(renewal.ExpirationIntent)
+		status.AutoRenewProductID = renewal.AutoRenewProductID
+		status.GracePeriodExpiresAt = msTime(renewal.GracePeriodExpiresDateMS)
+		status.InBillingRetry = renewal.IsInBillingRetryPeriod == "1"
+	}
+	activeUntil := status.AccessEndsAt()
+	status.IsActive = !activeUntil.IsZero() && now.Before(activeUntil)
+	if revokedAt := msTime(tx.CancellationDateMS); !revokedAt.IsZero() {
+		status.IsActive = false
+		status.RevokedAt = revokedAt
+	}
+
+	event := &storage.SubscriptionEvent{
+		ID:                    "receipt:" + tx.TransactionID,
+		UserToken:             payload.UserToken,
+		Source:                storage.EventSourceAppleReceipt,
+		Type:                  "CLIENT_RECEIPT",
+		TransactionID:         tx.TransactionID,
+		OriginalTransactionID: tx.OriginalTransactionID,
+		ProductID:             tx.ProductID,
+		ExpiresAt:             activeUntil,
+		OccurredAt:            now,
+		RecordedAt:            now,
+		RawPayload:            string(body),
+		TransactionType:       storage.ProductTypeAutoRenewable,
+		OwnershipType:         tx.InAppOwnershipType,
+		Environment:           status.Environment,
+		PurchaseDate:          msTime(tx.PurchaseDateMS),
+		OfferType:             status.OfferType,
+		OfferID:               tx.PromotionalOfferID,
+	}
+	if created := msTime(receipt.Receipt.ReceiptCreationDateMS); !created.IsZero() {
+		event.OccurredAt = created
+	}
+	return &update{status: status, event: event, merge: true}, nil
+}
+
+// latestSubscription returns the auto-renewable subscription transaction
+// that expires last, nil when there is none.
+func latestSubscription(txs []ReceiptTransaction) *ReceiptTransaction {
+	var latest *ReceiptTransaction
+	for i := range txs {
+		tx := &txs[i]
+		if tx.ExpiresDateMS == "" {
+			continue
+		}
+		if latest == nil || msTime(tx.ExpiresDateMS).After(msTime(latest.ExpiresDateMS)) {
+			latest = tx
+		}
+	}
+	return latest
+}
+
+// providerUpdate turns an App Store Server Notification body into the update
+// it causes, as of now.
+func (m *appleStateMachine) providerUpdate(body []byte, now time.Time) (*update, error) {
+	parsedNotification, err := m.parser.ParseAppStoreNotification(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse notification: %w", ErrUnverifiedNotification, err)
+	}
+	if parsedNotification.Summary != nil {
+		// Summaries carry no signed transaction.
+		u, err := m.summaryUpdate(parsedNotification, body, now)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnverifiedNotification, err)
+		}
+		return u, nil
+	}
+
+	parsedTx, err := m.parser.ParseTransaction(parsedNotification.Data.SignedTransactionInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse transaction: %w", ErrUnverifiedNotification, err)
+	}
+	if bundle := parsedNotification.Data.BundleID; len(m.bundleIDs) > 0 && !m.bundleIDs[bundle] {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBundle, bundle)
+	}
+
+	user := userToken(parsedNotification.Data.AppAccountToken, parsedTx)
+
+	eventID := parsedNotification.NotificationUUID
+	if eventID == "" {
+		eventID = "tx:" + parsedTx.TransactionID + ":" + parsedNotification.NotificationType
+	}
+	event := &storage.SubscriptionEvent{
+		ID:                    eventID,
+		UserToken:             user,
+		Source:                storage.EventSourceAppleServer,
+		Type:                  parsedNotification.NotificationType,
+		Subtype:               parsedNotification.Subtype,
+		TransactionID:         parsedTx.TransactionID,
+		OriginalTransactionID: parsedTx.OriginalTransactionID,
+		ProductID:             parsedTx.ProductID,
+		Price:                 parsedTx.Price,
+		Currency:              parsedTx.Currency,
+		OccurredAt:            tools.MsToTime(&parsedNotification.SignedDate),
+		RecordedAt:            now,
+		RawPayload:            string(body),
+	}
+
+	refund := refundOf(parsedNotification, parsedTx, event)
+
+	// One-off purchases carry no renewal info.
+	if isOneOff(parsedTx.Type) {
+		u, err := m.oneOffUpdate(parsedTx, user, parsedNotification.Data.Environment, event, now)
+		if err != nil {
+			return nil, err
+		}
+		u.refund = refund
+		return u, nil
+	}
+
+	parsedRenewalInfo, err := m.parser.ParseRenewalInfo(parsedNotification.Data.SignedRenewalInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse renewal info: %w", err)
+	}
+
+	expiresAt := tools.MsToTime(parsedTx.ExpiresDateMS)
+
+	var (
+		grace        time.Time
+		billingRetry bool
+	)
+
+	if parsedRenewalInfo != nil {
+		if t := tools.MsToTime(parsedRenewalInfo.GracePeriodExpiresDateMS); !t.IsZero() {
+			grace = t
+		}
+		billingRetry = parsedRenewalInfo.IsInBillingRetryPeriod != nil && *parsedRenewalInfo.IsInBillingRetryPeriod
+	}
+
+	status := &storage.SubscriptionStatus{
+		ExpiresAt:             expiresAt,
+		UserToken:             user,
+		ProductID:             parsedTx.ProductID,
+		OriginalTransactionID: parsedTx.OriginalTransactionID,
+		GracePeriodExpiresAt:  grace,
+		InBillingRetry:        billingRetry,
+		Environment:           parsedNotification.Data.Environment,
+	}
+	if parsedRenewalInfo != nil {
+		if parsedRenewalInfo.AutoRenewStatus != nil {
+			enabled := *parsedRenewalInfo.AutoRenewStatus == 1
+			status.AutoRenewEnabled = &enabled
+		}
+		if parsedRenewalInfo.ExpirationIntent != nil {
+			status.ExpirationIntent = *parsedRenewalInfo.ExpirationIntent
+		}
+		status.AutoRenewProductID = parsedRenewalInfo.AutoRenewProductID
+		status.RenewalPrice = parsedRenewalInfo.RenewalPrice
+		status.RenewalCurrency = parsedRenewalInfo.Currency
+	}
+	activeUntil := status.AccessEndsAt()
+
+	isActive := !activeUntil.IsZero() && now.Before(activeUntil)
+
+	if parsedTx.RevocationDateMS != nil && *parsedTx.RevocationDateMS > 0 {
+		isActive = false
+		status.RevokedAt = tools.MsToTime(parsedTx.RevocationDateMS)
+	}
+	if parsedNotification.NotificationType == "EXPIRED" {
+		isActive = false
+	}
+	status.IsActive = isActive
+
+	event.ExpiresAt = activeUntil
+	describeTransaction(parsedTx, status, event)
+	// A transaction replaced by an upgrade no longer says what the user has;
+	// the transaction of the new product does.
+	if parsedTx.IsUpgraded {
+		return &update{event: event, refund: refund}, nil
+	}
+	m.changePlan(status, parsedNotification.Subtype)
+
+	return &update{status: status, event: event, refund: refund}, nil
+}
+
+// refundOf returns the refund decision n reports about tx, or nil for any
+// other notification.
+func refundOf(n *AppStoreNotification, tx *Transaction, event *storage.SubscriptionEvent) *storage.Refund {
+	switch n.NotificationType {
+	case storage.RefundGranted, storage.RefundReversed, storage.RefundDeclined:
+	default:
+		return nil
+	}
+	environment := n.Data.Environment
+	if environment == "" {
+		environment = tx.Environment
+	}
+	return &storage.Refund{
+		ID:                    event.ID,
+		UserToken:             event.UserToken,
+		ProductID:             tx.ProductID,
+		TransactionID:         tx.TransactionID,
+		OriginalTransactionID: tx.OriginalTransactionID,
+		Type:                  n.NotificationType,
+		RevocationReason:      tx.RevocationReason,
+		Price:                 tx.Price,
+		Currency:              tx.Currency,
+		Environment:           environment,
+		OccurredAt:            event.OccurredAt,
+	}
+}
+
+// summaryUpdate turns the summary of a mass renewal extension into the
+// completed extension. The renewal dates themselves arrive with the
+// RENEWAL_EXTENDED notification of each subscription.
+func (m *appleStateMachine) summaryUpdate(n *AppStoreNotification, body []byte, now time.Time) (*update, error) {
+	summary := n.Summary
+	if len(m.bundleIDs) > 0 && !m.bundleIDs[summary.BundleID] {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBundle, summary.BundleID)
+	}
+	if summary.RequestIdentifier == "" {
+		return nil, errors.New("renewal extension summary without request identifier")
+	}
+
+	eventID := n.NotificationUUID
+	if eventID == "" {
+		eventID = "extension:" + summary.RequestIdentifier + ":" + n.NotificationType
+	}
+	completedAt := tools.MsToTime(&n.SignedDate)
+	if completedAt.IsZero() {
+		completedAt = now
+	}
+	return &update{
+		extension: &storage.RenewalExtension{
+			RequestID:      summary.RequestIdentifier,
+			ProductID:      summary.ProductID,
+			Environment:    summary.Environment,
+			Status:         storage.ExtensionComplete,
+			SucceededCount: summary.SucceededCount,
+			FailedCount:    summary.FailedCount,
+			CompletedAt:    completedAt,
+		},
+		event: &storage.SubscriptionEvent{
+			ID:         eventID,
+			Source:     storage.EventSourceAppleServer,
+			Type:       n.NotificationType,
+			Subtype:    n.Subtype,
+			ProductID:  summary.ProductID,
+			OccurredAt: completedAt,
+			RecordedAt: now,
+			RawPayload: string(body),
+		},
+	}, nil
+}
+
+// changePlan applies a switch to status.AutoRenewProductID within the
+// subscription group: an upgrade takes effect immediately, a downgrade or
+// crossgrade is kept as PendingProductID until the next renewal delivers a
+// transaction for it. The notification subtype tells which one it is; without
+// it the configured product levels do, and unknown products wait for the
+// renewal.
+func (m *appleStateMachine) changePlan(status *storage.SubscriptionStatus, subtype string) {
+	next := status.AutoRenewProductID
+	if next == "" || next == status.ProductID {
+		return
+	}
+	change := subtype
+	if change != planUpgrade && change != planDowngrade {
+		change = m.planChange(status.ProductID, next)
+	}
+	if change == planUpgrade {
+		status.ProductID = next
+		return
+	}
+	status.PendingProductID = next
+}
+
+// planChange classifies a switch from product to next by their levels, or
+// returns "" when they are not configured in the same group.
+func (m *appleStateMachine) planChange(product, next string) string {
+	from, ok := m.levels[product]
+	if !ok {
+		return ""
+	}
+	to, ok := m.levels[next]
+	if !ok || to.group != from.group {
+		return ""
+	}
+	switch {
+	case to.level < from.level:
+		return planUpgrade
+	case to.level > from.level:
+		return planDowngrade
+	}
+	return planCrossgrade
+}
+
+// isOneOff reports whether a transaction of type txType is anything but an
+// auto-renewable subscription. Older payloads without a type are treated as
+// subscriptions.
+func isOneOff(txType string) bool {
+	switch txType {
+	case storage.ProductTypeNonConsumable, storage.ProductTypeConsumable, storage.ProductTypeNonRenewing:
+		return true
+	}
+	return false
+}
+
+// oneOffUpdate describes a one-off purchase. Non-consumables and non-renewing
+// subscriptions become a Purchase. Consumables credit the user's balance once
+// per transaction: credit products add their credits to credits.Account,
+// other consumables add their quantity to an account named after the
+// product. A refunded consumable reverses its credit.
+func (m *appleStateMachine) oneOffUpdate(tx *Transaction, user, environment string, event *storage.SubscriptionEvent, now time.Time) (*update, error) {
+	if environment == "" {
+		environment = tx.Environment
+	}
+	u := &update{event: event}
+	purchasedAt := tools.MsToTime(tx.PurchaseDateMS)
+	if purchasedAt.IsZero() {
+		purchasedAt = event.OccurredAt
+	}
+	revokedAt := tools.MsToTime(tx.RevocationDateMS)
+
+	switch tx.Type {
+	case storage.ProductTypeConsumable:
+		creditID := "apple:" + tx.TransactionID
+		if !revokedAt.IsZero() {
+			u.clawback = creditID
+			break
+		}
+		quantity := int64(tx.Quantity)
+		if quantity <= 0 {
+			quantity = 1
+		}
+		u.credit = &storage.LedgerEntry{
+			ID:            creditID,
+			UserToken:     user,
+			Account:       tx.ProductID,
+			Amount:        quantity,
+			Reason:        storage.LedgerReasonPurchase,
+			TransactionID: tx.TransactionID,
+			CreatedAt:     now,
+		}
+		if amount, ok := m.credits[tx.ProductID]; ok {
+			u.credit.Account = credits.Account
+			u.credit.Amount = quantity * amount
+		}
+	default:
+		u.purchase = &storage.Purchase{
+			TransactionID:         tx.TransactionID,
+			OriginalTransactionID: tx.OriginalTransactionID,
+			UserToken:             user,
+			ProductID:             tx.ProductID,
+			ProductType:           tx.Type,
+			PurchasedAt:           purchasedAt,
+			RevokedAt:             revokedAt,
+			Environment:           environment,
+			OwnershipType:         tx.InAppOwnershipType,
+		}
+		if tx.Type == storage.ProductTypeNonRenewing {
+			d, ok := m.periods[tx.ProductID]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q", ErrUnknownPeriod, tx.ProductID)
+			}
+			u.purchase.ExpiresAt = purchasedAt.Add(d)
+			event.ExpiresAt = u.purchase.ExpiresAt
+		}
+	}
+
+	// The status is a scratch copy: it only feeds the event details.
+	describeTransaction(tx, &storage.SubscriptionStatus{Environment: environment}, event)
+	return u, nil
+}
+
+// userToken identifies the user of a transaction: the appAccountToken of the
+// signed transaction or, without one, of the notification, falling back to
+// the original transaction.
+func userToken(appAccountToken string, tx *Transaction) string {
+	if tx.AppAccountToken != "" {
+		return tx.AppAccountToken
+	}
+	if appAccountToken != "" {
+		return appAccountToken
+	}
+	return "tx:" + tx.OriginalTransactionID
+}
+
+// describeTransaction copies the transaction details kept for analytics and
+// offer-aware entitlements onto status and event.
+func describeTransaction(tx *Transaction, status *storage.SubscriptionStatus, event *storage.SubscriptionEvent) {
+	status.OriginalPurchaseDate = tools.MsToTime(tx.OriginalPurchaseDateMS)
+	status.OwnershipType = tx.InAppOwnershipType
+	status.SubscriptionGroupID = tx.SubscriptionGroupIdentifier
+	status.OfferID = tx.OfferIdentifier
+	if tx.OfferType != nil {
+		status.OfferType = *tx.OfferType
+	}
+	if status.Environment == "" {
+		status.Environment = tx.Environment
+	}
+
+	event.TransactionType = tx.Type
+	event.TransactionReason = tx.TransactionReason
+	event.OwnershipType = tx.InAppOwnershipType
+	event.Environment = status.Environment
+	event.Storefront = tx.Storefront
+	event.PurchaseDate = tools.MsToTime(tx.PurchaseDateMS)
+	event.OfferType = status.OfferType
+	event.OfferID = tx.OfferIdentifier
+	event.OfferDiscountType = tx.OfferDiscountType
+	event.IsUpgraded = tx.IsUpgraded
+}
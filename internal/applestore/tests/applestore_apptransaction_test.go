@@ -0,0 +1,214 @@
+package applestore
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+const (
+	testDeviceID = "A1B2C3D4-E5F6-4711-8899-AABBCCDDEEFF"
+	testNonce    = "5c2e8a1f-3b4d-4e6f-9a7b-0c1d2e3f4a5b"
+)
+
+type appTransactionHandler interface {
+	HandleAppTransaction(w http.ResponseWriter, r *http.Request)
+}
+
+// fakeAppTransaction собирает подписанную транзакцию приложения для testDeviceID
+func fakeAppTransaction(bundleID, originalVersion string, originalPurchase time.Time) string {
+	return fakeAppTransactionID("704000000000001", bundleID, originalVersion, originalPurchase)
+}
+
+// fakeAppTransactionID собирает транзакцию приложения с заданным appTransactionId
+func fakeAppTransactionID(id, bundleID, originalVersion string, originalPurchase time.Time) string {
+	verification := sha512.Sum384([]byte(testNonce + strings.ToLower(testDeviceID)))
+	return fakeJWS(map[string]any{
+		"bundleId":                   bundleID,
+		"applicationVersion":         "310",
+		"originalApplicationVersion": originalVersion,
+		"originalPurchaseDate":       originalPurchase.UnixMilli(),
+		"receiptType":                "Production",
+		"deviceVerification":         base64.StdEncoding.EncodeToString(verification[:]),
+		"deviceVerificationNonce":    testNonce,
+		"appTransactionId":           id,
+	})
+}
+
+func sendAppTransaction(service appTransactionHandler, body any) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	service.HandleAppTransaction(w, httptest.NewRequest(http.MethodPost, "/app-transaction", bytes.NewReader(b)))
+	return w
+}
+
+// TestHandleAppTransaction_LegacyPurchaser проверяет выдачу права покупателям платной версии
+func TestHandleAppTransaction_LegacyPurchaser(t *testing.T) {
+	purchases := storage.NewMemoryPurchaseStore()
+	events := storage.NewMemoryEventStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(NewMockStorage(), NewMockLogger(), parser,
+		applestore.WithPurchases(purchases),
+		applestore.WithEventStore(events),
+		applestore.WithBundleIDs("com.test.app"),
+		applestore.WithLegacyPurchasers(applestore.LegacyPurchasers{
+			ProductID: "com.test.legacy",
+			Version:   "2.0",
+			Before:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		}),
+	).(appTransactionHandler)
+
+	purchased := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	req := applestore.ClientAppTransaction{
+		UserToken:            "paid-user",
+		SignedAppTransaction: fakeAppTransaction("com.test.app", "1.10", purchased),
+		DeviceID:             testDeviceID,
+		Nonce:                strings.ToUpper(testNonce),
+	}
+	// Повторная отправка не выдает право второй раз
+	for i := 0; i < 2; i++ {
+		w := sendAppTransaction(service, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+		var result applestore.AppTransactionResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Ошибка декодирования ответа: %v", err)
+		}
+		if !result.LegacyPurchaser || result.Purchase == nil || result.Purchase.ProductID != "com.test.legacy" ||
+			!result.Purchase.IsActive || result.OriginalApplicationVersion != "1.10" || !result.OriginalPurchaseDate.Equal(purchased) {
+			t.Errorf("Неправильный ответ: %+v", result)
+		}
+	}
+
+	list, err := purchases.ListPurchases(t.Context(), "paid-user")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Ожидалась 1 покупка, получено %d (%v)", len(list), err)
+	}
+	if p := list[0]; p.ProductType != storage.ProductTypeNonConsumable || p.OriginalTransactionID != "704000000000001" ||
+		!p.PurchasedAt.Equal(purchased) || p.Environment != "Production" {
+		t.Errorf("Неправильная покупка: %+v", p)
+	}
+	timeline, err := events.ListEvents(t.Context(), "paid-user")
+	if err != nil || len(timeline) != 1 || timeline[0].Source != storage.EventSourceAppTransaction {
+		t.Errorf("Ожидалось 1 событие транзакции приложения, получено %+v (%v)", timeline, err)
+	}
+
+	// Версия 2.0 и новее после даты отсечения - не покупатель платной версии
+	req.UserToken = "free-user"
+	req.SignedAppTransaction = fakeAppTransactionID("704000000000002", "com.test.app", "2.0.1", purchased)
+	w := sendAppTransaction(service, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"legacyPurchaser":false`) {
+		t.Errorf("Ожидался ответ без права, получен %d: %s", w.Code, w.Body.String())
+	}
+	if list, _ := purchases.ListPurchases(t.Context(), "free-user"); len(list) != 0 {
+		t.Errorf("Право не должно выдаваться: %+v", list)
+	}
+
+	// Покупка до даты отсечения
+	req.UserToken = "early-user"
+	req.SignedAppTransaction = fakeAppTransactionID("704000000000003", "com.test.app", "3.0", time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC))
+	if w := sendAppTransaction(service, req); !strings.Contains(w.Body.String(), `"legacyPurchaser":true`) {
+		t.Errorf("Ожидалось право по дате покупки, получен %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestHandleAppTransaction_OneGrantPerAppTransaction проверяет, что покупка приложения не выдает право нескольким пользователям
+func TestHandleAppTransaction_OneGrantPerAppTransaction(t *testing.T) {
+	purchases := storage.NewMemoryPurchaseStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(NewMockStorage(), NewMockLogger(), parser,
+		applestore.WithPurchases(purchases),
+		applestore.WithLegacyPurchasers(applestore.LegacyPurchasers{ProductID: "com.test.legacy", Version: "2.0"}),
+	).(appTransactionHandler)
+
+	req := applestore.ClientAppTransaction{
+		UserToken:            "first-user",
+		SignedAppTransaction: fakeAppTransaction("com.test.app", "1.0", time.Now()),
+		DeviceID:             testDeviceID,
+		Nonce:                testNonce,
+	}
+	if w := sendAppTransaction(service, req); w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	// Та же транзакция приложения от другого пользователя
+	req.UserToken = "second-user"
+	if w := sendAppTransaction(service, req); w.Code != http.StatusConflict {
+		t.Errorf("Ожидался статус 409, получен %d: %s", w.Code, w.Body.String())
+	}
+	if list, _ := purchases.ListPurchases(t.Context(), "second-user"); len(list) != 0 {
+		t.Errorf("Право не должно выдаваться второму пользователю: %+v", list)
+	}
+	if list, _ := purchases.ListPurchases(t.Context(), "first-user"); len(list) != 1 || list[0].TransactionID != "legacy:704000000000001" {
+		t.Errorf("Право первого пользователя должно сохраниться: %+v", list)
+	}
+
+	// Без appTransactionId право не к чему привязать
+	req.UserToken = "third-user"
+	req.SignedAppTransaction = fakeAppTransactionID("", "com.test.app", "1.0", time.Now())
+	if w := sendAppTransaction(service, req); w.Code != http.StatusBadRequest {
+		t.Errorf("Ожидался статус 400, получен %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestHandleAppTransaction_Errors проверяет отказы при проверке транзакции приложения
+func TestHandleAppTransaction_Errors(t *testing.T) {
+	validator := NewMockJWSValidator()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(validator))
+	legacy := applestore.WithLegacyPurchasers(applestore.LegacyPurchasers{ProductID: "com.test.legacy", Version: "2.0"})
+	service := applestore.NewAppleStoreService(NewMockStorage(), NewMockLogger(), parser,
+		applestore.WithBundleIDs("com.test.app"), legacy).(appTransactionHandler)
+
+	valid := applestore.ClientAppTransaction{
+		UserToken:            "paid-user",
+		SignedAppTransaction: fakeAppTransaction("com.test.app", "1.0", time.Now()),
+		DeviceID:             testDeviceID,
+		Nonce:                testNonce,
+	}
+	with := func(change func(*applestore.ClientAppTransaction)) applestore.ClientAppTransaction {
+		req := valid
+		change(&req)
+		return req
+	}
+	tests := []struct {
+		name string
+		body applestore.ClientAppTransaction
+		code int
+	}{
+		{"без устройства", with(func(r *applestore.ClientAppTransaction) { r.DeviceID = "" }), http.StatusBadRequest},
+		{"чужое устройство", with(func(r *applestore.ClientAppTransaction) { r.DeviceID = "00000000-0000-4000-8000-000000000000" }), http.StatusForbidden},
+		{"чужой nonce", with(func(r *applestore.ClientAppTransaction) { r.Nonce = "00000000-0000-4000-8000-000000000000" }), http.StatusForbidden},
+		{"чужое приложение", with(func(r *applestore.ClientAppTransaction) {
+			r.SignedAppTransaction = fakeAppTransaction("com.other.app", "1.0", time.Now())
+		}), http.StatusBadRequest},
+		{"не JWS", with(func(r *applestore.ClientAppTransaction) { r.SignedAppTransaction = "garbage" }), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := sendAppTransaction(service, tt.body); w.Code != tt.code {
+				t.Errorf("Ожидался статус %d, получен %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	validator.SetValidateError(errors.New("bad signature"))
+	if w := sendAppTransaction(service, valid); w.Code != http.StatusBadRequest {
+		t.Errorf("Ожидался статус 400 для неверной подписи, получен %d", w.Code)
+	}
+
+	// Без настройки права endpoint недоступен
+	disabled := applestore.NewAppleStoreService(NewMockStorage(), NewMockLogger(), parser).(appTransactionHandler)
+	if w := sendAppTransaction(disabled, valid); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Ожидался статус 503, получен %d", w.Code)
+	}
+}
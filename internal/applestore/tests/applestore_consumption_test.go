@@ -0,0 +1,77 @@
+package applestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// fakeReporter запоминает запросы данных о потреблении
+type fakeReporter struct {
+	events []*storage.SubscriptionEvent
+	err    error
+}
+
+func (r *fakeReporter) ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error {
+	r.events = append(r.events, event)
+	return r.err
+}
+
+// consumptionNotification собирает уведомление CONSUMPTION_REQUEST о расходуемой покупке
+func consumptionNotification(uuid string) []byte {
+	return fakeNotificationBody(map[string]any{
+		"notificationType": "CONSUMPTION_REQUEST",
+		"notificationUUID": uuid,
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"appAccountToken": "user1",
+			"environment":     "Sandbox",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "9000",
+				"transactionId":         "9000",
+				"productId":             "com.test.coins",
+				"type":                  "Consumable",
+				"purchaseDate":          time.Now().Add(-time.Hour).UnixMilli(),
+				"environment":           "Sandbox",
+			}),
+		},
+	})
+}
+
+// TestHandleProviderNotification_ConsumptionRequest проверяет передачу запроса Apple в ConsumptionReporter
+func TestHandleProviderNotification_ConsumptionRequest(t *testing.T) {
+	mockStorage := NewMockStorage()
+	reporter := &fakeReporter{}
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser,
+		applestore.WithPurchases(storage.NewMemoryPurchaseStore()),
+		applestore.WithConsumptionReporter(reporter),
+	)
+
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(consumptionNotification("c-1"))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+	if len(reporter.events) != 1 {
+		t.Fatalf("Ожидался 1 запрос данных о потреблении, получено %d", len(reporter.events))
+	}
+	if e := reporter.events[0]; e.Type != "CONSUMPTION_REQUEST" || e.TransactionID != "9000" || e.UserToken != "user1" {
+		t.Errorf("Неправильное событие: %+v", e)
+	}
+
+	// Ошибка отправки возвращается, чтобы Apple повторила уведомление
+	reporter.err = errors.New("apple unavailable")
+	w = httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(consumptionNotification("c-2"))))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Ожидался статус 500, получен %d", w.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package applestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/storage"
+	"testing"
+)
+
+// TestHandleProviderNotification_DeadLetter проверяет попадание упавшего уведомления
+// в очередь ошибок и его повторную обработку тем же путем
+func TestHandleProviderNotification_DeadLetter(t *testing.T) {
+	// Подготовка
+	mockStorage := NewMockStorage()
+	mockStorage.SetSaveError(errors.New("storage error"))
+	mockLogger := NewMockLogger()
+
+	dlq := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), mockLogger, deadletter.Options{})
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, mockLogger, parser, applestore.WithDeadLetters(dlq))
+	dlq.Register(storage.EventSourceAppleServer, service.ProcessProviderPayload)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"signedPayload": providerNotificationPayload,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	// Выполнение
+	service.HandleProviderNotification(w, req)
+
+	// Проверка
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Ожидался статус 500, получен %d", w.Code)
+	}
+	list, err := dlq.List(context.Background())
+	if err != nil {
+		t.Fatalf("Ошибка при получении очереди: %v", err)
+	}
+	if len(list) != 1 || list[0].Payload != string(body) {
+		t.Fatalf("Уведомление не попало в очередь ошибок: %+v", list)
+	}
+
+	// Хранилище восстановлено — повтор проходит и сохраняет статус
+	mockStorage.SetSaveError(nil)
+	if err := dlq.Retry(context.Background(), list[0].ID); err != nil {
+		t.Fatalf("Ошибка повторной обработки: %v", err)
+	}
+	status, _ := mockStorage.GetSubscriptionStatus(context.Background(), "user456")
+	if status == nil || status.OriginalTransactionID != "123456" {
+		t.Errorf("Статус не сохранен после повтора: %+v", status)
+	}
+}
+
+// TestHandleProviderNotification_UnknownBundle проверяет отклонение чужого bundleId
+func TestHandleProviderNotification_UnknownBundle(t *testing.T) {
+	// Подготовка
+	mockStorage := NewMockStorage()
+	mockLogger := NewMockLogger()
+
+	dlq := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), mockLogger, deadletter.Options{})
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, mockLogger, parser,
+		applestore.WithDeadLetters(dlq),
+		applestore.WithBundleIDs("com.other.app"),
+	)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"signedPayload": providerNotificationPayload,
+	})
+
+	// Выполнение
+	err := service.ProcessProviderPayload(context.Background(), body)
+
+	// Проверка
+	if !errors.Is(err, applestore.ErrUnknownBundle) {
+		t.Errorf("Ожидалась ошибка %v, получена %v", applestore.ErrUnknownBundle, err)
+	}
+	if status, _ := mockStorage.GetSubscriptionStatus(context.Background(), "user456"); status != nil {
+		t.Error("Статус не должен сохраняться для чужого bundleId")
+	}
+}
+
+// TestHandleProviderNotification_UnverifiedNotDeadLettered проверяет, что мусор и
+// уведомления с неверной подписью транзакции не попадают в очередь ошибок
+func TestHandleProviderNotification_UnverifiedNotDeadLettered(t *testing.T) {
+	// Подготовка
+	validator := NewMockJWSValidator()
+	validator.SetValidateError(errors.New("bad signature"))
+	mockLogger := NewMockLogger()
+
+	dlq := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), mockLogger, deadletter.Options{})
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(validator))
+	service := applestore.NewAppleStoreService(NewMockStorage(), mockLogger, parser, applestore.WithDeadLetters(dlq))
+
+	signed, _ := json.Marshal(map[string]interface{}{
+		"signedPayload": providerNotificationPayload,
+	})
+	for _, body := range [][]byte{[]byte("not json"), signed} {
+		req := httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+
+		// Выполнение
+		service.HandleProviderNotification(w, req)
+
+		// Проверка
+		if w.Code == http.StatusOK {
+			t.Errorf("Ожидалась ошибка для тела %q", body)
+		}
+	}
+	list, err := dlq.List(context.Background())
+	if err != nil {
+		t.Fatalf("Ошибка при получении очереди: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("Непроверенные уведомления не должны попадать в очередь ошибок: %+v", list)
+	}
+}
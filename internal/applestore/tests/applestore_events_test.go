@@ -0,0 +1,281 @@
+package applestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// TestHandleProviderNotification_RecordsEvent проверяет запись события в журнал
+func TestHandleProviderNotification_RecordsEvent(t *testing.T) {
+	// Подготовка
+	mockStorage := NewMockStorage()
+	mockLogger := NewMockLogger()
+	mockValidator := NewMockJWSValidator()
+	events := storage.NewMemoryEventStore()
+
+	decoder := applestore.NewAppleDecoder(mockValidator)
+	parser := applestore.NewAppleParser(decoder)
+	service := applestore.NewAppleStoreService(mockStorage, mockLogger, parser, applestore.WithEventStore(events))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"signedPayload": providerNotificationPayload,
+	})
+
+	// Apple может повторно доставить то же уведомление
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		service.HandleProviderNotification(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Проверка
+	timeline, err := events.ListEvents(t.Context(), "user456")
+	if err != nil {
+		t.Fatalf("Ошибка при получении событий: %v", err)
+	}
+	if len(timeline) != 1 {
+		t.Fatalf("Ожидалось 1 событие, получено %d", len(timeline))
+	}
+
+	event := timeline[0]
+	if event.ID != "12345" || event.Type != "RENEWAL" || event.Source != storage.EventSourceAppleServer {
+		t.Errorf("Некорректное событие: %+v", event)
+	}
+	if event.OriginalTransactionID != "123456" || event.ProductID != "com.test.product" {
+		t.Errorf("Некорректные данные транзакции в событии: %+v", event)
+	}
+	if event.RawPayload != string(body) {
+		t.Errorf("Исходное тело уведомления не сохранено в событии")
+	}
+}
+
+// TestHandleClientNotification_RecordsEvent проверяет запись клиентской транзакции в журнал
+func TestHandleClientNotification_RecordsEvent(t *testing.T) {
+	// Подготовка
+	mockStorage := NewMockStorage()
+	mockLogger := NewMockLogger()
+	mockValidator := NewMockJWSValidator()
+	events := storage.NewMemoryEventStore()
+
+	decoder := applestore.NewAppleDecoder(mockValidator)
+	parser := applestore.NewAppleParser(decoder)
+	service := applestore.NewAppleStoreService(mockStorage, mockLogger, parser, applestore.WithEventStore(events))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"bundleId":              "com.test.app",
+		"appAccountToken":       "user123",
+		"signedTransactionInfo": clientTransactionJWS,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	// Выполнение
+	service.HandleClientNotification(w, req)
+
+	// Проверка
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	timeline, err := events.ListEvents(t.Context(), "user123")
+	if err != nil {
+		t.Fatalf("Ошибка при получении событий: %v", err)
+	}
+	if len(timeline) != 1 {
+		t.Fatalf("Ожидалось 1 событие, получено %d", len(timeline))
+	}
+	if timeline[0].TransactionID != "54321" || timeline[0].Source != storage.EventSourceAppleClient {
+		t.Errorf("Некорректное событие: %+v", timeline[0])
+	}
+}
+
+// TestHandleClientNotification_SignedAppAccountToken проверяет приоритет подписанного appAccountToken над телом запроса
+func TestHandleClientNotification_SignedAppAccountToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		bodyToken string
+		wantCode  int
+	}{
+		{"без токена в теле", "", http.StatusOK},
+		{"совпадающий токен", "signed-user", http.StatusOK},
+		{"чужой токен", "other-user", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := NewMockStorage()
+			parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+			service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser)
+
+			body := fakeClientBody(tt.bodyToken, map[string]any{
+				"originalTransactionId": "7000",
+				"transactionId":         "7001",
+				"productId":             "com.test.monthly",
+				"appAccountToken":       "signed-user",
+				"expiresDate":           time.Now().Add(time.Hour).UnixMilli(),
+			})
+			w := httptest.NewRecorder()
+			service.HandleClientNotification(w, httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(body)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("Ожидался статус %d, получен %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+
+			status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "signed-user")
+			if tt.wantCode == http.StatusOK && (status == nil || !status.IsActive) {
+				t.Errorf("Подписка должна быть сохранена за пользователем транзакции, получено %+v", status)
+			}
+			if tt.wantCode != http.StatusOK && status != nil {
+				t.Errorf("Отклоненное уведомление не должно менять статус: %+v", status)
+			}
+			if other, _ := mockStorage.GetSubscriptionStatus(t.Context(), "other-user"); other != nil {
+				t.Errorf("Подписка не должна попасть к пользователю из тела запроса: %+v", other)
+			}
+		})
+	}
+}
+
+// Тестовые данные, общие для тестов журнала событий
+const (
+	// {"notificationType":"RENEWAL","notificationUUID":"12345",...,"appAccountToken":"user456",...}
+	providerNotificationPayload = "eyJub3RpZmljYXRpb25UeXBlIjoiUkVORVdBTCIsIm5vdGlmaWNhdGlvblVVSUQiOiIxMjM0NSIsInZlcnNpb24iOiIyLjAiLCJzaWduZWREYXRlIjoxNjI1MDA0ODUyLCJkYXRhIjp7ImJ1bmRsZUlkIjoiY29tLnRlc3QuYXBwIiwiYnVuZGxlVmVyc2lvbiI6IjEuMCIsImVudmlyb25tZW50Ijoic2FuZGJveCIsImFwcEFjY291bnRUb2tlbiI6InVzZXI0NTYiLCJzaWduZWRUcmFuc2FjdGlvbkluZm8iOiJoZWFkZXIuZXlKdmNtbG5hVzVoYkZSeVlXNXpZV04wYVc5dVNXUWlPaUl4TWpNME5UWWlMQ0owY21GdWMyRmpkR2x2YmtsRUlqb2lOVFF6TWpFaUxDSndjbTlrZFdOMFNXUWlPaUpqYjIwdWRHVnpkQzV3Y205a2RXTjBJaXdpWlhod2FYSmxjMFJoZEdVaU9qRTNNalV3TURBd01EQXdNREI5LnNpZ25hdHVyZSIsInNpZ25lZFJlbmV3YWxJbmZvIjoiaGVhZGVyLmV5SmhkWFJ2VW1WdVpYZFRkR0YwZFhNaU9qRXNJbWx6U1c1Q2FXeHNhVzVuVW1WMGNubFdZV3hzWlhraU9tWmhiSE5sZlEuc2lnbmF0dXJlIn19"
+
+	// {"originalTransactionId":"123456","transactionId":"54321","productId":"com.test.product","expiresDate":1725000000000}
+	clientTransactionJWS = "header.eyJvcmlnaW5hbFRyYW5zYWN0aW9uSWQiOiIxMjM0NTYiLCJ0cmFuc2FjdGlvbklkIjoiNTQzMjEiLCJwcm9kdWN0SWQiOiJjb20udGVzdC5wcm9kdWN0IiwiZXhwaXJlc0RhdGUiOjE3MjUwMDAwMDAwMDB9.signature"
+)
+
+// TestAppleStateMachine_Replay проверяет, что повтор записанного события дает тот же статус
+func TestAppleStateMachine_Replay(t *testing.T) {
+	// Подготовка
+	mockStorage := NewMockStorage()
+	events := storage.NewMemoryEventStore()
+
+	decoder := applestore.NewAppleDecoder(NewMockJWSValidator())
+	parser := applestore.NewAppleParser(decoder)
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser, applestore.WithEventStore(events))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"signedPayload": providerNotificationPayload,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body))
+	service.HandleProviderNotification(httptest.NewRecorder(), req)
+
+	timeline, err := events.ListEvents(t.Context(), "user456")
+	if err != nil || len(timeline) != 1 {
+		t.Fatalf("Ожидалось 1 событие, получено %d (ошибка %v)", len(timeline), err)
+	}
+
+	// Выполнение
+	replayed, err := applestore.NewAppleStateMachine(parser).Replay(nil, timeline[0], time.Now())
+	if err != nil {
+		t.Fatalf("Ошибка воспроизведения события: %v", err)
+	}
+
+	// Проверка
+	stored, _ := mockStorage.GetSubscriptionStatus(t.Context(), "user456")
+	if stored == nil {
+		t.Fatal("Статус подписки не был сохранен")
+	}
+	if !replayed.Equal(stored) {
+		t.Errorf("Воспроизведенный статус %+v отличается от сохраненного %+v", replayed, stored)
+	}
+}
+
+// TestAppleReplayer_FoldsRecordedEvents проверяет повтор записанных событий без повторной проверки подписей
+func TestAppleReplayer_FoldsRecordedEvents(t *testing.T) {
+	events := storage.NewMemoryEventStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(NewMockStorage(), NewMockLogger(), parser, applestore.WithEventStore(events))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"signedPayload": providerNotificationPayload,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body))
+	service.HandleProviderNotification(httptest.NewRecorder(), req)
+
+	timeline, err := events.ListEvents(t.Context(), "user456")
+	if err != nil || len(timeline) != 1 {
+		t.Fatalf("Ожидалось 1 событие, получено %d (ошибка %v)", len(timeline), err)
+	}
+
+	// Подписи тестовых данных не проходят проверку Apple, но записанные события уже проверены
+	now := time.Now()
+	verifying := applestore.NewAppleStateMachine(applestore.NewAppleParser(applestore.NewAppleDecoder(applestore.NewAppleJWSValidator())))
+	if _, err := verifying.Replay(nil, timeline[0], now); err == nil {
+		t.Fatal("Ожидалась ошибка проверки подписи")
+	}
+	replayer := applestore.NewAppleReplayer()
+	status, err := replayer.Replay(nil, timeline[0], now)
+	if err != nil {
+		t.Fatalf("Ошибка воспроизведения события: %v", err)
+	}
+	if status.AutoRenewEnabled == nil || !*status.AutoRenewEnabled {
+		t.Fatalf("Ожидалось включенное автопродление: %+v", status)
+	}
+
+	// Транзакция от клиента дополняет статус, а не заменяет его
+	client := storage.SubscriptionEvent{
+		ID:         "client:54321",
+		UserToken:  "user456",
+		Source:     storage.EventSourceAppleClient,
+		RawPayload: `{"appAccountToken":"user456","signedTransactionInfo":"` + clientTransactionJWS + `"}`,
+	}
+	folded, err := replayer.Replay(status, client, now)
+	if err != nil {
+		t.Fatalf("Ошибка воспроизведения события: %v", err)
+	}
+	if folded.AutoRenewEnabled == nil || !*folded.AutoRenewEnabled || !folded.ExpiresAt.Equal(status.ExpiresAt) {
+		t.Errorf("Транзакция от клиента потеряла данные о продлении: %+v", folded)
+	}
+	alone, err := replayer.Replay(nil, client, now)
+	if err != nil || alone.AutoRenewEnabled != nil {
+		t.Errorf("Без предыдущего статуса данных о продлении нет: %+v (%v)", alone, err)
+	}
+}
+
+// TestAppleReplayer_Expiry проверяет, что событие истечения только снимает активность
+func TestAppleReplayer_Expiry(t *testing.T) {
+	now := time.Now().UTC()
+	expired := now.Add(-time.Hour)
+	event := storage.SubscriptionEvent{
+		ID:         "expiry:user1",
+		UserToken:  "user1",
+		Source:     storage.EventSourceExpiry,
+		ExpiresAt:  expired,
+		OccurredAt: expired,
+	}
+	replayer := applestore.NewAppleReplayer()
+
+	// Без предыдущего статуса деактивировать нечего
+	if got, err := replayer.Replay(nil, event, now); err != nil || got != nil {
+		t.Errorf("Ожидался пустой статус, получено %+v (%v)", got, err)
+	}
+
+	autoRenew := true
+	current := &storage.SubscriptionStatus{UserToken: "user1", ProductID: "pro", ExpiresAt: expired, IsActive: true,
+		Environment: "Production", AutoRenewEnabled: &autoRenew, OwnershipType: "PURCHASED"}
+	got, err := replayer.Replay(current, event, now)
+	if err != nil {
+		t.Fatalf("Ошибка воспроизведения события: %v", err)
+	}
+	want := *current
+	want.IsActive = false
+	if !got.Equal(&want) || !current.IsActive {
+		t.Errorf("Ожидался %+v, получен %+v", want, *got)
+	}
+
+	// Подписка продлена после проверки истечения
+	renewed := *current
+	renewed.ExpiresAt = now.Add(time.Hour)
+	if got, err := replayer.Replay(&renewed, event, now); err != nil || got != &renewed {
+		t.Errorf("Продленная подписка не должна меняться: %+v (%v)", got, err)
+	}
+}
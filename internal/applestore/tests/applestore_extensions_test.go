@@ -0,0 +1,114 @@
+package applestore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// TestHandleProviderNotification_RenewalExtended проверяет перенос даты продления после RENEWAL_EXTENDED
+func TestHandleProviderNotification_RenewalExtended(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser)
+
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Millisecond)
+	sendPlanNotification(t, service, mockStorage,
+		planNotification("e-1", "DID_RENEW", "", "8000-1", "com.test.pro", "com.test.pro", false))
+
+	extended := expires.AddDate(0, 0, 7)
+	body := fakeNotificationBody(map[string]any{
+		"notificationType": "RENEWAL_EXTENDED",
+		"notificationUUID": "e-2",
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"appAccountToken": "plan-user",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "8000",
+				"transactionId":         "8000-1",
+				"productId":             "com.test.pro",
+				"type":                  "Auto-Renewable Subscription",
+				"expiresDate":           extended.UnixMilli(),
+			}),
+			"signedRenewalInfo": fakeJWS(map[string]any{"autoRenewStatus": 1, "autoRenewProductId": "com.test.pro"}),
+		},
+	})
+	status := sendPlanNotification(t, service, mockStorage, body)
+	if !status.ExpiresAt.Equal(extended) || !status.IsActive {
+		t.Errorf("Ожидалось продление до %v, получено %+v", extended, status)
+	}
+}
+
+// summaryNotification собирает уведомление RENEWAL_EXTENSION с итогами массового продления
+func summaryNotification(bundleID, requestID string) []byte {
+	return fakeNotificationBody(map[string]any{
+		"notificationType": "RENEWAL_EXTENSION",
+		"subtype":          "SUMMARY",
+		"notificationUUID": "summary-" + requestID,
+		"signedDate":       time.Date(2030, 1, 11, 0, 0, 0, 0, time.UTC).UnixMilli(),
+		"summary": map[string]any{
+			"requestIdentifier":      requestID,
+			"environment":            "Production",
+			"bundleId":               bundleID,
+			"productId":              "com.test.monthly",
+			"storefrontCountryCodes": []string{"USA"},
+			"succeededCount":         120,
+			"failedCount":            3,
+		},
+	})
+}
+
+// TestHandleProviderNotification_RenewalExtensionSummary проверяет завершение массового продления
+func TestHandleProviderNotification_RenewalExtensionSummary(t *testing.T) {
+	mockStorage := NewMockStorage()
+	events := storage.NewMemoryEventStore()
+	store := storage.NewMemoryExtensionStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser,
+		applestore.WithEventStore(events),
+		applestore.WithRenewalExtensions(store),
+		applestore.WithBundleIDs("com.test.app"),
+	)
+
+	requested := time.Date(2030, 1, 10, 0, 0, 0, 0, time.UTC)
+	store.SaveRenewalExtension(t.Context(), &storage.RenewalExtension{RequestID: "mass-1", ProductID: "com.test.monthly",
+		Environment: "Production", Days: 3, Reason: 3, Status: storage.ExtensionPending, RequestedAt: requested})
+
+	send := func(body []byte) int {
+		w := httptest.NewRecorder()
+		service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := send(summaryNotification("com.test.app", "mass-1")); code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d", code)
+	}
+	ext, err := store.GetRenewalExtension(t.Context(), "mass-1")
+	if err != nil {
+		t.Fatalf("Запрос не найден: %v", err)
+	}
+	if ext.Status != storage.ExtensionComplete || ext.SucceededCount != 120 || ext.FailedCount != 3 ||
+		ext.Days != 3 || !ext.RequestedAt.Equal(requested) || !ext.CompletedAt.Equal(time.Date(2030, 1, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Неправильно завершенный запрос: %+v", ext)
+	}
+
+	// Продление, начатое в App Store Connect, сохраняется по итогам
+	if code := send(summaryNotification("com.test.app", "mass-2")); code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d", code)
+	}
+	if ext, err := store.GetRenewalExtension(t.Context(), "mass-2"); err != nil || ext.Status != storage.ExtensionComplete {
+		t.Errorf("Ожидался сохраненный запрос: %+v (%v)", ext, err)
+	}
+
+	if code := send(summaryNotification("com.other.app", "mass-3")); code != http.StatusInternalServerError {
+		t.Errorf("Итоги чужого приложения должны отклоняться, получен статус %d", code)
+	}
+	if list, _ := events.ListEvents(t.Context(), ""); len(list) != 0 {
+		t.Errorf("Итоги продления не относятся к пользователю и не записываются в события: %+v", list)
+	}
+}
@@ -0,0 +1,85 @@
+package applestore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// familyNotification собирает уведомление о транзакции члена семьи
+func familyNotification(uuid, notificationType, user, otx string, revoked bool) []byte {
+	tx := map[string]any{
+		"originalTransactionId": otx,
+		"transactionId":         otx + "-1",
+		"productId":             "com.test.family",
+		"type":                  "Auto-Renewable Subscription",
+		"inAppOwnershipType":    "FAMILY_SHARED",
+		"expiresDate":           time.Now().Add(24 * time.Hour).UnixMilli(),
+	}
+	if revoked {
+		tx["revocationDate"] = time.Now().UnixMilli()
+	}
+	return fakeNotificationBody(map[string]any{
+		"notificationType": notificationType,
+		"notificationUUID": uuid,
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":              "com.test.app",
+			"appAccountToken":       user,
+			"signedTransactionInfo": fakeJWS(tx),
+			"signedRenewalInfo":     fakeJWS(map[string]any{"autoRenewStatus": 1}),
+		},
+	})
+}
+
+// TestHandleProviderNotification_FamilyRevoke проверяет отзыв семейного доступа у члена семьи
+func TestHandleProviderNotification_FamilyRevoke(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	events := storage.NewMemoryEventStore()
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser, applestore.WithEventStore(events))
+
+	send := func(body []byte) {
+		w := httptest.NewRecorder()
+		service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Член семьи без собственной подписки получает доступ, а затем теряет его
+	send(familyNotification("f-1", "SUBSCRIBED", "member", "7000", false))
+	status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "member")
+	if status == nil || !status.IsActive || status.OwnershipType != storage.OwnershipFamilyShared {
+		t.Fatalf("Ожидался активный семейный доступ: %+v", status)
+	}
+	send(familyNotification("f-2", "REVOKE", "member", "7000", true))
+	status, _ = mockStorage.GetSubscriptionStatus(t.Context(), "member")
+	if status == nil || status.IsActive || status.RevokedAt.IsZero() {
+		t.Fatalf("Семейный доступ должен быть отозван: %+v", status)
+	}
+
+	// У пользователя есть собственная подписка: отзыв семейного доступа ее не затрагивает
+	own := &storage.SubscriptionStatus{
+		UserToken:             "owner",
+		ProductID:             "com.test.family",
+		OriginalTransactionID: "7100",
+		OwnershipType:         "PURCHASED",
+		ExpiresAt:             time.Now().Add(24 * time.Hour).UTC(),
+		IsActive:              true,
+	}
+	mockStorage.SetSubscriptionStatus(t.Context(), own)
+	send(familyNotification("f-3", "REVOKE", "owner", "7200", true))
+
+	status, _ = mockStorage.GetSubscriptionStatus(t.Context(), "owner")
+	if status == nil || status.OriginalTransactionID != "7100" || !status.IsActive || !status.RevokedAt.IsZero() {
+		t.Errorf("Собственная подписка не должна меняться: %+v", status)
+	}
+	if timeline, _ := events.ListEvents(t.Context(), "owner"); len(timeline) != 1 || timeline[0].Type != "REVOKE" {
+		t.Errorf("Событие отзыва должно быть записано: %+v", timeline)
+	}
+}
@@ -82,6 +82,36 @@ func TestAppleParser(t *testing.T) {
 		}
 	})
 
+	// Тест для TransactionOwner
+	t.Run("TransactionOwner", func(t *testing.T) {
+		mockValidator.ValidateError = nil
+
+		c, err := parser.TransactionOwner(fakeJWS(map[string]any{
+			"bundleId": "com.test.app", "transactionId": "123457", "originalTransactionId": "123456", "appAccountToken": "user123",
+		}))
+		if err != nil || c.BundleID != "com.test.app" || c.UserToken != "user123" {
+			t.Fatalf("Ожидался пользователь user123 приложения com.test.app, получено %+v (%v)", c, err)
+		}
+		if len(c.TransactionIDs) != 2 || c.TransactionIDs[0] != "123457" || c.TransactionIDs[1] != "123456" {
+			t.Errorf("Неправильные идентификаторы транзакции: %v", c.TransactionIDs)
+		}
+
+		// Без appAccountToken пользователь определяется по исходной транзакции
+		c, err = parser.TransactionOwner(fakeJWS(map[string]any{"bundleId": "com.test.app", "originalTransactionId": "123456"}))
+		if err != nil || c.UserToken != "tx:123456" {
+			t.Errorf("Ожидался пользователь tx:123456, получено %+v (%v)", c, err)
+		}
+
+		// Транзакция приложения не называет пользователя
+		c, err = parser.AppTransactionOwner(fakeJWS(map[string]any{"bundleId": "com.test.app", "appTransactionId": "705"}))
+		if err != nil || c.BundleID != "com.test.app" || c.UserToken != "" || len(c.TransactionIDs) != 1 || c.TransactionIDs[0] != "705" {
+			t.Errorf("Неправильный владелец транзакции приложения: %+v (%v)", c, err)
+		}
+		if _, err := parser.AppTransactionOwner(fakeJWS(map[string]any{"bundleId": "com.test.app"})); err == nil {
+			t.Error("Ожидалась ошибка для транзакции приложения без appTransactionId")
+		}
+	})
+
 	// Тест на ошибки валидации
 	t.Run("ValidateError", func(t *testing.T) {
 		// Настраиваем мок-валидатор на возврат ошибки
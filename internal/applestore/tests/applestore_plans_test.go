@@ -0,0 +1,124 @@
+package applestore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/contracts"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// planNotification собирает уведомление о транзакции product с продлением на autoRenewProduct
+func planNotification(uuid, notificationType, subtype, txID, product, autoRenewProduct string, upgraded bool) []byte {
+	return fakeNotificationBody(map[string]any{
+		"notificationType": notificationType,
+		"subtype":          subtype,
+		"notificationUUID": uuid,
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"appAccountToken": "plan-user",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "8000",
+				"transactionId":         txID,
+				"productId":             product,
+				"type":                  "Auto-Renewable Subscription",
+				"expiresDate":           time.Now().Add(24 * time.Hour).UnixMilli(),
+				"isUpgraded":            upgraded,
+			}),
+			"signedRenewalInfo": fakeJWS(map[string]any{
+				"autoRenewStatus":    1,
+				"autoRenewProductId": autoRenewProduct,
+			}),
+		},
+	})
+}
+
+// sendPlanNotification передает уведомление сервису и возвращает сохраненный статус
+func sendPlanNotification(t *testing.T, service contracts.Service, st *MockStorage, body []byte) *storage.SubscriptionStatus {
+	t.Helper()
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+	status, _ := st.GetSubscriptionStatus(t.Context(), "plan-user")
+	if status == nil {
+		t.Fatal("Статус подписки не был сохранен")
+	}
+	return status
+}
+
+// TestHandleProviderNotification_Downgrade проверяет, что понижение тарифа вступает в силу при продлении
+func TestHandleProviderNotification_Downgrade(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser)
+
+	status := sendPlanNotification(t, service, mockStorage,
+		planNotification("p-1", "DID_CHANGE_RENEWAL_PREF", "DOWNGRADE", "8000-1", "com.test.pro", "com.test.basic", false))
+	if status.ProductID != "com.test.pro" || status.PendingProductID != "com.test.basic" {
+		t.Errorf("До продления должен действовать прежний тариф: %+v", status)
+	}
+
+	status = sendPlanNotification(t, service, mockStorage,
+		planNotification("p-2", "DID_RENEW", "", "8000-2", "com.test.basic", "com.test.basic", false))
+	if status.ProductID != "com.test.basic" || status.PendingProductID != "" {
+		t.Errorf("После продления должен действовать новый тариф: %+v", status)
+	}
+}
+
+// TestHandleProviderNotification_Upgrade проверяет немедленное повышение тарифа
+func TestHandleProviderNotification_Upgrade(t *testing.T) {
+	mockStorage := NewMockStorage()
+	events := storage.NewMemoryEventStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser, applestore.WithEventStore(events))
+
+	status := sendPlanNotification(t, service, mockStorage,
+		planNotification("p-1", "DID_CHANGE_RENEWAL_PREF", "UPGRADE", "8000-1", "com.test.basic", "com.test.pro", false))
+	if status.ProductID != "com.test.pro" || status.PendingProductID != "" {
+		t.Errorf("Повышение тарифа должно действовать сразу: %+v", status)
+	}
+
+	// Запоздавшее уведомление о замененной транзакции не возвращает прежний тариф
+	status = sendPlanNotification(t, service, mockStorage,
+		planNotification("p-2", "DID_CHANGE_RENEWAL_STATUS", "", "8000-1", "com.test.basic", "com.test.pro", true))
+	if status.ProductID != "com.test.pro" {
+		t.Errorf("Замененная транзакция не должна менять статус: %+v", status)
+	}
+	timeline, err := events.ListEvents(t.Context(), "plan-user")
+	if err != nil || len(timeline) != 2 {
+		t.Fatalf("Ожидалось 2 события, получено %d (%v)", len(timeline), err)
+	}
+	if !timeline[1].IsUpgraded {
+		t.Errorf("Событие должно отмечать замененную транзакцию: %+v", timeline[1])
+	}
+}
+
+// TestHandleProviderNotification_PlanLevels проверяет определение смены тарифа по уровням группы
+func TestHandleProviderNotification_PlanLevels(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser,
+		applestore.WithSubscriptionGroups(map[string][]string{
+			"premium": {"com.test.pro", "com.test.basic"},
+		}))
+
+	// Уведомление без подтипа: уровень com.test.pro выше, поэтому тариф меняется сразу
+	status := sendPlanNotification(t, service, mockStorage,
+		planNotification("p-1", "DID_CHANGE_RENEWAL_PREF", "", "8000-1", "com.test.basic", "com.test.pro", false))
+	if status.ProductID != "com.test.pro" || status.PendingProductID != "" {
+		t.Errorf("Ожидалось немедленное повышение тарифа: %+v", status)
+	}
+
+	// Продукт вне групп ожидает продления
+	status = sendPlanNotification(t, service, mockStorage,
+		planNotification("p-2", "DID_CHANGE_RENEWAL_PREF", "", "8000-2", "com.test.pro", "com.test.other", false))
+	if status.ProductID != "com.test.pro" || status.PendingProductID != "com.test.other" {
+		t.Errorf("Неизвестный продукт должен ожидать продления: %+v", status)
+	}
+}
@@ -0,0 +1,277 @@
+package applestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/contracts"
+	"subscription-server/internal/credits"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// fakeClientBody собирает тело клиентского уведомления iOS с транзакцией tx
+func fakeClientBody(user string, tx map[string]any) []byte {
+	body, _ := json.Marshal(map[string]any{
+		"bundleId":              "com.test.app",
+		"appAccountToken":       user,
+		"signedTransactionInfo": fakeJWS(tx),
+	})
+	return body
+}
+
+// newPurchasesService создает сервис с хранилищем разовых покупок
+func newPurchasesService(st *MockStorage, purchases storage.PurchaseStore) contracts.Service {
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	return applestore.NewAppleStoreService(st, NewMockLogger(), parser,
+		applestore.WithPurchases(purchases),
+		applestore.WithNonRenewingPeriods(map[string]time.Duration{"com.test.season": 30 * 24 * time.Hour}),
+	)
+}
+
+// TestHandleClientNotification_NonConsumable проверяет сохранение бессрочной покупки
+func TestHandleClientNotification_NonConsumable(t *testing.T) {
+	mockStorage := NewMockStorage()
+	purchases := storage.NewMemoryPurchaseStore()
+	service := newPurchasesService(mockStorage, purchases)
+
+	purchased := time.Now().Add(-time.Hour).Truncate(time.Millisecond).UTC()
+	body := fakeClientBody("user1", map[string]any{
+		"originalTransactionId": "3000",
+		"transactionId":         "3000",
+		"productId":             "com.test.lifetime",
+		"type":                  "Non-Consumable",
+		"purchaseDate":          purchased.UnixMilli(),
+		"environment":           "Production",
+	})
+
+	w := httptest.NewRecorder()
+	service.HandleClientNotification(w, httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	if status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "user1"); status != nil {
+		t.Errorf("Разовая покупка не должна менять статус подписки: %+v", status)
+	}
+	list, err := purchases.ListPurchases(t.Context(), "user1")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Ожидалась 1 покупка, получено %d (%v)", len(list), err)
+	}
+	p := list[0]
+	if p.ProductID != "com.test.lifetime" || p.ProductType != storage.ProductTypeNonConsumable ||
+		!p.PurchasedAt.Equal(purchased) || !p.ExpiresAt.IsZero() || p.Environment != "Production" {
+		t.Errorf("Неправильная покупка: %+v", p)
+	}
+}
+
+// TestHandleProviderNotification_NonConsumableRefund проверяет отзыв бессрочной покупки при возврате
+func TestHandleProviderNotification_NonConsumableRefund(t *testing.T) {
+	mockStorage := NewMockStorage()
+	purchases := storage.NewMemoryPurchaseStore()
+	service := newPurchasesService(mockStorage, purchases)
+
+	revoked := time.Now().Truncate(time.Millisecond).UTC()
+	body := fakeNotificationBody(map[string]any{
+		"notificationType": "REFUND",
+		"notificationUUID": "refund-1",
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"environment":     "Production",
+			"appAccountToken": "user2",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "3100",
+				"transactionId":         "3100",
+				"productId":             "com.test.lifetime",
+				"type":                  "Non-Consumable",
+				"purchaseDate":          time.Now().Add(-24 * time.Hour).UnixMilli(),
+				"revocationDate":        revoked.UnixMilli(),
+			}),
+		},
+	})
+
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	list, _ := purchases.ListPurchases(t.Context(), "user2")
+	if len(list) != 1 || !list[0].RevokedAt.Equal(revoked) {
+		t.Fatalf("Покупка должна быть отозвана: %+v", list)
+	}
+}
+
+// TestHandleClientNotification_ConsumableIdempotent проверяет однократное зачисление расходуемой покупки
+func TestHandleClientNotification_ConsumableIdempotent(t *testing.T) {
+	mockStorage := NewMockStorage()
+	purchases := storage.NewMemoryPurchaseStore()
+	service := newPurchasesService(mockStorage, purchases)
+
+	send := func(transactionID string, quantity int) {
+		body := fakeClientBody("user3", map[string]any{
+			"originalTransactionId": transactionID,
+			"transactionId":         transactionID,
+			"productId":             "com.test.coins",
+			"type":                  "Consumable",
+			"quantity":              quantity,
+			"purchaseDate":          time.Now().UnixMilli(),
+		})
+		w := httptest.NewRecorder()
+		service.HandleClientNotification(w, httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Клиент может повторно прислать ту же транзакцию
+	send("4000", 3)
+	send("4000", 3)
+	send("4001", 0)
+
+	balances, err := purchases.Balances(t.Context(), "user3")
+	if err != nil {
+		t.Fatalf("Ошибка при получении баланса: %v", err)
+	}
+	if balances["com.test.coins"] != 4 {
+		t.Errorf("Ожидался баланс 4, получено %d", balances["com.test.coins"])
+	}
+	entries, _ := purchases.ListLedgerEntries(t.Context(), "user3")
+	if len(entries) != 2 {
+		t.Errorf("Ожидалось 2 записи в журнале, получено %d", len(entries))
+	}
+}
+
+// TestHandleClientNotification_NonRenewing проверяет вычисление срока непродлеваемой подписки
+func TestHandleClientNotification_NonRenewing(t *testing.T) {
+	mockStorage := NewMockStorage()
+	purchases := storage.NewMemoryPurchaseStore()
+	service := newPurchasesService(mockStorage, purchases)
+
+	purchased := time.Now().Truncate(time.Millisecond).UTC()
+	body := fakeClientBody("user4", map[string]any{
+		"originalTransactionId": "5000",
+		"transactionId":         "5000",
+		"productId":             "com.test.season",
+		"type":                  "Non-Renewing Subscription",
+		"purchaseDate":          purchased.UnixMilli(),
+	})
+	w := httptest.NewRecorder()
+	service.HandleClientNotification(w, httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	list, _ := purchases.ListPurchases(t.Context(), "user4")
+	if len(list) != 1 || !list[0].ExpiresAt.Equal(purchased.Add(30*24*time.Hour)) {
+		t.Fatalf("Неправильный срок абонемента: %+v", list)
+	}
+
+	// Для продукта без настроенного срока покупка не принимается
+	body = fakeClientBody("user4", map[string]any{
+		"originalTransactionId": "5001",
+		"transactionId":         "5001",
+		"productId":             "com.test.unknown",
+		"type":                  "Non-Renewing Subscription",
+		"purchaseDate":          purchased.UnixMilli(),
+	})
+	w = httptest.NewRecorder()
+	service.HandleClientNotification(w, httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Ожидался статус 500, получен %d", w.Code)
+	}
+}
+
+// TestHandleProviderNotification_CreditsClawback проверяет зачисление кредитов и их списание при возврате
+func TestHandleProviderNotification_CreditsClawback(t *testing.T) {
+	mockStorage := NewMockStorage()
+	purchases := storage.NewMemoryPurchaseStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser,
+		applestore.WithPurchases(purchases),
+		applestore.WithCreditProducts(map[string]int64{"com.test.coins100": 100}),
+	)
+	ledger := credits.NewLedger(purchases, credits.Options{})
+
+	send := func(uuid, notificationType string, revoked bool) {
+		tx := map[string]any{
+			"originalTransactionId": "6000",
+			"transactionId":         "6000",
+			"productId":             "com.test.coins100",
+			"type":                  "Consumable",
+			"quantity":              2,
+			"purchaseDate":          time.Now().Add(-time.Hour).UnixMilli(),
+		}
+		if revoked {
+			tx["revocationDate"] = time.Now().UnixMilli()
+		}
+		body := fakeNotificationBody(map[string]any{
+			"notificationType": notificationType,
+			"notificationUUID": uuid,
+			"signedDate":       time.Now().UnixMilli(),
+			"data": map[string]any{
+				"bundleId":              "com.test.app",
+				"appAccountToken":       "user5",
+				"signedTransactionInfo": fakeJWS(tx),
+			},
+		})
+		w := httptest.NewRecorder()
+		service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	send("buy-1", "ONE_TIME_CHARGE", false)
+	balance, _ := ledger.Balance(t.Context(), "user5")
+	if balance.Credits != 200 {
+		t.Fatalf("Ожидалось 200 кредитов, получено %d", balance.Credits)
+	}
+
+	if _, err := ledger.Debit(t.Context(), credits.DebitRequest{UserToken: "user5", Amount: 150, IdempotencyKey: "spend-1"}); err != nil {
+		t.Fatalf("Ошибка при списании: %v", err)
+	}
+
+	// Возврат забирает все зачисленные кредиты, даже если баланс уходит в минус
+	send("refund-1", "REFUND", true)
+	send("refund-1-again", "REFUND", true)
+	balance, _ = ledger.Balance(t.Context(), "user5")
+	if balance.Credits != -150 || !balance.Negative {
+		t.Errorf("Ожидался баланс -150 с флагом, получено %+v", balance)
+	}
+}
+
+// TestHandleProviderNotification_RefundBeforeCredit проверяет возврат транзакции, которая не зачислялась
+func TestHandleProviderNotification_RefundBeforeCredit(t *testing.T) {
+	purchases := storage.NewMemoryPurchaseStore()
+	service := newPurchasesService(NewMockStorage(), purchases)
+
+	body := fakeNotificationBody(map[string]any{
+		"notificationType": "REFUND",
+		"notificationUUID": "refund-2",
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"appAccountToken": "user6",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "6100",
+				"transactionId":         "6100",
+				"productId":             "com.test.coins",
+				"type":                  "Consumable",
+				"revocationDate":        time.Now().UnixMilli(),
+			}),
+		},
+	})
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+	if entries, _ := purchases.ListLedgerEntries(t.Context(), "user6"); len(entries) != 0 {
+		t.Errorf("Не ожидалось записей в журнале: %+v", entries)
+	}
+}
@@ -0,0 +1,483 @@
+package applestore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// receiptCA - тестовые корень, промежуточный сертификат WWDR и сертификат подписи чеков
+type receiptCA struct {
+	roots        *x509.CertPool
+	root         *x509.Certificate
+	rootKey      *rsa.PrivateKey
+	intermediate *x509.Certificate
+	wwdrKey      *rsa.PrivateKey
+	leaf         *x509.Certificate
+	key          *rsa.PrivateKey
+}
+
+var (
+	oidReceiptSigner    = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	oidWWDRIntermediate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+const receiptSignerName = "Mac App Store and iTunes Store Receipt Signing"
+
+// issueCert выпускает сертификат с отметкой Apple marker, если она задана
+func issueCert(t *testing.T, serial int64, cn string, marker asn1.ObjectIdentifier, ca bool, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Ошибка генерации ключа: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+	}
+	if marker != nil {
+		template.ExtraExtensions = []pkix.Extension{{Id: marker, Value: asn1.NullBytes}}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Ошибка создания сертификата %q: %v", cn, err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func newReceiptCA(t *testing.T) *receiptCA {
+	t.Helper()
+	root, rootKey := issueCert(t, 1, "Test Root CA", nil, true, nil, nil)
+	intermediate, wwdrKey := issueCert(t, 2, "Test WWDR CA", oidWWDRIntermediate, true, root, rootKey)
+	leaf, key := issueCert(t, 3, receiptSignerName, oidReceiptSigner, false, intermediate, wwdrKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &receiptCA{roots: roots, root: root, rootKey: rootKey, intermediate: intermediate, wwdrKey: wwdrKey, leaf: leaf, key: key}
+}
+
+// withLeaf возвращает копию ca, подписывающую чеки другим сертификатом того же WWDR
+func (ca *receiptCA) withLeaf(t *testing.T, cn string, marker asn1.ObjectIdentifier) *receiptCA {
+	t.Helper()
+	c := *ca
+	c.leaf, c.key = issueCert(t, 4, cn, marker, false, ca.intermediate, ca.wwdrKey)
+	return &c
+}
+
+// asn1 структуры для сборки чека
+type testReceiptAttribute struct {
+	Type    int
+	Version int
+	Value   []byte
+}
+
+type testIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type testSignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     testIssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type testContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type testSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      testContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []testSignerInfo `asn1:"set"`
+}
+
+func receiptField(t *testing.T, fieldType int, value any, params string) testReceiptAttribute {
+	t.Helper()
+	der, err := asn1.MarshalWithParams(value, params)
+	if err != nil {
+		t.Fatalf("Ошибка кодирования поля %d: %v", fieldType, err)
+	}
+	return testReceiptAttribute{Type: fieldType, Version: 1, Value: der}
+}
+
+func receiptSet(t *testing.T, attrs []testReceiptAttribute) []byte {
+	t.Helper()
+	der, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		t.Fatalf("Ошибка кодирования атрибутов: %v", err)
+	}
+	return der
+}
+
+// receiptInApp кодирует покупку чека; пустой expires - не подписка
+func receiptInApp(t *testing.T, productID, transactionID string, purchased, expires time.Time, trial bool) testReceiptAttribute {
+	t.Helper()
+	date := func(d time.Time) string {
+		if d.IsZero() {
+			return ""
+		}
+		return d.UTC().Format(time.RFC3339)
+	}
+	isTrial := 0
+	if trial {
+		isTrial = 1
+	}
+	purchase := receiptSet(t, []testReceiptAttribute{
+		receiptField(t, 1701, 1, ""),
+		receiptField(t, 1702, productID, "utf8"),
+		receiptField(t, 1703, transactionID, "utf8"),
+		receiptField(t, 1704, date(purchased), "ia5"),
+		receiptField(t, 1705, "9000", "utf8"),
+		receiptField(t, 1706, date(purchased.Add(-60*24*time.Hour)), "ia5"),
+		receiptField(t, 1708, date(expires), "ia5"),
+		receiptField(t, 1713, isTrial, ""),
+	})
+	return testReceiptAttribute{Type: 17, Version: 1, Value: purchase}
+}
+
+// fakeReceipt собирает подписанный ca чек PKCS#7 в base64
+func fakeReceipt(t *testing.T, ca *receiptCA, bundleID string, purchases ...testReceiptAttribute) string {
+	t.Helper()
+	attrs := []testReceiptAttribute{
+		receiptField(t, 0, "ProductionSandbox", "utf8"),
+		receiptField(t, 2, bundleID, "utf8"),
+		receiptField(t, 3, "1.2", "utf8"),
+		receiptField(t, 12, time.Now().UTC().Format(time.RFC3339), "ia5"),
+		receiptField(t, 19, "1.0", "utf8"),
+	}
+	payload := receiptSet(t, append(attrs, purchases...))
+
+	digest := sha256.Sum256(payload)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, ca.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Ошибка подписи чека: %v", err)
+	}
+	octets, _ := asn1.Marshal(payload)
+	sha256ID := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, Parameters: asn1.NullRawValue}
+	sd := testSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256ID},
+		ContentInfo: testContentInfo{
+			ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1},
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets},
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(append([]byte{}, ca.leaf.Raw...), ca.intermediate.Raw...)},
+		SignerInfos: []testSignerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     testIssuerAndSerial{Issuer: asn1.RawValue{FullBytes: ca.leaf.RawIssuer}, Serial: ca.leaf.SerialNumber},
+			DigestAlgorithm:           sha256ID,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           signature,
+		}},
+	}
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		t.Fatalf("Ошибка кодирования подписанных данных: %v", err)
+	}
+	der, err := asn1.Marshal(testContentInfo{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdDER},
+	})
+	if err != nil {
+		t.Fatalf("Ошибка кодирования чека: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// TestReceiptVerifier_Local проверяет локальную проверку чека PKCS#7
+func TestReceiptVerifier_Local(t *testing.T) {
+	ca := newReceiptCA(t)
+	verifier := applestore.NewReceiptVerifier(applestore.ReceiptOptions{Roots: ca.roots})
+
+	purchased := time.Now().Add(-time.Hour).Truncate(time.Second)
+	expires := purchased.Add(30 * 24 * time.Hour)
+	data := fakeReceipt(t, ca, "com.test.app", receiptInApp(t, "com.test.pro", "9000-2", purchased, expires, true))
+
+	receipt, err := verifier.VerifyReceipt(t.Context(), data)
+	if err != nil {
+		t.Fatalf("Ошибка проверки чека: %v", err)
+	}
+	if receipt.Environment != "Sandbox" || receipt.Receipt.BundleID != "com.test.app" ||
+		receipt.Receipt.ApplicationVersion != "1.2" || receipt.Receipt.OriginalApplicationVersion != "1.0" {
+		t.Errorf("Неправильные поля чека: %+v", receipt)
+	}
+	if len(receipt.LatestReceiptInfo) != 1 {
+		t.Fatalf("Ожидалась 1 покупка, получено %d", len(receipt.LatestReceiptInfo))
+	}
+	tx := receipt.LatestReceiptInfo[0]
+	if tx.ProductID != "com.test.pro" || tx.TransactionID != "9000-2" || tx.OriginalTransactionID != "9000" ||
+		tx.Quantity != "1" || tx.IsTrialPeriod != "true" {
+		t.Errorf("Неправильная покупка: %+v", tx)
+	}
+	if tx.ExpiresDateMS != jsonMS(expires) || tx.PurchaseDateMS != jsonMS(purchased) {
+		t.Errorf("Неправильные даты покупки: %+v", tx)
+	}
+
+	// Испорченная подпись
+	raw, _ := base64.StdEncoding.DecodeString(data)
+	raw[len(raw)-1] ^= 0xff
+	if _, err := verifier.VerifyReceipt(t.Context(), base64.StdEncoding.EncodeToString(raw)); !errors.Is(err, applestore.ErrInvalidReceipt) {
+		t.Errorf("Ожидалась ErrInvalidReceipt для испорченной подписи, получено %v", err)
+	}
+
+	// Чек, подписанный другим корнем
+	foreign := applestore.NewReceiptVerifier(applestore.ReceiptOptions{Roots: newReceiptCA(t).roots})
+	if _, err := foreign.VerifyReceipt(t.Context(), data); !errors.Is(err, applestore.ErrInvalidReceipt) {
+		t.Errorf("Ожидалась ErrInvalidReceipt для чужого корня, получено %v", err)
+	}
+
+	// Чек подписан другим сертификатом, выпущенным Apple: разработчика, без
+	// отметки подписи чеков, или под промежуточным сертификатом без отметки WWDR
+	signers := map[string]*receiptCA{
+		"сертификат разработчика": ca.withLeaf(t, "Apple Development: Mallory", nil),
+		"без отметки подписи":     ca.withLeaf(t, receiptSignerName, nil),
+		"отметка без имени":       ca.withLeaf(t, "Apple Development: Mallory", oidReceiptSigner),
+	}
+	rogue := *ca
+	rogue.intermediate, rogue.wwdrKey = issueCert(t, 5, "Test Developer ID CA", nil, true, ca.root, ca.rootKey)
+	signers["промежуточный без отметки WWDR"] = rogue.withLeaf(t, receiptSignerName, oidReceiptSigner)
+	for name, signer := range signers {
+		forged := fakeReceipt(t, signer, "com.test.app", receiptInApp(t, "com.test.pro", "9000-2", purchased, expires, false))
+		if _, err := verifier.VerifyReceipt(t.Context(), forged); !errors.Is(err, applestore.ErrInvalidReceipt) {
+			t.Errorf("%s: ожидалась ErrInvalidReceipt, получено %v", name, err)
+		}
+	}
+
+	// Чек по умолчанию проверяется по корню Apple
+	if _, err := applestore.NewReceiptVerifier(applestore.ReceiptOptions{}).VerifyReceipt(t.Context(), data); !errors.Is(err, applestore.ErrInvalidReceipt) {
+		t.Errorf("Ожидалась ErrInvalidReceipt для корня Apple, получено %v", err)
+	}
+
+	if _, err := verifier.VerifyReceipt(t.Context(), "не base64"); !errors.Is(err, applestore.ErrInvalidReceipt) {
+		t.Errorf("Ожидалась ErrInvalidReceipt для мусора, получено %v", err)
+	}
+}
+
+func jsonMS(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// TestReceiptVerifier_Fallback проверяет обращение к verifyReceipt с переходом в песочницу
+func TestReceiptVerifier_Fallback(t *testing.T) {
+	var got map[string]any
+	sandbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":      0,
+			"environment": "Sandbox",
+			"receipt":     map[string]any{"bundle_id": "com.test.app"},
+			"latest_receipt_info": []map[string]any{{
+				"product_id":              "com.test.pro",
+				"transaction_id":          "9000-3",
+				"original_transaction_id": "9000",
+				"expires_date_ms":         "1700000000000",
+			}},
+			"pending_renewal_info": []map[string]any{{
+				"original_transaction_id": "9000",
+				"auto_renew_status":       "0",
+			}},
+		})
+	}))
+	defer sandbox.Close()
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"status": 21007})
+	}))
+	defer production.Close()
+
+	verifier := applestore.NewReceiptVerifier(applestore.ReceiptOptions{
+		VerifyURL:    production.URL,
+		SandboxURL:   sandbox.URL,
+		SharedSecret: "secret",
+		Roots:        x509.NewCertPool(),
+	})
+	receipt, err := verifier.VerifyReceipt(t.Context(), "bm90IGEgcmVjZWlwdA==")
+	if err != nil {
+		t.Fatalf("Ошибка проверки чека: %v", err)
+	}
+	if got["receipt-data"] != "bm90IGEgcmVjZWlwdA==" || got["password"] != "secret" {
+		t.Errorf("Неправильный запрос verifyReceipt: %v", got)
+	}
+	if receipt.Environment != "Sandbox" || len(receipt.LatestReceiptInfo) != 1 || receipt.LatestReceiptInfo[0].TransactionID != "9000-3" ||
+		len(receipt.PendingRenewalInfo) != 1 || receipt.PendingRenewalInfo[0].AutoRenewStatus != "0" {
+		t.Errorf("Неправильный ответ verifyReceipt: %+v", receipt)
+	}
+
+	// Отказ Apple - недействительный чек
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"status": 21003})
+	}))
+	defer rejecting.Close()
+	verifier = applestore.NewReceiptVerifier(applestore.ReceiptOptions{VerifyURL: rejecting.URL, Roots: x509.NewCertPool()})
+	if _, err := verifier.VerifyReceipt(t.Context(), "bm90IGEgcmVjZWlwdA=="); !errors.Is(err, applestore.ErrInvalidReceipt) {
+		t.Errorf("Ожидалась ErrInvalidReceipt, получено %v", err)
+	}
+}
+
+// TestHandleClientReceipt проверяет статус подписки по чеку StoreKit 1 и его воспроизведение
+func TestHandleClientReceipt(t *testing.T) {
+	ca := newReceiptCA(t)
+	mockStorage := NewMockStorage()
+	events := storage.NewMemoryEventStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser,
+		applestore.WithEventStore(events),
+		applestore.WithBundleIDs("com.test.app"),
+		applestore.WithReceiptVerifier(applestore.NewReceiptVerifier(applestore.ReceiptOptions{Roots: ca.roots})),
+	).(interface {
+		HandleClientReceipt(w http.ResponseWriter, r *http.Request)
+	})
+
+	send := func(body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		service.HandleClientReceipt(w, httptest.NewRequest(http.MethodPost, "/client-receipt", bytes.NewReader(b)))
+		return w
+	}
+
+	now := time.Now().Truncate(time.Second)
+	data := fakeReceipt(t, ca, "com.test.app",
+		receiptInApp(t, "com.test.pro", "9000-1", now.Add(-40*24*time.Hour), now.Add(-10*24*time.Hour), true),
+		receiptInApp(t, "com.test.pro", "9000-2", now.Add(-10*24*time.Hour), now.Add(20*24*time.Hour), false),
+		receiptInApp(t, "com.test.coins", "9100", now.Add(-time.Hour), time.Time{}, false),
+	)
+	w := send(applestore.ClientReceipt{UserToken: "legacy-user", ReceiptData: data})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+	var result applestore.Entitlement
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Ошибка декодирования ответа: %v", err)
+	}
+	if result.UserToken != "legacy-user" || result.ProductID != "com.test.pro" ||
+		!result.IsActive || !result.ExpiresAt.Equal(now.Add(20*24*time.Hour)) {
+		t.Errorf("Неправильный ответ: %+v", result)
+	}
+	status, err := mockStorage.GetSubscriptionStatus(t.Context(), "legacy-user")
+	if err != nil || status.OriginalTransactionID != "9000" || status.Environment != "Sandbox" || status.OfferType != 0 {
+		t.Errorf("Неправильный статус: %+v (%v)", status, err)
+	}
+
+	list, err := events.ListEvents(t.Context(), "legacy-user")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Ожидалось 1 событие, получено %d (%v)", len(list), err)
+	}
+	event := list[0]
+	if event.ID != "receipt:9000-2" || event.Source != storage.EventSourceAppleReceipt || event.TransactionType != storage.ProductTypeAutoRenewable {
+		t.Errorf("Неправильное событие: %+v", event)
+	}
+	replayed, err := applestore.NewAppleStateMachine(parser).Replay(nil, event, time.Now())
+	if err != nil {
+		t.Fatalf("Ошибка воспроизведения: %v", err)
+	}
+	if replayed.ProductID != "com.test.pro" || !replayed.ExpiresAt.Equal(status.ExpiresAt) || !replayed.IsActive {
+		t.Errorf("Неправильный статус после воспроизведения: %+v", replayed)
+	}
+
+	tests := []struct {
+		name string
+		body any
+		code int
+	}{
+		{"без чека", applestore.ClientReceipt{UserToken: "legacy-user"}, http.StatusBadRequest},
+		{"недействительный чек", applestore.ClientReceipt{UserToken: "legacy-user", ReceiptData: "bm90IGEgcmVjZWlwdA=="}, http.StatusBadRequest},
+		{"чужое приложение", applestore.ClientReceipt{UserToken: "legacy-user", ReceiptData: fakeReceipt(t, ca, "com.other.app",
+			receiptInApp(t, "com.test.pro", "9000-2", now, now.Add(time.Hour), false))}, http.StatusBadRequest},
+		{"без подписки", applestore.ClientReceipt{UserToken: "legacy-user", ReceiptData: fakeReceipt(t, ca, "com.test.app",
+			receiptInApp(t, "com.test.coins", "9100", now, time.Time{}, false))}, http.StatusNotFound},
+		{"подписка другого пользователя", applestore.ClientReceipt{UserToken: "other-user", ReceiptData: data}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(tt.body); w.Code != tt.code {
+				t.Errorf("Ожидался статус %d, получен %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestHandleClientReceipt_MergesStoredStatus проверяет, что чек не затирает данные
+// уведомлений сервера и не откатывает более поздний срок действия
+func TestHandleClientReceipt_MergesStoredStatus(t *testing.T) {
+	ca := newReceiptCA(t)
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser,
+		applestore.WithReceiptVerifier(applestore.NewReceiptVerifier(applestore.ReceiptOptions{Roots: ca.roots})),
+	).(interface {
+		HandleClientReceipt(w http.ResponseWriter, r *http.Request)
+	})
+	send := func(data string) {
+		t.Helper()
+		b, _ := json.Marshal(applestore.ClientReceipt{UserToken: "legacy-user", ReceiptData: data})
+		w := httptest.NewRecorder()
+		service.HandleClientReceipt(w, httptest.NewRequest(http.MethodPost, "/client-receipt", bytes.NewReader(b)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	autoRenew := false
+	stored := &storage.SubscriptionStatus{
+		UserToken:             "legacy-user",
+		ProductID:             "com.test.pro",
+		OriginalTransactionID: "9000",
+		ExpiresAt:             now.Add(20 * 24 * time.Hour),
+		IsActive:              true,
+		Environment:           "Sandbox",
+		AutoRenewEnabled:      &autoRenew,
+		AutoRenewProductID:    "com.test.pro",
+		ExpirationIntent:      1,
+	}
+	mockStorage.SetSubscriptionStatus(t.Context(), stored)
+
+	// Устаревший чек с более ранним сроком ничего не меняет
+	send(fakeReceipt(t, ca, "com.test.app",
+		receiptInApp(t, "com.test.pro", "9000-1", now.Add(-10*24*time.Hour), now.Add(10*24*time.Hour), false)))
+	got, _ := mockStorage.GetSubscriptionStatus(t.Context(), "legacy-user")
+	if !got.Equal(stored) {
+		t.Errorf("Устаревший чек изменил статус: %+v", got)
+	}
+
+	// Чек того же периода сохраняет данные о продлении из уведомлений
+	send(fakeReceipt(t, ca, "com.test.app",
+		receiptInApp(t, "com.test.pro", "9000-2", now.Add(-10*24*time.Hour), now.Add(20*24*time.Hour), false)))
+	got, _ = mockStorage.GetSubscriptionStatus(t.Context(), "legacy-user")
+	if got.AutoRenewEnabled == nil || *got.AutoRenewEnabled || got.ExpirationIntent != 1 || !got.ExpiresAt.Equal(stored.ExpiresAt) {
+		t.Errorf("Чек затер данные о продлении: %+v", got)
+	}
+}
@@ -0,0 +1,85 @@
+package applestore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// refundNotification собирает уведомление notificationType о транзакции подписки 7000-1
+func refundNotification(uuid, notificationType string, revoked bool) []byte {
+	tx := map[string]any{
+		"originalTransactionId": "7000",
+		"transactionId":         "7000-1",
+		"productId":             "com.test.pro",
+		"type":                  "Auto-Renewable Subscription",
+		"expiresDate":           time.Now().Add(24 * time.Hour).UnixMilli(),
+		"price":                 9990,
+		"currency":              "USD",
+		"environment":           "Sandbox",
+	}
+	if revoked {
+		tx["revocationDate"] = time.Now().UnixMilli()
+		tx["revocationReason"] = 1
+	}
+	return fakeNotificationBody(map[string]any{
+		"notificationType": notificationType,
+		"notificationUUID": uuid,
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":              "com.test.app",
+			"appAccountToken":       "refund-user",
+			"environment":           "Sandbox",
+			"signedTransactionInfo": fakeJWS(tx),
+			"signedRenewalInfo":     fakeJWS(map[string]any{"autoRenewStatus": 0}),
+		},
+	})
+}
+
+// TestHandleProviderNotification_RefundHistory проверяет запись решений о возвратах
+func TestHandleProviderNotification_RefundHistory(t *testing.T) {
+	mockStorage := NewMockStorage()
+	refunds := storage.NewMemoryRefundStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser, applestore.WithRefunds(refunds))
+
+	for _, body := range [][]byte{
+		refundNotification("r-0", "DID_RENEW", false),
+		refundNotification("r-1", "REFUND", true),
+		refundNotification("r-2", "REFUND_REVERSED", false),
+		refundNotification("r-3", "REFUND_DECLINED", false),
+	} {
+		w := httptest.NewRecorder()
+		service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	list, err := refunds.ListRefunds(t.Context(), "refund-user")
+	if err != nil {
+		t.Fatalf("Ошибка чтения возвратов: %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("Ожидалось 3 решения о возврате, получено %d: %+v", len(list), list)
+	}
+	granted := list[0]
+	if granted.Type != storage.RefundGranted || granted.ID != "r-1" || granted.TransactionID != "7000-1" ||
+		granted.ProductID != "com.test.pro" || granted.RevocationReason == nil || *granted.RevocationReason != 1 ||
+		granted.Price == nil || *granted.Price != 9990 || granted.Environment != "Sandbox" {
+		t.Errorf("Неправильная запись возврата: %+v", granted)
+	}
+	if list[1].Type != storage.RefundReversed || list[2].Type != storage.RefundDeclined {
+		t.Errorf("Неправильный порядок решений: %+v", list)
+	}
+
+	// После отмены возврата подписка снова действует
+	status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "refund-user")
+	if status == nil || !status.RevokedAt.IsZero() {
+		t.Errorf("Отмененный возврат должен вернуть доступ: %+v", status)
+	}
+}
@@ -0,0 +1,164 @@
+package applestore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// fakeJWS собирает JWS с произвольной полезной нагрузкой; подпись проверяет MockJWSValidator
+func fakeJWS(payload any) string {
+	b, _ := json.Marshal(payload)
+	return "header." + base64.RawURLEncoding.EncodeToString(b) + ".signature"
+}
+
+// fakeNotificationBody собирает тело уведомления App Store Server Notifications V2
+func fakeNotificationBody(notification any) []byte {
+	b, _ := json.Marshal(notification)
+	body, _ := json.Marshal(map[string]string{
+		"signedPayload": base64.StdEncoding.EncodeToString(b),
+	})
+	return body
+}
+
+// TestHandleProviderNotification_StoresRenewalInfo проверяет сохранение данных о продлении
+func TestHandleProviderNotification_StoresRenewalInfo(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser)
+
+	expires := time.Now().Add(24 * time.Hour).UnixMilli()
+	body := fakeNotificationBody(map[string]any{
+		"notificationType": "DID_CHANGE_RENEWAL_STATUS",
+		"subtype":          "AUTO_RENEW_DISABLED",
+		"notificationUUID": "renewal-1",
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"environment":     "Production",
+			"appAccountToken": "user789",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "1000",
+				"transactionId":         "1001",
+				"productId":             "com.test.monthly",
+				"expiresDate":           expires,
+			}),
+			"signedRenewalInfo": fakeJWS(map[string]any{
+				"autoRenewStatus":        0,
+				"expirationIntent":       1,
+				"isInBillingRetryPeriod": false,
+				"autoRenewProductId":     "com.test.yearly",
+				"renewalPrice":           49990,
+				"currency":               "USD",
+			}),
+		},
+	})
+
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "user789")
+	if status == nil {
+		t.Fatal("Статус подписки не был сохранен")
+	}
+	if status.AutoRenewEnabled == nil || *status.AutoRenewEnabled {
+		t.Errorf("Ожидалось отключенное автопродление, получено %v", status.AutoRenewEnabled)
+	}
+	if status.ExpirationIntent != 1 {
+		t.Errorf("Ожидалась причина истечения 1, получено %d", status.ExpirationIntent)
+	}
+	if status.AutoRenewProductID != "com.test.yearly" {
+		t.Errorf("Неправильный продукт продления: %s", status.AutoRenewProductID)
+	}
+	if status.RenewalPrice == nil || *status.RenewalPrice != 49990 || status.RenewalCurrency != "USD" {
+		t.Errorf("Неправильная цена продления: %v %s", status.RenewalPrice, status.RenewalCurrency)
+	}
+	if status.Environment != "Production" || !status.IsActive {
+		t.Errorf("Неожиданный статус: %+v", status)
+	}
+}
+
+// TestHandleClientNotification_KeepsRenewalInfo проверяет, что клиентская транзакция не стирает данные о продлении
+func TestHandleClientNotification_KeepsRenewalInfo(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Millisecond).UTC()
+	grace := expires.Add(6 * 24 * time.Hour)
+	tx := func(id string, expiresAt time.Time) map[string]any {
+		return map[string]any{
+			"originalTransactionId": "1000",
+			"transactionId":         id,
+			"productId":             "com.test.monthly",
+			"type":                  "Auto-Renewable Subscription",
+			"expiresDate":           expiresAt.UnixMilli(),
+		}
+	}
+	body := fakeNotificationBody(map[string]any{
+		"notificationType": "DID_FAIL_TO_RENEW",
+		"subtype":          "GRACE_PERIOD",
+		"notificationUUID": "renewal-2",
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":              "com.test.app",
+			"environment":           "Production",
+			"appAccountToken":       "user789",
+			"signedTransactionInfo": fakeJWS(tx("1001", expires)),
+			"signedRenewalInfo": fakeJWS(map[string]any{
+				"autoRenewStatus":        1,
+				"expirationIntent":       2,
+				"isInBillingRetryPeriod": true,
+				"gracePeriodExpiresDate": grace.UnixMilli(),
+				"autoRenewProductId":     "com.test.yearly",
+				"renewalPrice":           49990,
+				"currency":               "USD",
+			}),
+		},
+	})
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	sendClient := func(tx map[string]any) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		service.HandleClientNotification(w, httptest.NewRequest(http.MethodPost, "/client-notification", bytes.NewReader(fakeClientBody("user789", tx))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+		}
+	}
+	renewalKept := func(status *storage.SubscriptionStatus) bool {
+		return status.AutoRenewEnabled != nil && *status.AutoRenewEnabled && status.AutoRenewProductID == "com.test.yearly" &&
+			status.RenewalPrice != nil && *status.RenewalPrice == 49990 && status.RenewalCurrency == "USD" && status.Environment == "Production"
+	}
+
+	// Приложение присылает ту же транзакцию, а затем более старую
+	sendClient(tx("1001", expires))
+	sendClient(tx("0999", expires.Add(-30*24*time.Hour)))
+	status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "user789")
+	if status == nil || !status.ExpiresAt.Equal(expires) || !renewalKept(status) ||
+		!status.InBillingRetry || status.ExpirationIntent != 2 || !status.GracePeriodExpiresAt.Equal(grace) {
+		t.Fatalf("Данные о продлении потеряны: %+v", status)
+	}
+
+	// Продление завершает период повторных попыток оплаты
+	renewed := expires.Add(30 * 24 * time.Hour)
+	sendClient(tx("1002", renewed))
+	status, _ = mockStorage.GetSubscriptionStatus(t.Context(), "user789")
+	if !status.ExpiresAt.Equal(renewed) || !renewalKept(status) || !status.IsActive ||
+		status.InBillingRetry || status.ExpirationIntent != 0 || !status.GracePeriodExpiresAt.IsZero() {
+		t.Errorf("Неправильный статус после продления: %+v", status)
+	}
+}
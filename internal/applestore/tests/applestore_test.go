@@ -8,10 +8,12 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"subscription-server/internal/applestore"
 	"subscription-server/internal/logger"
 	"subscription-server/internal/storage"
 	"testing"
+	"time"
 )
 
 // MockStorage реализует интерфейс storage.Storage для тестирования
@@ -46,6 +48,18 @@ func (m *MockStorage) SetSubscriptionStatus(ctx context.Context, status *storage
 	return nil
 }
 
+func (m *MockStorage) ListExpiredActive(ctx context.Context, cutoff time.Time, limit int) ([]storage.SubscriptionStatus, error) {
+	return nil, nil
+}
+
+func (m *MockStorage) DeactivateSubscription(ctx context.Context, expected *storage.SubscriptionStatus) (bool, error) {
+	return false, nil
+}
+
+func (m *MockStorage) Close() {
+	// No resources to clean up in the mock
+}
+
 func (m *MockStorage) SetGetError(err error) {
 	m.getError = err
 }
@@ -254,3 +268,61 @@ func TestHandleClientNotification_StorageError(t *testing.T) {
 		t.Error("Статус подписки был сохранен несмотря на ошибку")
 	}
 }
+
+// TestHandleClientRequest проверяет, что статус отдается с активностью по политике
+func TestHandleClientRequest(t *testing.T) {
+	mockStorage := NewMockStorage()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser)
+
+	// В хранилище подписка помечена активной, но срок уже истек
+	mockStorage.SetSubscriptionStatus(context.Background(), &storage.SubscriptionStatus{
+		UserToken: "user123",
+		ProductID: "com.test.product",
+		ExpiresAt: time.Now().Add(-time.Hour).UTC(),
+		IsActive:  true,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/status?userToken=user123", nil)
+	w := httptest.NewRecorder()
+	service.HandleClientRequest(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d", w.Code)
+	}
+	var got applestore.Entitlement
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("Ошибка при разборе ответа: %v", err)
+	}
+	if got.UserToken != "user123" || got.ProductID != "com.test.product" {
+		t.Errorf("Неожиданный ответ: %+v", got)
+	}
+	if got.IsActive {
+		t.Error("Истекшая подписка не должна быть активной")
+	}
+
+	// Ответ не раскрывает идентификаторы транзакций
+	mockStorage.SetSubscriptionStatus(context.Background(), &storage.SubscriptionStatus{
+		UserToken:             "user456",
+		ProductID:             "com.test.product",
+		OriginalTransactionID: "1000000123456789",
+		ExpiresAt:             time.Now().Add(time.Hour).UTC(),
+		Environment:           "Production",
+	})
+	w = httptest.NewRecorder()
+	service.HandleClientRequest(w, httptest.NewRequest(http.MethodGet, "/status?userToken=user456", nil))
+	if body := w.Body.String(); !strings.Contains(body, `"isActive":true`) ||
+		strings.Contains(body, "1000000123456789") || strings.Contains(body, "Production") {
+		t.Errorf("Ответ должен содержать только право доступа: %s", body)
+	}
+
+	// Неизвестный пользователь и отсутствующий параметр не отличаются от неактивного
+	for _, url := range []string{"/status?userToken=unknown", "/status"} {
+		w := httptest.NewRecorder()
+		service.HandleClientRequest(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"isActive":false`) ||
+			strings.Contains(w.Body.String(), "productId") {
+			t.Errorf("%s: ожидался неактивный ответ, получен %d: %s", url, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package applestore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// TestHandleProviderNotification_StoresTransactionDetails проверяет сохранение подробностей транзакции
+func TestHandleProviderNotification_StoresTransactionDetails(t *testing.T) {
+	mockStorage := NewMockStorage()
+	events := storage.NewMemoryEventStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(NewMockJWSValidator()))
+	service := applestore.NewAppleStoreService(mockStorage, NewMockLogger(), parser, applestore.WithEventStore(events))
+
+	originalPurchase := time.Now().Add(-30 * 24 * time.Hour).Truncate(time.Millisecond).UTC()
+	purchase := time.Now().Add(-time.Hour).Truncate(time.Millisecond).UTC()
+	body := fakeNotificationBody(map[string]any{
+		"notificationType": "DID_RENEW",
+		"notificationUUID": "details-1",
+		"signedDate":       time.Now().UnixMilli(),
+		"data": map[string]any{
+			"bundleId":    "com.test.app",
+			"environment": "Sandbox",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId":       "2000",
+				"transactionId":               "2001",
+				"productId":                   "com.test.monthly",
+				"expiresDate":                 time.Now().Add(24 * time.Hour).UnixMilli(),
+				"purchaseDate":                purchase.UnixMilli(),
+				"originalPurchaseDate":        originalPurchase.UnixMilli(),
+				"appAccountToken":             "user-from-tx",
+				"type":                        "Auto-Renewable Subscription",
+				"inAppOwnershipType":          "FAMILY_SHARED",
+				"subscriptionGroupIdentifier": "group-1",
+				"offerType":                   2,
+				"offerIdentifier":             "promo-1",
+				"offerDiscountType":           "PAY_AS_YOU_GO",
+				"storefront":                  "DEU",
+				"transactionReason":           "RENEWAL",
+			}),
+			"signedRenewalInfo": fakeJWS(map[string]any{
+				"autoRenewStatus": 1,
+			}),
+		},
+	})
+
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	// Пользователь берется из appAccountToken транзакции
+	status, _ := mockStorage.GetSubscriptionStatus(t.Context(), "user-from-tx")
+	if status == nil {
+		t.Fatal("Статус подписки не был сохранен")
+	}
+	if !status.OriginalPurchaseDate.Equal(originalPurchase) {
+		t.Errorf("Неправильная дата первой покупки: %v", status.OriginalPurchaseDate)
+	}
+	if status.OwnershipType != "FAMILY_SHARED" || status.SubscriptionGroupID != "group-1" {
+		t.Errorf("Неправильные данные владения: %+v", status)
+	}
+	if status.OfferType != 2 || status.OfferID != "promo-1" || status.Environment != "Sandbox" {
+		t.Errorf("Неправильные данные предложения: %+v", status)
+	}
+
+	timeline, err := events.ListEvents(t.Context(), "user-from-tx")
+	if err != nil || len(timeline) != 1 {
+		t.Fatalf("Ожидалось 1 событие, получено %d (%v)", len(timeline), err)
+	}
+	event := timeline[0]
+	if event.TransactionType != "Auto-Renewable Subscription" || event.TransactionReason != "RENEWAL" {
+		t.Errorf("Неправильный тип транзакции в событии: %+v", event)
+	}
+	if event.Storefront != "DEU" || !event.PurchaseDate.Equal(purchase) || event.IsUpgraded {
+		t.Errorf("Неправильные данные покупки в событии: %+v", event)
+	}
+	if event.OfferType != 2 || event.OfferID != "promo-1" || event.OfferDiscountType != "PAY_AS_YOU_GO" {
+		t.Errorf("Неправильные данные предложения в событии: %+v", event)
+	}
+}
@@ -0,0 +1,338 @@
+// Package appstoreapi calls the App Store Server API on behalf of the server.
+package appstoreapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"subscription-server/internal/signing"
+	"sync"
+	"time"
+)
+
+const (
+	ProductionURL = "https://api.storekit.itunes.apple.com"
+	SandboxURL    = "https://api.storekit-sandbox.itunes.apple.com"
+)
+
+// Error is a response other than 2xx from the App Store Server API.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int64  `json:"errorCode"`
+	Message    string `json:"errorMessage"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("app store server api: status %d: error %d: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("app store server api: status %d", e.StatusCode)
+}
+
+// Retryable reports whether the same request may succeed later.
+func (e *Error) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ConsumptionRequest is the body of Send Consumption Information. Apart from
+// the booleans, zero means undeclared.
+type ConsumptionRequest struct {
+	CustomerConsented        bool   `json:"customerConsented"`
+	ConsumptionStatus        int    `json:"consumptionStatus"`
+	Platform                 int    `json:"platform"`
+	SampleContentProvided    bool   `json:"sampleContentProvided"`
+	DeliveryStatus           int    `json:"deliveryStatus"`
+	AppAccountToken          string `json:"appAccountToken"`
+	AccountTenure            int    `json:"accountTenure"`
+	PlayTime                 int    `json:"playTime"`
+	LifetimeDollarsRefunded  int    `json:"lifetimeDollarsRefunded"`
+	LifetimeDollarsPurchased int    `json:"lifetimeDollarsPurchased"`
+	UserStatus               int    `json:"userStatus"`
+	RefundPreference         int    `json:"refundPreference"`
+}
+
+// ExtendRenewalDateRequest is the body of Extend a Subscription Renewal
+// Date.
+type ExtendRenewalDateRequest struct {
+	ExtendByDays      int    `json:"extendByDays"`
+	ExtendReasonCode  int    `json:"extendReasonCode"`
+	RequestIdentifier string `json:"requestIdentifier"`
+}
+
+type ExtendRenewalDateResponse struct {
+	OriginalTransactionID string `json:"originalTransactionId"`
+	WebOrderLineItemID    string `json:"webOrderLineItemId"`
+	Success               bool   `json:"success"`
+	// EffectiveDate is the new renewal date in milliseconds since the epoch.
+	EffectiveDate int64 `json:"effectiveDate"`
+}
+
+// MassExtendRenewalDateRequest is the body of Extend Subscription Renewal
+// Dates for All Active Subscribers. No storefronts means all of them.
+type MassExtendRenewalDateRequest struct {
+	ExtendByDays           int      `json:"extendByDays"`
+	ExtendReasonCode       int      `json:"extendReasonCode"`
+	RequestIdentifier      string   `json:"requestIdentifier"`
+	StorefrontCountryCodes []string `json:"storefrontCountryCodes,omitempty"`
+	ProductID              string   `json:"productId"`
+}
+
+// MassExtendRenewalDateStatus is the progress of a mass extension.
+type MassExtendRenewalDateStatus struct {
+	RequestIdentifier string `json:"requestIdentifier"`
+	Complete          bool   `json:"complete"`
+	// CompleteDate is in milliseconds since the epoch, 0 while running.
+	CompleteDate   int64 `json:"completeDate"`
+	SucceededCount int64 `json:"succeededCount"`
+	FailedCount    int64 `json:"failedCount"`
+}
+
+type Client interface {
+	// SendConsumptionInformation answers a CONSUMPTION_REQUEST for
+	// transactionID. environment is "Sandbox" or "Production".
+	SendConsumptionInformation(ctx context.Context, environment, transactionID string, req *ConsumptionRequest) error
+	// ExtendRenewalDate extends the subscription of originalTransactionID.
+	ExtendRenewalDate(ctx context.Context, environment, originalTransactionID string, req *ExtendRenewalDateRequest) (*ExtendRenewalDateResponse, error)
+	// MassExtendRenewalDate starts extending every active subscription to
+	// req.ProductID; Apple finishes it asynchronously.
+	MassExtendRenewalDate(ctx context.Context, environment string, req *MassExtendRenewalDateRequest) error
+	// MassExtendRenewalDateStatus reports on a mass extension.
+	MassExtendRenewalDateStatus(ctx context.Context, environment, productID, requestID string) (*MassExtendRenewalDateStatus, error)
+}
+
+type Options struct {
+	Key      *signing.Key
+	IssuerID string
+	BundleID string
+	// HTTPClient defaults to a client with a 30 second timeout.
+	HTTPClient *http.Client
+	// ProductionURL and SandboxURL override the API hosts, for tests.
+	ProductionURL string
+	SandboxURL    string
+	Now           func() time.Time
+}
+
+type client struct {
+	opts Options
+}
+
+func NewClient(opts Options) Client {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if opts.ProductionURL == "" {
+		opts.ProductionURL = ProductionURL
+	}
+	if opts.SandboxURL == "" {
+		opts.SandboxURL = SandboxURL
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &client{opts: opts}
+}
+
+func (c *client) SendConsumptionInformation(ctx context.Context, environment, transactionID string, req *ConsumptionRequest) error {
+	return c.do(ctx, http.MethodPut, environment, "/inApps/v1/transactions/consumption/"+url.PathEscape(transactionID), req, nil)
+}
+
+func (c *client) ExtendRenewalDate(ctx context.Context, environment, originalTransactionID string, req *ExtendRenewalDateRequest) (*ExtendRenewalDateResponse, error) {
+	var resp ExtendRenewalDateResponse
+	if err := c.do(ctx, http.MethodPut, environment, "/inApps/v1/subscriptions/extend/"+url.PathEscape(originalTransactionID), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *client) MassExtendRenewalDate(ctx context.Context, environment string, req *MassExtendRenewalDateRequest) error {
+	return c.do(ctx, http.MethodPost, environment, "/inApps/v1/subscriptions/extend/mass", req, nil)
+}
+
+func (c *client) MassExtendRenewalDateStatus(ctx context.Context, environment, productID, requestID string) (*MassExtendRenewalDateStatus, error) {
+	var status MassExtendRenewalDateStatus
+	path := "/inApps/v1/subscriptions/extend/mass/" + url.PathEscape(productID) + "/" + url.PathEscape(requestID)
+	if err := c.do(ctx, http.MethodGet, environment, path, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// do sends body, if any, as JSON and decodes a successful response into out,
+// if any.
+func (c *client) do(ctx context.Context, method, environment, path string, body, out any) error {
+	base := c.opts.ProductionURL
+	if environment == "Sandbox" {
+		base = c.opts.SandboxURL
+	}
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+	}
+	token, err := c.opts.Key.BearerToken(c.opts.IssuerID, c.opts.BundleID, c.opts.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, apiErr)
+		return apiErr
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Call is a request received by LocalClient. TransactionID is the
+// transaction, original transaction or, for mass extensions, product in the
+// path.
+type Call struct {
+	Method        string
+	Environment   string
+	TransactionID string
+	Body          any
+}
+
+// LocalClient stands in for the App Store Server API in tests and local
+// development: it records every call and answers with queued errors.
+// Extensions succeed; mass extensions complete once MassExtensionDone
+// reports their counts.
+type LocalClient struct {
+	mu     sync.Mutex
+	calls  []Call
+	errors []error
+	mass   map[string]*MassExtendRenewalDateStatus
+	// Now dates extensions, time.Now by default.
+	Now func() time.Time
+}
+
+func NewLocalClient() *LocalClient {
+	return &LocalClient{
+		mass: make(map[string]*MassExtendRenewalDateStatus),
+		Now:  time.Now,
+	}
+}
+
+// MassExtensionDone completes the mass extension requestID.
+func (l *LocalClient) MassExtensionDone(requestID string, succeeded, failed int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mass[requestID] = &MassExtendRenewalDateStatus{
+		RequestIdentifier: requestID,
+		Complete:          true,
+		CompleteDate:      l.Now().UnixMilli(),
+		SucceededCount:    succeeded,
+		FailedCount:       failed,
+	}
+}
+
+// FailNext makes the next calls fail with errs, one per call.
+func (l *LocalClient) FailNext(errs ...error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, errs...)
+}
+
+// Calls returns the calls received so far, including failed ones.
+func (l *LocalClient) Calls() []Call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Call(nil), l.calls...)
+}
+
+func (l *LocalClient) record(call Call) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+	if len(l.errors) == 0 {
+		return nil
+	}
+	err := l.errors[0]
+	l.errors = l.errors[1:]
+	return err
+}
+
+func (l *LocalClient) SendConsumptionInformation(ctx context.Context, environment, transactionID string, req *ConsumptionRequest) error {
+	copy := *req
+	return l.record(Call{
+		Method:        "SendConsumptionInformation",
+		Environment:   environment,
+		TransactionID: transactionID,
+		Body:          &copy,
+	})
+}
+
+func (l *LocalClient) ExtendRenewalDate(ctx context.Context, environment, originalTransactionID string, req *ExtendRenewalDateRequest) (*ExtendRenewalDateResponse, error) {
+	copy := *req
+	err := l.record(Call{
+		Method:        "ExtendRenewalDate",
+		Environment:   environment,
+		TransactionID: originalTransactionID,
+		Body:          &copy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ExtendRenewalDateResponse{
+		OriginalTransactionID: originalTransactionID,
+		Success:               true,
+		EffectiveDate:         l.Now().AddDate(0, 0, req.ExtendByDays).UnixMilli(),
+	}, nil
+}
+
+func (l *LocalClient) MassExtendRenewalDate(ctx context.Context, environment string, req *MassExtendRenewalDateRequest) error {
+	copy := *req
+	return l.record(Call{
+		Method:        "MassExtendRenewalDate",
+		Environment:   environment,
+		TransactionID: req.ProductID,
+		Body:          &copy,
+	})
+}
+
+func (l *LocalClient) MassExtendRenewalDateStatus(ctx context.Context, environment, productID, requestID string) (*MassExtendRenewalDateStatus, error) {
+	if err := l.record(Call{
+		Method:        "MassExtendRenewalDateStatus",
+		Environment:   environment,
+		TransactionID: productID,
+	}); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if status, ok := l.mass[requestID]; ok {
+		copy := *status
+		return &copy, nil
+	}
+	return &MassExtendRenewalDateStatus{RequestIdentifier: requestID}, nil
+}
@@ -0,0 +1,146 @@
+package appstoreapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription-server/internal/appstoreapi"
+	"subscription-server/internal/signing"
+	"testing"
+)
+
+// server записывает полученные запросы и отвечает заданным статусом
+type server struct {
+	*httptest.Server
+	requests []*http.Request
+	bodies   []string
+	status   int
+	response string
+}
+
+func newServer(t *testing.T, status int, response string) *server {
+	s := &server{status: status, response: response}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		w.WriteHeader(s.status)
+		io.WriteString(w, s.response)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newClient(t *testing.T, production, sandbox string) appstoreapi.Client {
+	pk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return appstoreapi.NewClient(appstoreapi.Options{
+		Key:           &signing.Key{ID: "KEY123", PrivateKey: pk},
+		IssuerID:      "issuer-1",
+		BundleID:      "com.test.app",
+		ProductionURL: production,
+		SandboxURL:    sandbox,
+	})
+}
+
+// TestClient_SendConsumptionInformation проверяет адрес, авторизацию и тело запроса
+func TestClient_SendConsumptionInformation(t *testing.T) {
+	production := newServer(t, http.StatusAccepted, "")
+	sandbox := newServer(t, http.StatusAccepted, "")
+	client := newClient(t, production.URL, sandbox.URL)
+
+	req := &appstoreapi.ConsumptionRequest{CustomerConsented: true, Platform: 1, AccountTenure: 3}
+	if err := client.SendConsumptionInformation(context.Background(), "Sandbox", "2000000123", req); err != nil {
+		t.Fatalf("Ошибка отправки: %v", err)
+	}
+	if len(production.requests) != 0 || len(sandbox.requests) != 1 {
+		t.Fatalf("Запрос среды Sandbox должен уйти на sandbox-адрес")
+	}
+
+	r := sandbox.requests[0]
+	if r.Method != http.MethodPut || r.URL.Path != "/inApps/v1/transactions/consumption/2000000123" {
+		t.Errorf("Неправильный запрос: %s %s", r.Method, r.URL.Path)
+	}
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer ") || strings.Count(auth, ".") != 2 {
+		t.Errorf("Ожидался токен Bearer, получено %q", auth)
+	}
+	var sent appstoreapi.ConsumptionRequest
+	if err := json.Unmarshal([]byte(sandbox.bodies[0]), &sent); err != nil || sent != *req {
+		t.Errorf("Неправильное тело запроса: %s", sandbox.bodies[0])
+	}
+
+	if err := client.SendConsumptionInformation(context.Background(), "Production", "2000000124", req); err != nil {
+		t.Fatalf("Ошибка отправки: %v", err)
+	}
+	if len(production.requests) != 1 {
+		t.Errorf("Запрос среды Production должен уйти на основной адрес")
+	}
+}
+
+// TestClient_Error проверяет разбор ошибок App Store Server API
+func TestClient_Error(t *testing.T) {
+	srv := newServer(t, http.StatusBadRequest, `{"errorCode":4000006,"errorMessage":"Invalid transaction id."}`)
+	client := newClient(t, srv.URL, srv.URL)
+
+	err := client.SendConsumptionInformation(context.Background(), "Production", "1", &appstoreapi.ConsumptionRequest{})
+	var apiErr *appstoreapi.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Ожидалась ошибка API, получено %v", err)
+	}
+	if apiErr.StatusCode != 400 || apiErr.Code != 4000006 || apiErr.Retryable() {
+		t.Errorf("Неправильная ошибка: %+v", apiErr)
+	}
+
+	srv.status, srv.response = http.StatusServiceUnavailable, ""
+	err = client.SendConsumptionInformation(context.Background(), "Production", "1", &appstoreapi.ConsumptionRequest{})
+	if !errors.As(err, &apiErr) || !apiErr.Retryable() {
+		t.Errorf("Ошибка 503 должна быть повторяемой, получено %v", err)
+	}
+}
+
+// TestClient_ExtendRenewalDate проверяет запросы продления подписок
+func TestClient_ExtendRenewalDate(t *testing.T) {
+	srv := newServer(t, http.StatusOK, `{"originalTransactionId":"5000","webOrderLineItemId":"77","success":true,"effectiveDate":1893456000000}`)
+	client := newClient(t, srv.URL, srv.URL)
+	ctx := context.Background()
+
+	resp, err := client.ExtendRenewalDate(ctx, "Production", "5000", &appstoreapi.ExtendRenewalDateRequest{ExtendByDays: 7, ExtendReasonCode: 3, RequestIdentifier: "outage-1"})
+	if err != nil {
+		t.Fatalf("Ошибка продления: %v", err)
+	}
+	if !resp.Success || resp.EffectiveDate != 1893456000000 || resp.OriginalTransactionID != "5000" {
+		t.Errorf("Неправильный ответ: %+v", resp)
+	}
+	if r := srv.requests[0]; r.Method != http.MethodPut || r.URL.Path != "/inApps/v1/subscriptions/extend/5000" {
+		t.Errorf("Неправильный запрос: %s %s", r.Method, r.URL.Path)
+	}
+	if srv.bodies[0] != `{"extendByDays":7,"extendReasonCode":3,"requestIdentifier":"outage-1"}` {
+		t.Errorf("Неправильное тело запроса: %s", srv.bodies[0])
+	}
+
+	err = client.MassExtendRenewalDate(ctx, "Production", &appstoreapi.MassExtendRenewalDateRequest{ExtendByDays: 3, RequestIdentifier: "mass-1", ProductID: "com.test.monthly"})
+	if err != nil {
+		t.Fatalf("Ошибка массового продления: %v", err)
+	}
+	if r := srv.requests[1]; r.Method != http.MethodPost || r.URL.Path != "/inApps/v1/subscriptions/extend/mass" {
+		t.Errorf("Неправильный запрос: %s %s", r.Method, r.URL.Path)
+	}
+
+	srv.response = `{"requestIdentifier":"mass-1","complete":true,"completeDate":1893456000000,"succeededCount":120,"failedCount":3}`
+	status, err := client.MassExtendRenewalDateStatus(ctx, "Production", "com.test.monthly", "mass-1")
+	if err != nil {
+		t.Fatalf("Ошибка запроса состояния: %v", err)
+	}
+	if !status.Complete || status.SucceededCount != 120 || status.FailedCount != 3 {
+		t.Errorf("Неправильное состояние: %+v", status)
+	}
+	if r := srv.requests[2]; r.Method != http.MethodGet || r.URL.Path != "/inApps/v1/subscriptions/extend/mass/com.test.monthly/mass-1" || srv.bodies[2] != "" {
+		t.Errorf("Неправильный запрос: %s %s %q", r.Method, r.URL.Path, srv.bodies[2])
+	}
+}
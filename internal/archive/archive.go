@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+const (
+	maxArchivedBody    = 1 << 20
+	maxArchivedOutcome = 4 << 10
+)
+
+type contextKey struct{}
+
+// RequestID returns the archive ID assigned to the request carrying ctx, or
+// an empty string when the request is not archived.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// WithRequestID returns a copy of ctx carrying archive ID id, for work that
+// continues a request outside of its handler.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// NewID returns a new archive ID. IDs start with the UTC receipt date so
+// backends can shard by day.
+func NewID(receivedAt time.Time) string {
+	var b [8]byte
+	rand.Read(b[:])
+	return receivedAt.UTC().Format("20060102") + "-" + hex.EncodeToString(b[:])
+}
+
+// Middleware stores every request passing through next, together with the
+// response status and error text, in a. Archival failures are logged and never
+// affect the response.
+func Middleware(a storage.RequestArchive, l logger.Logger, endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		receivedAt := time.Now().UTC()
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxArchivedBody))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		id := NewID(receivedAt)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		headers := r.Header.Clone()
+		headers.Del("Authorization")
+		headers.Del("Cookie")
+
+		outcome := "ok"
+		if rec.status >= http.StatusBadRequest {
+			outcome = rec.errorBody.String()
+		}
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+		defer cancel()
+
+		err = a.StoreRequest(ctx, &storage.ArchivedRequest{
+			ID:         id,
+			Endpoint:   endpoint,
+			ReceivedAt: receivedAt,
+			Headers:    headers,
+			Body:       body,
+			StatusCode: rec.status,
+			Outcome:    outcome,
+			Duration:   time.Since(receivedAt),
+		})
+		if err != nil {
+			l.Log(logger.LogMessage{
+				Time:    time.Now(),
+				Level:   "ERROR",
+				Sender:  "archive",
+				Message: fmt.Sprintf("failed to archive request %s to %s: %v", id, endpoint, err),
+			})
+		}
+	}
+}
+
+// recorder remembers the status code and, for failed requests, the start of
+// the response body.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	errorBody   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.status >= http.StatusBadRequest && r.errorBody.Len() < maxArchivedOutcome {
+		r.errorBody.Write(b[:min(len(b), maxArchivedOutcome-r.errorBody.Len())])
+	}
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,143 @@
+package archive
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+type fileArchive struct {
+	dir string
+}
+
+// NewFileArchive keeps each request as a gzipped JSON file under
+// dir/<yyyymmdd>/<id>.json.gz.
+func NewFileArchive(dir string) (storage.RequestArchive, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	return &fileArchive{
+		dir: dir,
+	}, nil
+}
+
+func (a *fileArchive) path(id string) (string, error) {
+	day, _, ok := strings.Cut(id, "-")
+	if !ok || len(day) != 8 || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("invalid archive id: %q", id)
+	}
+	return filepath.Join(a.dir, day, id+".json.gz"), nil
+}
+
+func (a *fileArchive) StoreRequest(ctx context.Context, req *storage.ArchivedRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := a.path(req.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("create day dir: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated entry.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create archive file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	if err := json.NewEncoder(zw).Encode(req); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write archive file: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write archive file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close archive file: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (a *fileArchive) GetRequest(ctx context.Context, id string) (*storage.ArchivedRequest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, err := a.path(id)
+	if err != nil {
+		return nil, storage.ErrArchivedRequestNotFound
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, storage.ErrArchivedRequestNotFound
+		}
+		return nil, fmt.Errorf("open archive file: %w", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("read archive file: %w", err)
+	}
+	defer zr.Close()
+
+	var req storage.ArchivedRequest
+	if err := json.NewDecoder(zr).Decode(&req); err != nil {
+		return nil, fmt.Errorf("decode archive file: %w", err)
+	}
+	return &req, nil
+}
+
+// PruneRequests removes whole days that ended before the given time; entries
+// are therefore kept up to one day longer than strictly required.
+func (a *fileArchive) PruneRequests(ctx context.Context, before time.Time) (int, error) {
+	days, err := os.ReadDir(a.dir)
+	if err != nil {
+		return 0, fmt.Errorf("read archive dir: %w", err)
+	}
+
+	pruned := 0
+	for _, day := range days {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		start, err := time.Parse("20060102", day.Name())
+		if !day.IsDir() || err != nil {
+			continue
+		}
+		if start.AddDate(0, 0, 1).After(before) {
+			continue
+		}
+
+		dayDir := filepath.Join(a.dir, day.Name())
+		entries, err := os.ReadDir(dayDir)
+		if err != nil {
+			return pruned, fmt.Errorf("read day dir: %w", err)
+		}
+		if err := os.RemoveAll(dayDir); err != nil {
+			return pruned, fmt.Errorf("remove day dir: %w", err)
+		}
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".json.gz") {
+				pruned++
+			}
+		}
+	}
+
+	return pruned, nil
+}
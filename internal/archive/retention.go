@@ -0,0 +1,42 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+// RunRetention prunes requests older than retention from a every interval
+// until ctx is done.
+func RunRetention(ctx context.Context, a storage.RequestArchive, l logger.Logger, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := a.PruneRequests(ctx, time.Now().Add(-retention))
+		switch {
+		case err != nil && ctx.Err() == nil:
+			l.Log(logger.LogMessage{
+				Time:    time.Now(),
+				Level:   "ERROR",
+				Sender:  "archive",
+				Message: fmt.Sprintf("failed to prune archive: %v", err),
+			})
+		case pruned > 0:
+			l.Log(logger.LogMessage{
+				Time:    time.Now(),
+				Level:   "INFO",
+				Sender:  "archive",
+				Message: fmt.Sprintf("pruned %d archived requests", pruned),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
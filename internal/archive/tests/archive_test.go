@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/archive"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+	"testing"
+)
+
+// nopLogger отбрасывает все сообщения
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.LogMessage) {}
+func (nopLogger) Close()                {}
+
+// TestFileArchive_Conformance прогоняет общий набор тестов для файлового архива
+func TestFileArchive_Conformance(t *testing.T) {
+	storagetest.RunRequestArchive(t, func(t *testing.T) storage.RequestArchive {
+		a, err := archive.NewFileArchive(t.TempDir())
+		if err != nil {
+			t.Fatalf("Не удалось создать файловый архив: %v", err)
+		}
+		return a
+	}, archive.NewID)
+}
+
+// TestMiddleware проверяет сохранение запроса и результата обработки
+func TestMiddleware(t *testing.T) {
+	requests := storage.NewMemoryRequestArchive()
+
+	var (
+		seenBody string
+		seenID   string
+	)
+	handler := archive.Middleware(requests, nopLogger{}, "/api/v1/notifications/apple/v2", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seenBody = string(body)
+		seenID = archive.RequestID(r.Context())
+		http.Error(w, "failed to process notification: boom", http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notifications/apple/v2", bytes.NewReader([]byte(`{"signedPayload":"abc"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+
+	// Выполнение
+	handler(w, req)
+
+	// Обработчик получает исходное тело
+	if seenBody != `{"signedPayload":"abc"}` {
+		t.Errorf("Обработчик получил некорректное тело: %q", seenBody)
+	}
+	if seenID == "" {
+		t.Fatal("Идентификатор архива не передан в контексте запроса")
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Ответ обработчика изменен: получен статус %d", w.Code)
+	}
+
+	// Запрос сохранен вместе с результатом
+	archived, err := requests.GetRequest(context.Background(), seenID)
+	if err != nil {
+		t.Fatalf("Запрос не найден в архиве: %v", err)
+	}
+	if string(archived.Body) != `{"signedPayload":"abc"}` || archived.Endpoint != "/api/v1/notifications/apple/v2" {
+		t.Errorf("Некорректная запись архива: %+v", archived)
+	}
+	if archived.StatusCode != http.StatusInternalServerError || archived.Outcome != "failed to process notification: boom\n" {
+		t.Errorf("Некорректный результат обработки: %d %q", archived.StatusCode, archived.Outcome)
+	}
+	if archived.Headers.Get("Content-Type") != "application/json" {
+		t.Errorf("Заголовки не сохранены: %v", archived.Headers)
+	}
+	if archived.Headers.Get("Authorization") != "" {
+		t.Error("Заголовок Authorization не должен попадать в архив")
+	}
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	StorageDriver     string
+	SQLitePath        string
+	RedisAddr         string
+	RedisPassword     string
+	RedisDB           int
+	RedisKeyPrefix    string
+	DatabaseURL       string
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	CacheMaxEntries   int
+	CacheTTL          time.Duration
+	AdminToken        string
+	ArchiveDriver     string
+	ArchiveDir        string
+	ArchiveRetention  time.Duration
+	IngestMode        string
+	IngestWorkers     int
+	IngestQueueSize   int
+	IngestLease       time.Duration
+	DeadLetterMax     int
+	ExpirySweepEvery  time.Duration
+	// Entitlement policy, see the entitlement package.
+	GracePeriodAccess  bool
+	BillingRetryAccess time.Duration
+	Environments       []string
+	FamilySharing      bool
+	FamilyProducts     []string
+	MaxRefunds         int
+	MaxRefundRate      float64
+	AppleBundleIDs     []string
+	// NonRenewingPeriods is the period granted by each non-renewing
+	// subscription product.
+	NonRenewingPeriods map[string]time.Duration
+	// CreditProducts is the number of credits each consumable is worth.
+	CreditProducts map[string]int64
+	// SubscriptionGroups lists the products of each App Store subscription
+	// group by level, highest level of service first.
+	SubscriptionGroups map[string][]string
+	// App Store Connect in-app purchase key, used to sign offers. Offer
+	// signing is disabled without it, StoreKit 2 tokens without the issuer.
+	AppleKeyID    string
+	AppleKeyPath  string
+	AppleIssuerID string
+	// OfferRules maps promotional offer identifiers to an eligibility rule
+	// of the offers package.
+	OfferRules map[string]string
+	// verifyReceipt fallback for StoreKit 1 receipts that fail local
+	// validation, disabled without a URL.
+	VerifyReceiptURL  string
+	ReceiptSandboxURL string
+	AppleSharedSecret string
+	// Legacy purchasers, see applestore.LegacyPurchasers. Disabled without
+	// a product and a version or date.
+	LegacyProductID  string
+	LegacyAppVersion string
+	LegacyBefore     time.Time
+	// Answers to CONSUMPTION_REQUEST notifications, sent only with the
+	// customers' consent.
+	ConsumptionConsent bool
+	ConsumptionSamples bool
+	RefundPreference   int
+	// USD value of one unit of each other currency, for lifetime amounts.
+	ConsumptionRates map[string]float64
+}
+
+// Load reads the server configuration from environment variables.
+// Missing values fall back to defaults suitable for a single instance.
+func Load() *Config {
+	cfg := &Config{
+		StorageDriver:      os.Getenv("STORAGE_DRIVER"),
+		SQLitePath:         envString("SQLITE_PATH", "subscriptions.db"),
+		RedisAddr:          envString("REDIS_ADDR", "localhost:6379"),
+		RedisPassword:      os.Getenv("REDIS_PASSWORD"),
+		RedisDB:            envInt("REDIS_DB", 0),
+		RedisKeyPrefix:     os.Getenv("REDIS_KEY_PREFIX"),
+		DatabaseURL:        os.Getenv("DATABASE_URL"),
+		DBMaxOpenConns:     envInt("DB_MAX_OPEN_CONNS", 10),
+		DBMaxIdleConns:     envInt("DB_MAX_IDLE_CONNS", 5),
+		DBConnMaxLifetime:  envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		CacheMaxEntries:    envInt("CACHE_MAX_ENTRIES", 0),
+		CacheTTL:           envDuration("CACHE_TTL", time.Minute),
+		AdminToken:         os.Getenv("ADMIN_TOKEN"),
+		ArchiveDriver:      envString("ARCHIVE_DRIVER", "none"),
+		ArchiveDir:         envString("ARCHIVE_DIR", "archive"),
+		ArchiveRetention:   envDuration("ARCHIVE_RETENTION", 90*24*time.Hour),
+		IngestMode:         envString("INGEST_MODE", "sync"),
+		IngestWorkers:      envInt("INGEST_WORKERS", 4),
+		IngestQueueSize:    envInt("INGEST_QUEUE_SIZE", 100),
+		IngestLease:        envDuration("INGEST_LEASE", 5*time.Minute),
+		DeadLetterMax:      envInt("DEADLETTER_MAX_ENTRIES", 1000),
+		ExpirySweepEvery:   envDuration("EXPIRY_SWEEP_INTERVAL", 5*time.Minute),
+		GracePeriodAccess:  envBool("ENTITLEMENT_GRACE_PERIOD", true),
+		BillingRetryAccess: time.Duration(envInt("ENTITLEMENT_BILLING_RETRY_DAYS", 0)) * 24 * time.Hour,
+		Environments:       envList("ENTITLEMENT_ENVIRONMENTS"),
+		FamilySharing:      envBool("ENTITLEMENT_FAMILY_SHARING", true),
+		FamilyProducts:     envList("ENTITLEMENT_FAMILY_PRODUCTS"),
+		MaxRefunds:         envInt("ENTITLEMENT_MAX_REFUNDS", 0),
+		MaxRefundRate:      envFloat("ENTITLEMENT_MAX_REFUND_RATE", 0),
+		AppleBundleIDs:     envList("APPLE_BUNDLE_IDS"),
+		NonRenewingPeriods: envDurations("NON_RENEWING_PERIODS"),
+		CreditProducts:     envAmounts("CREDIT_PRODUCTS"),
+		SubscriptionGroups: envGroups("SUBSCRIPTION_GROUPS"),
+		AppleKeyID:         os.Getenv("APPLE_KEY_ID"),
+		AppleKeyPath:       os.Getenv("APPLE_PRIVATE_KEY_PATH"),
+		AppleIssuerID:      os.Getenv("APPLE_ISSUER_ID"),
+		OfferRules:         envPairs("OFFER_RULES"),
+		VerifyReceiptURL:   os.Getenv("APPLE_VERIFY_RECEIPT_URL"),
+		ReceiptSandboxURL:  os.Getenv("APPLE_VERIFY_RECEIPT_SANDBOX_URL"),
+		AppleSharedSecret:  os.Getenv("APPLE_SHARED_SECRET"),
+		LegacyProductID:    os.Getenv("LEGACY_PURCHASER_PRODUCT_ID"),
+		LegacyAppVersion:   os.Getenv("LEGACY_PURCHASER_APP_VERSION"),
+		LegacyBefore:       envTime("LEGACY_PURCHASER_BEFORE"),
+		ConsumptionConsent: envBool("CONSUMPTION_CUSTOMER_CONSENT", false),
+		ConsumptionSamples: envBool("CONSUMPTION_SAMPLE_CONTENT", false),
+		RefundPreference:   envInt("CONSUMPTION_REFUND_PREFERENCE", 0),
+		ConsumptionRates:   envRates("CONSUMPTION_USD_RATES"),
+	}
+	if cfg.StorageDriver == "" {
+		cfg.StorageDriver = "memory"
+		if cfg.DatabaseURL != "" {
+			cfg.StorageDriver = "postgres"
+		}
+	}
+	return cfg
+}
+
+func envString(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// envTime parses an RFC 3339 time, the zero time when unset or malformed.
+func envTime(key string) time.Time {
+	t, err := time.Parse(time.RFC3339, os.Getenv(key))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// envList splits a comma separated variable, dropping empty items.
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envDurations parses a comma separated list of key=duration pairs, e.g.
+// "com.example.season=720h". Malformed pairs are skipped.
+func envDurations(key string) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			continue
+		}
+		durations[strings.TrimSpace(name)] = d
+	}
+	return durations
+}
+
+// envAmounts parses a comma separated list of key=amount pairs, e.g.
+// "com.example.coins100=100". Malformed or non-positive pairs are skipped.
+func envAmounts(key string) map[string]int64 {
+	amounts := make(map[string]int64)
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || n <= 0 {
+			continue
+		}
+		amounts[strings.TrimSpace(name)] = n
+	}
+	return amounts
+}
+
+// envRates parses a comma separated list of key=rate pairs, e.g.
+// "EUR=1.08". Malformed or non-positive pairs are skipped.
+func envRates(key string) map[string]float64 {
+	rates := make(map[string]float64)
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || f <= 0 {
+			continue
+		}
+		rates[strings.TrimSpace(name)] = f
+	}
+	return rates
+}
+
+// envPairs parses a comma separated list of key=value pairs, e.g.
+// "winback=lapsed". Malformed pairs are skipped.
+func envPairs(key string) map[string]string {
+	pairs := make(map[string]string)
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		pairs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return pairs
+}
+
+// envGroups parses a comma separated list of group=products pairs whose
+// products are separated by "|", e.g. "pro=com.example.pro|com.example.lite".
+// Groups without products are skipped.
+func envGroups(key string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		var products []string
+		for _, product := range strings.Split(value, "|") {
+			if product = strings.TrimSpace(product); product != "" {
+				products = append(products, product)
+			}
+		}
+		if len(products) > 0 {
+			groups[strings.TrimSpace(name)] = products
+		}
+	}
+	return groups
+}
@@ -0,0 +1,78 @@
+package consumption
+
+import (
+	"context"
+	"fmt"
+	"subscription-server/internal/archive"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"sync"
+	"time"
+)
+
+// BackgroundReporter sends consumption information without holding up the
+// notification that asked for it. Retries and backoff run on a context that
+// lives as long as the server.
+type BackgroundReporter interface {
+	// ReportConsumption starts the report and returns at once. When the
+	// report fails, the notification of event goes to the dead-letter queue,
+	// so retrying it reports again.
+	ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error
+	// Wait blocks until the reports in flight are done.
+	Wait()
+}
+
+type backgroundReporter struct {
+	ctx    context.Context
+	next   Reporter
+	dlq    deadletter.Queue
+	logger logger.Logger
+	wg     sync.WaitGroup
+}
+
+// NewBackgroundReporter reports through next until ctx is canceled. A report
+// cut short by ctx fails like any other.
+func NewBackgroundReporter(ctx context.Context, next Reporter, dlq deadletter.Queue, l logger.Logger) BackgroundReporter {
+	return &backgroundReporter{ctx: ctx, next: next, dlq: dlq, logger: l}
+}
+
+func (b *backgroundReporter) ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error {
+	// Keep the archived request the notification came with.
+	bg := archive.WithRequestID(b.ctx, archive.RequestID(ctx))
+	ev := *event
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.report(bg, &ev)
+	}()
+	return nil
+}
+
+func (b *backgroundReporter) report(ctx context.Context, event *storage.SubscriptionEvent) {
+	err := b.next.ReportConsumption(ctx, event)
+	if err == nil {
+		return
+	}
+	b.log("ERROR", fmt.Sprintf("consumption report for %s failed: %v", event.ID, err))
+	if b.dlq == nil {
+		return
+	}
+	// The report may have failed because the server is stopping.
+	if err := b.dlq.Record(context.WithoutCancel(ctx), event.Source, []byte(event.RawPayload), err); err != nil {
+		b.log("ERROR", fmt.Sprintf("dead-letter consumption request %s: %v", event.ID, err))
+	}
+}
+
+func (b *backgroundReporter) Wait() {
+	b.wg.Wait()
+}
+
+func (b *backgroundReporter) log(level, msg string) {
+	b.logger.Log(logger.LogMessage{
+		Time:    time.Now(),
+		Level:   level,
+		Sender:  "consumption",
+		Message: msg,
+	})
+}
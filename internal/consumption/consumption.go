@@ -0,0 +1,381 @@
+// Package consumption answers App Store CONSUMPTION_REQUEST notifications,
+// which Apple sends when a customer asks for a refund, with what the server
+// knows about the customer.
+package consumption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"subscription-server/internal/appstoreapi"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+// Operation names the audited App Store Server API call.
+const Operation = "consumption"
+
+// Values of ConsumptionRequest fields, see Apple's documentation.
+const (
+	platformApple = 1
+
+	consumptionNotConsumed       = 1
+	consumptionPartiallyConsumed = 2
+	consumptionFullyConsumed     = 3
+
+	deliveryWorking = 0
+	deliveryOther   = 5
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type Options struct {
+	// CustomerConsented states that customers agreed to share consumption
+	// data. Apple rejects the data without consent, so nothing is sent
+	// unless it is set.
+	CustomerConsented     bool
+	SampleContentProvided bool
+	// RefundPreference is Apple's refundPreference code, 0 for undeclared.
+	RefundPreference int
+	// USDRates is the USD value of one unit of each currency, used to count
+	// prices not paid in USD towards the lifetime amounts.
+	USDRates map[string]float64
+	// PlayTime, if set, returns how long the user has used the app. The
+	// server sees purchases only, so playTime is undeclared without it.
+	PlayTime func(ctx context.Context, userToken string) (time.Duration, error)
+	// Attempts is how often a retryable failure is tried, 3 by default.
+	// Backoff is the wait before the second attempt, doubled after each
+	// further one, 1s by default.
+	Attempts int
+	Backoff  time.Duration
+	// Now and Sleep override the clock and waiting, for tests.
+	Now   func() time.Time
+	Sleep func(ctx context.Context, d time.Duration) error
+}
+
+type Reporter interface {
+	// ReportConsumption sends the consumption information for the
+	// transaction of event, a CONSUMPTION_REQUEST, and records every attempt
+	// in the audit log. The error of the last attempt is returned.
+	ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error
+}
+
+type reporter struct {
+	client    appstoreapi.Client
+	events    storage.EventStore
+	purchases storage.PurchaseStore
+	audit     storage.APICallLog
+	opts      Options
+}
+
+func NewReporter(c appstoreapi.Client, ev storage.EventStore, ps storage.PurchaseStore, audit storage.APICallLog, opts Options) Reporter {
+	if opts.Attempts <= 0 {
+		opts.Attempts = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.Sleep == nil {
+		opts.Sleep = sleep
+	}
+	return &reporter{
+		client:    c,
+		events:    ev,
+		purchases: ps,
+		audit:     audit,
+		opts:      opts,
+	}
+}
+
+func (r *reporter) ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error {
+	call := storage.APICall{
+		Operation:     Operation,
+		UserToken:     event.UserToken,
+		TransactionID: event.TransactionID,
+		Environment:   event.Environment,
+	}
+	if !r.opts.CustomerConsented {
+		call.SentAt = r.opts.Now().UTC()
+		call.ID = callID(event, call.SentAt, 0)
+		call.Request = "{}"
+		call.Error = "not sent: customer consent is not configured"
+		return r.record(ctx, &call)
+	}
+
+	req, err := r.build(ctx, event)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encode consumption request: %w", err)
+	}
+	call.Request = string(body)
+
+	backoff := r.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		call.Attempt = attempt
+		call.SentAt = r.opts.Now().UTC()
+		call.ID = callID(event, call.SentAt, attempt)
+		err = r.client.SendConsumptionInformation(ctx, event.Environment, event.TransactionID, req)
+
+		call.StatusCode, call.Error = 200, ""
+		var apiErr *appstoreapi.Error
+		switch {
+		case errors.As(err, &apiErr):
+			call.StatusCode, call.Error = apiErr.StatusCode, apiErr.Error()
+		case err != nil:
+			call.StatusCode, call.Error = 0, err.Error()
+		}
+		if auditErr := r.record(ctx, &call); auditErr != nil {
+			return auditErr
+		}
+
+		if err == nil {
+			return nil
+		}
+		if apiErr != nil && !apiErr.Retryable() || attempt >= r.opts.Attempts {
+			return fmt.Errorf("send consumption information: %w", err)
+		}
+		if err := r.opts.Sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// callID identifies an attempt. Notifications retried from the dead-letter
+// queue report again, so attempts are told apart by time as well.
+func callID(event *storage.SubscriptionEvent, sentAt time.Time, attempt int) string {
+	return event.ID + ":" + strconv.FormatInt(sentAt.UnixNano(), 10) + ":" + strconv.Itoa(attempt)
+}
+
+func (r *reporter) record(ctx context.Context, call *storage.APICall) error {
+	if err := r.audit.RecordAPICall(ctx, call); err != nil {
+		return fmt.Errorf("record consumption call: %w", err)
+	}
+	return nil
+}
+
+// build assembles the consumption information from the user's events and
+// ledger. userStatus stays undeclared: accounts are managed by the app, so
+// the server cannot tell an active account from a suspended one.
+func (r *reporter) build(ctx context.Context, event *storage.SubscriptionEvent) (*appstoreapi.ConsumptionRequest, error) {
+	timeline, err := r.events.ListEvents(ctx, event.UserToken)
+	if err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+
+	req := &appstoreapi.ConsumptionRequest{
+		CustomerConsented:     true,
+		Platform:              platformApple,
+		SampleContentProvided: r.opts.SampleContentProvided,
+		DeliveryStatus:        deliveryOther,
+		AccountTenure:         tenure(timeline, r.opts.Now()),
+		RefundPreference:      r.opts.RefundPreference,
+	}
+	if uuidPattern.MatchString(event.UserToken) {
+		req.AppAccountToken = event.UserToken
+	}
+	req.LifetimeDollarsPurchased, req.LifetimeDollarsRefunded = lifetimeDollars(timeline, r.opts.USDRates)
+	if r.opts.PlayTime != nil {
+		played, err := r.opts.PlayTime(ctx, event.UserToken)
+		if err != nil {
+			return nil, fmt.Errorf("get play time: %w", err)
+		}
+		req.PlayTime = playTimeRange(played)
+	}
+	for _, e := range timeline {
+		if e.TransactionID == event.TransactionID && e.Type != "CONSUMPTION_REQUEST" {
+			req.DeliveryStatus = deliveryWorking
+			break
+		}
+	}
+
+	if event.TransactionType == storage.ProductTypeConsumable {
+		status, err := r.consumed(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		req.ConsumptionStatus = status
+	}
+	return req, nil
+}
+
+// consumed works out how much of the credit of a consumable was spent.
+// Debits spend the oldest credits of an account first, so credits bought
+// earlier and debits made before the purchase do not count against it.
+func (r *reporter) consumed(ctx context.Context, event *storage.SubscriptionEvent) (int, error) {
+	credit, err := r.purchases.GetLedgerEntry(ctx, "apple:"+event.TransactionID)
+	switch {
+	case errors.Is(err, storage.ErrLedgerEntryNotFound):
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("get credit: %w", err)
+	}
+	entries, err := r.purchases.ListLedgerEntries(ctx, event.UserToken)
+	if err != nil {
+		return 0, fmt.Errorf("list ledger: %w", err)
+	}
+
+	switch left := unspent(entries, credit); {
+	case left < 0:
+		// The credit is not in the user's ledger.
+		return 0, nil
+	case left >= credit.Amount:
+		return consumptionNotConsumed, nil
+	case left == 0:
+		return consumptionFullyConsumed, nil
+	}
+	return consumptionPartiallyConsumed, nil
+}
+
+// unspent replays the ledger of credit's account and returns what is left
+// of credit, or -1 if it is missing. Clawbacks take back what is left of the
+// credit they name; other debits spend credits in order.
+func unspent(entries []storage.LedgerEntry, credit *storage.LedgerEntry) int64 {
+	type lot struct {
+		id   string
+		left int64
+	}
+	var lots []lot
+	for _, e := range entries {
+		if e.Account != credit.Account {
+			continue
+		}
+		switch {
+		case e.Reason == storage.LedgerReasonClawback:
+			for i := range lots {
+				if lots[i].id == "apple:"+e.TransactionID {
+					lots[i].left = max(lots[i].left+e.Amount, 0)
+				}
+			}
+		case e.Amount > 0:
+			lots = append(lots, lot{id: e.ID, left: e.Amount})
+		default:
+			owed := -e.Amount
+			for i := range lots {
+				spent := min(lots[i].left, owed)
+				lots[i].left -= spent
+				owed -= spent
+			}
+		}
+	}
+	for _, l := range lots {
+		if l.id == credit.ID {
+			return l.left
+		}
+	}
+	return -1
+}
+
+// tenure buckets the age of the user's first event into Apple's
+// accountTenure ranges.
+func tenure(timeline []storage.SubscriptionEvent, now time.Time) int {
+	var first time.Time
+	for _, e := range timeline {
+		if !e.OccurredAt.IsZero() && (first.IsZero() || e.OccurredAt.Before(first)) {
+			first = e.OccurredAt
+		}
+	}
+	if first.IsZero() {
+		return 0
+	}
+	days := now.Sub(first).Hours() / 24
+	for i, limit := range []float64{3, 10, 30, 90, 180, 365} {
+		if days < limit {
+			return i + 1
+		}
+	}
+	return 7
+}
+
+// lifetimeDollars buckets what the user paid and got refunded into Apple's
+// ranges, counting each transaction once. A refund counts until a later
+// REFUND_REVERSED. Prices are in milliunits and converted to USD with rates;
+// the amounts are undeclared when a currency has no rate.
+func lifetimeDollars(timeline []storage.SubscriptionEvent, rates map[string]float64) (purchased, refunded int) {
+	prices := make(map[string]int64)
+	refunds := make(map[string]bool)
+	for _, e := range timeline {
+		if e.TransactionID == "" {
+			continue
+		}
+		switch e.Type {
+		case "REFUND":
+			refunds[e.TransactionID] = true
+		case "REFUND_REVERSED":
+			refunds[e.TransactionID] = false
+		}
+		if e.Price == nil {
+			continue
+		}
+		price, ok := usd(*e.Price, e.Currency, rates)
+		if !ok {
+			return 0, 0
+		}
+		prices[e.TransactionID] = price
+	}
+
+	var paid, back int64
+	for id, price := range prices {
+		paid += price
+		if refunds[id] {
+			back += price
+		}
+	}
+	return dollarRange(paid), dollarRange(back)
+}
+
+// usd converts a price in milliunits of currency to milliunits of USD.
+func usd(price int64, currency string, rates map[string]float64) (int64, bool) {
+	if currency == "USD" {
+		return price, true
+	}
+	rate, ok := rates[currency]
+	if !ok || rate <= 0 {
+		return 0, false
+	}
+	return int64(math.Round(float64(price) * rate)), true
+}
+
+func dollarRange(milliunits int64) int {
+	if milliunits <= 0 {
+		return 1
+	}
+	for i, limit := range []int64{50_000, 100_000, 500_000, 1_000_000, 2_000_000} {
+		if milliunits < limit {
+			return i + 2
+		}
+	}
+	return 7
+}
+
+// playTimeRange buckets how long the user played into Apple's playTime
+// ranges.
+func playTimeRange(d time.Duration) int {
+	for i, limit := range []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 4 * 24 * time.Hour, 16 * 24 * time.Hour} {
+		if d < limit {
+			return i + 1
+		}
+	}
+	return 7
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,334 @@
+package consumption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"subscription-server/internal/appstoreapi"
+	"subscription-server/internal/consumption"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+const user = "4a6d9a7c-3b2e-4f1a-9c8d-1e2f3a4b5c6d"
+
+// fixture заполняет журнал событий и кредитов пользователя
+func fixture(t *testing.T, now time.Time) (storage.EventStore, storage.PurchaseStore, *storage.SubscriptionEvent) {
+	t.Helper()
+	ctx := context.Background()
+	events := storage.NewMemoryEventStore()
+	purchases := storage.NewMemoryPurchaseStore()
+	price := func(v int64) *int64 { return &v }
+
+	for _, e := range []storage.SubscriptionEvent{
+		{ID: "e-1", UserToken: user, Type: "SUBSCRIBED", TransactionID: "1", Price: price(9990), Currency: "USD", OccurredAt: now.Add(-40 * 24 * time.Hour)},
+		{ID: "e-2", UserToken: user, Type: "DID_RENEW", TransactionID: "2", Price: price(9990), Currency: "USD", OccurredAt: now.Add(-10 * 24 * time.Hour)},
+		{ID: "e-3", UserToken: user, Type: "REFUND", TransactionID: "2", Price: price(9990), Currency: "USD", OccurredAt: now.Add(-9 * 24 * time.Hour)},
+		{ID: "e-4", UserToken: user, Type: "ONE_TIME_CHARGE", TransactionID: "3", Price: price(49990), Currency: "USD",
+			TransactionType: storage.ProductTypeConsumable, OccurredAt: now.Add(-time.Hour)},
+	} {
+		if err := events.AppendEvent(ctx, &e); err != nil {
+			t.Fatalf("Ошибка записи события: %v", err)
+		}
+	}
+	purchases.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "apple:3", UserToken: user, Account: "credits", Amount: 100, CreatedAt: now.Add(-time.Hour)})
+	purchases.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "debit:1", UserToken: user, Account: "credits", Amount: -40, CreatedAt: now})
+
+	request := &storage.SubscriptionEvent{ID: "consumption-1", UserToken: user, Type: "CONSUMPTION_REQUEST", TransactionID: "3",
+		TransactionType: storage.ProductTypeConsumable, Environment: "Sandbox", OccurredAt: now}
+	events.AppendEvent(ctx, request)
+	return events, purchases, request
+}
+
+// TestReporter_ReportConsumption проверяет содержимое отправленных данных о потреблении
+func TestReporter_ReportConsumption(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	events, purchases, request := fixture(t, now)
+	client := appstoreapi.NewLocalClient()
+	audit := storage.NewMemoryAPICallLog()
+
+	reporter := consumption.NewReporter(client, events, purchases, audit, consumption.Options{
+		CustomerConsented: true,
+		RefundPreference:  2,
+		Now:               func() time.Time { return now },
+	})
+	if err := reporter.ReportConsumption(ctx, request); err != nil {
+		t.Fatalf("Ошибка отправки: %v", err)
+	}
+
+	calls := client.Calls()
+	if len(calls) != 1 || calls[0].TransactionID != "3" || calls[0].Environment != "Sandbox" {
+		t.Fatalf("Неправильные вызовы API: %+v", calls)
+	}
+	got := calls[0].Body.(*appstoreapi.ConsumptionRequest)
+	want := appstoreapi.ConsumptionRequest{
+		CustomerConsented:        true,
+		ConsumptionStatus:        2, // потрачена часть кредитов
+		Platform:                 1,
+		DeliveryStatus:           0,
+		AppAccountToken:          user,
+		AccountTenure:            4, // 30-90 дней
+		LifetimeDollarsPurchased: 3, // 69.97 USD
+		LifetimeDollarsRefunded:  2, // 9.99 USD
+		RefundPreference:         2,
+	}
+	if *got != want {
+		t.Errorf("Ожидалось %+v, получено %+v", want, *got)
+	}
+
+	logged, err := audit.ListAPICalls(ctx, user)
+	if err != nil || len(logged) != 1 {
+		t.Fatalf("Ожидалась 1 запись аудита, получено %d (%v)", len(logged), err)
+	}
+	var sent appstoreapi.ConsumptionRequest
+	if err := json.Unmarshal([]byte(logged[0].Request), &sent); err != nil || sent != want {
+		t.Errorf("В аудите сохранено не то, что отправлено: %s", logged[0].Request)
+	}
+	if logged[0].Operation != consumption.Operation || logged[0].StatusCode != 200 || logged[0].Error != "" {
+		t.Errorf("Неправильная запись аудита: %+v", logged[0])
+	}
+}
+
+// TestReporter_LifetimeAndPlayTime проверяет пересчет валют, отмену возврата и время использования
+func TestReporter_LifetimeAndPlayTime(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	price := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name          string
+		rates         map[string]float64
+		wantPurchased int
+		wantRefunded  int
+	}{
+		// 9.99 + 9.99 + 49.99 + 100 EUR * 1.1 = 179.97 USD, возврат отменен
+		{"с курсом", map[string]float64{"EUR": 1.1}, 4, 1},
+		{"без курса", nil, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, purchases, request := fixture(t, now)
+			for _, e := range []storage.SubscriptionEvent{
+				{ID: "e-5", UserToken: user, Type: "REFUND_REVERSED", TransactionID: "2", Price: price(9990), Currency: "USD", OccurredAt: now.Add(-8 * 24 * time.Hour)},
+				{ID: "e-6", UserToken: user, Type: "ONE_TIME_CHARGE", TransactionID: "4", Price: price(100000), Currency: "EUR", OccurredAt: now.Add(-2 * time.Hour)},
+			} {
+				if err := events.AppendEvent(ctx, &e); err != nil {
+					t.Fatalf("Ошибка записи события: %v", err)
+				}
+			}
+			client := appstoreapi.NewLocalClient()
+			var played string
+			reporter := consumption.NewReporter(client, events, purchases, storage.NewMemoryAPICallLog(), consumption.Options{
+				CustomerConsented: true,
+				USDRates:          tt.rates,
+				PlayTime: func(ctx context.Context, userToken string) (time.Duration, error) {
+					played = userToken
+					return 2 * time.Hour, nil
+				},
+				Now: func() time.Time { return now },
+			})
+			if err := reporter.ReportConsumption(ctx, request); err != nil {
+				t.Fatalf("Ошибка отправки: %v", err)
+			}
+
+			got := client.Calls()[0].Body.(*appstoreapi.ConsumptionRequest)
+			if got.LifetimeDollarsPurchased != tt.wantPurchased || got.LifetimeDollarsRefunded != tt.wantRefunded {
+				t.Errorf("Ожидалось purchased=%d refunded=%d, получено %d и %d",
+					tt.wantPurchased, tt.wantRefunded, got.LifetimeDollarsPurchased, got.LifetimeDollarsRefunded)
+			}
+			if got.PlayTime != 3 || played != user { // 1-6 часов
+				t.Errorf("Ожидалось playTime=3 для %s, получено %d для %q", user, got.PlayTime, played)
+			}
+			if got.UserStatus != 0 {
+				t.Errorf("Статус аккаунта должен оставаться необъявленным, получено %d", got.UserStatus)
+			}
+		})
+	}
+}
+
+// TestReporter_Retry проверяет повторы при временных ошибках Apple
+func TestReporter_Retry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	events, purchases, request := fixture(t, now)
+
+	var waits []time.Duration
+	newReporter := func(client appstoreapi.Client, audit storage.APICallLog) consumption.Reporter {
+		return consumption.NewReporter(client, events, purchases, audit, consumption.Options{
+			CustomerConsented: true,
+			Attempts:          3,
+			Backoff:           time.Second,
+			Now:               func() time.Time { return now },
+			Sleep: func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			},
+		})
+	}
+
+	// Две временные ошибки, затем успех
+	client := appstoreapi.NewLocalClient()
+	client.FailNext(&appstoreapi.Error{StatusCode: 503}, &appstoreapi.Error{StatusCode: 429})
+	audit := storage.NewMemoryAPICallLog()
+	if err := newReporter(client, audit).ReportConsumption(ctx, request); err != nil {
+		t.Fatalf("Ошибка отправки: %v", err)
+	}
+	if len(client.Calls()) != 3 || len(waits) != 2 || waits[0] != time.Second || waits[1] != 2*time.Second {
+		t.Errorf("Ожидалось 3 попытки с паузами 1s и 2s: %d попыток, паузы %v", len(client.Calls()), waits)
+	}
+	logged, _ := audit.ListAPICalls(ctx, user)
+	if len(logged) != 3 || logged[0].StatusCode != 503 || logged[2].StatusCode != 200 || logged[2].Attempt != 3 {
+		t.Errorf("Каждая попытка должна попасть в аудит: %+v", logged)
+	}
+
+	// Ошибка запроса не повторяется
+	client = appstoreapi.NewLocalClient()
+	client.FailNext(&appstoreapi.Error{StatusCode: 400, Code: 4000023, Message: "invalid"})
+	var apiErr *appstoreapi.Error
+	if err := newReporter(client, storage.NewMemoryAPICallLog()).ReportConsumption(ctx, request); !errors.As(err, &apiErr) {
+		t.Fatalf("Ожидалась ошибка API, получено %v", err)
+	}
+	if len(client.Calls()) != 1 {
+		t.Errorf("Ошибка 400 не должна повторяться: %d попыток", len(client.Calls()))
+	}
+}
+
+// TestReporter_NoConsent проверяет, что без согласия данные не отправляются
+func TestReporter_NoConsent(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	events, purchases, request := fixture(t, now)
+	client := appstoreapi.NewLocalClient()
+	audit := storage.NewMemoryAPICallLog()
+
+	reporter := consumption.NewReporter(client, events, purchases, audit, consumption.Options{Now: func() time.Time { return now }})
+	if err := reporter.ReportConsumption(ctx, request); err != nil {
+		t.Fatalf("Ошибка: %v", err)
+	}
+	if len(client.Calls()) != 0 {
+		t.Errorf("Без согласия запросы не отправляются: %+v", client.Calls())
+	}
+	logged, _ := audit.ListAPICalls(ctx, user)
+	if len(logged) != 1 || logged[0].Error == "" {
+		t.Errorf("Пропуск должен попасть в аудит: %+v", logged)
+	}
+}
+
+// TestReporter_ConsumedFromLaterDebits проверяет, что потребление считается по
+// списаниям после покупки, а старые кредиты тратятся первыми
+func TestReporter_ConsumedFromLaterDebits(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	entry := func(id string, amount int64, reason string, at time.Duration) storage.LedgerEntry {
+		return storage.LedgerEntry{ID: id, UserToken: user, Account: "credits", Amount: amount, Reason: reason, CreatedAt: now.Add(at)}
+	}
+	credit := entry("apple:3", 100, storage.LedgerReasonPurchase, -time.Hour)
+
+	tests := []struct {
+		name    string
+		entries []storage.LedgerEntry
+		want    int
+	}{
+		{"списания до покупки", []storage.LedgerEntry{
+			entry("apple:0", 50, storage.LedgerReasonPurchase, -3*time.Hour),
+			entry("debit:0", -50, storage.LedgerReasonDebit, -2*time.Hour),
+			credit,
+		}, 1},
+		{"сначала тратится старый кредит", []storage.LedgerEntry{
+			entry("apple:0", 50, storage.LedgerReasonPurchase, -2*time.Hour),
+			credit,
+			entry("debit:1", -40, storage.LedgerReasonDebit, 0),
+		}, 1},
+		{"часть после старого кредита", []storage.LedgerEntry{
+			entry("apple:0", 50, storage.LedgerReasonPurchase, -2*time.Hour),
+			credit,
+			entry("debit:1", -60, storage.LedgerReasonDebit, 0),
+		}, 2},
+		{"возврат старого кредита не тратит новый", []storage.LedgerEntry{
+			entry("apple:0", 50, storage.LedgerReasonPurchase, -2*time.Hour),
+			credit,
+			{ID: "apple:0:clawback", UserToken: user, Account: "credits", Amount: -50, Reason: storage.LedgerReasonClawback, TransactionID: "0", CreatedAt: now.Add(-time.Minute)},
+			entry("debit:1", -100, storage.LedgerReasonDebit, 0),
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, _, request := fixture(t, now)
+			purchases := storage.NewMemoryPurchaseStore()
+			for _, e := range tt.entries {
+				if _, err := purchases.AppendLedgerEntry(ctx, &e); err != nil {
+					t.Fatalf("Ошибка записи в журнал: %v", err)
+				}
+			}
+			client := appstoreapi.NewLocalClient()
+			reporter := consumption.NewReporter(client, events, purchases, storage.NewMemoryAPICallLog(), consumption.Options{
+				CustomerConsented: true,
+				Now:               func() time.Time { return now },
+			})
+			if err := reporter.ReportConsumption(ctx, request); err != nil {
+				t.Fatalf("Ошибка отправки: %v", err)
+			}
+			calls := client.Calls()
+			if len(calls) != 1 {
+				t.Fatalf("Ожидался 1 вызов API, получено %d", len(calls))
+			}
+			if got := calls[0].Body.(*appstoreapi.ConsumptionRequest).ConsumptionStatus; got != tt.want {
+				t.Errorf("Ожидался consumptionStatus %d, получен %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// blockingReporter ждет сигнала и завершает отправку с ошибкой err
+type blockingReporter struct {
+	release chan struct{}
+	err     error
+}
+
+func (r *blockingReporter) ReportConsumption(ctx context.Context, event *storage.SubscriptionEvent) error {
+	<-r.release
+	return r.err
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.LogMessage) {}
+func (nopLogger) Close()                {}
+
+// TestBackgroundReporter_DeadLettersFailure проверяет фоновую отправку и перенос ошибки в очередь ошибок
+func TestBackgroundReporter_DeadLettersFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := &blockingReporter{release: make(chan struct{}), err: errors.New("apple unavailable")}
+	dlq := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), nopLogger{}, deadletter.Options{})
+	reporter := consumption.NewBackgroundReporter(ctx, next, dlq, nopLogger{})
+
+	event := &storage.SubscriptionEvent{ID: "consumption-1", UserToken: user, Type: "CONSUMPTION_REQUEST",
+		Source: storage.EventSourceAppleServer, TransactionID: "3", RawPayload: `{"signedPayload":"x"}`}
+	done := make(chan error, 1)
+	go func() { done <- reporter.ReportConsumption(context.Background(), event) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Ошибка постановки отправки: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReportConsumption ждет ответа Apple")
+	}
+
+	close(next.release)
+	reporter.Wait()
+
+	list, err := dlq.List(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при получении списка: %v", err)
+	}
+	if len(list) != 1 || list[0].Source != storage.EventSourceAppleServer || list[0].Payload != event.RawPayload || list[0].Error != "apple unavailable" {
+		t.Errorf("Ожидалось уведомление в очереди ошибок, получено %+v", list)
+	}
+}
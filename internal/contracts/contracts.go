@@ -1,6 +1,9 @@
 package contracts
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 type JWSValidator interface {
 	Validate(header string, payload string, signature string) error
@@ -10,4 +13,19 @@ type Service interface {
 	HandleProviderNotification(w http.ResponseWriter, r *http.Request)
 	HandleClientNotification(w http.ResponseWriter, r *http.Request)
 	HandleClientRequest(w http.ResponseWriter, r *http.Request)
+	// ProcessProviderPayload processes a raw server-to-server notification
+	// body, e.g. one retried from the dead-letter queue.
+	ProcessProviderPayload(ctx context.Context, payload []byte) error
+}
+
+// ReceiptService validates legacy StoreKit 1 app receipts. The App Store
+// service implements it.
+type ReceiptService interface {
+	HandleClientReceipt(w http.ResponseWriter, r *http.Request)
+}
+
+// AppTransactionService grants entitlements from verified StoreKit 2 app
+// transactions. The App Store service implements it.
+type AppTransactionService interface {
+	HandleAppTransaction(w http.ResponseWriter, r *http.Request)
 }
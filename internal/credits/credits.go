@@ -0,0 +1,114 @@
+package credits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+// Account is the ledger account holding spendable credits. Consumables listed
+// in the credit products configuration credit it instead of an account named
+// after the product.
+const Account = "credits"
+
+var (
+	ErrInvalidDebit = errors.New("invalid debit")
+)
+
+// Balance is a user's spendable credits.
+type Balance struct {
+	UserToken string `json:"userToken"`
+	Credits   int64  `json:"credits"`
+	// Negative is set when refunds clawed back credits that were already
+	// spent. Debits fail until purchases bring the balance back up.
+	Negative bool `json:"negative"`
+}
+
+type DebitRequest struct {
+	UserToken string `json:"userToken"`
+	Amount    int64  `json:"amount"`
+	// IdempotencyKey identifies the spend in the caller's system. Retrying
+	// with the same key never debits twice.
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+type Options struct {
+	// Now overrides the clock, for tests.
+	Now func() time.Time
+}
+
+// Ledger spends and reports the credits of users. Crediting happens when
+// store notifications are processed.
+type Ledger interface {
+	Balance(ctx context.Context, userToken string) (*Balance, error)
+	// Debit spends req.Amount credits if the balance covers them and returns
+	// the ledger entry. A repeated key returns the original entry;
+	// storage.ErrLedgerEntryConflict if the request differs from it.
+	Debit(ctx context.Context, req DebitRequest) (*storage.LedgerEntry, error)
+	// History returns the movements of a user's credits, oldest first.
+	History(ctx context.Context, userToken string) ([]storage.LedgerEntry, error)
+}
+
+type ledger struct {
+	store storage.PurchaseStore
+	opts  Options
+}
+
+func NewLedger(st storage.PurchaseStore, opts Options) Ledger {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &ledger{
+		store: st,
+		opts:  opts,
+	}
+}
+
+func (l *ledger) Balance(ctx context.Context, userToken string) (*Balance, error) {
+	balances, err := l.store.Balances(ctx, userToken)
+	if err != nil {
+		return nil, fmt.Errorf("get balances: %w", err)
+	}
+	credits := balances[Account]
+	return &Balance{
+		UserToken: userToken,
+		Credits:   credits,
+		Negative:  credits < 0,
+	}, nil
+}
+
+func (l *ledger) Debit(ctx context.Context, req DebitRequest) (*storage.LedgerEntry, error) {
+	switch {
+	case req.UserToken == "":
+		return nil, fmt.Errorf("%w: userToken is required", ErrInvalidDebit)
+	case req.IdempotencyKey == "":
+		return nil, fmt.Errorf("%w: idempotencyKey is required", ErrInvalidDebit)
+	case req.Amount <= 0:
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidDebit)
+	}
+
+	return l.store.DebitLedgerEntry(ctx, &storage.LedgerEntry{
+		ID:        "debit:" + req.IdempotencyKey,
+		UserToken: req.UserToken,
+		Account:   Account,
+		Amount:    -req.Amount,
+		Reason:    storage.LedgerReasonDebit,
+		CreatedAt: l.opts.Now().UTC(),
+	})
+}
+
+func (l *ledger) History(ctx context.Context, userToken string) ([]storage.LedgerEntry, error) {
+	entries, err := l.store.ListLedgerEntries(ctx, userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list ledger entries: %w", err)
+	}
+	history := []storage.LedgerEntry{}
+	for _, e := range entries {
+		if e.Account == Account {
+			history = append(history, e)
+		}
+	}
+	return history, nil
+}
@@ -0,0 +1,95 @@
+package credits
+
+import (
+	"context"
+	"errors"
+	"subscription-server/internal/credits"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// TestLedger_Debit проверяет списание кредитов с ключом идемпотентности
+func TestLedger_Debit(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := storage.NewMemoryPurchaseStore()
+	ledger := credits.NewLedger(store, credits.Options{Now: func() time.Time { return now }})
+
+	store.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "apple:1", UserToken: "user1", Account: credits.Account, Amount: 100, Reason: storage.LedgerReasonPurchase, CreatedAt: now})
+	store.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "apple:2", UserToken: "user1", Account: "com.test.hints", Amount: 5, Reason: storage.LedgerReasonPurchase, CreatedAt: now})
+
+	entry, err := ledger.Debit(ctx, credits.DebitRequest{UserToken: "user1", Amount: 30, IdempotencyKey: "order-1"})
+	if err != nil {
+		t.Fatalf("Ошибка при списании: %v", err)
+	}
+	if entry.Amount != -30 || entry.Account != credits.Account || entry.Reason != storage.LedgerReasonDebit || !entry.CreatedAt.Equal(now) {
+		t.Errorf("Неправильная запись списания: %+v", entry)
+	}
+
+	// Повтор с тем же ключом не списывает повторно
+	if _, err := ledger.Debit(ctx, credits.DebitRequest{UserToken: "user1", Amount: 30, IdempotencyKey: "order-1"}); err != nil {
+		t.Fatalf("Ошибка при повторном списании: %v", err)
+	}
+	if _, err := ledger.Debit(ctx, credits.DebitRequest{UserToken: "user1", Amount: 31, IdempotencyKey: "order-1"}); !errors.Is(err, storage.ErrLedgerEntryConflict) {
+		t.Errorf("Ожидалась ошибка конфликта ключа, получено %v", err)
+	}
+	if _, err := ledger.Debit(ctx, credits.DebitRequest{UserToken: "user1", Amount: 71, IdempotencyKey: "order-2"}); !errors.Is(err, storage.ErrInsufficientBalance) {
+		t.Errorf("Ожидалась ошибка недостатка кредитов, получено %v", err)
+	}
+
+	balance, err := ledger.Balance(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Ошибка при получении баланса: %v", err)
+	}
+	if balance.Credits != 70 || balance.Negative {
+		t.Errorf("Неправильный баланс: %+v", balance)
+	}
+
+	history, err := ledger.History(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Ошибка при получении истории: %v", err)
+	}
+	if len(history) != 2 {
+		t.Errorf("История должна содержать только движения кредитов, получено %+v", history)
+	}
+}
+
+// TestLedger_DebitValidation проверяет отклонение некорректных запросов списания
+func TestLedger_DebitValidation(t *testing.T) {
+	ledger := credits.NewLedger(storage.NewMemoryPurchaseStore(), credits.Options{})
+
+	requests := []credits.DebitRequest{
+		{Amount: 1, IdempotencyKey: "k"},
+		{UserToken: "user1", Amount: 1},
+		{UserToken: "user1", IdempotencyKey: "k"},
+		{UserToken: "user1", Amount: -5, IdempotencyKey: "k"},
+	}
+	for _, req := range requests {
+		if _, err := ledger.Debit(context.Background(), req); !errors.Is(err, credits.ErrInvalidDebit) {
+			t.Errorf("Запрос %+v: ожидалась ErrInvalidDebit, получено %v", req, err)
+		}
+	}
+}
+
+// TestLedger_NegativeBalance проверяет флаг отрицательного баланса после возврата
+func TestLedger_NegativeBalance(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryPurchaseStore()
+	ledger := credits.NewLedger(store, credits.Options{})
+
+	store.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "apple:1", UserToken: "user1", Account: credits.Account, Amount: 10, Reason: storage.LedgerReasonPurchase})
+	store.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "debit:a", UserToken: "user1", Account: credits.Account, Amount: -8, Reason: storage.LedgerReasonDebit})
+	store.AppendLedgerEntry(ctx, &storage.LedgerEntry{ID: "apple:1:clawback", UserToken: "user1", Account: credits.Account, Amount: -10, Reason: storage.LedgerReasonClawback})
+
+	balance, err := ledger.Balance(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Ошибка при получении баланса: %v", err)
+	}
+	if balance.Credits != -8 || !balance.Negative {
+		t.Errorf("Ожидался отрицательный баланс с флагом, получено %+v", balance)
+	}
+	if _, err := ledger.Debit(ctx, credits.DebitRequest{UserToken: "user1", Amount: 1, IdempotencyKey: "b"}); !errors.Is(err, storage.ErrInsufficientBalance) {
+		t.Errorf("Списание при отрицательном балансе должно быть отклонено, получено %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package deadletter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"subscription-server/internal/archive"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned by Record when the queue already holds MaxEntries
+// entries and the payload is not one of them.
+var ErrFull = errors.New("dead-letter queue is full")
+
+// ProcessFunc reprocesses a dead-lettered payload through the regular path.
+type ProcessFunc func(ctx context.Context, payload []byte) error
+
+type RetryResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+type Queue interface {
+	// Register sets the processor used to retry payloads of source.
+	Register(source string, fn ProcessFunc)
+	// Record stores a payload that failed with cause. Recording the same
+	// payload again bumps its attempt counter.
+	Record(ctx context.Context, source string, payload []byte, cause error) error
+	List(ctx context.Context) ([]storage.DeadLetter, error)
+	Get(ctx context.Context, id string) (*storage.DeadLetter, error)
+	// Retry reprocesses one entry and removes it on success.
+	Retry(ctx context.Context, id string) error
+	// RetryAll retries every entry and reports the outcome of each.
+	RetryAll(ctx context.Context) ([]RetryResult, error)
+}
+
+type Options struct {
+	// MaxEntries bounds the number of stored entries. New payloads are
+	// refused once it is reached; known ones still bump their counters.
+	MaxEntries int
+}
+
+type queue struct {
+	store  storage.DeadLetterStore
+	logger logger.Logger
+	opts   Options
+
+	mu         sync.RWMutex
+	processors map[string]ProcessFunc
+}
+
+func NewQueue(st storage.DeadLetterStore, l logger.Logger, opts Options) Queue {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 1000
+	}
+	return &queue{
+		store:      st,
+		logger:     l,
+		opts:       opts,
+		processors: make(map[string]ProcessFunc),
+	}
+}
+
+func (q *queue) Register(source string, fn ProcessFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.processors[source] = fn
+}
+
+func (q *queue) Record(ctx context.Context, source string, payload []byte, cause error) error {
+	now := time.Now().UTC()
+	sum := sha256.Sum256(payload)
+	id := source + ":" + hex.EncodeToString(sum[:16])
+
+	dl, err := q.store.GetDeadLetter(ctx, id)
+	switch {
+	case errors.Is(err, storage.ErrDeadLetterNotFound):
+		list, err := q.store.ListDeadLetters(ctx)
+		if err != nil {
+			return fmt.Errorf("list dead letters: %w", err)
+		}
+		if len(list) >= q.opts.MaxEntries {
+			q.logger.Log(logger.LogMessage{
+				Time:    now,
+				Level:   "ERROR",
+				Sender:  "deadletter",
+				Message: fmt.Sprintf("dropped %s, queue holds %d entries: %v", id, len(list), cause),
+			})
+			return ErrFull
+		}
+		dl = &storage.DeadLetter{
+			ID:            id,
+			Source:        source,
+			Payload:       string(payload),
+			FirstFailedAt: now,
+			ArchiveID:     archive.RequestID(ctx),
+		}
+	case err != nil:
+		return fmt.Errorf("get dead letter: %w", err)
+	}
+	dl.Attempts++
+	dl.Error = cause.Error()
+	dl.LastFailedAt = now
+
+	if err := q.store.SaveDeadLetter(ctx, dl); err != nil {
+		return fmt.Errorf("save dead letter: %w", err)
+	}
+
+	q.logger.Log(logger.LogMessage{
+		Time:    now,
+		Level:   "ERROR",
+		Sender:  "deadletter",
+		Message: fmt.Sprintf("dead-lettered %s (attempt %d): %v", id, dl.Attempts, cause),
+	})
+	return nil
+}
+
+func (q *queue) List(ctx context.Context) ([]storage.DeadLetter, error) {
+	return q.store.ListDeadLetters(ctx)
+}
+
+func (q *queue) Get(ctx context.Context, id string) (*storage.DeadLetter, error) {
+	return q.store.GetDeadLetter(ctx, id)
+}
+
+func (q *queue) Retry(ctx context.Context, id string) error {
+	dl, err := q.store.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	q.mu.RLock()
+	process, ok := q.processors[dl.Source]
+	q.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no processor registered for source %q", dl.Source)
+	}
+
+	if cause := process(ctx, []byte(dl.Payload)); cause != nil {
+		if err := q.Record(ctx, dl.Source, []byte(dl.Payload), cause); err != nil {
+			return fmt.Errorf("retry failed: %v; record failure: %w", cause, err)
+		}
+		return fmt.Errorf("retry failed: %w", cause)
+	}
+
+	if err := q.store.DeleteDeadLetter(ctx, id); err != nil && !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		return fmt.Errorf("delete dead letter: %w", err)
+	}
+	return nil
+}
+
+func (q *queue) RetryAll(ctx context.Context) ([]RetryResult, error) {
+	list, err := q.store.ListDeadLetters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RetryResult, 0, len(list))
+	for _, dl := range list {
+		result := RetryResult{ID: dl.ID}
+		if err := q.Retry(ctx, dl.ID); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,107 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"testing"
+)
+
+// nopLogger отбрасывает все сообщения
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.LogMessage) {}
+func (nopLogger) Close()                {}
+
+// TestQueue_RecordAndRetry проверяет накопление попыток и повторную обработку
+func TestQueue_RecordAndRetry(t *testing.T) {
+	ctx := context.Background()
+	q := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), nopLogger{}, deadletter.Options{})
+
+	payload := []byte(`{"signedPayload":"abc"}`)
+
+	// Apple повторно доставляет то же уведомление — запись должна быть одна
+	for i := 0; i < 2; i++ {
+		if err := q.Record(ctx, "apple_server", payload, errors.New("storage down")); err != nil {
+			t.Fatalf("Ошибка при записи в очередь: %v", err)
+		}
+	}
+	list, err := q.List(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при получении списка: %v", err)
+	}
+	if len(list) != 1 || list[0].Attempts != 2 || list[0].Error != "storage down" {
+		t.Fatalf("Ожидалась 1 запись с 2 попытками, получено %+v", list)
+	}
+	id := list[0].ID
+
+	// Без зарегистрированного обработчика повтор невозможен
+	if err := q.Retry(ctx, id); err == nil {
+		t.Error("Ожидалась ошибка повтора без обработчика")
+	}
+
+	// Обработчик все еще падает: счетчик попыток растет
+	fixed := false
+	var processed []byte
+	q.Register("apple_server", func(ctx context.Context, p []byte) error {
+		if !fixed {
+			return errors.New("still broken")
+		}
+		processed = p
+		return nil
+	})
+	if err := q.Retry(ctx, id); err == nil {
+		t.Error("Ожидалась ошибка повтора")
+	}
+	dl, err := q.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Ошибка при получении записи: %v", err)
+	}
+	if dl.Attempts != 3 || dl.Error != "still broken" {
+		t.Errorf("Некорректная запись после неудачного повтора: %+v", dl)
+	}
+
+	// После исправления запись обрабатывается и удаляется
+	fixed = true
+	results, err := q.RetryAll(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка повтора всех записей: %v", err)
+	}
+	if len(results) != 1 || results[0].Error != "" {
+		t.Errorf("Некорректный результат повтора: %+v", results)
+	}
+	if string(processed) != string(payload) {
+		t.Errorf("Обработчик получил %q вместо исходного тела", processed)
+	}
+	if _, err := q.Get(ctx, id); !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		t.Errorf("Запись должна быть удалена после успешного повтора, получено %v", err)
+	}
+}
+
+// TestQueue_MaxEntries проверяет ограничение размера очереди
+func TestQueue_MaxEntries(t *testing.T) {
+	ctx := context.Background()
+	q := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), nopLogger{}, deadletter.Options{MaxEntries: 1})
+	cause := errors.New("storage down")
+
+	if err := q.Record(ctx, "apple_server", []byte("first"), cause); err != nil {
+		t.Fatalf("Ошибка при записи в очередь: %v", err)
+	}
+	// Новая запись сверх лимита отклоняется
+	if err := q.Record(ctx, "apple_server", []byte("second"), cause); !errors.Is(err, deadletter.ErrFull) {
+		t.Errorf("Ожидалась ошибка %v, получена %v", deadletter.ErrFull, err)
+	}
+	// Уже сохраненная запись продолжает считать попытки
+	if err := q.Record(ctx, "apple_server", []byte("first"), cause); err != nil {
+		t.Fatalf("Ошибка при повторной записи: %v", err)
+	}
+	list, err := q.List(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при получении списка: %v", err)
+	}
+	if len(list) != 1 || list[0].Attempts != 2 {
+		t.Errorf("Ожидалась 1 запись с 2 попытками, получено %+v", list)
+	}
+}
@@ -2,13 +2,36 @@ package deps
 
 import (
 	"subscription-server/internal/contracts"
+	"subscription-server/internal/credits"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/extensions"
 	"subscription-server/internal/logger"
+	"subscription-server/internal/offers"
+	"subscription-server/internal/projection"
+	"subscription-server/internal/refunds"
 	"subscription-server/internal/storage"
 )
 
 type Deps struct {
 	Storage       storage.Storage
+	Events        storage.EventStore
+	Purchases     storage.PurchaseStore
+	Credits       credits.Ledger
+	Archive       storage.RequestArchive
 	Logger        logger.Logger
 	AppleService  contracts.Service
 	GoogleService contracts.Service
+	Projection    projection.Engine
+	DeadLetters   deadletter.Queue
+	Entitlements  entitlement.Engine
+	AdminToken    string
+	// APICalls audits requests to the App Store Server API.
+	APICalls storage.APICallLog
+	// Offers is nil when no App Store Connect key is configured.
+	Offers offers.Signer
+	// Extensions is nil when the App Store Server API is not configured.
+	Extensions extensions.Extender
+	// Refunds summarises refund histories.
+	Refunds refunds.Tracker
 }
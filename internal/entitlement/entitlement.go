@@ -0,0 +1,159 @@
+package entitlement
+
+import (
+	"sort"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+// Policy decides which stored facts grant access.
+type Policy struct {
+	// HonourGracePeriod keeps access until GracePeriodExpiresAt.
+	HonourGracePeriod bool
+	// BillingRetryAccess keeps access for this long after ExpiresAt while
+	// Apple is still retrying the renewal payment. Zero disables it.
+	BillingRetryAccess time.Duration
+	// Environments, when not empty, lists the only environments granting
+	// access. Records with an unknown environment are not restricted.
+	Environments []string
+	// FamilySharing lets purchases shared through Family Sharing grant
+	// access. FamilyProducts, when not empty, narrows this to the listed
+	// products.
+	FamilySharing  bool
+	FamilyProducts []string
+	// MaxRefunds and MaxRefundRate mark users as serial refunders once they
+	// got more refunds, or a higher share of their transactions refunded.
+	// The rate only counts from the second refund. Zero disables either.
+	MaxRefunds    int
+	MaxRefundRate float64
+}
+
+// DefaultPolicy matches what the server did before policies existed:
+// grace periods count, billing retry does not, family members share the
+// purchaser's access.
+func DefaultPolicy() Policy {
+	return Policy{HonourGracePeriod: true, FamilySharing: true}
+}
+
+// Engine evaluates a Policy against stored subscription facts. Every reader
+// deciding whether a user has access goes through it instead of trusting the
+// IsActive flag frozen at write time.
+type Engine interface {
+	IsActive(status *storage.SubscriptionStatus, now time.Time) bool
+	// Resolve returns a copy of status with IsActive computed as of now.
+	Resolve(status *storage.SubscriptionStatus, now time.Time) *storage.SubscriptionStatus
+	// ResolvePurchases returns copies of a user's one-off purchases with
+	// IsActive computed as of now. Consecutive non-renewing subscriptions to
+	// the same product are stacked, so ExpiresAt may move past the stored
+	// value.
+	ResolvePurchases(purchases []storage.Purchase, now time.Time) []storage.Purchase
+	// SerialRefunder reports whether a user with refunds refunded out of
+	// purchases transactions abuses refunds. Offers are refused to them.
+	SerialRefunder(refunds, purchases int) bool
+}
+
+type engine struct {
+	policy         Policy
+	environments   map[string]bool
+	familyProducts map[string]bool
+}
+
+func NewEngine(p Policy) Engine {
+	e := &engine{policy: p}
+	if len(p.Environments) > 0 {
+		e.environments = make(map[string]bool, len(p.Environments))
+		for _, env := range p.Environments {
+			e.environments[env] = true
+		}
+	}
+	if len(p.FamilyProducts) > 0 {
+		e.familyProducts = make(map[string]bool, len(p.FamilyProducts))
+		for _, product := range p.FamilyProducts {
+			e.familyProducts[product] = true
+		}
+	}
+	return e
+}
+
+func (e *engine) IsActive(status *storage.SubscriptionStatus, now time.Time) bool {
+	if !status.RevokedAt.IsZero() {
+		return false
+	}
+	if !e.allowedEnvironment(status.Environment) || !e.allowedOwnership(status.OwnershipType, status.ProductID) {
+		return false
+	}
+	if status.ExpiresAt.IsZero() {
+		return false
+	}
+
+	if now.Before(status.ExpiresAt) {
+		return true
+	}
+	if e.policy.HonourGracePeriod && now.Before(status.GracePeriodExpiresAt) {
+		return true
+	}
+	if status.InBillingRetry && now.Before(status.ExpiresAt.Add(e.policy.BillingRetryAccess)) {
+		return true
+	}
+	return false
+}
+
+func (e *engine) Resolve(status *storage.SubscriptionStatus, now time.Time) *storage.SubscriptionStatus {
+	resolved := *status
+	resolved.IsActive = e.IsActive(status, now)
+	return &resolved
+}
+
+func (e *engine) allowedEnvironment(env string) bool {
+	return e.environments == nil || env == "" || e.environments[env]
+}
+
+func (e *engine) allowedOwnership(ownership, productID string) bool {
+	if ownership != storage.OwnershipFamilyShared {
+		return true
+	}
+	return e.policy.FamilySharing && (e.familyProducts == nil || e.familyProducts[productID])
+}
+
+func (e *engine) ResolvePurchases(purchases []storage.Purchase, now time.Time) []storage.Purchase {
+	resolved := make([]storage.Purchase, len(purchases))
+	copy(resolved, purchases)
+	sort.SliceStable(resolved, func(i, j int) bool {
+		return resolved[i].PurchasedAt.Before(resolved[j].PurchasedAt)
+	})
+
+	// periodEnds tracks, per product, where the last non-renewing period
+	// ends; a purchase made before that starts when it ends.
+	periodEnds := make(map[string]time.Time)
+	for i := range resolved {
+		p := &resolved[i]
+		if p.ProductType == storage.ProductTypeNonRenewing && p.RevokedAt.IsZero() && !p.ExpiresAt.IsZero() {
+			start := p.PurchasedAt
+			if end := periodEnds[p.ProductID]; end.After(start) {
+				start = end
+			}
+			p.ExpiresAt = start.Add(p.ExpiresAt.Sub(p.PurchasedAt))
+			periodEnds[p.ProductID] = p.ExpiresAt
+		}
+
+		switch {
+		case !p.RevokedAt.IsZero(), !e.allowedEnvironment(p.Environment), !e.allowedOwnership(p.OwnershipType, p.ProductID):
+			p.IsActive = false
+		case p.ProductType == storage.ProductTypeNonRenewing:
+			p.IsActive = now.Before(p.ExpiresAt)
+		default:
+			p.IsActive = true
+		}
+	}
+	return resolved
+}
+
+func (e *engine) SerialRefunder(refunds, purchases int) bool {
+	if e.policy.MaxRefunds > 0 && refunds > e.policy.MaxRefunds {
+		return true
+	}
+	if e.policy.MaxRefundRate <= 0 || refunds < 2 || purchases <= 0 {
+		return false
+	}
+	return float64(refunds)/float64(purchases) > e.policy.MaxRefundRate
+}
@@ -0,0 +1,214 @@
+package entitlement
+
+import (
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// TestEngine_IsActive проверяет вычисление активности по сохраненным фактам
+func TestEngine_IsActive(t *testing.T) {
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		policy entitlement.Policy
+		status storage.SubscriptionStatus
+		want   bool
+	}{
+		{
+			name:   "действующая подписка",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day)},
+			want:   true,
+		},
+		{
+			name:   "истекшая подписка",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(-time.Minute), IsActive: true},
+			want:   false,
+		},
+		{
+			name:   "без даты истечения",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{IsActive: true},
+			want:   false,
+		},
+		{
+			name:   "льготный период учитывается",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(-day), GracePeriodExpiresAt: now.Add(day)},
+			want:   true,
+		},
+		{
+			name:   "льготный период отключен",
+			policy: entitlement.Policy{},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(-day), GracePeriodExpiresAt: now.Add(day)},
+			want:   false,
+		},
+		{
+			name:   "повтор оплаты в пределах окна",
+			policy: entitlement.Policy{BillingRetryAccess: 3 * day},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(-2 * day), InBillingRetry: true},
+			want:   true,
+		},
+		{
+			name:   "повтор оплаты за пределами окна",
+			policy: entitlement.Policy{BillingRetryAccess: 3 * day},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(-4 * day), InBillingRetry: true},
+			want:   false,
+		},
+		{
+			name:   "повтор оплаты без разрешающей политики",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(-time.Hour), InBillingRetry: true},
+			want:   false,
+		},
+		{
+			name:   "отозванная подписка",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), RevokedAt: now.Add(-day)},
+			want:   false,
+		},
+		{
+			name:   "запрещенное окружение",
+			policy: entitlement.Policy{Environments: []string{"Production"}},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), Environment: "Sandbox"},
+			want:   false,
+		},
+		{
+			name:   "разрешенное окружение",
+			policy: entitlement.Policy{Environments: []string{"Production"}},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), Environment: "Production"},
+			want:   true,
+		},
+		{
+			name:   "неизвестное окружение не ограничивается",
+			policy: entitlement.Policy{Environments: []string{"Production"}},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day)},
+			want:   true,
+		},
+		{
+			name:   "семейный доступ по умолчанию",
+			policy: entitlement.DefaultPolicy(),
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), OwnershipType: storage.OwnershipFamilyShared},
+			want:   true,
+		},
+		{
+			name:   "семейный доступ отключен",
+			policy: entitlement.Policy{},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), OwnershipType: storage.OwnershipFamilyShared},
+			want:   false,
+		},
+		{
+			name:   "собственная покупка без семейного доступа",
+			policy: entitlement.Policy{},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), OwnershipType: "PURCHASED"},
+			want:   true,
+		},
+		{
+			name:   "семейный доступ для разрешенного продукта",
+			policy: entitlement.Policy{FamilySharing: true, FamilyProducts: []string{"family"}},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), ProductID: "family", OwnershipType: storage.OwnershipFamilyShared},
+			want:   true,
+		},
+		{
+			name:   "семейный доступ для другого продукта",
+			policy: entitlement.Policy{FamilySharing: true, FamilyProducts: []string{"family"}},
+			status: storage.SubscriptionStatus{ExpiresAt: now.Add(day), ProductID: "solo", OwnershipType: storage.OwnershipFamilyShared},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := entitlement.NewEngine(tt.policy)
+			if got := e.IsActive(&tt.status, now); got != tt.want {
+				t.Errorf("Ожидалось %v, получено %v", tt.want, got)
+			}
+
+			resolved := e.Resolve(&tt.status, now)
+			if resolved.IsActive != tt.want {
+				t.Errorf("Resolve: ожидалось %v, получено %v", tt.want, resolved.IsActive)
+			}
+			if resolved == &tt.status {
+				t.Error("Resolve должен возвращать копию")
+			}
+		})
+	}
+}
+
+// TestEngine_ResolvePurchases проверяет вычисление доступа по разовым покупкам
+func TestEngine_ResolvePurchases(t *testing.T) {
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	e := entitlement.NewEngine(entitlement.Policy{Environments: []string{"Production"}})
+
+	purchases := []storage.Purchase{
+		// Второй сезонный абонемент куплен до окончания первого и продлевает его
+		{TransactionID: "season-2", ProductID: "season", ProductType: storage.ProductTypeNonRenewing,
+			PurchasedAt: now.Add(-20 * day), ExpiresAt: now.Add(-20*day + 30*day)},
+		{TransactionID: "season-1", ProductID: "season", ProductType: storage.ProductTypeNonRenewing,
+			PurchasedAt: now.Add(-40 * day), ExpiresAt: now.Add(-40*day + 30*day)},
+		{TransactionID: "lifetime", ProductID: "lifetime", ProductType: storage.ProductTypeNonConsumable,
+			PurchasedAt: now.Add(-100 * day)},
+		{TransactionID: "refunded", ProductID: "pro", ProductType: storage.ProductTypeNonConsumable,
+			PurchasedAt: now.Add(-5 * day), RevokedAt: now.Add(-day)},
+		{TransactionID: "sandbox", ProductID: "pro", ProductType: storage.ProductTypeNonConsumable,
+			PurchasedAt: now.Add(-5 * day), Environment: "Sandbox"},
+	}
+
+	resolved := e.ResolvePurchases(purchases, now)
+	if len(resolved) != len(purchases) {
+		t.Fatalf("Ожидалось %d покупок, получено %d", len(purchases), len(resolved))
+	}
+	byID := make(map[string]storage.Purchase)
+	for _, p := range resolved {
+		byID[p.TransactionID] = p
+	}
+
+	if p := byID["season-1"]; p.IsActive || !p.ExpiresAt.Equal(now.Add(-10*day)) {
+		t.Errorf("Первый абонемент: %+v", p)
+	}
+	if p := byID["season-2"]; !p.IsActive || !p.ExpiresAt.Equal(now.Add(20*day)) {
+		t.Errorf("Второй абонемент должен начаться после первого: %+v", p)
+	}
+	if !byID["lifetime"].IsActive {
+		t.Error("Непотребляемая покупка должна быть активна бессрочно")
+	}
+	if byID["refunded"].IsActive {
+		t.Error("Возвращенная покупка не должна быть активна")
+	}
+	if byID["sandbox"].IsActive {
+		t.Error("Покупка из запрещенного окружения не должна быть активна")
+	}
+	if !purchases[0].ExpiresAt.Equal(now.Add(10 * day)) {
+		t.Error("ResolvePurchases не должен изменять исходный срез")
+	}
+}
+
+// TestEngine_SerialRefunder проверяет признаки злоупотребления возвратами
+func TestEngine_SerialRefunder(t *testing.T) {
+	tests := []struct {
+		name               string
+		policy             entitlement.Policy
+		refunds, purchases int
+		want               bool
+	}{
+		{"выключено", entitlement.DefaultPolicy(), 10, 10, false},
+		{"в пределах лимита", entitlement.Policy{MaxRefunds: 2}, 2, 10, false},
+		{"сверх лимита", entitlement.Policy{MaxRefunds: 2}, 3, 10, true},
+		{"доля в пределах", entitlement.Policy{MaxRefundRate: 0.5}, 2, 4, false},
+		{"доля сверх", entitlement.Policy{MaxRefundRate: 0.5}, 3, 4, true},
+		{"один возврат не считается по доле", entitlement.Policy{MaxRefundRate: 0.5}, 1, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entitlement.NewEngine(tt.policy).SerialRefunder(tt.refunds, tt.purchases); got != tt.want {
+				t.Errorf("SerialRefunder(%d, %d) = %v, ожидалось %v", tt.refunds, tt.purchases, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package expiry
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+// EventTypeExpired marks events recorded by the sweeper.
+const EventTypeExpired = "EXPIRED_BY_SWEEPER"
+
+type Options struct {
+	// BatchSize bounds the records read per query. Defaults to 100.
+	BatchSize int
+	// Now overrides the clock, for tests.
+	Now func() time.Time
+}
+
+// Sweeper deactivates subscriptions whose access, grace period included, has
+// ended without an EXPIRED notification. Several instances may sweep the same
+// storage: each record is flipped by exactly one of them.
+type Sweeper interface {
+	// Sweep deactivates every overdue record and returns how many it changed.
+	Sweep(ctx context.Context) (int, error)
+	// Run sweeps every interval until ctx is done.
+	Run(ctx context.Context, interval time.Duration)
+}
+
+type sweeper struct {
+	storage storage.Storage
+	events  storage.EventStore
+	logger  logger.Logger
+	opts    Options
+}
+
+// NewSweeper returns a Sweeper over st. ev may be nil when events are not
+// recorded.
+func NewSweeper(st storage.Storage, ev storage.EventStore, l logger.Logger, opts Options) Sweeper {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &sweeper{
+		storage: st,
+		events:  ev,
+		logger:  l,
+		opts:    opts,
+	}
+}
+
+func (s *sweeper) Sweep(ctx context.Context) (int, error) {
+	now := s.opts.Now().UTC()
+	swept := 0
+	for {
+		batch, err := s.storage.ListExpiredActive(ctx, now, s.opts.BatchSize)
+		if err != nil {
+			return swept, fmt.Errorf("list expired subscriptions: %w", err)
+		}
+
+		changed := 0
+		for _, status := range batch {
+			ok, err := s.storage.DeactivateSubscription(ctx, &status)
+			if err != nil {
+				return swept, fmt.Errorf("deactivate %s: %w", status.UserToken, err)
+			}
+			if !ok {
+				// Renewed or swept by another instance meanwhile.
+				continue
+			}
+			changed++
+			if err := s.record(ctx, status, now); err != nil {
+				return swept + changed, err
+			}
+		}
+		swept += changed
+
+		// A batch where nothing changed means the rest is contended by
+		// other instances; leave it to them instead of spinning.
+		if len(batch) < s.opts.BatchSize || changed == 0 {
+			return swept, nil
+		}
+	}
+}
+
+func (s *sweeper) record(ctx context.Context, status storage.SubscriptionStatus, now time.Time) error {
+	if s.events == nil {
+		return nil
+	}
+	// The ID is derived from the expiry so a record swept twice after
+	// being reactivated with the same date still yields one event.
+	event := &storage.SubscriptionEvent{
+		ID:                    "expiry:" + status.UserToken + ":" + strconv.FormatInt(status.AccessEndsAt().UnixMilli(), 10),
+		UserToken:             status.UserToken,
+		Source:                storage.EventSourceExpiry,
+		Type:                  EventTypeExpired,
+		OriginalTransactionID: status.OriginalTransactionID,
+		ProductID:             status.ProductID,
+		ExpiresAt:             status.ExpiresAt,
+		OccurredAt:            status.AccessEndsAt(),
+		RecordedAt:            now,
+	}
+	if err := s.events.AppendEvent(ctx, event); err != nil {
+		return fmt.Errorf("record expiry of %s: %w", status.UserToken, err)
+	}
+	return nil
+}
+
+func (s *sweeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		swept, err := s.Sweep(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			s.log("ERROR", fmt.Sprintf("failed to sweep expired subscriptions: %v", err))
+		case swept > 0:
+			s.log("INFO", fmt.Sprintf("deactivated %d expired subscriptions", swept))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *sweeper) log(level, msg string) {
+	s.logger.Log(logger.LogMessage{
+		Time:    time.Now(),
+		Level:   level,
+		Sender:  "expiry",
+		Message: msg,
+	})
+}
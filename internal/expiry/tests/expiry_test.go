@@ -0,0 +1,129 @@
+package expiry
+
+import (
+	"context"
+	"subscription-server/internal/expiry"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nopLogger отбрасывает все сообщения
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.LogMessage) {}
+func (nopLogger) Close()                {}
+
+// TestSweeper_DeactivatesExpired проверяет деактивацию просроченных подписок и запись события
+func TestSweeper_DeactivatesExpired(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	ev := storage.NewMemoryEventStore()
+
+	statuses := []*storage.SubscriptionStatus{
+		{UserToken: "expired", ProductID: "premium", ExpiresAt: now.Add(-time.Minute), IsActive: true},
+		{UserToken: "valid", ProductID: "premium", ExpiresAt: now.Add(time.Hour), IsActive: true},
+		{UserToken: "inactive", ProductID: "premium", ExpiresAt: now.Add(-time.Hour), IsActive: false},
+	}
+	for _, s := range statuses {
+		if err := st.SetSubscriptionStatus(ctx, s); err != nil {
+			t.Fatalf("Ошибка при сохранении статуса: %v", err)
+		}
+	}
+
+	s := expiry.NewSweeper(st, ev, nopLogger{}, expiry.Options{Now: func() time.Time { return now }})
+	swept, err := s.Sweep(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при очистке: %v", err)
+	}
+	if swept != 1 {
+		t.Errorf("Ожидалась 1 деактивированная подписка, получено %d", swept)
+	}
+
+	got, _ := st.GetSubscriptionStatus(ctx, "expired")
+	if got.IsActive {
+		t.Error("Просроченная подписка осталась активной")
+	}
+	got, _ = st.GetSubscriptionStatus(ctx, "valid")
+	if !got.IsActive {
+		t.Error("Действующая подписка была деактивирована")
+	}
+
+	events, err := ev.ListEvents(ctx, "expired")
+	if err != nil {
+		t.Fatalf("Ошибка при получении событий: %v", err)
+	}
+	if len(events) != 1 || events[0].Source != storage.EventSourceExpiry || events[0].Type != expiry.EventTypeExpired {
+		t.Errorf("Ожидалось событие истечения, получено %+v", events)
+	}
+
+	// Повторный проход ничего не меняет
+	swept, err = s.Sweep(ctx)
+	if err != nil || swept != 0 {
+		t.Errorf("Ожидался пустой повторный проход, получено %d, %v", swept, err)
+	}
+}
+
+// TestSweeper_ConcurrentInstances проверяет, что параллельные экземпляры деактивируют каждую запись один раз
+func TestSweeper_ConcurrentInstances(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	ev := storage.NewMemoryEventStore()
+
+	const users = 50
+	for i := 0; i < users; i++ {
+		status := &storage.SubscriptionStatus{
+			UserToken: "user-" + string(rune('A'+i)),
+			ExpiresAt: now.Add(-time.Duration(i+1) * time.Minute),
+			IsActive:  true,
+		}
+		if err := st.SetSubscriptionStatus(ctx, status); err != nil {
+			t.Fatalf("Ошибка при сохранении статуса: %v", err)
+		}
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := expiry.NewSweeper(st, ev, nopLogger{}, expiry.Options{
+				BatchSize: 7,
+				Now:       func() time.Time { return now },
+			})
+			swept, err := s.Sweep(ctx)
+			if err != nil {
+				t.Errorf("Ошибка при очистке: %v", err)
+			}
+			mu.Lock()
+			total += swept
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Экземпляры могут уступить друг другу записи; добиваем остаток одним проходом
+	rest, err := expiry.NewSweeper(st, ev, nopLogger{}, expiry.Options{Now: func() time.Time { return now }}).Sweep(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при очистке: %v", err)
+	}
+	if total+rest != users {
+		t.Errorf("Ожидалось %d деактиваций, получено %d", users, total+rest)
+	}
+
+	tokens, err := ev.ListEventUsers(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при получении пользователей: %v", err)
+	}
+	if len(tokens) != users {
+		t.Errorf("Ожидались события для %d пользователей, получено %d", users, len(tokens))
+	}
+}
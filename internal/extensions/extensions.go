@@ -0,0 +1,321 @@
+// Package extensions extends subscription renewal dates through the App Store
+// Server API, for a single subscriber or for every active subscriber of a
+// product, and keeps track of each request by its identifier.
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"subscription-server/internal/appstoreapi"
+	tools "subscription-server/internal/helpers"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+var (
+	ErrInvalidRequest = errors.New("invalid extension request")
+	ErrNoSubscription = errors.New("no subscription to extend")
+)
+
+// Operation names of the audited App Store Server API calls.
+const (
+	OperationExtend     = "extend_renewal_date"
+	OperationMassExtend = "mass_extend_renewal_date"
+)
+
+// Apple's limits on extensions.
+const (
+	maxDays      = 90
+	maxReason    = 3
+	maxRequestID = 128
+)
+
+// Request extends the subscription of one user.
+type Request struct {
+	UserToken string `json:"userToken"`
+	Days      int    `json:"extendByDays"`
+	// Reason is Apple's extendReasonCode: 0 undeclared, 1 customer
+	// satisfaction, 2 other, 3 service issue or outage.
+	Reason int `json:"extendReasonCode"`
+	// RequestID makes the request idempotent; a repeated ID returns the
+	// stored outcome. A UUID is generated when it is empty.
+	RequestID string `json:"requestId"`
+}
+
+// MassRequest extends the subscriptions of every active subscriber of
+// ProductID.
+type MassRequest struct {
+	ProductID string `json:"productId"`
+	// Environment is "Production" (the default) or "Sandbox".
+	Environment string `json:"environment"`
+	// Storefronts limits the extension to these countries, all by default.
+	Storefronts []string `json:"storefrontCountryCodes"`
+	Days        int      `json:"extendByDays"`
+	Reason      int      `json:"extendReasonCode"`
+	RequestID   string   `json:"requestId"`
+}
+
+type Options struct {
+	// Now and NewID override the clock and request identifiers, for tests.
+	Now   func() time.Time
+	NewID func() (string, error)
+}
+
+type Extender interface {
+	// Extend asks Apple to extend the user's subscription and stores the
+	// outcome. A request Apple rejects is stored as failed and returned
+	// along with the error.
+	Extend(ctx context.Context, req Request) (*storage.RenewalExtension, error)
+	// ExtendAll starts a mass extension. Apple completes it asynchronously
+	// and reports with a RENEWAL_EXTENSION notification.
+	ExtendAll(ctx context.Context, req MassRequest) (*storage.RenewalExtension, error)
+	// Get returns a stored request. A pending mass extension is first
+	// refreshed from Apple.
+	Get(ctx context.Context, requestID string) (*storage.RenewalExtension, error)
+	// List returns all stored requests, newest first.
+	List(ctx context.Context) ([]storage.RenewalExtension, error)
+}
+
+type extender struct {
+	client     appstoreapi.Client
+	storage    storage.Storage
+	extensions storage.ExtensionStore
+	audit      storage.APICallLog
+	opts       Options
+}
+
+func NewExtender(c appstoreapi.Client, st storage.Storage, ext storage.ExtensionStore, audit storage.APICallLog, opts Options) Extender {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.NewID == nil {
+		opts.NewID = tools.NewUUID
+	}
+	return &extender{
+		client:     c,
+		storage:    st,
+		extensions: ext,
+		audit:      audit,
+		opts:       opts,
+	}
+}
+
+func (e *extender) Extend(ctx context.Context, req Request) (*storage.RenewalExtension, error) {
+	if req.UserToken == "" {
+		return nil, fmt.Errorf("%w: userToken is required", ErrInvalidRequest)
+	}
+	if err := validate(req.Days, req.Reason, req.RequestID); err != nil {
+		return nil, err
+	}
+	if stored, err := e.stored(ctx, req.RequestID); stored != nil || err != nil {
+		return stored, err
+	}
+
+	status, err := e.storage.GetSubscriptionStatus(ctx, req.UserToken)
+	switch {
+	case errors.Is(err, storage.ErrSubscriptionNotFound):
+		return nil, ErrNoSubscription
+	case err != nil:
+		return nil, fmt.Errorf("get subscription status: %w", err)
+	case status == nil || status.OriginalTransactionID == "":
+		return nil, ErrNoSubscription
+	}
+
+	id, err := e.requestID(req.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	body := &appstoreapi.ExtendRenewalDateRequest{
+		ExtendByDays:      req.Days,
+		ExtendReasonCode:  req.Reason,
+		RequestIdentifier: id,
+	}
+	ext := &storage.RenewalExtension{
+		RequestID:             id,
+		UserToken:             req.UserToken,
+		OriginalTransactionID: status.OriginalTransactionID,
+		Environment:           status.Environment,
+		Days:                  req.Days,
+		Reason:                req.Reason,
+		RequestedAt:           e.opts.Now().UTC(),
+	}
+
+	resp, err := e.client.ExtendRenewalDate(ctx, status.Environment, status.OriginalTransactionID, body)
+	if auditErr := e.record(ctx, OperationExtend, ext, body, err); auditErr != nil {
+		return nil, auditErr
+	}
+	switch {
+	case err != nil:
+		ext.Status, ext.Error = storage.ExtensionFailed, err.Error()
+		err = fmt.Errorf("extend renewal date: %w", err)
+	case !resp.Success:
+		ext.Status, ext.Error = storage.ExtensionFailed, "apple did not extend the renewal date"
+	default:
+		ext.Status = storage.ExtensionSucceeded
+		ext.EffectiveDate = time.UnixMilli(resp.EffectiveDate).UTC()
+	}
+	ext.CompletedAt = e.opts.Now().UTC()
+
+	if saveErr := e.extensions.SaveRenewalExtension(ctx, ext); saveErr != nil {
+		return nil, fmt.Errorf("save renewal extension: %w", saveErr)
+	}
+	return ext, err
+}
+
+func (e *extender) ExtendAll(ctx context.Context, req MassRequest) (*storage.RenewalExtension, error) {
+	if req.ProductID == "" {
+		return nil, fmt.Errorf("%w: productId is required", ErrInvalidRequest)
+	}
+	switch req.Environment {
+	case "":
+		req.Environment = "Production"
+	case "Production", "Sandbox":
+	default:
+		return nil, fmt.Errorf("%w: unknown environment %q", ErrInvalidRequest, req.Environment)
+	}
+	if err := validate(req.Days, req.Reason, req.RequestID); err != nil {
+		return nil, err
+	}
+	if stored, err := e.stored(ctx, req.RequestID); stored != nil || err != nil {
+		return stored, err
+	}
+
+	id, err := e.requestID(req.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	body := &appstoreapi.MassExtendRenewalDateRequest{
+		ExtendByDays:           req.Days,
+		ExtendReasonCode:       req.Reason,
+		RequestIdentifier:      id,
+		StorefrontCountryCodes: req.Storefronts,
+		ProductID:              req.ProductID,
+	}
+	ext := &storage.RenewalExtension{
+		RequestID:   id,
+		ProductID:   req.ProductID,
+		Environment: req.Environment,
+		Days:        req.Days,
+		Reason:      req.Reason,
+		Status:      storage.ExtensionPending,
+		RequestedAt: e.opts.Now().UTC(),
+	}
+
+	err = e.client.MassExtendRenewalDate(ctx, req.Environment, body)
+	if auditErr := e.record(ctx, OperationMassExtend, ext, body, err); auditErr != nil {
+		return nil, auditErr
+	}
+	if err != nil {
+		ext.Status, ext.Error = storage.ExtensionFailed, err.Error()
+		ext.CompletedAt = e.opts.Now().UTC()
+		err = fmt.Errorf("mass extend renewal date: %w", err)
+	}
+
+	if saveErr := e.extensions.SaveRenewalExtension(ctx, ext); saveErr != nil {
+		return nil, fmt.Errorf("save renewal extension: %w", saveErr)
+	}
+	return ext, err
+}
+
+func (e *extender) Get(ctx context.Context, requestID string) (*storage.RenewalExtension, error) {
+	ext, err := e.extensions.GetRenewalExtension(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if ext.Status != storage.ExtensionPending {
+		return ext, nil
+	}
+
+	status, err := e.client.MassExtendRenewalDateStatus(ctx, ext.Environment, ext.ProductID, ext.RequestID)
+	if err != nil {
+		return nil, fmt.Errorf("get mass extension status: %w", err)
+	}
+	if !status.Complete {
+		return ext, nil
+	}
+	complete(ext, status.SucceededCount, status.FailedCount, time.UnixMilli(status.CompleteDate).UTC())
+	if err := e.extensions.SaveRenewalExtension(ctx, ext); err != nil {
+		return nil, fmt.Errorf("save renewal extension: %w", err)
+	}
+	return ext, nil
+}
+
+func (e *extender) List(ctx context.Context) ([]storage.RenewalExtension, error) {
+	return e.extensions.ListRenewalExtensions(ctx)
+}
+
+// complete records the outcome of a mass extension, however it became known.
+func complete(ext *storage.RenewalExtension, succeeded, failed int64, at time.Time) {
+	ext.Status = storage.ExtensionComplete
+	ext.SucceededCount = succeeded
+	ext.FailedCount = failed
+	ext.CompletedAt = at
+}
+
+func validate(days, reason int, requestID string) error {
+	switch {
+	case days < 1 || days > maxDays:
+		return fmt.Errorf("%w: extendByDays must be between 1 and %d", ErrInvalidRequest, maxDays)
+	case reason < 0 || reason > maxReason:
+		return fmt.Errorf("%w: extendReasonCode must be between 0 and %d", ErrInvalidRequest, maxReason)
+	case len(requestID) > maxRequestID:
+		return fmt.Errorf("%w: requestId is longer than %d characters", ErrInvalidRequest, maxRequestID)
+	}
+	return nil
+}
+
+// stored returns the request already made with requestID, if any.
+func (e *extender) stored(ctx context.Context, requestID string) (*storage.RenewalExtension, error) {
+	if requestID == "" {
+		return nil, nil
+	}
+	ext, err := e.extensions.GetRenewalExtension(ctx, requestID)
+	switch {
+	case errors.Is(err, storage.ErrRenewalExtensionNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("get renewal extension: %w", err)
+	}
+	return ext, nil
+}
+
+func (e *extender) requestID(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	id, err := e.opts.NewID()
+	if err != nil {
+		return "", fmt.Errorf("generate request identifier: %w", err)
+	}
+	return id, nil
+}
+
+// record audits the call made for ext. The request identifier is unique per
+// request, and requests are never retried, so it identifies the call too.
+func (e *extender) record(ctx context.Context, operation string, ext *storage.RenewalExtension, body any, err error) error {
+	payload, _ := json.Marshal(body)
+	call := &storage.APICall{
+		ID:            ext.RequestID,
+		Operation:     operation,
+		UserToken:     ext.UserToken,
+		TransactionID: ext.OriginalTransactionID,
+		Environment:   ext.Environment,
+		Request:       string(payload),
+		StatusCode:    200,
+		Attempt:       1,
+		SentAt:        ext.RequestedAt,
+	}
+	var apiErr *appstoreapi.Error
+	switch {
+	case errors.As(err, &apiErr):
+		call.StatusCode, call.Error = apiErr.StatusCode, apiErr.Error()
+	case err != nil:
+		call.StatusCode, call.Error = 0, err.Error()
+	}
+	if err := e.audit.RecordAPICall(ctx, call); err != nil {
+		return fmt.Errorf("record %s call: %w", operation, err)
+	}
+	return nil
+}
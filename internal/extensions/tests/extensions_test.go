@@ -0,0 +1,164 @@
+package extensions
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"subscription-server/internal/appstoreapi"
+	"subscription-server/internal/extensions"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// fixture собирает сервис продлений с одной сохраненной подпиской user1
+func fixture(t *testing.T, now time.Time) (extensions.Extender, *appstoreapi.LocalClient, storage.ExtensionStore, storage.APICallLog) {
+	t.Helper()
+	st := storage.NewMemoryStorage()
+	err := st.SetSubscriptionStatus(context.Background(), &storage.SubscriptionStatus{
+		UserToken:             "user1",
+		ProductID:             "com.test.monthly",
+		OriginalTransactionID: "5000",
+		Environment:           "Sandbox",
+		ExpiresAt:             now.Add(24 * time.Hour),
+		IsActive:              true,
+	})
+	if err != nil {
+		t.Fatalf("Ошибка сохранения статуса: %v", err)
+	}
+
+	client := appstoreapi.NewLocalClient()
+	client.Now = func() time.Time { return now }
+	store := storage.NewMemoryExtensionStore()
+	audit := storage.NewMemoryAPICallLog()
+	ids := 0
+	extender := extensions.NewExtender(client, st, store, audit, extensions.Options{
+		Now: func() time.Time { return now },
+		NewID: func() (string, error) {
+			ids++
+			return "generated-" + strconv.Itoa(ids), nil
+		},
+	})
+	return extender, client, store, audit
+}
+
+// TestExtender_Extend проверяет продление подписки одного пользователя
+func TestExtender_Extend(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	extender, client, store, audit := fixture(t, now)
+
+	ext, err := extender.Extend(ctx, extensions.Request{UserToken: "user1", Days: 7, Reason: 3, RequestID: "outage-1"})
+	if err != nil {
+		t.Fatalf("Ошибка продления: %v", err)
+	}
+	if ext.Status != storage.ExtensionSucceeded || ext.OriginalTransactionID != "5000" || !ext.EffectiveDate.Equal(now.AddDate(0, 0, 7)) {
+		t.Errorf("Неправильный результат: %+v", ext)
+	}
+
+	calls := client.Calls()
+	if len(calls) != 1 || calls[0].TransactionID != "5000" || calls[0].Environment != "Sandbox" {
+		t.Fatalf("Неправильные вызовы API: %+v", calls)
+	}
+	body := calls[0].Body.(*appstoreapi.ExtendRenewalDateRequest)
+	if body.ExtendByDays != 7 || body.ExtendReasonCode != 3 || body.RequestIdentifier != "outage-1" {
+		t.Errorf("Неправильное тело запроса: %+v", body)
+	}
+	if stored, err := store.GetRenewalExtension(ctx, "outage-1"); err != nil || stored.Status != storage.ExtensionSucceeded {
+		t.Errorf("Запрос не сохранен: %+v (%v)", stored, err)
+	}
+	if logged, _ := audit.ListAPICalls(ctx, "user1"); len(logged) != 1 || logged[0].Operation != extensions.OperationExtend {
+		t.Errorf("Запрос не попал в аудит: %+v", logged)
+	}
+
+	// Повтор с тем же идентификатором не отправляется в Apple
+	again, err := extender.Extend(ctx, extensions.Request{UserToken: "user1", Days: 7, Reason: 3, RequestID: "outage-1"})
+	if err != nil || again.RequestID != "outage-1" || len(client.Calls()) != 1 {
+		t.Errorf("Повторный запрос должен вернуть сохраненный результат: %+v (%v), вызовов %d", again, err, len(client.Calls()))
+	}
+
+	// Без идентификатора он создается
+	generated, err := extender.Extend(ctx, extensions.Request{UserToken: "user1", Days: 1})
+	if err != nil || generated.RequestID != "generated-1" {
+		t.Errorf("Ожидался сгенерированный идентификатор: %+v (%v)", generated, err)
+	}
+}
+
+// TestExtender_ExtendErrors проверяет ошибки продления
+func TestExtender_ExtendErrors(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	extender, client, store, _ := fixture(t, now)
+
+	for _, req := range []extensions.Request{
+		{Days: 7},
+		{UserToken: "user1", Days: 0},
+		{UserToken: "user1", Days: 91},
+		{UserToken: "user1", Days: 7, Reason: 4},
+	} {
+		if _, err := extender.Extend(ctx, req); !errors.Is(err, extensions.ErrInvalidRequest) {
+			t.Errorf("Запрос %+v: ожидалась ошибка ErrInvalidRequest, получено %v", req, err)
+		}
+	}
+	if _, err := extender.Extend(ctx, extensions.Request{UserToken: "nobody", Days: 7}); !errors.Is(err, extensions.ErrNoSubscription) {
+		t.Errorf("Ожидалась ошибка ErrNoSubscription, получено %v", err)
+	}
+
+	// Отказ Apple сохраняется как неудачный запрос
+	client.FailNext(&appstoreapi.Error{StatusCode: 400, Code: 4040009, Message: "Subscription extension ineligible."})
+	ext, err := extender.Extend(ctx, extensions.Request{UserToken: "user1", Days: 7, RequestID: "rejected"})
+	var apiErr *appstoreapi.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Ожидалась ошибка API, получено %v", err)
+	}
+	if ext == nil || ext.Status != storage.ExtensionFailed || ext.Error == "" {
+		t.Errorf("Ожидался неудачный запрос: %+v", ext)
+	}
+	if stored, _ := store.GetRenewalExtension(ctx, "rejected"); stored == nil || stored.Status != storage.ExtensionFailed {
+		t.Errorf("Неудачный запрос не сохранен: %+v", stored)
+	}
+}
+
+// TestExtender_ExtendAll проверяет массовое продление и обновление его состояния
+func TestExtender_ExtendAll(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	extender, client, _, _ := fixture(t, now)
+
+	ext, err := extender.ExtendAll(ctx, extensions.MassRequest{ProductID: "com.test.monthly", Storefronts: []string{"USA"}, Days: 3, Reason: 3})
+	if err != nil {
+		t.Fatalf("Ошибка массового продления: %v", err)
+	}
+	if ext.Status != storage.ExtensionPending || ext.Environment != "Production" || ext.RequestID != "generated-1" {
+		t.Errorf("Неправильный результат: %+v", ext)
+	}
+	body := client.Calls()[0].Body.(*appstoreapi.MassExtendRenewalDateRequest)
+	if body.ProductID != "com.test.monthly" || len(body.StorefrontCountryCodes) != 1 || body.RequestIdentifier != "generated-1" {
+		t.Errorf("Неправильное тело запроса: %+v", body)
+	}
+
+	// Пока Apple не закончила, запрос остается в ожидании
+	if got, err := extender.Get(ctx, ext.RequestID); err != nil || got.Status != storage.ExtensionPending {
+		t.Errorf("Ожидался запрос в ожидании: %+v (%v)", got, err)
+	}
+
+	client.MassExtensionDone(ext.RequestID, 120, 3)
+	got, err := extender.Get(ctx, ext.RequestID)
+	if err != nil || got.Status != storage.ExtensionComplete || got.SucceededCount != 120 || got.FailedCount != 3 || !got.CompletedAt.Equal(now) {
+		t.Errorf("Ожидался завершенный запрос: %+v (%v)", got, err)
+	}
+
+	// Завершенный запрос больше не запрашивается у Apple
+	calls := len(client.Calls())
+	extender.Get(ctx, ext.RequestID)
+	if len(client.Calls()) != calls {
+		t.Errorf("Завершенный запрос не должен обновляться")
+	}
+
+	if _, err := extender.ExtendAll(ctx, extensions.MassRequest{ProductID: "com.test.monthly", Environment: "Staging", Days: 3}); !errors.Is(err, extensions.ErrInvalidRequest) {
+		t.Errorf("Ожидалась ошибка ErrInvalidRequest, получено %v", err)
+	}
+	if _, err := extender.Get(ctx, "unknown"); !errors.Is(err, storage.ErrRenewalExtensionNotFound) {
+		t.Errorf("Ожидалась ошибка ErrRenewalExtensionNotFound, получено %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"subscription-server/internal/archive"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"sync"
+	"time"
+)
+
+// ErrBackpressure is returned by Enqueue when the worker for the partition
+// already has a full backlog. Callers should ask the sender to retry later.
+var ErrBackpressure = errors.New("ingest queue is full")
+
+type Options struct {
+	// Workers is the number of notifications processed concurrently.
+	Workers int
+	// QueueSize bounds the backlog of each worker.
+	QueueSize int
+	// Lease is how long an instance keeps the notifications it accepted or
+	// claimed before other instances may claim them. It must cover draining
+	// a full backlog, or a notification may be processed twice.
+	Lease time.Duration
+}
+
+// Ingestor accepts notifications into a durable queue and processes them in
+// the background. Notifications with the same partition key are processed
+// one at a time in arrival order.
+type Ingestor interface {
+	// Register sets the processor for notifications of source.
+	Register(source string, fn deadletter.ProcessFunc)
+	// Start starts the workers, claims notifications no instance holds a
+	// lease on, such as those left over from a previous run, and keeps
+	// claiming them periodically. Everything stops when ctx is canceled.
+	Start(ctx context.Context) error
+	Enqueue(ctx context.Context, source, partitionKey string, payload []byte) error
+	// Wait blocks until the workers have stopped.
+	Wait()
+}
+
+type shard struct {
+	mu    sync.Mutex
+	items chan storage.QueuedNotification
+}
+
+type ingestor struct {
+	queue  storage.NotificationQueue
+	dlq    deadletter.Queue
+	logger logger.Logger
+	shards []*shard
+	lease  time.Duration
+	wg     sync.WaitGroup
+
+	// inflight holds the notifications this instance queued and has not
+	// acknowledged yet, so reclaiming renews their lease instead of
+	// queueing them twice.
+	inflightMu sync.Mutex
+	inflight   map[int64]struct{}
+
+	mu         sync.RWMutex
+	processors map[string]deadletter.ProcessFunc
+}
+
+// NewIngestor creates an ingestor backed by q. Notifications that fail
+// processing are moved to dlq.
+func NewIngestor(q storage.NotificationQueue, dlq deadletter.Queue, l logger.Logger, opts Options) Ingestor {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = 5 * time.Minute
+	}
+
+	shards := make([]*shard, opts.Workers)
+	for i := range shards {
+		shards[i] = &shard{items: make(chan storage.QueuedNotification, opts.QueueSize)}
+	}
+	return &ingestor{
+		queue:      q,
+		dlq:        dlq,
+		logger:     l,
+		shards:     shards,
+		lease:      opts.Lease,
+		inflight:   make(map[int64]struct{}),
+		processors: make(map[string]deadletter.ProcessFunc),
+	}
+}
+
+func (in *ingestor) Register(source string, fn deadletter.ProcessFunc) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.processors[source] = fn
+}
+
+func (in *ingestor) Start(ctx context.Context) error {
+	for _, sh := range in.shards {
+		in.wg.Add(1)
+		go in.work(ctx, sh)
+	}
+
+	if err := in.claim(ctx); err != nil {
+		return err
+	}
+	in.wg.Add(1)
+	go in.reclaim(ctx)
+	return nil
+}
+
+// reclaim claims notifications whose lease ran out, e.g. because the
+// instance that held them stopped.
+func (in *ingestor) reclaim(ctx context.Context) {
+	defer in.wg.Done()
+	ticker := time.NewTicker(in.lease)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := in.claim(ctx); err != nil && ctx.Err() == nil {
+				in.log("ERROR", fmt.Sprintf("claim notifications: %v", err))
+			}
+		}
+	}
+}
+
+// claim takes over every notification without a lease in batches the size
+// of the worker backlogs. A notification still queued here whose lease ran
+// out gets a new lease but is not queued again.
+//
+// claim never waits for a backlog to drain, since that would stall Enqueue
+// on the shard lock. A notification whose shard is full, and every later one
+// for that shard, keeps its lease and is claimed again once it runs out.
+func (in *ingestor) claim(ctx context.Context) error {
+	batch := len(in.shards) * cap(in.shards[0].items)
+	claimed, deferred := 0, 0
+	for {
+		now := time.Now().UTC()
+		list, err := in.queue.ClaimNotifications(ctx, now, now.Add(in.lease), batch)
+		if err != nil {
+			return fmt.Errorf("claim notifications: %w", err)
+		}
+		full := make(map[*shard]bool)
+		for _, n := range list {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !in.track(n.Seq) {
+				continue
+			}
+			sh := in.shardFor(n.PartitionKey)
+			if !full[sh] && in.offer(sh, n) {
+				claimed++
+				continue
+			}
+			full[sh] = true
+			in.untrack(n.Seq)
+			deferred++
+		}
+		if len(list) < batch || len(full) > 0 {
+			break
+		}
+	}
+	if deferred > 0 {
+		in.log("INFO", fmt.Sprintf("backlog full, deferred %d pending notifications until their lease ends", deferred))
+	}
+	if claimed > 0 {
+		in.log("INFO", fmt.Sprintf("claimed %d pending notifications", claimed))
+	}
+	return nil
+}
+
+// offer queues n on sh unless its backlog is full.
+func (in *ingestor) offer(sh *shard, n storage.QueuedNotification) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	select {
+	case sh.items <- n:
+		return true
+	default:
+		return false
+	}
+}
+
+// track records seq as queued here and reports whether it was not already.
+func (in *ingestor) track(seq int64) bool {
+	in.inflightMu.Lock()
+	defer in.inflightMu.Unlock()
+	if _, ok := in.inflight[seq]; ok {
+		return false
+	}
+	in.inflight[seq] = struct{}{}
+	return true
+}
+
+func (in *ingestor) untrack(seq int64) {
+	in.inflightMu.Lock()
+	defer in.inflightMu.Unlock()
+	delete(in.inflight, seq)
+}
+
+func (in *ingestor) Enqueue(ctx context.Context, source, partitionKey string, payload []byte) error {
+	sh := in.shardFor(partitionKey)
+
+	// Holding the shard lock between the capacity check and the send keeps
+	// the send from blocking and preserves arrival order within the shard.
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if len(sh.items) == cap(sh.items) {
+		return ErrBackpressure
+	}
+
+	n := storage.QueuedNotification{
+		Source:       source,
+		PartitionKey: partitionKey,
+		Payload:      string(payload),
+		ArchiveID:    archive.RequestID(ctx),
+		EnqueuedAt:   time.Now().UTC(),
+	}
+	n.LeaseUntil = n.EnqueuedAt.Add(in.lease)
+	if err := in.queue.EnqueueNotification(ctx, &n); err != nil {
+		return err
+	}
+	in.track(n.Seq)
+	sh.items <- n
+	return nil
+}
+
+func (in *ingestor) Wait() {
+	in.wg.Wait()
+}
+
+func (in *ingestor) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return in.shards[h.Sum32()%uint32(len(in.shards))]
+}
+
+func (in *ingestor) work(ctx context.Context, sh *shard) {
+	defer in.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-sh.items:
+			in.process(ctx, n)
+		}
+	}
+}
+
+// process runs n to completion even if ctx is canceled meanwhile, so a
+// notification is never left half-applied. Anything still queued on shutdown
+// stays in the durable queue and is claimed once its lease ends.
+func (in *ingestor) process(ctx context.Context, n storage.QueuedNotification) {
+	ctx = archive.WithRequestID(context.WithoutCancel(ctx), n.ArchiveID)
+
+	in.mu.RLock()
+	fn, ok := in.processors[n.Source]
+	in.mu.RUnlock()
+
+	var err error
+	if ok {
+		err = fn(ctx, []byte(n.Payload))
+	} else {
+		err = fmt.Errorf("no processor registered for %q", n.Source)
+	}
+	if err != nil && in.dlq != nil {
+		if dlqErr := in.dlq.Record(ctx, n.Source, []byte(n.Payload), err); dlqErr != nil {
+			// Leave it in the queue so it is claimed again when the
+			// lease ends.
+			in.untrack(n.Seq)
+			in.log("ERROR", fmt.Sprintf("notification %d failed: %v (dead-letter failed: %v)", n.Seq, err, dlqErr))
+			return
+		}
+	}
+	if err != nil {
+		in.log("ERROR", fmt.Sprintf("notification %d failed: %v", n.Seq, err))
+	}
+
+	if err := in.queue.AckNotification(ctx, n.Seq); err != nil {
+		in.log("ERROR", fmt.Sprintf("ack notification %d: %v", n.Seq, err))
+	}
+	in.untrack(n.Seq)
+}
+
+func (in *ingestor) log(level, msg string) {
+	in.logger.Log(logger.LogMessage{
+		Time:    time.Now(),
+		Level:   level,
+		Sender:  "ingest",
+		Message: msg,
+	})
+}
@@ -0,0 +1,315 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/ingest"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nopLogger отбрасывает все сообщения
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.LogMessage) {}
+func (nopLogger) Close()                {}
+
+// waitEmpty ждет, пока в долговременной очереди не останется уведомлений
+func waitEmpty(t *testing.T, q storage.NotificationQueue) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pending, err := q.PendingNotifications(context.Background())
+		if err != nil {
+			t.Fatalf("Ошибка при чтении очереди: %v", err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Очередь не опустела за отведенное время")
+}
+
+// TestIngestor_PerUserOrdering проверяет, что уведомления одного пользователя обрабатываются по порядку
+func TestIngestor_PerUserOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := storage.NewMemoryNotificationQueue()
+	in := ingest.NewIngestor(q, nil, nopLogger{}, ingest.Options{Workers: 4, QueueSize: 100})
+
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	in.Register("apple_server", func(ctx context.Context, p []byte) error {
+		var user, n string
+		fmt.Sscanf(string(p), "%s %s", &user, &n)
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		seen[user] = append(seen[user], n)
+		mu.Unlock()
+		return nil
+	})
+	if err := in.Start(ctx); err != nil {
+		t.Fatalf("Ошибка запуска: %v", err)
+	}
+
+	users := []string{"alice", "bob", "carol"}
+	for i := 0; i < 20; i++ {
+		for _, u := range users {
+			if err := in.Enqueue(ctx, "apple_server", u, []byte(fmt.Sprintf("%s %02d", u, i))); err != nil {
+				t.Fatalf("Ошибка постановки в очередь: %v", err)
+			}
+		}
+	}
+	waitEmpty(t, q)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, u := range users {
+		if len(seen[u]) != 20 {
+			t.Fatalf("Пользователь %s: ожидалось 20 уведомлений, получено %d", u, len(seen[u]))
+		}
+		for i, n := range seen[u] {
+			if n != fmt.Sprintf("%02d", i) {
+				t.Fatalf("Пользователь %s: нарушен порядок %v", u, seen[u])
+			}
+		}
+	}
+}
+
+// TestIngestor_Backpressure проверяет отказ при переполненной очереди
+func TestIngestor_Backpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := storage.NewMemoryNotificationQueue()
+	in := ingest.NewIngestor(q, nil, nopLogger{}, ingest.Options{Workers: 1, QueueSize: 2})
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	in.Register("apple_server", func(ctx context.Context, p []byte) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	})
+	if err := in.Start(ctx); err != nil {
+		t.Fatalf("Ошибка запуска: %v", err)
+	}
+
+	// Первое уведомление занимает обработчик, следующие два заполняют очередь
+	if err := in.Enqueue(ctx, "apple_server", "u", []byte("1")); err != nil {
+		t.Fatalf("Ошибка постановки в очередь: %v", err)
+	}
+	<-started
+	for _, p := range []string{"2", "3"} {
+		if err := in.Enqueue(ctx, "apple_server", "u", []byte(p)); err != nil {
+			t.Fatalf("Ошибка постановки в очередь: %v", err)
+		}
+	}
+	if err := in.Enqueue(ctx, "apple_server", "u", []byte("4")); !errors.Is(err, ingest.ErrBackpressure) {
+		t.Fatalf("Ожидалась ошибка ErrBackpressure, получено %v", err)
+	}
+
+	// Отклоненное уведомление не должно попасть в долговременную очередь
+	pending, _ := q.PendingNotifications(ctx)
+	if len(pending) != 3 {
+		t.Errorf("Ожидалось 3 уведомления в очереди, получено %d", len(pending))
+	}
+
+	close(release)
+	waitEmpty(t, q)
+}
+
+// TestIngestor_BackpressureWhileClaiming проверяет, что повторный захват не блокирует прием при полной очереди
+func TestIngestor_BackpressureWhileClaiming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := storage.NewMemoryNotificationQueue()
+	in := ingest.NewIngestor(q, nil, nopLogger{}, ingest.Options{Workers: 1, QueueSize: 1, Lease: 20 * time.Millisecond})
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var mu sync.Mutex
+	var got []string
+	in.Register("apple_server", func(ctx context.Context, p []byte) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		got = append(got, string(p))
+		mu.Unlock()
+		return nil
+	})
+	if err := in.Start(ctx); err != nil {
+		t.Fatalf("Ошибка запуска: %v", err)
+	}
+
+	// Обработчик занят, очередь заполнена
+	if err := in.Enqueue(ctx, "apple_server", "u", []byte("1")); err != nil {
+		t.Fatalf("Ошибка постановки в очередь: %v", err)
+	}
+	<-started
+	if err := in.Enqueue(ctx, "apple_server", "u", []byte("2")); err != nil {
+		t.Fatalf("Ошибка постановки в очередь: %v", err)
+	}
+
+	// Уведомление без аренды будет захвачено периодическим проходом
+	if err := q.EnqueueNotification(ctx, &storage.QueuedNotification{Source: "apple_server", PartitionKey: "u", Payload: "3", EnqueuedAt: time.Now()}); err != nil {
+		t.Fatalf("Ошибка подготовки очереди: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- in.Enqueue(ctx, "apple_server", "u", []byte("4")) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ingest.ErrBackpressure) {
+			t.Fatalf("Ожидалась ошибка ErrBackpressure, получено %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue заблокирован захватом уведомлений")
+	}
+
+	// Отложенное уведомление обрабатывается после освобождения очереди
+	close(release)
+	waitEmpty(t, q)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 3 {
+		t.Errorf("Ожидалось 3 обработанных уведомления, получено %v", got)
+	}
+}
+
+// TestIngestor_RecoversPending проверяет обработку уведомлений, оставшихся с прошлого запуска
+func TestIngestor_RecoversPending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := storage.NewMemoryNotificationQueue()
+	for _, p := range []string{"a", "b"} {
+		if err := q.EnqueueNotification(ctx, &storage.QueuedNotification{Source: "apple_server", PartitionKey: "u", Payload: p, EnqueuedAt: time.Now()}); err != nil {
+			t.Fatalf("Ошибка подготовки очереди: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var got []string
+	in := ingest.NewIngestor(q, nil, nopLogger{}, ingest.Options{Workers: 2})
+	in.Register("apple_server", func(ctx context.Context, p []byte) error {
+		mu.Lock()
+		got = append(got, string(p))
+		mu.Unlock()
+		return nil
+	})
+	if err := in.Start(ctx); err != nil {
+		t.Fatalf("Ошибка запуска: %v", err)
+	}
+	waitEmpty(t, q)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Ожидалось [a b], получено %v", got)
+	}
+}
+
+// TestIngestor_FailureGoesToDeadLetters проверяет перенос упавших уведомлений в очередь ошибок
+func TestIngestor_FailureGoesToDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := storage.NewMemoryNotificationQueue()
+	dlq := deadletter.NewQueue(storage.NewMemoryDeadLetterStore(), nopLogger{}, deadletter.Options{})
+	in := ingest.NewIngestor(q, dlq, nopLogger{}, ingest.Options{})
+	in.Register("apple_server", func(ctx context.Context, p []byte) error {
+		return errors.New("storage down")
+	})
+	if err := in.Start(ctx); err != nil {
+		t.Fatalf("Ошибка запуска: %v", err)
+	}
+	if err := in.Enqueue(ctx, "apple_server", "u", []byte("payload")); err != nil {
+		t.Fatalf("Ошибка постановки в очередь: %v", err)
+	}
+	waitEmpty(t, q)
+
+	list, err := dlq.List(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка при получении списка: %v", err)
+	}
+	if len(list) != 1 || list[0].Payload != "payload" || list[0].Error != "storage down" {
+		t.Errorf("Ожидалась 1 запись в очереди ошибок, получено %+v", list)
+	}
+
+	cancel()
+	in.Wait()
+}
+
+// TestIngestor_ClaimsWithLease проверяет, что экземпляры не обрабатывают одно уведомление дважды
+func TestIngestor_ClaimsWithLease(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := storage.NewMemoryNotificationQueue()
+	now := time.Now()
+	// Первое уведомление обрабатывается другим экземпляром, второе осталось с прошлого запуска
+	for _, n := range []storage.QueuedNotification{
+		{Source: "apple_server", PartitionKey: "u1", Payload: "held", EnqueuedAt: now, LeaseUntil: now.Add(200 * time.Millisecond)},
+		{Source: "apple_server", PartitionKey: "u2", Payload: "free", EnqueuedAt: now},
+	} {
+		if err := q.EnqueueNotification(ctx, &n); err != nil {
+			t.Fatalf("Ошибка подготовки очереди: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	var instances []ingest.Ingestor
+	for i := 0; i < 2; i++ {
+		in := ingest.NewIngestor(q, nil, nopLogger{}, ingest.Options{Workers: 2, Lease: 50 * time.Millisecond})
+		in.Register("apple_server", func(ctx context.Context, p []byte) error {
+			mu.Lock()
+			seen[string(p)]++
+			mu.Unlock()
+			return nil
+		})
+		if err := in.Start(ctx); err != nil {
+			t.Fatalf("Ошибка запуска: %v", err)
+		}
+		instances = append(instances, in)
+	}
+
+	// Пока аренда не истекла, уведомление не трогают
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if seen["held"] != 0 || seen["free"] != 1 {
+		t.Errorf("До окончания аренды ожидалось {free:1}, получено %v", seen)
+	}
+	mu.Unlock()
+
+	waitEmpty(t, q)
+	// Даем второму экземпляру шанс повторно забрать уже обработанное
+	time.Sleep(150 * time.Millisecond)
+	mu.Lock()
+	if seen["held"] != 1 || seen["free"] != 1 {
+		t.Errorf("Каждое уведомление должно обрабатываться один раз, получено %v", seen)
+	}
+	mu.Unlock()
+
+	cancel()
+	for _, in := range instances {
+		in.Wait()
+	}
+}
@@ -0,0 +1,498 @@
+// Package offers signs App Store promotional offers for users the configured
+// eligibility rules allow.
+package offers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"subscription-server/internal/entitlement"
+	tools "subscription-server/internal/helpers"
+	"subscription-server/internal/refunds"
+	"subscription-server/internal/signing"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+var (
+	ErrInvalidRequest = errors.New("invalid offer request")
+	ErrUnknownBundle  = errors.New("unknown bundle")
+	ErrNotEligible    = errors.New("user is not eligible for the offer")
+	// ErrNoIssuer means StoreKit 2 tokens were requested without an issuer
+	// ID configured.
+	ErrNoIssuer = errors.New("no App Store Connect issuer configured")
+	// ErrNoCustomers means offers were requested without a way to verify
+	// signed transactions.
+	ErrNoCustomers = errors.New("no transaction verifier configured")
+)
+
+// Eligibility rules. Apple only honours promotional offers for customers who
+// have subscribed before, so every rule requires a stored subscription.
+const (
+	// RuleAny admits every current or former subscriber. Offers without a
+	// rule use it.
+	RuleAny = "any"
+	// RuleLapsed admits subscribers whose access has ended, for win-back
+	// offers.
+	RuleLapsed = "lapsed"
+	// RuleActive admits subscribers with access, for retention offers.
+	RuleActive = "active"
+)
+
+// separator joins the fields of the signed payload, as StoreKit requires.
+const separator = "\u2063"
+
+type Request struct {
+	// BundleID may be omitted when a single bundle is configured.
+	BundleID  string `json:"bundleId"`
+	ProductID string `json:"productId"`
+	OfferID   string `json:"offerId"`
+	// UserToken is the appAccountToken the app passes to StoreKit with the
+	// offer.
+	UserToken string `json:"userToken"`
+	// TransactionID picks which ID of the verified transaction a StoreKit 2
+	// token is tied to: the transaction, original transaction or app
+	// transaction ID. It defaults to the transaction or app transaction ID.
+	TransactionID string `json:"transactionId,omitempty"`
+	// SignedTransaction is a StoreKit 2 signed transaction of the customer.
+	// Eligibility is decided for the user it belongs to, which must be
+	// UserToken.
+	SignedTransaction string `json:"signedTransaction"`
+	// SignedAppTransaction is StoreKit 2's AppTransaction of the customer.
+	// Customers who never subscribed have no signed transaction, so
+	// introductory offer eligibility accepts it instead.
+	SignedAppTransaction string `json:"signedAppTransaction,omitempty"`
+}
+
+// Customer is who a verified transaction or app transaction belongs to.
+type Customer struct {
+	BundleID string
+	// UserToken is the user the subscription is stored under. App
+	// transactions carry none.
+	UserToken string
+	// TransactionIDs are the IDs a token may be tied to, the default first.
+	TransactionIDs []string
+}
+
+// Customers tells who StoreKit 2 signed transactions belong to.
+type Customers interface {
+	// TransactionOwner verifies signedTransaction.
+	TransactionOwner(signedTransaction string) (*Customer, error)
+	// AppTransactionOwner verifies signedAppTransaction.
+	AppTransactionOwner(signedAppTransaction string) (*Customer, error)
+}
+
+// Claims binds an ID to the first user who presents it and returns the user
+// it is bound to; storage.PurchaseStore implements it.
+type Claims interface {
+	ClaimOriginalTransaction(ctx context.Context, id, userToken string) (string, error)
+}
+
+// Signature carries what StoreKit needs to apply a promotional offer:
+// SKPaymentDiscount in StoreKit 1, Product.PurchaseOption.promotionalOffer in
+// StoreKit 2.
+type Signature struct {
+	BundleID        string `json:"bundleId"`
+	ProductID       string `json:"productId"`
+	OfferID         string `json:"offerId"`
+	AppAccountToken string `json:"appAccountToken"`
+	KeyID           string `json:"keyIdentifier"`
+	Nonce           string `json:"nonce"`
+	// Timestamp is in milliseconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+	// Signature is the base64 encoded DER ECDSA signature.
+	Signature string `json:"signature"`
+}
+
+// SignedToken is a compact JWS for StoreKit 2 purchase options:
+// promotionalOffer(_:compactJWS:) or introductoryOfferEligibility(compactJWS:).
+type SignedToken struct {
+	JWS string `json:"jws"`
+	// AllowIntroductoryOffer is set for introductory offer eligibility tokens.
+	AllowIntroductoryOffer *bool `json:"allowIntroductoryOffer,omitempty"`
+}
+
+type promotionalOfferClaims struct {
+	Issuer        string `json:"iss"`
+	IssuedAt      int64  `json:"iat"`
+	Audience      string `json:"aud"`
+	BundleID      string `json:"bid"`
+	Nonce         string `json:"nonce"`
+	ProductID     string `json:"productId"`
+	OfferID       string `json:"offerIdentifier"`
+	TransactionID string `json:"transactionId,omitempty"`
+}
+
+type introEligibilityClaims struct {
+	Issuer                 string `json:"iss"`
+	IssuedAt               int64  `json:"iat"`
+	Audience               string `json:"aud"`
+	BundleID               string `json:"bid"`
+	Nonce                  string `json:"nonce"`
+	ProductID              string `json:"productId"`
+	AllowIntroductoryOffer bool   `json:"allowIntroductoryOffer"`
+	TransactionID          string `json:"transactionId,omitempty"`
+}
+
+type Options struct {
+	// BundleIDs lists the bundles offers may be signed for.
+	BundleIDs []string
+	// IssuerID is the App Store Connect issuer of the key, required for
+	// StoreKit 2 tokens.
+	IssuerID string
+	// Groups lists the products of each subscription group, as configured
+	// for the Apple service. Without it all products share one group.
+	Groups map[string][]string
+	// Rules maps offer identifiers to an eligibility rule.
+	Rules map[string]string
+	// Customers verifies the signed transactions of requests. Without it
+	// every request fails with ErrNoCustomers.
+	Customers Customers
+	// Claims binds app transactions to the first user asking for
+	// introductory offer eligibility with them. Without it app transactions
+	// are refused.
+	Claims Claims
+	// Refunds, when set, refuses offers to users the entitlement policy
+	// judges serial refunders.
+	Refunds refunds.Tracker
+	// Now and Nonce override the clock and nonce generator, for tests.
+	Now   func() time.Time
+	Nonce func() (string, error)
+}
+
+type Signer interface {
+	// Sign checks that req.SignedTransaction belongs to req.UserToken, that
+	// the user is eligible for req.OfferID and signs the offer. It fails
+	// with ErrInvalidRequest, ErrUnknownBundle or ErrNotEligible when it
+	// refuses to sign.
+	Sign(ctx context.Context, req Request) (*Signature, error)
+	// SignPromotionalOffer applies the same checks as Sign and returns the
+	// offer as a StoreKit 2 token.
+	SignPromotionalOffer(ctx context.Context, req Request) (*SignedToken, error)
+	// SignIntroEligibility returns a StoreKit 2 token telling whether
+	// req.UserToken may still get the introductory offer of req.ProductID.
+	// It accepts req.SignedAppTransaction instead of a signed transaction.
+	// req.OfferID is not used.
+	SignIntroEligibility(ctx context.Context, req Request) (*SignedToken, error)
+}
+
+type signer struct {
+	key     *signing.Key
+	storage storage.Storage
+	policy  entitlement.Engine
+	bundles map[string]bool
+	groups  map[string]string
+	opts    Options
+}
+
+func NewSigner(key *signing.Key, st storage.Storage, policy entitlement.Engine, opts Options) Signer {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.Nonce == nil {
+		opts.Nonce = tools.NewUUID
+	}
+	s := &signer{
+		key:     key,
+		storage: st,
+		policy:  policy,
+		bundles: make(map[string]bool, len(opts.BundleIDs)),
+		groups:  make(map[string]string),
+		opts:    opts,
+	}
+	for _, id := range opts.BundleIDs {
+		s.bundles[id] = true
+	}
+	for group, products := range opts.Groups {
+		for _, product := range products {
+			s.groups[product] = group
+		}
+	}
+	return s
+}
+
+func (s *signer) Sign(ctx context.Context, req Request) (*Signature, error) {
+	if req.ProductID == "" || req.OfferID == "" || req.UserToken == "" {
+		return nil, fmt.Errorf("%w: productId, offerId and userToken are required", ErrInvalidRequest)
+	}
+	c, err := s.customer(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkEligible(ctx, c.UserToken, req.OfferID, s.opts.Now()); err != nil {
+		return nil, err
+	}
+
+	nonce, err := s.opts.Nonce()
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	sig := &Signature{
+		BundleID:        c.BundleID,
+		ProductID:       req.ProductID,
+		OfferID:         req.OfferID,
+		AppAccountToken: strings.ToLower(req.UserToken),
+		KeyID:           s.key.ID,
+		Nonce:           strings.ToLower(nonce),
+		Timestamp:       s.opts.Now().UnixMilli(),
+	}
+	der, err := s.key.SignDER([]byte(Payload(sig)))
+	if err != nil {
+		return nil, err
+	}
+	sig.Signature = base64.StdEncoding.EncodeToString(der)
+	return sig, nil
+}
+
+func (s *signer) SignPromotionalOffer(ctx context.Context, req Request) (*SignedToken, error) {
+	if req.ProductID == "" || req.OfferID == "" || req.UserToken == "" {
+		return nil, fmt.Errorf("%w: productId, offerId and userToken are required", ErrInvalidRequest)
+	}
+	if s.opts.IssuerID == "" {
+		return nil, ErrNoIssuer
+	}
+	c, err := s.customer(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := tokenTransaction(req, c)
+	if err != nil {
+		return nil, err
+	}
+	now := s.opts.Now()
+	if err := s.checkEligible(ctx, c.UserToken, req.OfferID, now); err != nil {
+		return nil, err
+	}
+
+	nonce, err := s.opts.Nonce()
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	jws, err := s.key.SignJWS(promotionalOfferClaims{
+		Issuer:        s.opts.IssuerID,
+		IssuedAt:      now.Unix(),
+		Audience:      signing.Audience,
+		BundleID:      c.BundleID,
+		Nonce:         strings.ToLower(nonce),
+		ProductID:     req.ProductID,
+		OfferID:       req.OfferID,
+		TransactionID: transactionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SignedToken{JWS: jws}, nil
+}
+
+func (s *signer) SignIntroEligibility(ctx context.Context, req Request) (*SignedToken, error) {
+	if req.ProductID == "" || req.UserToken == "" {
+		return nil, fmt.Errorf("%w: productId and userToken are required", ErrInvalidRequest)
+	}
+	if s.opts.IssuerID == "" {
+		return nil, ErrNoIssuer
+	}
+	c, err := s.customer(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := tokenTransaction(req, c)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := s.introEligible(ctx, c.UserToken, req.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := s.opts.Nonce()
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	jws, err := s.key.SignJWS(introEligibilityClaims{
+		Issuer:                 s.opts.IssuerID,
+		IssuedAt:               s.opts.Now().Unix(),
+		Audience:               signing.Audience,
+		BundleID:               c.BundleID,
+		Nonce:                  strings.ToLower(nonce),
+		ProductID:              req.ProductID,
+		AllowIntroductoryOffer: allow,
+		TransactionID:          transactionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SignedToken{JWS: jws, AllowIntroductoryOffer: &allow}, nil
+}
+
+// Payload returns the string whose signature StoreKit verifies.
+func Payload(sig *Signature) string {
+	return strings.Join([]string{
+		sig.BundleID,
+		sig.KeyID,
+		sig.ProductID,
+		sig.OfferID,
+		sig.AppAccountToken,
+		sig.Nonce,
+		strconv.FormatInt(sig.Timestamp, 10),
+	}, separator)
+}
+
+// bundle returns the bundle to sign for: the requested one if it is
+// configured, or the only configured bundle.
+func (s *signer) bundle(requested string) (string, error) {
+	if requested == "" {
+		if len(s.opts.BundleIDs) != 1 {
+			return "", fmt.Errorf("%w: bundleId is required", ErrInvalidRequest)
+		}
+		return s.opts.BundleIDs[0], nil
+	}
+	if !s.bundles[requested] {
+		return "", fmt.Errorf("%w: %q", ErrUnknownBundle, requested)
+	}
+	return requested, nil
+}
+
+// customer verifies the signed transaction of req, or with appTransaction
+// its signed app transaction, and returns who eligibility is decided for:
+// UserToken is req.UserToken, and BundleID the bundle to sign for.
+func (s *signer) customer(ctx context.Context, req Request, appTransaction bool) (*Customer, error) {
+	if s.opts.Customers == nil {
+		return nil, ErrNoCustomers
+	}
+	var (
+		c   *Customer
+		err error
+	)
+	switch {
+	case req.SignedTransaction != "":
+		c, err = s.opts.Customers.TransactionOwner(req.SignedTransaction)
+	case appTransaction && req.SignedAppTransaction != "":
+		c, err = s.opts.Customers.AppTransactionOwner(req.SignedAppTransaction)
+	case appTransaction:
+		return nil, fmt.Errorf("%w: signedTransaction or signedAppTransaction is required", ErrInvalidRequest)
+	default:
+		return nil, fmt.Errorf("%w: signedTransaction is required", ErrInvalidRequest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if req.BundleID != "" && req.BundleID != c.BundleID {
+		return nil, fmt.Errorf("%w: transaction is for bundle %q", ErrInvalidRequest, c.BundleID)
+	}
+	if c.BundleID, err = s.bundle(c.BundleID); err != nil {
+		return nil, err
+	}
+
+	if req.SignedTransaction == "" {
+		// An app transaction names no user; the first one to present it
+		// keeps it.
+		if s.opts.Claims == nil {
+			return nil, ErrNoCustomers
+		}
+		if len(c.TransactionIDs) == 0 {
+			return nil, fmt.Errorf("%w: app transaction has no appTransactionId", ErrInvalidRequest)
+		}
+		owner, err := s.opts.Claims.ClaimOriginalTransaction(ctx, "app:"+c.TransactionIDs[0], req.UserToken)
+		if err != nil {
+			return nil, fmt.Errorf("claim app transaction: %w", err)
+		}
+		c.UserToken = owner
+	}
+	if !strings.EqualFold(c.UserToken, req.UserToken) {
+		return nil, fmt.Errorf("%w: transaction belongs to another user", ErrNotEligible)
+	}
+	return c, nil
+}
+
+// tokenTransaction returns the transaction ID a StoreKit 2 token is tied
+// to: req.TransactionID if it is one of the verified IDs of c, the default
+// ID otherwise.
+func tokenTransaction(req Request, c *Customer) (string, error) {
+	if req.TransactionID == "" {
+		if len(c.TransactionIDs) == 0 {
+			return "", nil
+		}
+		return c.TransactionIDs[0], nil
+	}
+	if !slices.Contains(c.TransactionIDs, req.TransactionID) {
+		return "", fmt.Errorf("%w: transactionId %q is not the signed transaction's", ErrInvalidRequest, req.TransactionID)
+	}
+	return req.TransactionID, nil
+}
+
+func (s *signer) checkEligible(ctx context.Context, user, offerID string, now time.Time) error {
+	status, err := s.storage.GetSubscriptionStatus(ctx, user)
+	switch {
+	case errors.Is(err, storage.ErrSubscriptionNotFound):
+		return fmt.Errorf("%w: no subscription", ErrNotEligible)
+	case err != nil:
+		return fmt.Errorf("get subscription status: %w", err)
+	case status == nil:
+		return fmt.Errorf("%w: no subscription", ErrNotEligible)
+	}
+
+	if err := s.checkRefunds(ctx, user); err != nil {
+		return err
+	}
+
+	rule := s.opts.Rules[offerID]
+	switch rule {
+	case "", RuleAny:
+		return nil
+	case RuleLapsed:
+		if s.policy.IsActive(status, now) {
+			return fmt.Errorf("%w: subscription is active", ErrNotEligible)
+		}
+		return nil
+	case RuleActive:
+		if !s.policy.IsActive(status, now) {
+			return fmt.Errorf("%w: subscription is not active", ErrNotEligible)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown rule %q for offer %q", ErrNotEligible, rule, offerID)
+	}
+}
+
+// introEligible reports whether the user may get an introductory offer for
+// productID. Apple grants one per subscription group, so a stored
+// subscription to a product of the same group rules it out, as does refund
+// abuse.
+func (s *signer) introEligible(ctx context.Context, user, productID string) (bool, error) {
+	switch err := s.checkRefunds(ctx, user); {
+	case errors.Is(err, ErrNotEligible):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	status, err := s.storage.GetSubscriptionStatus(ctx, user)
+	switch {
+	case errors.Is(err, storage.ErrSubscriptionNotFound):
+		return true, nil
+	case err != nil:
+		return false, fmt.Errorf("get subscription status: %w", err)
+	case status == nil:
+		return true, nil
+	}
+	return s.groups[status.ProductID] != s.groups[productID], nil
+}
+
+// checkRefunds fails with ErrNotEligible for serial refunders.
+func (s *signer) checkRefunds(ctx context.Context, userToken string) error {
+	if s.opts.Refunds == nil {
+		return nil
+	}
+	summary, err := s.opts.Refunds.User(ctx, userToken)
+	if err != nil {
+		return fmt.Errorf("get refund history: %w", err)
+	}
+	if summary.SerialRefunder {
+		return fmt.Errorf("%w: serial refunder", ErrNotEligible)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package offers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/offers"
+	"subscription-server/internal/refunds"
+	"subscription-server/internal/signing"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// newKey создает ключ App Store Connect в формате .p8
+func newKey(t *testing.T) *signing.Key {
+	t.Helper()
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Ошибка генерации ключа: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		t.Fatalf("Ошибка кодирования ключа: %v", err)
+	}
+	parsed, err := signing.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("Ошибка разбора ключа: %v", err)
+	}
+	return &signing.Key{ID: "KEY123", PrivateKey: parsed}
+}
+
+// customers разбирает подписанные транзакции вида "bundle/user" с транзакцией
+// 1000 и исходной транзакцией 2000, а транзакции приложения вида "bundle/id"
+type customers struct{}
+
+func (customers) TransactionOwner(signedTransaction string) (*offers.Customer, error) {
+	bundleID, user, ok := strings.Cut(signedTransaction, "/")
+	if !ok {
+		return nil, errors.New("invalid signature")
+	}
+	return &offers.Customer{BundleID: bundleID, UserToken: user, TransactionIDs: []string{"1000", "2000"}}, nil
+}
+
+func (customers) AppTransactionOwner(signedAppTransaction string) (*offers.Customer, error) {
+	bundleID, id, ok := strings.Cut(signedAppTransaction, "/")
+	if !ok {
+		return nil, errors.New("invalid signature")
+	}
+	return &offers.Customer{BundleID: bundleID, TransactionIDs: []string{id}}, nil
+}
+
+// signed возвращает подписанную транзакцию пользователя для customers
+func signed(bundleID, user string) string {
+	return bundleID + "/" + user
+}
+
+// TestSigner_Sign проверяет подпись предложения открытым ключом
+func TestSigner_Sign(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "USER-1", ExpiresAt: now.Add(-time.Hour)})
+
+	key := newKey(t)
+	signer := offers.NewSigner(key, st, entitlement.NewEngine(entitlement.DefaultPolicy()), offers.Options{
+		BundleIDs: []string{"com.test.app"},
+		Customers: customers{},
+		Now:       func() time.Time { return now },
+		Nonce:     func() (string, error) { return "4A6D9A7C-3B2E-4F1A-9C8D-1E2F3A4B5C6D", nil },
+	})
+
+	sig, err := signer.Sign(ctx, offers.Request{ProductID: "com.test.monthly", OfferID: "winback", UserToken: "USER-1",
+		SignedTransaction: signed("com.test.app", "USER-1")})
+	if err != nil {
+		t.Fatalf("Ошибка подписи: %v", err)
+	}
+	if sig.BundleID != "com.test.app" || sig.KeyID != "KEY123" || sig.Timestamp != now.UnixMilli() {
+		t.Errorf("Неправильные поля подписи: %+v", sig)
+	}
+	if sig.AppAccountToken != "user-1" || sig.Nonce != "4a6d9a7c-3b2e-4f1a-9c8d-1e2f3a4b5c6d" {
+		t.Errorf("Токен и nonce должны быть в нижнем регистре: %+v", sig)
+	}
+
+	payload := strings.Join([]string{
+		"com.test.app", "KEY123", "com.test.monthly", "winback", "user-1",
+		"4a6d9a7c-3b2e-4f1a-9c8d-1e2f3a4b5c6d", "1894276800000",
+	}, "\u2063")
+	if got := offers.Payload(sig); got != payload {
+		t.Fatalf("Неправильная подписываемая строка: %q", got)
+	}
+	der, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		t.Fatalf("Подпись не в base64: %v", err)
+	}
+	digest := sha256.Sum256([]byte(payload))
+	if !ecdsa.VerifyASN1(&key.PrivateKey.PublicKey, digest[:], der) {
+		t.Error("Подпись не проверяется открытым ключом")
+	}
+}
+
+// TestSigner_Eligibility проверяет правила доступности предложений
+func TestSigner_Eligibility(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "active", ExpiresAt: now.Add(time.Hour)})
+	st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "lapsed", ExpiresAt: now.Add(-time.Hour)})
+
+	signer := offers.NewSigner(newKey(t), st, entitlement.NewEngine(entitlement.DefaultPolicy()), offers.Options{
+		BundleIDs: []string{"com.test.app", "com.test.other"},
+		Rules:     map[string]string{"winback": offers.RuleLapsed, "stay": offers.RuleActive, "typo": "lapsd"},
+		Customers: customers{},
+		Now:       func() time.Time { return now },
+	})
+	app := func(user string) string { return signed("com.test.app", user) }
+
+	tests := []struct {
+		name string
+		req  offers.Request
+		want error
+	}{
+		{"возврат ушедшего пользователя", offers.Request{BundleID: "com.test.app", OfferID: "winback", UserToken: "lapsed", SignedTransaction: app("lapsed")}, nil},
+		{"возврат для активного пользователя", offers.Request{BundleID: "com.test.app", OfferID: "winback", UserToken: "active", SignedTransaction: app("active")}, offers.ErrNotEligible},
+		{"удержание активного пользователя", offers.Request{BundleID: "com.test.app", OfferID: "stay", UserToken: "active", SignedTransaction: app("active")}, nil},
+		{"удержание ушедшего пользователя", offers.Request{BundleID: "com.test.app", OfferID: "stay", UserToken: "lapsed", SignedTransaction: app("lapsed")}, offers.ErrNotEligible},
+		{"предложение без правила", offers.Request{BundleID: "com.test.app", OfferID: "other", UserToken: "lapsed", SignedTransaction: app("lapsed")}, nil},
+		{"неизвестное правило", offers.Request{BundleID: "com.test.app", OfferID: "typo", UserToken: "lapsed", SignedTransaction: app("lapsed")}, offers.ErrNotEligible},
+		{"пользователь без подписки", offers.Request{BundleID: "com.test.app", OfferID: "other", UserToken: "new", SignedTransaction: app("new")}, offers.ErrNotEligible},
+		{"неизвестное приложение", offers.Request{OfferID: "other", UserToken: "lapsed", SignedTransaction: signed("com.test.unknown", "lapsed")}, offers.ErrUnknownBundle},
+		{"приложение из транзакции", offers.Request{OfferID: "other", UserToken: "lapsed", SignedTransaction: signed("com.test.other", "lapsed")}, nil},
+		{"транзакция другого приложения", offers.Request{BundleID: "com.test.app", OfferID: "other", UserToken: "lapsed", SignedTransaction: signed("com.test.other", "lapsed")}, offers.ErrInvalidRequest},
+		{"транзакция другого пользователя", offers.Request{BundleID: "com.test.app", OfferID: "winback", UserToken: "new", SignedTransaction: app("lapsed")}, offers.ErrNotEligible},
+		{"без подписанной транзакции", offers.Request{BundleID: "com.test.app", OfferID: "other", UserToken: "lapsed"}, offers.ErrInvalidRequest},
+		{"неверная подпись транзакции", offers.Request{BundleID: "com.test.app", OfferID: "other", UserToken: "lapsed", SignedTransaction: "forged"}, offers.ErrInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.ProductID = "com.test.monthly"
+			_, err := signer.Sign(ctx, tt.req)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Ожидалась ошибка %v, получено %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// verifyJWS проверяет подпись ES256 и возвращает утверждения токена
+func verifyJWS(t *testing.T, key *signing.Key, jws string) map[string]any {
+	t.Helper()
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Ожидалось 3 части JWS, получено %d", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("Неправильная подпись JWS: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(&key.PrivateKey.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatal("Подпись JWS не проверяется открытым ключом")
+	}
+	var claims map[string]any
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		t.Fatalf("Ошибка разбора утверждений: %v", err)
+	}
+	return claims
+}
+
+// TestSigner_SignPromotionalOffer проверяет токен промо-предложения StoreKit 2
+func TestSigner_SignPromotionalOffer(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "user-1", ExpiresAt: now.Add(time.Hour)})
+
+	key := newKey(t)
+	opts := offers.Options{
+		BundleIDs: []string{"com.test.app"},
+		Rules:     map[string]string{"winback": offers.RuleLapsed},
+		Customers: customers{},
+		Now:       func() time.Time { return now },
+		Nonce:     func() (string, error) { return "4A6D9A7C-3B2E-4F1A-9C8D-1E2F3A4B5C6D", nil },
+	}
+	policy := entitlement.NewEngine(entitlement.DefaultPolicy())
+
+	req := offers.Request{ProductID: "com.test.monthly", OfferID: "loyal", UserToken: "user-1", TransactionID: "2000",
+		SignedTransaction: signed("com.test.app", "user-1")}
+	if _, err := offers.NewSigner(key, st, policy, opts).SignPromotionalOffer(ctx, req); !errors.Is(err, offers.ErrNoIssuer) {
+		t.Fatalf("Без издателя ожидалась ошибка ErrNoIssuer, получено %v", err)
+	}
+
+	opts.IssuerID = "issuer-1"
+	signer := offers.NewSigner(key, st, policy, opts)
+	token, err := signer.SignPromotionalOffer(ctx, req)
+	if err != nil {
+		t.Fatalf("Ошибка подписи: %v", err)
+	}
+	claims := verifyJWS(t, key, token.JWS)
+	want := map[string]any{
+		"iss": "issuer-1", "aud": "appstoreconnect-v1", "bid": "com.test.app",
+		"nonce": "4a6d9a7c-3b2e-4f1a-9c8d-1e2f3a4b5c6d", "productId": "com.test.monthly",
+		"offerIdentifier": "loyal", "transactionId": "2000", "iat": float64(now.Unix()),
+	}
+	for name, value := range want {
+		if claims[name] != value {
+			t.Errorf("Утверждение %s: ожидалось %v, получено %v", name, value, claims[name])
+		}
+	}
+	if token.AllowIntroductoryOffer != nil {
+		t.Error("Токен промо-предложения не содержит признак вводного предложения")
+	}
+
+	// Правила доступности применяются и к токенам StoreKit 2
+	req.OfferID = "winback"
+	if _, err := signer.SignPromotionalOffer(ctx, req); !errors.Is(err, offers.ErrNotEligible) {
+		t.Errorf("Ожидалась ошибка ErrNotEligible, получено %v", err)
+	}
+}
+
+// TestSigner_SignIntroEligibility проверяет право на вводное предложение по группам подписок
+func TestSigner_SignIntroEligibility(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "pro-user", ProductID: "com.test.pro", ExpiresAt: now.Add(-time.Hour)})
+
+	key := newKey(t)
+	signer := offers.NewSigner(key, st, entitlement.NewEngine(entitlement.DefaultPolicy()), offers.Options{
+		BundleIDs: []string{"com.test.app"},
+		IssuerID:  "issuer-1",
+		Groups: map[string][]string{
+			"premium": {"com.test.pro", "com.test.basic"},
+			"extras":  {"com.test.extras"},
+		},
+		Customers: customers{},
+		Now:       func() time.Time { return now },
+	})
+
+	tests := []struct {
+		name    string
+		user    string
+		product string
+		want    bool
+	}{
+		{"новый пользователь", "new-user", "com.test.basic", true},
+		{"подписчик той же группы", "pro-user", "com.test.basic", false},
+		{"подписчик другой группы", "pro-user", "com.test.extras", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := signer.SignIntroEligibility(ctx, offers.Request{ProductID: tt.product, UserToken: tt.user,
+				SignedTransaction: signed("com.test.app", tt.user)})
+			if err != nil {
+				t.Fatalf("Ошибка подписи: %v", err)
+			}
+			if token.AllowIntroductoryOffer == nil || *token.AllowIntroductoryOffer != tt.want {
+				t.Errorf("Ожидалось %v, получено %v", tt.want, token.AllowIntroductoryOffer)
+			}
+			claims := verifyJWS(t, key, token.JWS)
+			if claims["allowIntroductoryOffer"] != tt.want || claims["productId"] != tt.product || claims["nonce"] == "" {
+				t.Errorf("Неправильные утверждения: %v", claims)
+			}
+		})
+	}
+}
+
+// TestSigner_SerialRefunder проверяет отказ в предложениях пользователям, злоупотребляющим возвратами
+func TestSigner_SerialRefunder(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	rs := storage.NewMemoryRefundStore()
+	for _, user := range []string{"refunder", "loyal"} {
+		st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: user, ProductID: "com.test.pro", ExpiresAt: now.Add(-time.Hour)})
+	}
+	for _, tx := range []string{"1", "2", "3"} {
+		rs.RecordRefund(ctx, &storage.Refund{ID: "r-" + tx, UserToken: "refunder", ProductID: "com.test.pro",
+			TransactionID: tx, Type: storage.RefundGranted, OccurredAt: now})
+	}
+
+	policy := entitlement.NewEngine(entitlement.Policy{MaxRefunds: 2})
+	signer := offers.NewSigner(newKey(t), st, policy, offers.Options{
+		BundleIDs: []string{"com.test.app"},
+		IssuerID:  "issuer-1",
+		Groups:    map[string][]string{"premium": {"com.test.pro"}, "extras": {"com.test.extras"}},
+		Refunds:   refunds.NewTracker(rs, storage.NewMemoryEventStore(), policy),
+		Customers: customers{},
+		Now:       func() time.Time { return now },
+	})
+
+	req := offers.Request{ProductID: "com.test.pro", OfferID: "winback", UserToken: "refunder",
+		SignedTransaction: signed("com.test.app", "refunder")}
+	if _, err := signer.Sign(ctx, req); !errors.Is(err, offers.ErrNotEligible) {
+		t.Errorf("Ожидалась ошибка ErrNotEligible, получено %v", err)
+	}
+	if _, err := signer.SignPromotionalOffer(ctx, req); !errors.Is(err, offers.ErrNotEligible) {
+		t.Errorf("Ожидалась ошибка ErrNotEligible, получено %v", err)
+	}
+	token, err := signer.SignIntroEligibility(ctx, offers.Request{ProductID: "com.test.extras", UserToken: "refunder",
+		SignedTransaction: req.SignedTransaction})
+	if err != nil || *token.AllowIntroductoryOffer {
+		t.Errorf("Вводное предложение должно быть недоступно: %+v (%v)", token, err)
+	}
+
+	req.UserToken, req.SignedTransaction = "loyal", signed("com.test.app", "loyal")
+	if _, err := signer.Sign(ctx, req); err != nil {
+		t.Errorf("Пользователь без возвратов должен получить предложение: %v", err)
+	}
+}
+
+// TestSigner_TokenTransaction проверяет привязку токенов к проверенной транзакции
+func TestSigner_TokenTransaction(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	st := storage.NewMemoryStorage()
+	st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "user-1", ProductID: "com.test.pro", ExpiresAt: now.Add(-time.Hour)})
+
+	key := newKey(t)
+	opts := offers.Options{
+		BundleIDs: []string{"com.test.app"},
+		IssuerID:  "issuer-1",
+		Groups:    map[string][]string{"premium": {"com.test.pro"}},
+		Customers: customers{},
+		Now:       func() time.Time { return now },
+	}
+	signer := offers.NewSigner(key, st, entitlement.NewEngine(entitlement.DefaultPolicy()), opts)
+	req := offers.Request{ProductID: "com.test.pro", OfferID: "winback", UserToken: "user-1",
+		SignedTransaction: signed("com.test.app", "user-1")}
+
+	// По умолчанию токен привязан к проверенной транзакции
+	token, err := signer.SignPromotionalOffer(ctx, req)
+	if err != nil {
+		t.Fatalf("Ошибка подписи: %v", err)
+	}
+	if claims := verifyJWS(t, key, token.JWS); claims["transactionId"] != "1000" {
+		t.Errorf("Ожидалась транзакция 1000, получено %v", claims["transactionId"])
+	}
+
+	// Чужая транзакция отклоняется
+	req.TransactionID = "9999"
+	if _, err := signer.SignPromotionalOffer(ctx, req); !errors.Is(err, offers.ErrInvalidRequest) {
+		t.Errorf("Ожидалась ошибка ErrInvalidRequest, получено %v", err)
+	}
+	if _, err := signer.SignIntroEligibility(ctx, req); !errors.Is(err, offers.ErrInvalidRequest) {
+		t.Errorf("Ожидалась ошибка ErrInvalidRequest, получено %v", err)
+	}
+
+	// Новый клиент подтверждает право на вводное предложение транзакцией приложения
+	intro := offers.Request{ProductID: "com.test.pro", UserToken: "new-user", SignedAppTransaction: "com.test.app/705"}
+	if _, err := signer.SignIntroEligibility(ctx, intro); !errors.Is(err, offers.ErrNoCustomers) {
+		t.Errorf("Без привязки транзакций ожидалась ошибка ErrNoCustomers, получено %v", err)
+	}
+	opts.Claims = storage.NewMemoryPurchaseStore()
+	signer = offers.NewSigner(key, st, entitlement.NewEngine(entitlement.DefaultPolicy()), opts)
+	token, err = signer.SignIntroEligibility(ctx, intro)
+	if err != nil {
+		t.Fatalf("Ошибка подписи: %v", err)
+	}
+	claims := verifyJWS(t, key, token.JWS)
+	if claims["allowIntroductoryOffer"] != true || claims["transactionId"] != "705" {
+		t.Errorf("Неправильные утверждения: %v", claims)
+	}
+	// Транзакция приложения закреплена за первым пользователем
+	intro.UserToken = "other-user"
+	if _, err := signer.SignIntroEligibility(ctx, intro); !errors.Is(err, offers.ErrNotEligible) {
+		t.Errorf("Ожидалась ошибка ErrNotEligible, получено %v", err)
+	}
+	// Промо-предложения по-прежнему требуют подписанную транзакцию
+	promo := offers.Request{ProductID: "com.test.pro", OfferID: "winback", UserToken: "new-user", SignedAppTransaction: "com.test.app/705"}
+	if _, err := signer.SignPromotionalOffer(ctx, promo); !errors.Is(err, offers.ErrInvalidRequest) {
+		t.Errorf("Ожидалась ошибка ErrInvalidRequest, получено %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/storage"
+	"time"
+)
+
+// Replayer applies a single stored event to current, the status replayed from
+// the earlier events of the user (nil before the first), and returns the
+// resulting status.
+type Replayer interface {
+	Replay(current *storage.SubscriptionStatus, event storage.SubscriptionEvent, now time.Time) (*storage.SubscriptionStatus, error)
+}
+
+type Options struct {
+	// DryRun reports the differences without writing anything.
+	DryRun bool
+}
+
+// Change describes a user whose stored status differs from the rebuilt one.
+// Before is nil when the user had no stored status.
+type Change struct {
+	UserToken string                      `json:"userToken"`
+	Before    *storage.SubscriptionStatus `json:"before"`
+	After     *storage.SubscriptionStatus `json:"after"`
+}
+
+// Failure is an event that could not be replayed.
+type Failure struct {
+	UserToken string `json:"userToken"`
+	EventID   string `json:"eventId"`
+	Error     string `json:"error"`
+}
+
+type Report struct {
+	DryRun   bool      `json:"dryRun"`
+	Users    int       `json:"users"`
+	Events   int       `json:"events"`
+	Changes  []Change  `json:"changes"`
+	Failures []Failure `json:"failures"`
+}
+
+type Engine interface {
+	Rebuild(ctx context.Context, opts Options) (*Report, error)
+}
+
+type engine struct {
+	events   storage.EventStore
+	storage  storage.Storage
+	replayer Replayer
+	logger   logger.Logger
+	now      func() time.Time
+}
+
+func NewEngine(ev storage.EventStore, st storage.Storage, r Replayer, l logger.Logger) Engine {
+	return &engine{
+		events:   ev,
+		storage:  st,
+		replayer: r,
+		logger:   l,
+		now:      time.Now,
+	}
+}
+
+// Rebuild folds every user's events in signedDate order through the replayer
+// and compares the resulting status with the stored one. An event that fails
+// to replay is reported and skipped. Unless opts.DryRun is set, changed
+// statuses are written back.
+func (e *engine) Rebuild(ctx context.Context, opts Options) (*Report, error) {
+	users, err := e.events.ListEventUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list event users: %w", err)
+	}
+
+	report := &Report{
+		DryRun:   opts.DryRun,
+		Changes:  []Change{},
+		Failures: []Failure{},
+	}
+	now := e.now().UTC()
+
+	for _, user := range users {
+		events, err := e.events.ListEvents(ctx, user)
+		if err != nil {
+			return nil, fmt.Errorf("list events for %s: %w", user, err)
+		}
+		report.Users++
+		report.Events += len(events)
+
+		var rebuilt *storage.SubscriptionStatus
+		for _, event := range events {
+			status, err := e.replayer.Replay(rebuilt, event, now)
+			if err != nil {
+				report.Failures = append(report.Failures, Failure{
+					UserToken: user,
+					EventID:   event.ID,
+					Error:     err.Error(),
+				})
+				continue
+			}
+			rebuilt = status
+		}
+		if rebuilt == nil {
+			continue
+		}
+
+		current, err := e.storage.GetSubscriptionStatus(ctx, rebuilt.UserToken)
+		if err != nil && !errors.Is(err, storage.ErrSubscriptionNotFound) {
+			return nil, fmt.Errorf("get status for %s: %w", rebuilt.UserToken, err)
+		}
+		if current != nil && sameStatus(current, rebuilt) {
+			continue
+		}
+
+		report.Changes = append(report.Changes, Change{
+			UserToken: rebuilt.UserToken,
+			Before:    current,
+			After:     rebuilt,
+		})
+		if opts.DryRun {
+			continue
+		}
+		if err := e.storage.SetSubscriptionStatus(ctx, rebuilt); err != nil {
+			return nil, fmt.Errorf("set status for %s: %w", rebuilt.UserToken, err)
+		}
+	}
+
+	e.logger.Log(logger.LogMessage{
+		Time:   now,
+		Level:  "INFO",
+		Sender: "projection",
+		Message: fmt.Sprintf("rebuild finished: dryRun=%t users=%d events=%d changes=%d failures=%d",
+			report.DryRun, report.Users, report.Events, len(report.Changes), len(report.Failures)),
+	})
+
+	return report, nil
+}
+
+func sameStatus(a, b *storage.SubscriptionStatus) bool {
+	return a.Equal(b)
+}
@@ -0,0 +1,97 @@
+package projection
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"subscription-server/internal/applestore"
+	"subscription-server/internal/expiry"
+	"subscription-server/internal/projection"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// acceptAllValidator принимает любые подписи
+type acceptAllValidator struct{}
+
+func (acceptAllValidator) Validate(header, payload, signature string) error { return nil }
+
+// fakeJWS собирает JWS с произвольной полезной нагрузкой
+func fakeJWS(payload any) string {
+	b, _ := json.Marshal(payload)
+	return "header." + base64.RawURLEncoding.EncodeToString(b) + ".signature"
+}
+
+// TestEngine_RebuildMatchesSweptStatus проверяет, что пересборка с событием
+// истечения дает тот же статус, что и живая обработка с проверкой истечения
+func TestEngine_RebuildMatchesSweptStatus(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	expires := now.Add(time.Hour)
+	grace := now.Add(2 * time.Hour)
+
+	st := storage.NewMemoryStorage()
+	events := storage.NewMemoryEventStore()
+	parser := applestore.NewAppleParser(applestore.NewAppleDecoder(acceptAllValidator{}))
+	service := applestore.NewAppleStoreService(st, nopLogger{}, parser, applestore.WithEventStore(events))
+
+	notification, _ := json.Marshal(map[string]any{
+		"notificationType": "DID_FAIL_TO_RENEW",
+		"subtype":          "GRACE_PERIOD",
+		"notificationUUID": "fail-1",
+		"signedDate":       now.UnixMilli(),
+		"data": map[string]any{
+			"bundleId":        "com.test.app",
+			"environment":     "Production",
+			"appAccountToken": "user1",
+			"signedTransactionInfo": fakeJWS(map[string]any{
+				"originalTransactionId": "1000",
+				"transactionId":         "1001",
+				"productId":             "com.test.monthly",
+				"expiresDate":           expires.UnixMilli(),
+			}),
+			"signedRenewalInfo": fakeJWS(map[string]any{
+				"autoRenewStatus":        1,
+				"isInBillingRetryPeriod": true,
+				"gracePeriodExpiresDate": grace.UnixMilli(),
+			}),
+		},
+	})
+	body, _ := json.Marshal(map[string]string{"signedPayload": base64.StdEncoding.EncodeToString(notification)})
+	w := httptest.NewRecorder()
+	service.HandleProviderNotification(w, httptest.NewRequest(http.MethodPost, "/provider-notification", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Ожидался статус 200, получен %d: %s", w.Code, w.Body.String())
+	}
+
+	// Льготный период закончился без уведомления EXPIRED
+	sweeper := expiry.NewSweeper(st, events, nopLogger{}, expiry.Options{
+		Now: func() time.Time { return grace.Add(time.Minute) },
+	})
+	if swept, err := sweeper.Sweep(ctx); err != nil || swept != 1 {
+		t.Fatalf("Ожидалась деактивация 1 подписки, получено %d (%v)", swept, err)
+	}
+	live, err := st.GetSubscriptionStatus(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Ошибка при получении статуса: %v", err)
+	}
+	if live.IsActive || !live.GracePeriodExpiresAt.Equal(grace.Truncate(time.Millisecond)) || live.AutoRenewEnabled == nil {
+		t.Fatalf("Некорректный статус после проверки истечения: %+v", live)
+	}
+
+	engine := projection.NewEngine(events, st, applestore.NewAppleReplayer(), nopLogger{})
+	report, err := engine.Rebuild(ctx, projection.Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Ошибка пересборки: %v", err)
+	}
+	if report.Events != 2 || len(report.Failures) != 0 {
+		t.Fatalf("Ожидалось 2 события без ошибок, получено %d и %+v", report.Events, report.Failures)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Пересобранный статус отличается от живого: %+v -> %+v", report.Changes[0].Before, report.Changes[0].After)
+	}
+}
@@ -0,0 +1,127 @@
+package projection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"subscription-server/internal/logger"
+	"subscription-server/internal/projection"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// jsonReplayer восстанавливает статус прямо из JSON в RawPayload события;
+// событие с пустым продуктом дополняет текущий статус
+type jsonReplayer struct{}
+
+func (jsonReplayer) Replay(current *storage.SubscriptionStatus, event storage.SubscriptionEvent, now time.Time) (*storage.SubscriptionStatus, error) {
+	var status storage.SubscriptionStatus
+	if err := json.Unmarshal([]byte(event.RawPayload), &status); err != nil {
+		return nil, err
+	}
+	if status.ProductID == "" && current != nil {
+		merged := *current
+		merged.ExpiresAt = status.ExpiresAt
+		return &merged, nil
+	}
+	return &status, nil
+}
+
+// nopLogger отбрасывает все сообщения
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.LogMessage) {}
+func (nopLogger) Close()                {}
+
+func appendEvent(t *testing.T, events storage.EventStore, id string, user string, occurredAt time.Time, status *storage.SubscriptionStatus) {
+	t.Helper()
+
+	payload := "not json"
+	if status != nil {
+		b, _ := json.Marshal(status)
+		payload = string(b)
+	}
+	err := events.AppendEvent(context.Background(), &storage.SubscriptionEvent{
+		ID:         id,
+		UserToken:  user,
+		Source:     storage.EventSourceAppleServer,
+		Type:       "DID_RENEW",
+		OccurredAt: occurredAt,
+		RawPayload: payload,
+	})
+	if err != nil {
+		t.Fatalf("Ошибка при добавлении события: %v", err)
+	}
+}
+
+// TestEngine_Rebuild проверяет пересборку статусов из истории событий
+func TestEngine_Rebuild(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	events := storage.NewMemoryEventStore()
+	st := storage.NewMemoryStorage()
+
+	// user1: события добавлены не по порядку, побеждает последнее по signedDate
+	appendEvent(t, events, "e2", "user1", base.Add(time.Hour), &storage.SubscriptionStatus{UserToken: "user1", ProductID: "pro", IsActive: true})
+	appendEvent(t, events, "e1", "user1", base, &storage.SubscriptionStatus{UserToken: "user1", ProductID: "basic"})
+	// user2: в хранилище уже верный статус, изменений быть не должно
+	user2 := &storage.SubscriptionStatus{UserToken: "user2", ProductID: "basic", ExpiresAt: base}
+	appendEvent(t, events, "e3", "user2", base, user2)
+	if err := st.SetSubscriptionStatus(ctx, user2); err != nil {
+		t.Fatalf("Ошибка при сохранении статуса: %v", err)
+	}
+	// user3: событие не удается воспроизвести
+	appendEvent(t, events, "e4", "user3", base, nil)
+	// user4: второе событие дополняет статус, построенный из первого
+	appendEvent(t, events, "e5", "user4", base, &storage.SubscriptionStatus{UserToken: "user4", ProductID: "pro", ExpiresAt: base})
+	appendEvent(t, events, "e6", "user4", base.Add(time.Hour), &storage.SubscriptionStatus{ExpiresAt: base.Add(time.Hour)})
+
+	engine := projection.NewEngine(events, st, jsonReplayer{}, nopLogger{})
+
+	// Пробный запуск ничего не записывает
+	report, err := engine.Rebuild(ctx, projection.Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Ошибка пробной пересборки: %v", err)
+	}
+	if report.Users != 4 || report.Events != 6 {
+		t.Errorf("Ожидалось 4 пользователя и 6 событий, получено %d и %d", report.Users, report.Events)
+	}
+	if len(report.Changes) != 2 || report.Changes[0].UserToken != "user1" || report.Changes[1].UserToken != "user4" {
+		t.Fatalf("Ожидались изменения для user1 и user4, получено %+v", report.Changes)
+	}
+	if after := report.Changes[1].After; after.ProductID != "pro" || !after.ExpiresAt.Equal(base.Add(time.Hour)) {
+		t.Errorf("События user4 должны сворачиваться в один статус: %+v", after)
+	}
+	if report.Changes[0].Before != nil || report.Changes[0].After.ProductID != "pro" {
+		t.Errorf("Некорректное изменение: %+v", report.Changes[0])
+	}
+	if len(report.Failures) != 1 || report.Failures[0].EventID != "e4" {
+		t.Errorf("Ожидалась ошибка воспроизведения e4, получено %+v", report.Failures)
+	}
+	if _, err := st.GetSubscriptionStatus(ctx, "user1"); !errors.Is(err, storage.ErrSubscriptionNotFound) {
+		t.Errorf("Пробный запуск не должен записывать статусы, получено %v", err)
+	}
+
+	// Настоящий запуск записывает изменения
+	if _, err := engine.Rebuild(ctx, projection.Options{}); err != nil {
+		t.Fatalf("Ошибка пересборки: %v", err)
+	}
+	got, err := st.GetSubscriptionStatus(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Ошибка при получении статуса: %v", err)
+	}
+	if got.ProductID != "pro" || !got.IsActive {
+		t.Errorf("Некорректный статус после пересборки: %+v", got)
+	}
+
+	// Повторный запуск уже не находит отличий
+	report, err = engine.Rebuild(ctx, projection.Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Ошибка повторной пересборки: %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Ожидалось отсутствие изменений, получено %+v", report.Changes)
+	}
+}
@@ -0,0 +1,181 @@
+// Package refunds summarises the refund history of users and products, for
+// support and as a refund-abuse signal for the entitlement policy.
+package refunds
+
+import (
+	"context"
+	"fmt"
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/storage"
+)
+
+// Stats counts refund decisions by transaction. A transaction counts as
+// refunded or reversed by its latest decision; every declined request
+// counts.
+type Stats struct {
+	// Transactions is the number of distinct transactions, refunded or not.
+	Transactions int `json:"transactions"`
+	Refunds      int `json:"refunds"`
+	Reversed     int `json:"reversed"`
+	Declined     int `json:"declined"`
+	// Rate is Refunds per transaction, 0 without transactions.
+	Rate float64 `json:"refundRate"`
+}
+
+// UserSummary is the refund history of a user.
+type UserSummary struct {
+	UserToken string `json:"userToken"`
+	Stats
+	// Products breaks the stats down by product.
+	Products map[string]*Stats `json:"products"`
+	// SerialRefunder is the verdict of the entitlement policy.
+	SerialRefunder bool             `json:"serialRefunder"`
+	History        []storage.Refund `json:"history"`
+}
+
+// ProductSummary is the refund history of a product across users.
+type ProductSummary struct {
+	ProductID string `json:"productId"`
+	Refunds   int    `json:"refunds"`
+	Reversed  int    `json:"reversed"`
+	Declined  int    `json:"declined"`
+	// Users is the number of users with a refunded transaction.
+	Users   int              `json:"users"`
+	History []storage.Refund `json:"history"`
+}
+
+type Tracker interface {
+	User(ctx context.Context, userToken string) (*UserSummary, error)
+	Product(ctx context.Context, productID string) (*ProductSummary, error)
+}
+
+type tracker struct {
+	refunds storage.RefundStore
+	events  storage.EventStore
+	policy  entitlement.Engine
+}
+
+// NewTracker counts a user's transactions from events and judges refund
+// abuse by policy.
+func NewTracker(rs storage.RefundStore, ev storage.EventStore, policy entitlement.Engine) Tracker {
+	return &tracker{
+		refunds: rs,
+		events:  ev,
+		policy:  policy,
+	}
+}
+
+func (t *tracker) User(ctx context.Context, userToken string) (*UserSummary, error) {
+	history, err := t.refunds.ListRefunds(ctx, userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+	events, err := t.events.ListEvents(ctx, userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+
+	// products maps every known transaction to its product.
+	products := make(map[string]string)
+	for _, e := range events {
+		if e.TransactionID != "" {
+			products[e.TransactionID] = e.ProductID
+		}
+	}
+	for _, r := range history {
+		products[r.TransactionID] = r.ProductID
+	}
+
+	summary := &UserSummary{
+		UserToken: userToken,
+		Products:  make(map[string]*Stats),
+		History:   history,
+	}
+	stats := func(product string) *Stats {
+		s, ok := summary.Products[product]
+		if !ok {
+			s = &Stats{}
+			summary.Products[product] = s
+		}
+		return s
+	}
+	for _, product := range products {
+		stats(product).Transactions++
+	}
+	latest, declined := decisions(history)
+	for tx, decision := range latest {
+		s := stats(products[tx])
+		switch decision {
+		case storage.RefundGranted:
+			s.Refunds++
+		case storage.RefundReversed:
+			s.Reversed++
+		}
+	}
+	for _, r := range declined {
+		stats(r.ProductID).Declined++
+	}
+
+	for _, s := range summary.Products {
+		s.Rate = rate(s.Refunds, s.Transactions)
+		summary.Transactions += s.Transactions
+		summary.Refunds += s.Refunds
+		summary.Reversed += s.Reversed
+		summary.Declined += s.Declined
+	}
+	summary.Rate = rate(summary.Refunds, summary.Transactions)
+	summary.SerialRefunder = t.policy.SerialRefunder(summary.Refunds, summary.Transactions)
+	return summary, nil
+}
+
+func (t *tracker) Product(ctx context.Context, productID string) (*ProductSummary, error) {
+	history, err := t.refunds.ListProductRefunds(ctx, productID)
+	if err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+
+	summary := &ProductSummary{
+		ProductID: productID,
+		History:   history,
+	}
+	latest, declined := decisions(history)
+	users := make(map[string]bool)
+	for _, r := range history {
+		if latest[r.TransactionID] == storage.RefundGranted {
+			users[r.UserToken] = true
+		}
+	}
+	for _, decision := range latest {
+		switch decision {
+		case storage.RefundGranted:
+			summary.Refunds++
+		case storage.RefundReversed:
+			summary.Reversed++
+		}
+	}
+	summary.Declined = len(declined)
+	summary.Users = len(users)
+	return summary, nil
+}
+
+// decisions returns the latest refund or reversal of each transaction in
+// history, which is ordered by time, and the declined requests.
+func decisions(history []storage.Refund) (latest map[string]string, declined []storage.Refund) {
+	latest = make(map[string]string)
+	for _, r := range history {
+		switch r.Type {
+		case storage.RefundGranted, storage.RefundReversed:
+			latest[r.TransactionID] = r.Type
+		case storage.RefundDeclined:
+			declined = append(declined, r)
+		}
+	}
+	return latest, declined
+}
+
+func rate(refunds, transactions int) float64 {
+	if transactions == 0 {
+		return 0
+	}
+	return float64(refunds) / float64(transactions)
+}
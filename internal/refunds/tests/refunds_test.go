@@ -0,0 +1,92 @@
+package refunds
+
+import (
+	"context"
+	"subscription-server/internal/entitlement"
+	"subscription-server/internal/refunds"
+	"subscription-server/internal/storage"
+	"testing"
+	"time"
+)
+
+// fixture заполняет историю: три транзакции user1, из них одна возвращена,
+// одна возвращена и восстановлена, и один отказ у user2
+func fixture(t *testing.T) (storage.RefundStore, storage.EventStore) {
+	t.Helper()
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	rs := storage.NewMemoryRefundStore()
+	ev := storage.NewMemoryEventStore()
+
+	for i, e := range []storage.SubscriptionEvent{
+		{TransactionID: "1", ProductID: "monthly", Type: "SUBSCRIBED"},
+		{TransactionID: "2", ProductID: "monthly", Type: "DID_RENEW"},
+		{TransactionID: "3", ProductID: "coins", Type: "ONE_TIME_CHARGE"},
+	} {
+		e.ID = "e-" + e.TransactionID
+		e.UserToken = "user1"
+		e.OccurredAt = base.Add(time.Duration(i) * time.Hour)
+		if err := ev.AppendEvent(ctx, &e); err != nil {
+			t.Fatalf("Ошибка записи события: %v", err)
+		}
+	}
+	for i, r := range []storage.Refund{
+		{UserToken: "user1", ProductID: "monthly", TransactionID: "2", Type: storage.RefundGranted},
+		{UserToken: "user1", ProductID: "coins", TransactionID: "3", Type: storage.RefundGranted},
+		{UserToken: "user1", ProductID: "coins", TransactionID: "3", Type: storage.RefundReversed},
+		{UserToken: "user1", ProductID: "monthly", TransactionID: "1", Type: storage.RefundDeclined},
+		{UserToken: "user2", ProductID: "monthly", TransactionID: "9", Type: storage.RefundGranted},
+	} {
+		r.ID = "r-" + string(rune('a'+i))
+		r.OccurredAt = base.Add(time.Duration(10+i) * time.Hour)
+		if err := rs.RecordRefund(ctx, &r); err != nil {
+			t.Fatalf("Ошибка записи возврата: %v", err)
+		}
+	}
+	return rs, ev
+}
+
+// TestTracker_User проверяет статистику возвратов пользователя
+func TestTracker_User(t *testing.T) {
+	rs, ev := fixture(t)
+	tracker := refunds.NewTracker(rs, ev, entitlement.NewEngine(entitlement.Policy{MaxRefunds: 1}))
+
+	summary, err := tracker.User(context.Background(), "user1")
+	if err != nil {
+		t.Fatalf("Ошибка: %v", err)
+	}
+	if summary.Transactions != 3 || summary.Refunds != 1 || summary.Reversed != 1 || summary.Declined != 1 {
+		t.Errorf("Неправильная статистика: %+v", summary.Stats)
+	}
+	if summary.Rate < 0.33 || summary.Rate > 0.34 {
+		t.Errorf("Ожидалась доля возвратов 1/3, получено %v", summary.Rate)
+	}
+	if m := summary.Products["monthly"]; m == nil || m.Transactions != 2 || m.Refunds != 1 || m.Declined != 1 || m.Rate != 0.5 {
+		t.Errorf("Неправильная статистика monthly: %+v", m)
+	}
+	if c := summary.Products["coins"]; c == nil || c.Refunds != 0 || c.Reversed != 1 {
+		t.Errorf("Неправильная статистика coins: %+v", c)
+	}
+	if summary.SerialRefunder || len(summary.History) != 4 {
+		t.Errorf("Один возврат не превышает лимит: %+v", summary)
+	}
+
+	strict := refunds.NewTracker(rs, ev, entitlement.NewEngine(entitlement.Policy{MaxRefundRate: 0.2}))
+	if s, _ := strict.User(context.Background(), "user2"); s.SerialRefunder || s.Transactions != 1 || s.Rate != 1 {
+		t.Errorf("Единственный возврат не считается по доле: %+v", s)
+	}
+}
+
+// TestTracker_Product проверяет статистику возвратов продукта
+func TestTracker_Product(t *testing.T) {
+	rs, ev := fixture(t)
+	tracker := refunds.NewTracker(rs, ev, entitlement.NewEngine(entitlement.DefaultPolicy()))
+
+	summary, err := tracker.Product(context.Background(), "monthly")
+	if err != nil {
+		t.Fatalf("Ошибка: %v", err)
+	}
+	if summary.Refunds != 2 || summary.Reversed != 0 || summary.Declined != 1 || summary.Users != 2 || len(summary.History) != 3 {
+		t.Errorf("Неправильная статистика: %+v", summary)
+	}
+}
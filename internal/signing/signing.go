@@ -0,0 +1,144 @@
+// Package signing holds the ES256 machinery shared by everything the server
+// signs with its App Store Connect in-app purchase key.
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid ES256 private key")
+)
+
+// Audience is the aud claim of every token signed for Apple.
+const Audience = "appstoreconnect-v1"
+
+// tokenLifetime is how long App Store Server API tokens are valid; Apple
+// rejects tokens valid for more than an hour.
+const tokenLifetime = 20 * time.Minute
+
+// Key is an App Store Connect key with the identifier Apple knows it by.
+type Key struct {
+	ID         string
+	PrivateKey *ecdsa.PrivateKey
+}
+
+// ParsePrivateKey decodes a PEM encoded P-256 key, either PKCS#8 as in the
+// .p8 files App Store Connect hands out, or SEC 1.
+func ParsePrivateKey(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block", ErrInvalidKey)
+	}
+
+	var key *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		k, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		key = k
+	default:
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		ec, ok := k.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: not an ECDSA key", ErrInvalidKey)
+		}
+		key = ec
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%w: curve %s", ErrInvalidKey, key.Curve.Params().Name)
+	}
+	return key, nil
+}
+
+// LoadKey reads the key id from the PEM file at path.
+func LoadKey(id, path string) (*Key, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	pk, err := ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ID: id, PrivateKey: pk}, nil
+}
+
+// SignDER signs the SHA-256 digest of data and returns the ASN.1 DER
+// signature, the form StoreKit expects in promotional offer signatures.
+func (k *Key) SignDER(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, k.PrivateKey, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	return sig, nil
+}
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// SignJWS returns claims as a compact JWS signed with ES256, the form of
+// StoreKit 2 offer signatures and App Store Server API tokens.
+func (k *Key) SignJWS(claims any) (string, error) {
+	header, err := json.Marshal(jwsHeader{Alg: "ES256", Kid: k.ID, Typ: "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("encode header: %w", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("encode claims: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, k.PrivateKey, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	// JWS carries the raw 32 byte r and s instead of DER.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// APIClaims are the claims of an App Store Server API bearer token.
+type APIClaims struct {
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Audience  string `json:"aud"`
+	BundleID  string `json:"bid"`
+}
+
+// BearerToken returns a token authorizing App Store Server API requests for
+// bundleID as of now. issuerID is the issuer of the key in App Store Connect.
+func (k *Key) BearerToken(issuerID, bundleID string, now time.Time) (string, error) {
+	return k.SignJWS(APIClaims{
+		Issuer:    issuerID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenLifetime).Unix(),
+		Audience:  Audience,
+		BundleID:  bundleID,
+	})
+}
@@ -0,0 +1,90 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"subscription-server/internal/signing"
+	"testing"
+	"time"
+)
+
+// TestParsePrivateKey проверяет разбор ключей в форматах PKCS#8 и SEC 1
+func TestParsePrivateKey(t *testing.T) {
+	pk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(pk)
+	sec1, _ := x509.MarshalECPrivateKey(pk)
+
+	for _, block := range []*pem.Block{
+		{Type: "PRIVATE KEY", Bytes: pkcs8},
+		{Type: "EC PRIVATE KEY", Bytes: sec1},
+	} {
+		parsed, err := signing.ParsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Fatalf("Ошибка разбора %s: %v", block.Type, err)
+		}
+		if !parsed.Equal(pk) {
+			t.Errorf("Ключ %s разобран неверно", block.Type)
+		}
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(other)
+	if _, err := signing.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); !errors.Is(err, signing.ErrInvalidKey) {
+		t.Errorf("Ключ P-384 должен отклоняться, получено %v", err)
+	}
+	if _, err := signing.ParsePrivateKey([]byte("not a key")); !errors.Is(err, signing.ErrInvalidKey) {
+		t.Errorf("Ожидалась ошибка ErrInvalidKey, получено %v", err)
+	}
+}
+
+// TestKey_BearerToken проверяет подпись и содержимое токена App Store Server API
+func TestKey_BearerToken(t *testing.T) {
+	pk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key := &signing.Key{ID: "KEY123", PrivateKey: pk}
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	token, err := key.BearerToken("issuer-1", "com.test.app", now)
+	if err != nil {
+		t.Fatalf("Ошибка подписи токена: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Ожидалось 3 части JWS, получено %d", len(parts))
+	}
+	var header map[string]string
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(raw, &header)
+	if header["alg"] != "ES256" || header["kid"] != "KEY123" || header["typ"] != "JWT" {
+		t.Errorf("Неправильный заголовок: %v", header)
+	}
+
+	var claims signing.APIClaims
+	raw, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(raw, &claims)
+	if claims.Issuer != "issuer-1" || claims.BundleID != "com.test.app" || claims.Audience != signing.Audience {
+		t.Errorf("Неправильные утверждения: %+v", claims)
+	}
+	if claims.IssuedAt != now.Unix() || claims.ExpiresAt <= claims.IssuedAt || claims.ExpiresAt > now.Add(time.Hour).Unix() {
+		t.Errorf("Неправильный срок действия: %+v", claims)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("Подпись должна состоять из 64 байт r||s: %d (%v)", len(sig), err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&pk.PublicKey, digest[:], r, s) {
+		t.Error("Подпись не проверяется открытым ключом")
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// APICall is one request the server made to the App Store Server API, kept
+// as an audit of what was sent to Apple on behalf of a user.
+type APICall struct {
+	// ID is unique per attempt.
+	ID            string `json:"id"`
+	Operation     string `json:"operation"`
+	UserToken     string `json:"userToken"`
+	TransactionID string `json:"transactionId,omitempty"`
+	Environment   string `json:"environment,omitempty"`
+	// Request is the JSON body that was sent.
+	Request string `json:"request"`
+	// StatusCode is 0 when no response was received.
+	StatusCode int       `json:"statusCode"`
+	Error      string    `json:"error,omitempty"`
+	Attempt    int       `json:"attempt"`
+	SentAt     time.Time `json:"sentAt"`
+}
+
+// APICallLog is an append-only audit of App Store Server API requests.
+type APICallLog interface {
+	// RecordAPICall stores call unless one with the same ID exists.
+	RecordAPICall(ctx context.Context, call *APICall) error
+	// ListAPICalls returns the calls made for userToken by SentAt.
+	ListAPICalls(ctx context.Context, userToken string) ([]APICall, error)
+}
+
+type memoryAPICallLog struct {
+	mu     sync.RWMutex
+	ids    map[string]struct{}
+	byUser map[string][]APICall
+}
+
+func NewMemoryAPICallLog() APICallLog {
+	return &memoryAPICallLog{
+		ids:    make(map[string]struct{}),
+		byUser: make(map[string][]APICall),
+	}
+}
+
+func (m *memoryAPICallLog) RecordAPICall(ctx context.Context, call *APICall) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, exists := m.ids[call.ID]; exists {
+			return nil
+		}
+		m.ids[call.ID] = struct{}{}
+		m.byUser[call.UserToken] = append(m.byUser[call.UserToken], *call)
+		return nil
+	}
+}
+
+func (m *memoryAPICallLog) ListAPICalls(ctx context.Context, userToken string) ([]APICall, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		calls := make([]APICall, len(m.byUser[userToken]))
+		copy(calls, m.byUser[userToken])
+		sort.SliceStable(calls, func(i, j int) bool {
+			return calls[i].SentAt.Before(calls[j].SentAt)
+		})
+		return calls, nil
+	}
+}
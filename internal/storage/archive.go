@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrArchivedRequestNotFound = errors.New("archived request not found")
+)
+
+// ArchivedRequest is an inbound notification exactly as it was received,
+// together with what the server answered.
+type ArchivedRequest struct {
+	ID         string        `json:"id"`
+	Endpoint   string        `json:"endpoint"`
+	ReceivedAt time.Time     `json:"receivedAt"`
+	Headers    http.Header   `json:"headers"`
+	Body       []byte        `json:"body"`
+	StatusCode int           `json:"statusCode"`
+	Outcome    string        `json:"outcome"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// RequestArchive keeps inbound notifications for later inspection.
+type RequestArchive interface {
+	StoreRequest(ctx context.Context, req *ArchivedRequest) error
+	GetRequest(ctx context.Context, id string) (*ArchivedRequest, error)
+	// PruneRequests deletes requests received before the given time and
+	// returns how many were removed.
+	PruneRequests(ctx context.Context, before time.Time) (int, error)
+}
+
+type memoryRequestArchive struct {
+	mu   sync.RWMutex
+	data map[string]*ArchivedRequest
+}
+
+func NewMemoryRequestArchive() RequestArchive {
+	return &memoryRequestArchive{
+		data: make(map[string]*ArchivedRequest),
+	}
+}
+
+func (m *memoryRequestArchive) StoreRequest(ctx context.Context, req *ArchivedRequest) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.data[req.ID] = cloneArchivedRequest(req)
+		return nil
+	}
+}
+
+func (m *memoryRequestArchive) GetRequest(ctx context.Context, id string) (*ArchivedRequest, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		req, exists := m.data[id]
+		if !exists {
+			return nil, ErrArchivedRequestNotFound
+		}
+		return cloneArchivedRequest(req), nil
+	}
+}
+
+func (m *memoryRequestArchive) PruneRequests(ctx context.Context, before time.Time) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		pruned := 0
+		for id, req := range m.data {
+			if req.ReceivedAt.Before(before) {
+				delete(m.data, id)
+				pruned++
+			}
+		}
+		return pruned, nil
+	}
+}
+
+func cloneArchivedRequest(req *ArchivedRequest) *ArchivedRequest {
+	copy := *req
+	copy.Headers = req.Headers.Clone()
+	copy.Body = bytes.Clone(req.Body)
+	return &copy
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"subscription-server/internal/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CacheOptions struct {
+	// MaxEntries bounds the number of cached users; the least recently used
+	// entry is evicted first.
+	MaxEntries int
+	// TTL is the longest time an entry is served from memory. Active
+	// subscriptions are additionally never cached past their ExpiresAt.
+	TTL time.Duration
+	// Now is used instead of time.Now when set (tests).
+	Now func() time.Time
+	// ResubscribeEvery is the wait between attempts to subscribe to the
+	// changes of a shared backend, 1s by default.
+	ResubscribeEvery time.Duration
+	// Logger reports losing and regaining the changes subscription.
+	Logger logger.Logger
+}
+
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// CachedStorage is a Storage that serves reads from a local cache.
+type CachedStorage interface {
+	Storage
+	Stats() CacheStats
+}
+
+type cacheEntry struct {
+	status    SubscriptionStatus
+	expiresAt time.Time
+}
+
+type cachedStorage struct {
+	next Storage
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation is bumped on every invalidation so a read that raced with
+	// a write does not put the value it fetched back into the cache.
+	generation uint64
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	invalidations atomic.Uint64
+
+	// bypass is set while changes made by other instances cannot be seen;
+	// reads then go straight to next.
+	bypass atomic.Bool
+
+	stop context.CancelFunc
+}
+
+// NewCachedStorage wraps next with a read-through LRU cache. Writes go straight
+// to next and drop the cached entry. If next implements ChangeNotifier, writes
+// made by other instances invalidate the cache as well; the cache is bypassed
+// while it is not subscribed to those changes.
+func NewCachedStorage(next Storage, opts CacheOptions) CachedStorage {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.ResubscribeEvery <= 0 {
+		opts.ResubscribeEvery = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &cachedStorage{
+		next:    next,
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		stop:    cancel,
+	}
+
+	if notifier, ok := next.(ChangeNotifier); ok {
+		c.bypass.Store(true)
+		go c.watch(ctx, notifier)
+	}
+
+	return c
+}
+
+// watch invalidates entries changed by other instances. Whenever the
+// subscription fails or ends it bypasses the cache and subscribes again;
+// entries cached before are dropped, since changes may have been missed.
+func (c *cachedStorage) watch(ctx context.Context, notifier ChangeNotifier) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		changes, err := notifier.SubscribeChanges(ctx)
+		if err == nil {
+			c.flush()
+			c.bypass.Store(false)
+			c.log("INFO", "subscribed to changes, cache enabled")
+			for token := range changes {
+				c.invalidate(token)
+			}
+			err = fmt.Errorf("changes subscription closed")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.bypass.Store(true)
+		c.flush()
+		c.log("ERROR", fmt.Sprintf("cache disabled, retrying in %s: %v", c.opts.ResubscribeEvery, err))
+		t.Reset(c.opts.ResubscribeEvery)
+	}
+}
+
+func (c *cachedStorage) log(level, message string) {
+	if c.opts.Logger == nil {
+		return
+	}
+	c.opts.Logger.Log(logger.LogMessage{
+		Time:    time.Now().UTC(),
+		Level:   level,
+		Sender:  "cache",
+		Message: message,
+	})
+}
+
+func (c *cachedStorage) GetSubscriptionStatus(ctx context.Context, userToken string) (*SubscriptionStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if c.bypass.Load() {
+		c.misses.Add(1)
+		return c.next.GetSubscriptionStatus(ctx, userToken)
+	}
+
+	status, generation, ok := c.lookup(userToken)
+	if ok {
+		c.hits.Add(1)
+		return status, nil
+	}
+	c.misses.Add(1)
+
+	status, err := c.next.GetSubscriptionStatus(ctx, userToken)
+	if err != nil {
+		return nil, err
+	}
+	c.store(status, generation)
+
+	return status, nil
+}
+
+func (c *cachedStorage) SetSubscriptionStatus(ctx context.Context, status *SubscriptionStatus) error {
+	if err := c.next.SetSubscriptionStatus(ctx, status); err != nil {
+		return err
+	}
+	c.invalidate(status.UserToken)
+	return nil
+}
+
+func (c *cachedStorage) ListExpiredActive(ctx context.Context, cutoff time.Time, limit int) ([]SubscriptionStatus, error) {
+	return c.next.ListExpiredActive(ctx, cutoff, limit)
+}
+
+func (c *cachedStorage) DeactivateSubscription(ctx context.Context, expected *SubscriptionStatus) (bool, error) {
+	changed, err := c.next.DeactivateSubscription(ctx, expected)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		c.invalidate(expected.UserToken)
+	}
+	return changed, nil
+}
+
+func (c *cachedStorage) Stats() CacheStats {
+	return CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+func (c *cachedStorage) Close() {
+	c.stop()
+	c.next.Close()
+}
+
+func (c *cachedStorage) lookup(userToken string) (*SubscriptionStatus, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[userToken]
+	if !ok {
+		return nil, c.generation, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.opts.Now().Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, userToken)
+		return nil, c.generation, false
+	}
+	c.lru.MoveToFront(elem)
+
+	return entry.status.clone(), c.generation, true
+}
+
+func (c *cachedStorage) store(status *SubscriptionStatus, generation uint64) {
+	now := c.opts.Now()
+	expiresAt := now.Add(c.opts.TTL)
+	if status.IsActive && !status.ExpiresAt.IsZero() && status.ExpiresAt.Before(expiresAt) {
+		expiresAt = status.ExpiresAt
+	}
+	if !now.Before(expiresAt) || c.opts.MaxEntries <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	entry := &cacheEntry{status: *status.clone(), expiresAt: expiresAt}
+	if elem, ok := c.entries[status.UserToken]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[status.UserToken] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.opts.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).status.UserToken)
+		c.evictions.Add(1)
+	}
+}
+
+// flush drops every entry.
+func (c *cachedStorage) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *cachedStorage) invalidate(userToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if elem, ok := c.entries[userToken]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, userToken)
+		c.invalidations.Add(1)
+	}
+}
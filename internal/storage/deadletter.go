@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// DeadLetter is an inbound payload that could not be processed.
+type DeadLetter struct {
+	ID            string    `json:"id"`
+	Source        string    `json:"source"`
+	Payload       string    `json:"payload"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt"`
+	ArchiveID     string    `json:"archiveId,omitempty"`
+}
+
+// DeadLetterStore keeps failed payloads until they are retried successfully.
+type DeadLetterStore interface {
+	// SaveDeadLetter inserts the entry or replaces the one with the same ID.
+	SaveDeadLetter(ctx context.Context, dl *DeadLetter) error
+	GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error)
+	// ListDeadLetters returns all entries, oldest failure first.
+	ListDeadLetters(ctx context.Context) ([]DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id string) error
+}
+
+type memoryDeadLetterStore struct {
+	mu   sync.RWMutex
+	data map[string]*DeadLetter
+}
+
+func NewMemoryDeadLetterStore() DeadLetterStore {
+	return &memoryDeadLetterStore{
+		data: make(map[string]*DeadLetter),
+	}
+}
+
+func (m *memoryDeadLetterStore) SaveDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		copy := *dl
+		m.data[dl.ID] = &copy
+		return nil
+	}
+}
+
+func (m *memoryDeadLetterStore) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		dl, exists := m.data[id]
+		if !exists {
+			return nil, ErrDeadLetterNotFound
+		}
+		copy := *dl
+		return &copy, nil
+	}
+}
+
+func (m *memoryDeadLetterStore) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		list := make([]DeadLetter, 0, len(m.data))
+		for _, dl := range m.data {
+			list = append(list, *dl)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if !list[i].FirstFailedAt.Equal(list[j].FirstFailedAt) {
+				return list[i].FirstFailedAt.Before(list[j].FirstFailedAt)
+			}
+			return list[i].ID < list[j].ID
+		})
+		return list, nil
+	}
+}
+
+func (m *memoryDeadLetterStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, exists := m.data[id]; !exists {
+			return ErrDeadLetterNotFound
+		}
+		delete(m.data, id)
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SubscriptionEvent is one processed store event. Events are never updated or
+// deleted, so the list of events for a user is their subscription timeline.
+type SubscriptionEvent struct {
+	ID                    string    `json:"id"`
+	UserToken             string    `json:"userToken"`
+	Source                string    `json:"source"`
+	Type                  string    `json:"type"`
+	Subtype               string    `json:"subtype,omitempty"`
+	TransactionID         string    `json:"transactionId,omitempty"`
+	OriginalTransactionID string    `json:"originalTransactionId,omitempty"`
+	ProductID             string    `json:"productId,omitempty"`
+	Price                 *int64    `json:"price,omitempty"`
+	Currency              string    `json:"currency,omitempty"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+	OccurredAt            time.Time `json:"occurredAt"`
+	RecordedAt            time.Time `json:"recordedAt"`
+	// RawPayload is the request body the event was built from.
+	RawPayload string `json:"-"`
+	// ArchiveID points at the archived request the event came from, if any.
+	ArchiveID string `json:"archiveId,omitempty"`
+
+	// Transaction details, see applestore.Transaction.
+	TransactionType   string    `json:"transactionType,omitempty"`
+	TransactionReason string    `json:"transactionReason,omitempty"`
+	OwnershipType     string    `json:"ownershipType,omitempty"`
+	Environment       string    `json:"environment,omitempty"`
+	Storefront        string    `json:"storefront,omitempty"`
+	PurchaseDate      time.Time `json:"purchaseDate,omitzero"`
+	OfferType         int       `json:"offerType,omitempty"`
+	OfferID           string    `json:"offerId,omitempty"`
+	OfferDiscountType string    `json:"offerDiscountType,omitempty"`
+	IsUpgraded        bool      `json:"isUpgraded,omitempty"`
+}
+
+const (
+	EventSourceAppleServer = "apple_server"
+	EventSourceAppleClient = "apple_client"
+	// EventSourceAppleReceipt events carry a verified StoreKit 1 receipt.
+	EventSourceAppleReceipt = "apple_receipt"
+	// EventSourceAppTransaction events record purchases granted for a
+	// verified StoreKit 2 app transaction.
+	EventSourceAppTransaction = "apple_app_transaction"
+	EventSourceExpiry         = "expiry_sweeper"
+)
+
+// EventStore is an append-only log of subscription events. Appending an event
+// whose ID is already stored is a no-op, so retried deliveries are harmless.
+type EventStore interface {
+	AppendEvent(ctx context.Context, event *SubscriptionEvent) error
+	ListEvents(ctx context.Context, userToken string) ([]SubscriptionEvent, error)
+	// ListEventUsers returns every user token that has at least one event.
+	ListEventUsers(ctx context.Context) ([]string, error)
+}
+
+type memoryEventStore struct {
+	mu     sync.RWMutex
+	ids    map[string]struct{}
+	byUser map[string][]SubscriptionEvent
+}
+
+func NewMemoryEventStore() EventStore {
+	return &memoryEventStore{
+		ids:    make(map[string]struct{}),
+		byUser: make(map[string][]SubscriptionEvent),
+	}
+}
+
+func (m *memoryEventStore) AppendEvent(ctx context.Context, event *SubscriptionEvent) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, exists := m.ids[event.ID]; exists {
+			return nil
+		}
+		m.ids[event.ID] = struct{}{}
+		m.byUser[event.UserToken] = append(m.byUser[event.UserToken], *event)
+		return nil
+	}
+}
+
+func (m *memoryEventStore) ListEvents(ctx context.Context, userToken string) ([]SubscriptionEvent, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		events := make([]SubscriptionEvent, len(m.byUser[userToken]))
+		copy(events, m.byUser[userToken])
+		sortEvents(events)
+		return events, nil
+	}
+}
+
+func (m *memoryEventStore) ListEventUsers(ctx context.Context) ([]string, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		users := make([]string, 0, len(m.byUser))
+		for user := range m.byUser {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		return users, nil
+	}
+}
+
+func sortEvents(events []SubscriptionEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].OccurredAt.Equal(events[j].OccurredAt) {
+			return events[i].OccurredAt.Before(events[j].OccurredAt)
+		}
+		return events[i].RecordedAt.Before(events[j].RecordedAt)
+	})
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRenewalExtensionNotFound = errors.New("renewal extension not found")
+)
+
+// States of a renewal extension request.
+const (
+	// ExtensionPending is a mass extension Apple has accepted but not
+	// finished.
+	ExtensionPending = "pending"
+	// ExtensionSucceeded and ExtensionFailed are the outcome of a single
+	// subscription's extension.
+	ExtensionSucceeded = "succeeded"
+	ExtensionFailed    = "failed"
+	// ExtensionComplete is a mass extension Apple has finished; the counts
+	// tell how it went.
+	ExtensionComplete = "complete"
+)
+
+// RenewalExtension is a request to Apple to extend the renewal date of one
+// subscription or of every active subscriber of a product.
+type RenewalExtension struct {
+	// RequestID is the requestIdentifier sent to Apple.
+	RequestID string `json:"requestId"`
+	// UserToken and OriginalTransactionID are set for a single
+	// subscription, ProductID for a mass extension.
+	UserToken             string `json:"userToken,omitempty"`
+	OriginalTransactionID string `json:"originalTransactionId,omitempty"`
+	ProductID             string `json:"productId,omitempty"`
+	Environment           string `json:"environment,omitempty"`
+	Days                  int    `json:"extendByDays"`
+	// Reason is Apple's extendReasonCode.
+	Reason int    `json:"extendReasonCode"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// EffectiveDate is the new renewal date of a single subscription.
+	EffectiveDate  time.Time `json:"effectiveDate,omitzero"`
+	SucceededCount int64     `json:"succeededCount"`
+	FailedCount    int64     `json:"failedCount"`
+	RequestedAt    time.Time `json:"requestedAt,omitzero"`
+	CompletedAt    time.Time `json:"completedAt,omitzero"`
+}
+
+// ExtensionStore keeps renewal extension requests by request identifier.
+type ExtensionStore interface {
+	// SaveRenewalExtension inserts the request or replaces the one with the
+	// same RequestID.
+	SaveRenewalExtension(ctx context.Context, e *RenewalExtension) error
+	GetRenewalExtension(ctx context.Context, requestID string) (*RenewalExtension, error)
+	// ListRenewalExtensions returns all requests, newest first.
+	ListRenewalExtensions(ctx context.Context) ([]RenewalExtension, error)
+}
+
+type memoryExtensionStore struct {
+	mu   sync.RWMutex
+	data map[string]*RenewalExtension
+}
+
+func NewMemoryExtensionStore() ExtensionStore {
+	return &memoryExtensionStore{
+		data: make(map[string]*RenewalExtension),
+	}
+}
+
+func (m *memoryExtensionStore) SaveRenewalExtension(ctx context.Context, e *RenewalExtension) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		copy := *e
+		m.data[e.RequestID] = &copy
+		return nil
+	}
+}
+
+func (m *memoryExtensionStore) GetRenewalExtension(ctx context.Context, requestID string) (*RenewalExtension, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		e, exists := m.data[requestID]
+		if !exists {
+			return nil, ErrRenewalExtensionNotFound
+		}
+		copy := *e
+		return &copy, nil
+	}
+}
+
+func (m *memoryExtensionStore) ListRenewalExtensions(ctx context.Context) ([]RenewalExtension, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		list := make([]RenewalExtension, 0, len(m.data))
+		for _, e := range m.data {
+			list = append(list, *e)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if !list[i].RequestedAt.Equal(list[j].RequestedAt) {
+				return list[i].RequestedAt.After(list[j].RequestedAt)
+			}
+			return list[i].RequestID < list[j].RequestID
+		})
+		return list, nil
+	}
+}
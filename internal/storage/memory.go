@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
@@ -33,9 +35,7 @@ func (m *memoryStorage) GetSubscriptionStatus(ctx context.Context, userToken str
 		if !exists {
 			return nil, ErrSubscriptionNotFound
 		}
-		copy := *status
-
-		return &copy, nil
+		return status.clone(), nil
 	}
 
 }
@@ -48,8 +48,57 @@ func (m *memoryStorage) SetSubscriptionStatus(ctx context.Context, status *Subsc
 		m.mu.Lock()
 		defer m.mu.Unlock()
 
-		copy := *status
-		m.data[status.UserToken] = &copy
+		m.data[status.UserToken] = status.clone()
 		return nil
 	}
 }
+
+func (m *memoryStorage) ListExpiredActive(ctx context.Context, cutoff time.Time, limit int) ([]SubscriptionStatus, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		list := []SubscriptionStatus{}
+		for _, status := range m.data {
+			if status.IsActive && status.AccessEndsAt().Before(cutoff) {
+				list = append(list, *status.clone())
+			}
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if a, b := list[i].AccessEndsAt(), list[j].AccessEndsAt(); !a.Equal(b) {
+				return a.Before(b)
+			}
+			return list[i].UserToken < list[j].UserToken
+		})
+		if limit > 0 && len(list) > limit {
+			list = list[:limit]
+		}
+		return list, nil
+	}
+}
+
+func (m *memoryStorage) DeactivateSubscription(ctx context.Context, expected *SubscriptionStatus) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		status, exists := m.data[expected.UserToken]
+		if !exists || !status.IsActive ||
+			!status.ExpiresAt.Equal(expected.ExpiresAt) ||
+			!status.GracePeriodExpiresAt.Equal(expected.GracePeriodExpiresAt) {
+			return false, nil
+		}
+		status.IsActive = false
+		return true, nil
+	}
+}
+
+func (m *memoryStorage) Close() {
+	// Nothing to release for the in-memory backend
+}
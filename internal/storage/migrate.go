@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// migrate applies every migration from migrations/<dir> that is not yet recorded
+// in schema_migrations. Each file runs in its own transaction.
+func migrate(ctx context.Context, db *sql.DB, d dialect, dir string) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version TEXT PRIMARY KEY,
+		applied_at `+d.timestampType+` NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	root := path.Join("migrations", dir)
+	entries, err := fs.ReadDir(migrationsFS, root)
+	if err != nil {
+		return fmt.Errorf("read migrations: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && path.Ext(e.Name()) == ".sql" {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var applied int
+		if err := db.QueryRowContext(ctx,
+			d.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), name,
+		).Scan(&applied); err != nil {
+			return fmt.Errorf("check migration %s: %w", name, err)
+		}
+		if applied > 0 {
+			continue
+		}
+
+		body, err := migrationsFS.ReadFile(path.Join(root, name))
+		if err != nil {
+			return fmt.Errorf("read migration %s: %w", name, err)
+		}
+		if err := applyMigration(ctx, db, d, name, string(body)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, d dialect, name string, body string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin migration %s: %w", name, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return fmt.Errorf("apply migration %s: %w", name, err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		d.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, `+d.now+`)`), name,
+	); err != nil {
+		return fmt.Errorf("record migration %s: %w", name, err)
+	}
+
+	return tx.Commit()
+}
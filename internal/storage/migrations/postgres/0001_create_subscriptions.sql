@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS subscriptions (
+    user_token              TEXT PRIMARY KEY,
+    product_id              TEXT NOT NULL DEFAULT '',
+    original_transaction_id TEXT NOT NULL DEFAULT '',
+    expires_at              TIMESTAMPTZ NOT NULL,
+    is_active               BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at              TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS subscriptions_original_transaction_id_idx
+    ON subscriptions (original_transaction_id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS notification_queue (
+    seq           BIGSERIAL PRIMARY KEY,
+    source        TEXT NOT NULL,
+    partition_key TEXT NOT NULL,
+    payload       TEXT NOT NULL,
+    archive_id    TEXT NOT NULL DEFAULT '',
+    enqueued_at   TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS grace_period_expires_at TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00+00';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS in_billing_retry BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00+00';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS environment TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS original_purchase_date TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00+00';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS ownership_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS subscription_group_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS offer_type INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS offer_id TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS transaction_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS transaction_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS ownership_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS environment TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS storefront TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS purchase_date TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00+00';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS offer_type INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS offer_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS offer_discount_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN IF NOT EXISTS is_upgraded BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS purchases (
+    transaction_id          TEXT PRIMARY KEY,
+    original_transaction_id TEXT NOT NULL,
+    user_token              TEXT NOT NULL,
+    product_id              TEXT NOT NULL,
+    product_type            TEXT NOT NULL,
+    purchased_at            TIMESTAMPTZ NOT NULL,
+    expires_at              TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00+00',
+    revoked_at              TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00+00',
+    environment             TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS purchases_user_token_idx
+    ON purchases (user_token, purchased_at);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id             TEXT PRIMARY KEY,
+    user_token     TEXT NOT NULL,
+    account        TEXT NOT NULL,
+    amount         BIGINT NOT NULL,
+    reason         TEXT NOT NULL,
+    transaction_id TEXT NOT NULL DEFAULT '',
+    created_at     TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_user_token_idx
+    ON ledger_entries (user_token, created_at);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS ledger_balances (
+    user_token TEXT NOT NULL,
+    account    TEXT NOT NULL,
+    balance    BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_token, account)
+);
+
+INSERT INTO ledger_balances (user_token, account, balance)
+SELECT user_token, account, SUM(amount)
+FROM ledger_entries
+GROUP BY user_token, account
+ON CONFLICT (user_token, account) DO NOTHING;
@@ -0,0 +1 @@
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS ownership_type TEXT NOT NULL DEFAULT '';
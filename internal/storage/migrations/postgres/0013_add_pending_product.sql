@@ -0,0 +1 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS pending_product_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS api_calls (
+    id             TEXT PRIMARY KEY,
+    operation      TEXT NOT NULL,
+    user_token     TEXT NOT NULL,
+    transaction_id TEXT NOT NULL DEFAULT '',
+    environment    TEXT NOT NULL DEFAULT '',
+    request        TEXT NOT NULL,
+    status_code    INTEGER NOT NULL DEFAULT 0,
+    error          TEXT NOT NULL DEFAULT '',
+    attempt        INTEGER NOT NULL DEFAULT 1,
+    sent_at        TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS api_calls_user_token_idx
+    ON api_calls (user_token, sent_at);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS subscriptions (
+    user_token              TEXT PRIMARY KEY,
+    product_id              TEXT NOT NULL DEFAULT '',
+    original_transaction_id TEXT NOT NULL DEFAULT '',
+    expires_at              TIMESTAMP NOT NULL,
+    is_active               BOOLEAN NOT NULL DEFAULT 0,
+    updated_at              TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS subscriptions_original_transaction_id_idx
+    ON subscriptions (original_transaction_id);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS subscription_events (
+    id                      TEXT PRIMARY KEY,
+    user_token              TEXT NOT NULL,
+    source                  TEXT NOT NULL,
+    type                    TEXT NOT NULL,
+    subtype                 TEXT NOT NULL DEFAULT '',
+    transaction_id          TEXT NOT NULL DEFAULT '',
+    original_transaction_id TEXT NOT NULL DEFAULT '',
+    product_id              TEXT NOT NULL DEFAULT '',
+    price                   BIGINT,
+    currency                TEXT NOT NULL DEFAULT '',
+    expires_at              TIMESTAMP NOT NULL,
+    occurred_at             TIMESTAMP NOT NULL,
+    recorded_at             TIMESTAMP NOT NULL,
+    raw_payload             TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS subscription_events_user_token_idx
+    ON subscription_events (user_token, occurred_at, recorded_at);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS request_archive (
+    id          TEXT PRIMARY KEY,
+    endpoint    TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    headers     TEXT NOT NULL,
+    body_gzip   BLOB NOT NULL,
+    status_code INTEGER NOT NULL,
+    outcome     TEXT NOT NULL DEFAULT '',
+    duration_ms BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS request_archive_received_at_idx
+    ON request_archive (received_at);
+
+ALTER TABLE subscription_events ADD COLUMN archive_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id              TEXT PRIMARY KEY,
+    source          TEXT NOT NULL,
+    payload         TEXT NOT NULL,
+    error           TEXT NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 1,
+    first_failed_at TIMESTAMP NOT NULL,
+    last_failed_at  TIMESTAMP NOT NULL,
+    archive_id      TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS dead_letters_first_failed_at_idx
+    ON dead_letters (first_failed_at);
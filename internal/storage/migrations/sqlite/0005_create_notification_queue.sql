@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS notification_queue (
+    seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+    source        TEXT NOT NULL,
+    partition_key TEXT NOT NULL,
+    payload       TEXT NOT NULL,
+    archive_id    TEXT NOT NULL DEFAULT '',
+    enqueued_at   TIMESTAMP NOT NULL
+);
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS subscriptions_active_expires_at_idx
+    ON subscriptions (is_active, expires_at);
@@ -0,0 +1,4 @@
+ALTER TABLE subscriptions ADD COLUMN grace_period_expires_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+ALTER TABLE subscriptions ADD COLUMN in_billing_retry BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN revoked_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+ALTER TABLE subscriptions ADD COLUMN environment TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+ALTER TABLE subscriptions ADD COLUMN auto_renew_enabled BOOLEAN;
+ALTER TABLE subscriptions ADD COLUMN expiration_intent INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN auto_renew_product_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN renewal_price BIGINT;
+ALTER TABLE subscriptions ADD COLUMN renewal_currency TEXT NOT NULL DEFAULT '';
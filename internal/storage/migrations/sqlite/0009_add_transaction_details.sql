@@ -0,0 +1,16 @@
+ALTER TABLE subscriptions ADD COLUMN original_purchase_date TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+ALTER TABLE subscriptions ADD COLUMN ownership_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN subscription_group_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN offer_type INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN offer_id TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE subscription_events ADD COLUMN transaction_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN transaction_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN ownership_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN environment TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN storefront TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN purchase_date TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+ALTER TABLE subscription_events ADD COLUMN offer_type INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscription_events ADD COLUMN offer_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN offer_discount_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscription_events ADD COLUMN is_upgraded BOOLEAN NOT NULL DEFAULT 0;
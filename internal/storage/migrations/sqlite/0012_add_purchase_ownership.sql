@@ -0,0 +1 @@
+ALTER TABLE purchases ADD COLUMN ownership_type TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE subscriptions ADD COLUMN pending_product_id TEXT NOT NULL DEFAULT '';
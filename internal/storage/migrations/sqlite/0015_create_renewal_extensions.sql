@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS renewal_extensions (
+    request_id              TEXT PRIMARY KEY,
+    user_token              TEXT NOT NULL DEFAULT '',
+    original_transaction_id TEXT NOT NULL DEFAULT '',
+    product_id              TEXT NOT NULL DEFAULT '',
+    environment             TEXT NOT NULL DEFAULT '',
+    days                    INTEGER NOT NULL,
+    reason                  INTEGER NOT NULL DEFAULT 0,
+    status                  TEXT NOT NULL,
+    error                   TEXT NOT NULL DEFAULT '',
+    effective_date          TIMESTAMP NOT NULL,
+    succeeded_count         BIGINT NOT NULL DEFAULT 0,
+    failed_count            BIGINT NOT NULL DEFAULT 0,
+    requested_at            TIMESTAMP NOT NULL,
+    completed_at            TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS renewal_extensions_requested_at_idx
+    ON renewal_extensions (requested_at);
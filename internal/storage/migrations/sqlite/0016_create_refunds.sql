@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS refunds (
+    id                      TEXT PRIMARY KEY,
+    user_token              TEXT NOT NULL,
+    product_id              TEXT NOT NULL DEFAULT '',
+    transaction_id          TEXT NOT NULL,
+    original_transaction_id TEXT NOT NULL DEFAULT '',
+    type                    TEXT NOT NULL,
+    revocation_reason       INTEGER,
+    price                   BIGINT,
+    currency                TEXT NOT NULL DEFAULT '',
+    environment             TEXT NOT NULL DEFAULT '',
+    occurred_at             TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS refunds_user_token_idx
+    ON refunds (user_token, occurred_at);
+
+CREATE INDEX IF NOT EXISTS refunds_product_id_idx
+    ON refunds (product_id, occurred_at);
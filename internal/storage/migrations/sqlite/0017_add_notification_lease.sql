@@ -0,0 +1,4 @@
+ALTER TABLE notification_queue ADD COLUMN lease_until TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+
+CREATE INDEX IF NOT EXISTS notification_queue_lease_until_idx
+    ON notification_queue (lease_until, seq);
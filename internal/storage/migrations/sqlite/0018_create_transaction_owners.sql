@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS transaction_owners (
+    original_transaction_id TEXT PRIMARY KEY,
+    user_token              TEXT NOT NULL
+);
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+var postgresDialect = dialect{
+	name:          "postgres",
+	timestampType: "TIMESTAMPTZ",
+	now:           "NOW()",
+	numbered:      true,
+	skipLocked:    ` FOR UPDATE SKIP LOCKED`,
+}
+
+type PostgresOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// NewPostgresStorage connects to dsn, applies pending migrations and returns a
+// Storage backed by the subscriptions table.
+func NewPostgresStorage(ctx context.Context, dsn string, opts PostgresOptions) (Storage, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping postgres: %w", err)
+	}
+	if err := migrate(ctx, db, postgresDialect, "postgres"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate postgres: %w", err)
+	}
+
+	return &sqlStorage{
+		db:      db,
+		dialect: postgresDialect,
+	}, nil
+}
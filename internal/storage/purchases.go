@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Product types, as reported in the type field of an App Store transaction.
+const (
+	ProductTypeAutoRenewable = "Auto-Renewable Subscription"
+	ProductTypeNonRenewing   = "Non-Renewing Subscription"
+	ProductTypeNonConsumable = "Non-Consumable"
+	ProductTypeConsumable    = "Consumable"
+)
+
+// Purchase is a one-off entitlement: a non-consumable, which lasts until it
+// is revoked, or a non-renewing subscription, whose period the server
+// computes at purchase time.
+type Purchase struct {
+	TransactionID         string    `json:"transactionId"`
+	OriginalTransactionID string    `json:"originalTransactionId"`
+	UserToken             string    `json:"userToken"`
+	ProductID             string    `json:"productId"`
+	ProductType           string    `json:"productType"`
+	PurchasedAt           time.Time `json:"purchasedAt"`
+	// ExpiresAt is zero for non-consumables.
+	ExpiresAt   time.Time `json:"expiresAt,omitzero"`
+	RevokedAt   time.Time `json:"revokedAt,omitzero"`
+	Environment string    `json:"environment,omitempty"`
+	// OwnershipType is "PURCHASED" or "FAMILY_SHARED".
+	OwnershipType string `json:"ownershipType,omitempty"`
+	// IsActive is not stored; readers compute it with the entitlement
+	// package.
+	IsActive bool `json:"isActive"`
+}
+
+// Ledger entry reasons.
+const (
+	LedgerReasonPurchase = "purchase"
+	LedgerReasonClawback = "clawback"
+	LedgerReasonDebit    = "debit"
+)
+
+var (
+	ErrLedgerEntryNotFound = errors.New("ledger entry not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	// ErrLedgerEntryConflict means an entry ID was reused for a different
+	// user, account or amount.
+	ErrLedgerEntryConflict = errors.New("ledger entry id reused with different data")
+)
+
+// LedgerEntry moves the balance of one of a user's accounts. Consumables
+// credit an account named after their product, or credits.Account when they
+// are configured as credit products.
+type LedgerEntry struct {
+	// ID makes the entry idempotent, e.g. "apple:" plus the transaction ID.
+	ID            string    `json:"id"`
+	UserToken     string    `json:"userToken"`
+	Account       string    `json:"account"`
+	Amount        int64     `json:"amount"`
+	Reason        string    `json:"reason"`
+	TransactionID string    `json:"transactionId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// PurchaseStore keeps everything bought outside of auto-renewable
+// subscriptions.
+type PurchaseStore interface {
+	// SavePurchase inserts or replaces the purchase with the same
+	// TransactionID.
+	SavePurchase(ctx context.Context, p *Purchase) error
+	// InsertPurchase saves p unless a purchase with the same TransactionID
+	// exists, and returns the stored purchase either way.
+	InsertPurchase(ctx context.Context, p *Purchase) (*Purchase, error)
+	// ClaimOriginalTransaction binds originalTransactionID to userToken
+	// unless it is bound already, and returns the user it is bound to.
+	ClaimOriginalTransaction(ctx context.Context, originalTransactionID, userToken string) (string, error)
+	// ListPurchases returns the purchases of userToken by PurchasedAt.
+	ListPurchases(ctx context.Context, userToken string) ([]Purchase, error)
+	// AppendLedgerEntry records e unless an entry with the same ID exists and
+	// reports whether it was added. The balance may go negative.
+	AppendLedgerEntry(ctx context.Context, e *LedgerEntry) (bool, error)
+	// DebitLedgerEntry records e, whose Amount is negative, only if the
+	// balance of its account covers it, and returns the stored entry. If an
+	// entry with the same ID exists it is returned without debiting again,
+	// or ErrLedgerEntryConflict if it differs from e.
+	DebitLedgerEntry(ctx context.Context, e *LedgerEntry) (*LedgerEntry, error)
+	GetLedgerEntry(ctx context.Context, id string) (*LedgerEntry, error)
+	// ListLedgerEntries returns the entries of userToken by CreatedAt.
+	ListLedgerEntries(ctx context.Context, userToken string) ([]LedgerEntry, error)
+	// Balances sums the entries of userToken per account.
+	Balances(ctx context.Context, userToken string) (map[string]int64, error)
+}
+
+// sameEntry reports whether a repeated entry ID carries the same movement.
+func sameEntry(a, b *LedgerEntry) bool {
+	return a.UserToken == b.UserToken && a.Account == b.Account && a.Amount == b.Amount
+}
+
+type memoryPurchaseStore struct {
+	mu        sync.RWMutex
+	purchases map[string]Purchase
+	owners    map[string]string
+	ledgerIDs map[string]LedgerEntry
+	ledger    map[string][]LedgerEntry
+}
+
+func NewMemoryPurchaseStore() PurchaseStore {
+	return &memoryPurchaseStore{
+		purchases: make(map[string]Purchase),
+		owners:    make(map[string]string),
+		ledgerIDs: make(map[string]LedgerEntry),
+		ledger:    make(map[string][]LedgerEntry),
+	}
+}
+
+func (m *memoryPurchaseStore) SavePurchase(ctx context.Context, p *Purchase) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		stored := *p
+		stored.IsActive = false
+		m.purchases[p.TransactionID] = stored
+		return nil
+	}
+}
+
+func (m *memoryPurchaseStore) ClaimOriginalTransaction(ctx context.Context, originalTransactionID, userToken string) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		owner, ok := m.owners[originalTransactionID]
+		if !ok {
+			owner = userToken
+			m.owners[originalTransactionID] = owner
+		}
+		return owner, nil
+	}
+}
+
+func (m *memoryPurchaseStore) InsertPurchase(ctx context.Context, p *Purchase) (*Purchase, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		stored, ok := m.purchases[p.TransactionID]
+		if !ok {
+			stored = *p
+			stored.IsActive = false
+			m.purchases[p.TransactionID] = stored
+		}
+		return &stored, nil
+	}
+}
+
+func (m *memoryPurchaseStore) ListPurchases(ctx context.Context, userToken string) ([]Purchase, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		list := []Purchase{}
+		for _, p := range m.purchases {
+			if p.UserToken == userToken {
+				list = append(list, p)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if !list[i].PurchasedAt.Equal(list[j].PurchasedAt) {
+				return list[i].PurchasedAt.Before(list[j].PurchasedAt)
+			}
+			return list[i].TransactionID < list[j].TransactionID
+		})
+		return list, nil
+	}
+}
+
+func (m *memoryPurchaseStore) AppendLedgerEntry(ctx context.Context, e *LedgerEntry) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, exists := m.ledgerIDs[e.ID]; exists {
+			return false, nil
+		}
+		m.append(e)
+		return true, nil
+	}
+}
+
+func (m *memoryPurchaseStore) DebitLedgerEntry(ctx context.Context, e *LedgerEntry) (*LedgerEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if stored, exists := m.ledgerIDs[e.ID]; exists {
+			if !sameEntry(&stored, e) {
+				return nil, ErrLedgerEntryConflict
+			}
+			return &stored, nil
+		}
+		var balance int64
+		for _, entry := range m.ledger[e.UserToken] {
+			if entry.Account == e.Account {
+				balance += entry.Amount
+			}
+		}
+		if balance+e.Amount < 0 {
+			return nil, ErrInsufficientBalance
+		}
+		m.append(e)
+		stored := *e
+		return &stored, nil
+	}
+}
+
+func (m *memoryPurchaseStore) append(e *LedgerEntry) {
+	m.ledgerIDs[e.ID] = *e
+	m.ledger[e.UserToken] = append(m.ledger[e.UserToken], *e)
+}
+
+func (m *memoryPurchaseStore) GetLedgerEntry(ctx context.Context, id string) (*LedgerEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		e, exists := m.ledgerIDs[id]
+		if !exists {
+			return nil, ErrLedgerEntryNotFound
+		}
+		return &e, nil
+	}
+}
+
+func (m *memoryPurchaseStore) ListLedgerEntries(ctx context.Context, userToken string) ([]LedgerEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		entries := make([]LedgerEntry, len(m.ledger[userToken]))
+		copy(entries, m.ledger[userToken])
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+		})
+		return entries, nil
+	}
+}
+
+func (m *memoryPurchaseStore) Balances(ctx context.Context, userToken string) (map[string]int64, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		balances := make(map[string]int64)
+		for _, e := range m.ledger[userToken] {
+			balances[e.Account] += e.Amount
+		}
+		return balances, nil
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueuedNotification is an accepted notification waiting to be processed.
+type QueuedNotification struct {
+	// Seq is assigned by the queue and orders notifications by arrival.
+	Seq          int64
+	Source       string
+	PartitionKey string
+	Payload      string
+	ArchiveID    string
+	EnqueuedAt   time.Time
+	// LeaseUntil is when the instance processing the notification gives it
+	// up. Until then no other instance claims it.
+	LeaseUntil time.Time
+}
+
+// NotificationQueue durably stores accepted notifications until they are
+// acknowledged, so nothing is lost if the process stops mid-way.
+type NotificationQueue interface {
+	// EnqueueNotification stores n leased until n.LeaseUntil.
+	EnqueueNotification(ctx context.Context, n *QueuedNotification) error
+	// PendingNotifications returns every unacknowledged notification in
+	// Seq order.
+	PendingNotifications(ctx context.Context) ([]QueuedNotification, error)
+	// ClaimNotifications leases up to limit unacknowledged notifications
+	// whose lease ended by now until the given time, and returns them in Seq
+	// order. Concurrent callers never claim the same notification. A limit
+	// of 0 or less claims all of them.
+	ClaimNotifications(ctx context.Context, now, until time.Time, limit int) ([]QueuedNotification, error)
+	AckNotification(ctx context.Context, seq int64) error
+}
+
+type memoryNotificationQueue struct {
+	mu      sync.Mutex
+	nextSeq int64
+	pending map[int64]QueuedNotification
+}
+
+func NewMemoryNotificationQueue() NotificationQueue {
+	return &memoryNotificationQueue{
+		pending: make(map[int64]QueuedNotification),
+	}
+}
+
+func (m *memoryNotificationQueue) EnqueueNotification(ctx context.Context, n *QueuedNotification) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.nextSeq++
+		n.Seq = m.nextSeq
+		m.pending[n.Seq] = *n
+		return nil
+	}
+}
+
+func (m *memoryNotificationQueue) PendingNotifications(ctx context.Context) ([]QueuedNotification, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		list := make([]QueuedNotification, 0, len(m.pending))
+		for _, n := range m.pending {
+			list = append(list, n)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+		return list, nil
+	}
+}
+
+func (m *memoryNotificationQueue) ClaimNotifications(ctx context.Context, now, until time.Time, limit int) ([]QueuedNotification, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		list := []QueuedNotification{}
+		for _, n := range m.pending {
+			if !n.LeaseUntil.After(now) {
+				list = append(list, n)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+		if limit > 0 && len(list) > limit {
+			list = list[:limit]
+		}
+		for i := range list {
+			list[i].LeaseUntil = until
+			m.pending[list[i].Seq] = list[i]
+		}
+		return list, nil
+	}
+}
+
+func (m *memoryNotificationQueue) AckNotification(ctx context.Context, seq int64) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.pending, seq)
+		return nil
+	}
+}
@@ -0,0 +1,1072 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisOptions struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string
+}
+
+type redisStorage struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStorage connects to Redis and returns a Storage that keeps one hash
+// per user plus secondary index sets, and publishes the user token of every
+// modified record so other instances can drop stale state.
+func NewRedisStorage(ctx context.Context, opts RedisOptions) (Storage, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ping redis: %w", err)
+	}
+
+	prefix := opts.KeyPrefix
+	if prefix == "" {
+		prefix = "subscription-server"
+	}
+
+	return &redisStorage{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+func (s *redisStorage) userKey(userToken string) string {
+	return s.prefix + ":sub:" + userToken
+}
+
+func (s *redisStorage) originalTransactionKey(originalTransactionID string) string {
+	return s.prefix + ":idx:otx:" + originalTransactionID
+}
+
+// expiryKey is a sorted set of active users scored by AccessEndsAt in
+// milliseconds.
+func (s *redisStorage) expiryKey() string {
+	return s.prefix + ":idx:expiry"
+}
+
+func (s *redisStorage) changesChannel() string {
+	return s.prefix + ":changes"
+}
+
+func (s *redisStorage) GetSubscriptionStatus(ctx context.Context, userToken string) (*SubscriptionStatus, error) {
+	fields, err := s.client.HGetAll(ctx, s.userKey(userToken)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get subscription status: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	status := &SubscriptionStatus{
+		UserToken:             userToken,
+		ProductID:             fields["product_id"],
+		OriginalTransactionID: fields["original_transaction_id"],
+		Environment:           fields["environment"],
+		AutoRenewProductID:    fields["auto_renew_product_id"],
+		RenewalCurrency:       fields["renewal_currency"],
+		OwnershipType:         fields["ownership_type"],
+		SubscriptionGroupID:   fields["subscription_group_id"],
+		OfferID:               fields["offer_id"],
+		PendingProductID:      fields["pending_product_id"],
+	}
+	for name, dst := range map[string]*time.Time{
+		"expires_at":              &status.ExpiresAt,
+		"grace_period_expires_at": &status.GracePeriodExpiresAt,
+		"revoked_at":              &status.RevokedAt,
+		"original_purchase_date":  &status.OriginalPurchaseDate,
+	} {
+		if *dst, err = parseRedisTime(fields[name]); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+	}
+	for name, dst := range map[string]*bool{
+		"is_active":        &status.IsActive,
+		"in_billing_retry": &status.InBillingRetry,
+	} {
+		if *dst, err = parseRedisBool(fields[name]); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+	}
+
+	if v := fields["auto_renew_enabled"]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse auto_renew_enabled: %w", err)
+		}
+		status.AutoRenewEnabled = &enabled
+	}
+	for name, dst := range map[string]*int{
+		"expiration_intent": &status.ExpirationIntent,
+		"offer_type":        &status.OfferType,
+	} {
+		if v := fields[name]; v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", name, err)
+			}
+		}
+	}
+	if v := fields["renewal_price"]; v != "" {
+		price, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse renewal_price: %w", err)
+		}
+		status.RenewalPrice = &price
+	}
+
+	return status, nil
+}
+
+// formatRedisTime stores zero times as an empty string so that fields added
+// later read back as zero on older records.
+func formatRedisTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseRedisTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// formatRedisOptional stores nil as an empty string.
+func formatRedisOptional[T any](v *T) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(*v)
+}
+
+func parseRedisBool(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// setStatusScript replaces the user hash and moves the user between index sets
+// atomically, then announces the change.
+//
+// KEYS[1] user hash, KEYS[2] expiry index; ARGV: prefix, user token,
+// product_id, original_transaction_id, is_active, changes channel, expiry
+// score in milliseconds, followed by the field/value pairs of the hash.
+var setStatusScript = redis.NewScript(`
+local old = redis.call('HMGET', KEYS[1], 'original_transaction_id', 'product_id')
+local otxKey = ARGV[1] .. ':idx:otx:'
+local productKey = ARGV[1] .. ':idx:product:'
+
+if old[1] and old[1] ~= ARGV[4] then
+	redis.call('SREM', otxKey .. old[1], ARGV[2])
+end
+if old[2] and old[2] ~= ARGV[3] then
+	redis.call('SREM', productKey .. old[2], ARGV[2])
+end
+
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], unpack(ARGV, 8))
+
+if ARGV[4] ~= '' then
+	redis.call('SADD', otxKey .. ARGV[4], ARGV[2])
+end
+if ARGV[3] ~= '' then
+	redis.call('SADD', productKey .. ARGV[3], ARGV[2])
+end
+if ARGV[5] == 'true' then
+	redis.call('ZADD', KEYS[2], ARGV[7], ARGV[2])
+else
+	redis.call('ZREM', KEYS[2], ARGV[2])
+end
+
+redis.call('PUBLISH', ARGV[6], ARGV[2])
+return 1
+`)
+
+// deactivateScript flips an active record with the expected expiry and grace
+// period to inactive and announces the change. It returns 1 when the record
+// changed.
+//
+// KEYS[1] user hash, KEYS[2] expiry index; ARGV: user token, expires_at,
+// grace_period_expires_at, changes channel.
+var deactivateScript = redis.NewScript(`
+local cur = redis.call('HMGET', KEYS[1], 'is_active', 'expires_at', 'grace_period_expires_at')
+if cur[1] ~= 'true' or cur[2] ~= ARGV[2] or (cur[3] or '') ~= ARGV[3] then
+	return 0
+end
+
+redis.call('HSET', KEYS[1], 'is_active', 'false')
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('PUBLISH', ARGV[4], ARGV[1])
+return 1
+`)
+
+func (s *redisStorage) SetSubscriptionStatus(ctx context.Context, status *SubscriptionStatus) error {
+	isActive := strconv.FormatBool(status.IsActive)
+	err := setStatusScript.Run(ctx, s.client,
+		[]string{s.userKey(status.UserToken), s.expiryKey()},
+		s.prefix,
+		status.UserToken,
+		status.ProductID,
+		status.OriginalTransactionID,
+		isActive,
+		s.changesChannel(),
+		status.AccessEndsAt().UnixMilli(),
+		"expires_at", status.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		"product_id", status.ProductID,
+		"original_transaction_id", status.OriginalTransactionID,
+		"is_active", isActive,
+		"grace_period_expires_at", formatRedisTime(status.GracePeriodExpiresAt),
+		"in_billing_retry", strconv.FormatBool(status.InBillingRetry),
+		"revoked_at", formatRedisTime(status.RevokedAt),
+		"environment", status.Environment,
+		"auto_renew_enabled", formatRedisOptional(status.AutoRenewEnabled),
+		"expiration_intent", strconv.Itoa(status.ExpirationIntent),
+		"auto_renew_product_id", status.AutoRenewProductID,
+		"renewal_price", formatRedisOptional(status.RenewalPrice),
+		"renewal_currency", status.RenewalCurrency,
+		"original_purchase_date", formatRedisTime(status.OriginalPurchaseDate),
+		"ownership_type", status.OwnershipType,
+		"subscription_group_id", status.SubscriptionGroupID,
+		"offer_type", strconv.Itoa(status.OfferType),
+		"offer_id", status.OfferID,
+		"pending_product_id", status.PendingProductID,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("set subscription status: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) ListExpiredActive(ctx context.Context, cutoff time.Time, limit int) ([]SubscriptionStatus, error) {
+	// Scores are whole milliseconds, so "< cutoff" becomes an exclusive bound.
+	max := strconv.FormatInt(cutoff.UnixMilli(), 10)
+	if cutoff.Equal(time.UnixMilli(cutoff.UnixMilli())) {
+		max = "(" + max
+	}
+	count := int64(limit)
+	if limit <= 0 {
+		count = -1
+	}
+	tokens, err := s.client.ZRangeByScore(ctx, s.expiryKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list expired subscriptions: %w", err)
+	}
+
+	list := make([]SubscriptionStatus, 0, len(tokens))
+	for _, token := range tokens {
+		status, err := s.GetSubscriptionStatus(ctx, token)
+		if errors.Is(err, ErrSubscriptionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if status.IsActive && status.AccessEndsAt().Before(cutoff) {
+			list = append(list, *status)
+		}
+	}
+	return list, nil
+}
+
+func (s *redisStorage) DeactivateSubscription(ctx context.Context, expected *SubscriptionStatus) (bool, error) {
+	changed, err := deactivateScript.Run(ctx, s.client,
+		[]string{s.userKey(expected.UserToken), s.expiryKey()},
+		expected.UserToken,
+		expected.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		formatRedisTime(expected.GracePeriodExpiresAt),
+		s.changesChannel(),
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("deactivate subscription: %w", err)
+	}
+	return changed == 1, nil
+}
+
+// UserTokensByOriginalTransactionID returns every user token whose record
+// currently points at originalTransactionID.
+func (s *redisStorage) UserTokensByOriginalTransactionID(ctx context.Context, originalTransactionID string) ([]string, error) {
+	tokens, err := s.client.SMembers(ctx, s.originalTransactionKey(originalTransactionID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("lookup original transaction index: %w", err)
+	}
+	return tokens, nil
+}
+
+// SubscribeChanges streams the user token of every record written by any
+// instance sharing this Redis. The channel is closed when ctx is done.
+func (s *redisStorage) SubscribeChanges(ctx context.Context) (<-chan string, error) {
+	sub := s.client.Subscribe(ctx, s.changesChannel())
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("subscribe to changes: %w", err)
+	}
+
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case out <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (s *redisStorage) Close() {
+	s.client.Close()
+}
+
+// The stores below keep their records as JSON. Append-only logs use a set of
+// seen IDs and one list per user; keyed records use one hash per kind.
+
+func (s *redisStorage) key(parts ...string) string {
+	key := s.prefix
+	for _, part := range parts {
+		key += ":" + part
+	}
+	return key
+}
+
+// appendOnceScript pushes a record onto every list unless its ID was seen
+// before. It returns 1 when the record was added.
+//
+// KEYS[1] ID set, KEYS[2..] lists; ARGV: ID, record, and optionally a member
+// added to the set KEYS[2] instead of pushing onto it.
+var appendOnceScript = redis.NewScript(`
+if redis.call('SADD', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+local first = 2
+if ARGV[3] then
+	redis.call('SADD', KEYS[2], ARGV[3])
+	first = 3
+end
+for i = first, #KEYS do
+	redis.call('RPUSH', KEYS[i], ARGV[2])
+end
+return 1
+`)
+
+func (s *redisStorage) appendOnce(ctx context.Context, keys []string, args ...any) (bool, error) {
+	added, err := appendOnceScript.Run(ctx, s.client, keys, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return added == 1, nil
+}
+
+// decodeRedisRecords unmarshals JSON records, skipping missing ones.
+func decodeRedisRecords[T any](values []any) ([]T, error) {
+	list := make([]T, 0, len(values))
+	for _, v := range values {
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var record T
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			return nil, err
+		}
+		list = append(list, record)
+	}
+	return list, nil
+}
+
+func (s *redisStorage) listRecords(ctx context.Context, key string) ([]any, error) {
+	values, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]any, len(values))
+	for i, v := range values {
+		records[i] = v
+	}
+	return records, nil
+}
+
+// redisEvent keeps the raw payload, which SubscriptionEvent leaves out of
+// its JSON.
+type redisEvent struct {
+	SubscriptionEvent
+	RawPayload string `json:"rawPayload,omitempty"`
+}
+
+func (s *redisStorage) AppendEvent(ctx context.Context, event *SubscriptionEvent) error {
+	record, err := json.Marshal(redisEvent{SubscriptionEvent: *event, RawPayload: event.RawPayload})
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	_, err = s.appendOnce(ctx,
+		[]string{s.key("event", "ids"), s.key("event", "users"), s.key("events", event.UserToken)},
+		event.ID, record, event.UserToken)
+	if err != nil {
+		return fmt.Errorf("append event: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) ListEvents(ctx context.Context, userToken string) ([]SubscriptionEvent, error) {
+	values, err := s.listRecords(ctx, s.key("events", userToken))
+	if err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+	records, err := decodeRedisRecords[redisEvent](values)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal event: %w", err)
+	}
+	events := make([]SubscriptionEvent, len(records))
+	for i, r := range records {
+		events[i] = r.SubscriptionEvent
+		events[i].RawPayload = r.RawPayload
+	}
+	sortEvents(events)
+	return events, nil
+}
+
+func (s *redisStorage) ListEventUsers(ctx context.Context) ([]string, error) {
+	users, err := s.client.SMembers(ctx, s.key("event", "users")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list event users: %w", err)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (s *redisStorage) RecordAPICall(ctx context.Context, call *APICall) error {
+	record, err := json.Marshal(call)
+	if err != nil {
+		return fmt.Errorf("marshal api call: %w", err)
+	}
+	_, err = s.appendOnce(ctx, []string{s.key("apicall", "ids"), s.key("apicalls", call.UserToken)}, call.ID, record)
+	if err != nil {
+		return fmt.Errorf("record api call: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) ListAPICalls(ctx context.Context, userToken string) ([]APICall, error) {
+	values, err := s.listRecords(ctx, s.key("apicalls", userToken))
+	if err != nil {
+		return nil, fmt.Errorf("list api calls: %w", err)
+	}
+	calls, err := decodeRedisRecords[APICall](values)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal api call: %w", err)
+	}
+	sort.SliceStable(calls, func(i, j int) bool {
+		return calls[i].SentAt.Before(calls[j].SentAt)
+	})
+	return calls, nil
+}
+
+func (s *redisStorage) RecordRefund(ctx context.Context, r *Refund) error {
+	record, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal refund: %w", err)
+	}
+	_, err = s.appendOnce(ctx,
+		[]string{s.key("refund", "ids"), s.key("refunds", "user", r.UserToken), s.key("refunds", "product", r.ProductID)},
+		r.ID, record)
+	if err != nil {
+		return fmt.Errorf("record refund: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) ListRefunds(ctx context.Context, userToken string) ([]Refund, error) {
+	return s.listRefunds(ctx, s.key("refunds", "user", userToken))
+}
+
+func (s *redisStorage) ListProductRefunds(ctx context.Context, productID string) ([]Refund, error) {
+	return s.listRefunds(ctx, s.key("refunds", "product", productID))
+}
+
+func (s *redisStorage) listRefunds(ctx context.Context, key string) ([]Refund, error) {
+	values, err := s.listRecords(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+	refunds, err := decodeRedisRecords[Refund](values)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal refund: %w", err)
+	}
+	sort.SliceStable(refunds, func(i, j int) bool {
+		return refunds[i].OccurredAt.Before(refunds[j].OccurredAt)
+	})
+	return refunds, nil
+}
+
+func (s *redisStorage) SaveDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	record, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("marshal dead letter: %w", err)
+	}
+	if err := s.client.HSet(ctx, s.key("deadletters"), dl.ID, record).Err(); err != nil {
+		return fmt.Errorf("save dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	raw, err := s.client.HGet(ctx, s.key("deadletters"), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get dead letter: %w", err)
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal([]byte(raw), &dl); err != nil {
+		return nil, fmt.Errorf("unmarshal dead letter: %w", err)
+	}
+	return &dl, nil
+}
+
+func (s *redisStorage) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	values, err := s.client.HVals(ctx, s.key("deadletters")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list dead letters: %w", err)
+	}
+	list := make([]DeadLetter, len(values))
+	for i, raw := range values {
+		if err := json.Unmarshal([]byte(raw), &list[i]); err != nil {
+			return nil, fmt.Errorf("unmarshal dead letter: %w", err)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].FirstFailedAt.Equal(list[j].FirstFailedAt) {
+			return list[i].FirstFailedAt.Before(list[j].FirstFailedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (s *redisStorage) DeleteDeadLetter(ctx context.Context, id string) error {
+	deleted, err := s.client.HDel(ctx, s.key("deadletters"), id).Result()
+	if err != nil {
+		return fmt.Errorf("delete dead letter: %w", err)
+	}
+	if deleted == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func (s *redisStorage) SaveRenewalExtension(ctx context.Context, e *RenewalExtension) error {
+	record, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal renewal extension: %w", err)
+	}
+	if err := s.client.HSet(ctx, s.key("extensions"), e.RequestID, record).Err(); err != nil {
+		return fmt.Errorf("save renewal extension: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) GetRenewalExtension(ctx context.Context, requestID string) (*RenewalExtension, error) {
+	raw, err := s.client.HGet(ctx, s.key("extensions"), requestID).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrRenewalExtensionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get renewal extension: %w", err)
+	}
+	var e RenewalExtension
+	if err := json.Unmarshal([]byte(raw), &e); err != nil {
+		return nil, fmt.Errorf("unmarshal renewal extension: %w", err)
+	}
+	return &e, nil
+}
+
+func (s *redisStorage) ListRenewalExtensions(ctx context.Context) ([]RenewalExtension, error) {
+	values, err := s.client.HVals(ctx, s.key("extensions")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list renewal extensions: %w", err)
+	}
+	list := make([]RenewalExtension, len(values))
+	for i, raw := range values {
+		if err := json.Unmarshal([]byte(raw), &list[i]); err != nil {
+			return nil, fmt.Errorf("unmarshal renewal extension: %w", err)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].RequestedAt.Equal(list[j].RequestedAt) {
+			return list[i].RequestedAt.After(list[j].RequestedAt)
+		}
+		return list[i].RequestID < list[j].RequestID
+	})
+	return list, nil
+}
+
+// savePurchaseScript stores a purchase and moves it to the purchase set of
+// its user.
+//
+// KEYS[1] purchases hash, KEYS[2] owners hash, KEYS[3] purchase set of the
+// user; ARGV: transaction ID, record, user token, prefix of the purchase
+// sets, and "1" to keep an existing purchase.
+var savePurchaseScript = redis.NewScript(`
+if ARGV[5] == '1' then
+	local stored = redis.call('HGET', KEYS[1], ARGV[1])
+	if stored then
+		return stored
+	end
+end
+local owner = redis.call('HGET', KEYS[2], ARGV[1])
+if owner and owner ~= ARGV[3] then
+	redis.call('SREM', ARGV[4] .. owner, ARGV[1])
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('SADD', KEYS[3], ARGV[1])
+return ARGV[2]
+`)
+
+func (s *redisStorage) savePurchase(ctx context.Context, p *Purchase, keep bool) (string, error) {
+	stored := *p
+	stored.IsActive = false
+	record, err := json.Marshal(&stored)
+	if err != nil {
+		return "", fmt.Errorf("marshal purchase: %w", err)
+	}
+	keepFlag := "0"
+	if keep {
+		keepFlag = "1"
+	}
+	return savePurchaseScript.Run(ctx, s.client,
+		[]string{s.key("purchases"), s.key("purchase", "owners"), s.key("purchases", p.UserToken)},
+		p.TransactionID, record, p.UserToken, s.key("purchases", ""), keepFlag,
+	).Text()
+}
+
+func (s *redisStorage) SavePurchase(ctx context.Context, p *Purchase) error {
+	if _, err := s.savePurchase(ctx, p, false); err != nil {
+		return fmt.Errorf("save purchase: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) ClaimOriginalTransaction(ctx context.Context, originalTransactionID, userToken string) (string, error) {
+	key := s.key("transaction", "owners")
+	if err := s.client.HSetNX(ctx, key, originalTransactionID, userToken).Err(); err != nil {
+		return "", fmt.Errorf("claim original transaction: %w", err)
+	}
+	owner, err := s.client.HGet(ctx, key, originalTransactionID).Result()
+	if err != nil {
+		return "", fmt.Errorf("claim original transaction: %w", err)
+	}
+	return owner, nil
+}
+
+func (s *redisStorage) InsertPurchase(ctx context.Context, p *Purchase) (*Purchase, error) {
+	raw, err := s.savePurchase(ctx, p, true)
+	if err != nil {
+		return nil, fmt.Errorf("insert purchase: %w", err)
+	}
+	var stored Purchase
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+		return nil, fmt.Errorf("unmarshal purchase: %w", err)
+	}
+	return &stored, nil
+}
+
+func (s *redisStorage) ListPurchases(ctx context.Context, userToken string) ([]Purchase, error) {
+	ids, err := s.client.SMembers(ctx, s.key("purchases", userToken)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list purchases: %w", err)
+	}
+	list := []Purchase{}
+	if len(ids) > 0 {
+		values, err := s.client.HMGet(ctx, s.key("purchases"), ids...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("list purchases: %w", err)
+		}
+		if list, err = decodeRedisRecords[Purchase](values); err != nil {
+			return nil, fmt.Errorf("unmarshal purchase: %w", err)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].PurchasedAt.Equal(list[j].PurchasedAt) {
+			return list[i].PurchasedAt.Before(list[j].PurchasedAt)
+		}
+		return list[i].TransactionID < list[j].TransactionID
+	})
+	return list, nil
+}
+
+// ledgerScript records a ledger entry once and adds it to the balance of its
+// account. It returns the status and the stored entry: "added", "exists" for
+// an entry ID seen before, or "insufficient" when a debit is not covered.
+//
+// KEYS[1] ledger hash, KEYS[2] entry list of the user, KEYS[3] balances of
+// the user; ARGV: entry ID, record, account, amount, and "1" to refuse
+// overdrawing the account.
+var ledgerScript = redis.NewScript(`
+local stored = redis.call('HGET', KEYS[1], ARGV[1])
+if stored then
+	return {'exists', stored}
+end
+if ARGV[5] == '1' then
+	local balance = tonumber(redis.call('HGET', KEYS[3], ARGV[3]) or '0')
+	if balance + tonumber(ARGV[4]) < 0 then
+		return {'insufficient', ''}
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('RPUSH', KEYS[2], ARGV[1])
+redis.call('HINCRBY', KEYS[3], ARGV[3], ARGV[4])
+return {'added', ARGV[2]}
+`)
+
+func (s *redisStorage) recordLedgerEntry(ctx context.Context, e *LedgerEntry, debit bool) (string, *LedgerEntry, error) {
+	record, err := json.Marshal(e)
+	if err != nil {
+		return "", nil, fmt.Errorf("marshal ledger entry: %w", err)
+	}
+	debitFlag := "0"
+	if debit {
+		debitFlag = "1"
+	}
+	res, err := ledgerScript.Run(ctx, s.client,
+		[]string{s.key("ledger"), s.key("ledger", e.UserToken), s.key("balances", e.UserToken)},
+		e.ID, record, e.Account, e.Amount, debitFlag,
+	).StringSlice()
+	if err != nil {
+		return "", nil, err
+	}
+	if res[0] == "insufficient" {
+		return res[0], nil, nil
+	}
+	var stored LedgerEntry
+	if err := json.Unmarshal([]byte(res[1]), &stored); err != nil {
+		return "", nil, fmt.Errorf("unmarshal ledger entry: %w", err)
+	}
+	return res[0], &stored, nil
+}
+
+func (s *redisStorage) AppendLedgerEntry(ctx context.Context, e *LedgerEntry) (bool, error) {
+	status, _, err := s.recordLedgerEntry(ctx, e, false)
+	if err != nil {
+		return false, fmt.Errorf("append ledger entry: %w", err)
+	}
+	return status == "added", nil
+}
+
+func (s *redisStorage) DebitLedgerEntry(ctx context.Context, e *LedgerEntry) (*LedgerEntry, error) {
+	status, stored, err := s.recordLedgerEntry(ctx, e, true)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("debit ledger entry: %w", err)
+	case status == "insufficient":
+		return nil, ErrInsufficientBalance
+	case status == "exists" && !sameEntry(stored, e):
+		return nil, ErrLedgerEntryConflict
+	}
+	return stored, nil
+}
+
+func (s *redisStorage) GetLedgerEntry(ctx context.Context, id string) (*LedgerEntry, error) {
+	raw, err := s.client.HGet(ctx, s.key("ledger"), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrLedgerEntryNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get ledger entry: %w", err)
+	}
+	var e LedgerEntry
+	if err := json.Unmarshal([]byte(raw), &e); err != nil {
+		return nil, fmt.Errorf("unmarshal ledger entry: %w", err)
+	}
+	return &e, nil
+}
+
+func (s *redisStorage) ListLedgerEntries(ctx context.Context, userToken string) ([]LedgerEntry, error) {
+	ids, err := s.client.LRange(ctx, s.key("ledger", userToken), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list ledger entries: %w", err)
+	}
+	entries := []LedgerEntry{}
+	if len(ids) > 0 {
+		values, err := s.client.HMGet(ctx, s.key("ledger"), ids...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("list ledger entries: %w", err)
+		}
+		if entries, err = decodeRedisRecords[LedgerEntry](values); err != nil {
+			return nil, fmt.Errorf("unmarshal ledger entry: %w", err)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+func (s *redisStorage) Balances(ctx context.Context, userToken string) (map[string]int64, error) {
+	values, err := s.client.HGetAll(ctx, s.key("balances", userToken)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get balances: %w", err)
+	}
+	balances := make(map[string]int64, len(values))
+	for account, v := range values {
+		if balances[account], err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("parse balance of %s: %w", account, err)
+		}
+	}
+	return balances, nil
+}
+
+// Queued notifications live in a hash by Seq; their leases are a sorted set
+// scored by LeaseUntil in microseconds.
+
+// claimScript leases the notifications whose lease ended, lowest Seq first,
+// and returns their Seq and record pairs.
+//
+// KEYS[1] lease index, KEYS[2] notifications hash; ARGV: now and lease end in
+// microseconds, limit.
+var claimScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+table.sort(due, function(a, b) return tonumber(a) < tonumber(b) end)
+local limit = tonumber(ARGV[3])
+local claimed = {}
+for _, seq in ipairs(due) do
+	if limit > 0 and #claimed >= 2 * limit then
+		break
+	end
+	local record = redis.call('HGET', KEYS[2], seq)
+	if record then
+		redis.call('ZADD', KEYS[1], ARGV[2], seq)
+		claimed[#claimed + 1] = seq
+		claimed[#claimed + 1] = record
+	end
+end
+return claimed
+`)
+
+// enqueueScript stores a notification with the next Seq and returns it.
+//
+// KEYS[1] sequence, KEYS[2] notifications hash, KEYS[3] lease index; ARGV:
+// record without Seq, lease end in microseconds.
+var enqueueScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('HSET', KEYS[2], seq, ARGV[1])
+redis.call('ZADD', KEYS[3], ARGV[2], seq)
+return seq
+`)
+
+func (s *redisStorage) EnqueueNotification(ctx context.Context, n *QueuedNotification) error {
+	record, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("marshal notification: %w", err)
+	}
+	seq, err := enqueueScript.Run(ctx, s.client,
+		[]string{s.key("queue", "seq"), s.key("queue"), s.key("queue", "leases")},
+		record, n.LeaseUntil.UnixMicro(),
+	).Int64()
+	if err != nil {
+		return fmt.Errorf("enqueue notification: %w", err)
+	}
+	n.Seq = seq
+	return nil
+}
+
+func (s *redisStorage) PendingNotifications(ctx context.Context) ([]QueuedNotification, error) {
+	records, err := s.client.HGetAll(ctx, s.key("queue")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list pending notifications: %w", err)
+	}
+	leases, err := s.client.ZRangeWithScores(ctx, s.key("queue", "leases"), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list notification leases: %w", err)
+	}
+	leaseUntil := make(map[string]time.Time, len(leases))
+	for _, z := range leases {
+		leaseUntil[fmt.Sprint(z.Member)] = time.UnixMicro(int64(z.Score)).UTC()
+	}
+
+	list := make([]QueuedNotification, 0, len(records))
+	for seq, raw := range records {
+		n, err := decodeQueuedNotification(seq, raw)
+		if err != nil {
+			return nil, err
+		}
+		n.LeaseUntil = leaseUntil[seq]
+		list = append(list, *n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+	return list, nil
+}
+
+func (s *redisStorage) ClaimNotifications(ctx context.Context, now, until time.Time, limit int) ([]QueuedNotification, error) {
+	records, err := claimScript.Run(ctx, s.client,
+		[]string{s.key("queue", "leases"), s.key("queue")},
+		now.UnixMicro(), until.UnixMicro(), limit,
+	).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("claim notifications: %w", err)
+	}
+	list := make([]QueuedNotification, 0, len(records)/2)
+	for i := 0; i+1 < len(records); i += 2 {
+		n, err := decodeQueuedNotification(records[i], records[i+1])
+		if err != nil {
+			return nil, err
+		}
+		n.LeaseUntil = until
+		list = append(list, *n)
+	}
+	return list, nil
+}
+
+// decodeQueuedNotification unmarshals a queued record stored under seq.
+func decodeQueuedNotification(seq, raw string) (*QueuedNotification, error) {
+	var n QueuedNotification
+	if err := json.Unmarshal([]byte(raw), &n); err != nil {
+		return nil, fmt.Errorf("unmarshal notification: %w", err)
+	}
+	var err error
+	if n.Seq, err = strconv.ParseInt(seq, 10, 64); err != nil {
+		return nil, fmt.Errorf("parse notification seq: %w", err)
+	}
+	return &n, nil
+}
+
+func (s *redisStorage) AckNotification(ctx context.Context, seq int64) error {
+	field := strconv.FormatInt(seq, 10)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, s.key("queue"), field)
+		pipe.ZRem(ctx, s.key("queue", "leases"), field)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ack notification: %w", err)
+	}
+	return nil
+}
+
+// redisArchivedRequest keeps the body gzipped, like the SQL archive.
+type redisArchivedRequest struct {
+	ArchivedRequest
+	Body []byte `json:"bodyGzip"`
+}
+
+// storeRequestScript stores an archived request unless its ID exists.
+//
+// KEYS[1] archive hash, KEYS[2] index scored by receipt time in
+// microseconds; ARGV: ID, record, score.
+var storeRequestScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+end
+return 1
+`)
+
+// pruneRequestsScript deletes the archived requests received before a time
+// and returns how many were removed.
+//
+// KEYS[1] archive hash, KEYS[2] receipt index; ARGV: exclusive or inclusive
+// maximum score.
+var pruneRequestsScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(ids) do
+	redis.call('HDEL', KEYS[1], id)
+	redis.call('ZREM', KEYS[2], id)
+end
+return #ids
+`)
+
+func (s *redisStorage) StoreRequest(ctx context.Context, req *ArchivedRequest) error {
+	body, err := gzipBytes(req.Body)
+	if err != nil {
+		return fmt.Errorf("compress body: %w", err)
+	}
+	record, err := json.Marshal(redisArchivedRequest{ArchivedRequest: *req, Body: body})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	err = storeRequestScript.Run(ctx, s.client,
+		[]string{s.key("archive"), s.key("archive", "received")},
+		req.ID, record, req.ReceivedAt.UnixMicro(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("store request: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) GetRequest(ctx context.Context, id string) (*ArchivedRequest, error) {
+	raw, err := s.client.HGet(ctx, s.key("archive"), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrArchivedRequestNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get request: %w", err)
+	}
+	var record redisArchivedRequest
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return nil, fmt.Errorf("unmarshal request: %w", err)
+	}
+	req := record.ArchivedRequest
+	if req.Body, err = gunzipBytes(record.Body); err != nil {
+		return nil, fmt.Errorf("decompress body: %w", err)
+	}
+	req.ReceivedAt = req.ReceivedAt.UTC()
+	return &req, nil
+}
+
+func (s *redisStorage) PruneRequests(ctx context.Context, before time.Time) (int, error) {
+	// Scores are whole microseconds, so "< before" becomes an exclusive bound.
+	max := strconv.FormatInt(before.UnixMicro(), 10)
+	if before.Equal(time.UnixMicro(before.UnixMicro())) {
+		max = "(" + max
+	}
+	n, err := pruneRequestsScript.Run(ctx, s.client,
+		[]string{s.key("archive"), s.key("archive", "received")}, max,
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("prune requests: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Refund outcomes, named after the App Store notifications reporting them.
+const (
+	RefundGranted  = "REFUND"
+	RefundReversed = "REFUND_REVERSED"
+	RefundDeclined = "REFUND_DECLINED"
+)
+
+// Refund is one refund decision about a user's transaction. A transaction
+// may have several: a refund can be reversed, and declined requests can be
+// repeated.
+type Refund struct {
+	// ID is the ID of the event that reported the decision.
+	ID                    string `json:"id"`
+	UserToken             string `json:"userToken"`
+	ProductID             string `json:"productId"`
+	TransactionID         string `json:"transactionId"`
+	OriginalTransactionID string `json:"originalTransactionId,omitempty"`
+	// Type is RefundGranted, RefundReversed or RefundDeclined.
+	Type string `json:"type"`
+	// RevocationReason is Apple's revocationReason: 1 for an issue in the
+	// app, 0 for any other reason. Nil when not reported.
+	RevocationReason *int `json:"revocationReason,omitempty"`
+	// Price is in milliunits of Currency.
+	Price       *int64    `json:"price,omitempty"`
+	Currency    string    `json:"currency,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	OccurredAt  time.Time `json:"occurredAt"`
+}
+
+// RefundStore is an append-only history of refund decisions.
+type RefundStore interface {
+	// RecordRefund stores r unless one with the same ID exists.
+	RecordRefund(ctx context.Context, r *Refund) error
+	// ListRefunds returns the refunds of userToken by OccurredAt.
+	ListRefunds(ctx context.Context, userToken string) ([]Refund, error)
+	// ListProductRefunds returns the refunds of productID by OccurredAt.
+	ListProductRefunds(ctx context.Context, productID string) ([]Refund, error)
+}
+
+type memoryRefundStore struct {
+	mu   sync.RWMutex
+	ids  map[string]struct{}
+	list []Refund
+}
+
+func NewMemoryRefundStore() RefundStore {
+	return &memoryRefundStore{
+		ids: make(map[string]struct{}),
+	}
+}
+
+func (m *memoryRefundStore) RecordRefund(ctx context.Context, r *Refund) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, exists := m.ids[r.ID]; exists {
+			return nil
+		}
+		m.ids[r.ID] = struct{}{}
+		m.list = append(m.list, *r)
+		return nil
+	}
+}
+
+func (m *memoryRefundStore) ListRefunds(ctx context.Context, userToken string) ([]Refund, error) {
+	return m.filter(ctx, func(r *Refund) bool { return r.UserToken == userToken })
+}
+
+func (m *memoryRefundStore) ListProductRefunds(ctx context.Context, productID string) ([]Refund, error) {
+	return m.filter(ctx, func(r *Refund) bool { return r.ProductID == productID })
+}
+
+func (m *memoryRefundStore) filter(ctx context.Context, match func(*Refund) bool) ([]Refund, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		refunds := []Refund{}
+		for i := range m.list {
+			if match(&m.list[i]) {
+				refunds = append(refunds, m.list[i])
+			}
+		}
+		sort.SliceStable(refunds, func(i, j int) bool {
+			return refunds[i].OccurredAt.Before(refunds[j].OccurredAt)
+		})
+		return refunds, nil
+	}
+}
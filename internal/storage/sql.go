@@ -0,0 +1,1191 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialect captures the few places where the SQL backends disagree.
+type dialect struct {
+	name          string
+	timestampType string
+	now           string
+	numbered      bool // $1, $2 placeholders instead of ?
+	// skipLocked is appended to a SELECT claiming rows so that concurrent
+	// claims pass over each other's rows instead of waiting for them.
+	skipLocked string
+}
+
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type sqlStorage struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// subscriptionColumns is the column list read by scanSubscription.
+const subscriptionColumns = `user_token, product_id, original_transaction_id, expires_at, is_active,
+		grace_period_expires_at, in_billing_retry, revoked_at, environment,
+		auto_renew_enabled, expiration_intent, auto_renew_product_id, renewal_price, renewal_currency,
+		original_purchase_date, ownership_type, subscription_group_id, offer_type, offer_id, pending_product_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSubscription(row rowScanner) (*SubscriptionStatus, error) {
+	var (
+		status       SubscriptionStatus
+		autoRenew    sql.NullBool
+		renewalPrice sql.NullInt64
+	)
+	if err := row.Scan(
+		&status.UserToken,
+		&status.ProductID,
+		&status.OriginalTransactionID,
+		&status.ExpiresAt,
+		&status.IsActive,
+		&status.GracePeriodExpiresAt,
+		&status.InBillingRetry,
+		&status.RevokedAt,
+		&status.Environment,
+		&autoRenew,
+		&status.ExpirationIntent,
+		&status.AutoRenewProductID,
+		&renewalPrice,
+		&status.RenewalCurrency,
+		&status.OriginalPurchaseDate,
+		&status.OwnershipType,
+		&status.SubscriptionGroupID,
+		&status.OfferType,
+		&status.OfferID,
+		&status.PendingProductID,
+	); err != nil {
+		return nil, err
+	}
+	if autoRenew.Valid {
+		status.AutoRenewEnabled = &autoRenew.Bool
+	}
+	if renewalPrice.Valid {
+		status.RenewalPrice = &renewalPrice.Int64
+	}
+	status.ExpiresAt = status.ExpiresAt.UTC()
+	status.GracePeriodExpiresAt = status.GracePeriodExpiresAt.UTC()
+	status.RevokedAt = status.RevokedAt.UTC()
+	status.OriginalPurchaseDate = status.OriginalPurchaseDate.UTC()
+	return &status, nil
+}
+
+func (s *sqlStorage) GetSubscriptionStatus(ctx context.Context, userToken string) (*SubscriptionStatus, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE user_token = ?`), userToken)
+
+	status, err := scanSubscription(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, fmt.Errorf("get subscription status: %w", err)
+	}
+
+	return status, nil
+}
+
+func (s *sqlStorage) SetSubscriptionStatus(ctx context.Context, status *SubscriptionStatus) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO subscriptions (
+			user_token, product_id, original_transaction_id, expires_at, is_active,
+			grace_period_expires_at, in_billing_retry, revoked_at, environment,
+			auto_renew_enabled, expiration_intent, auto_renew_product_id, renewal_price, renewal_currency,
+			original_purchase_date, ownership_type, subscription_group_id, offer_type, offer_id,
+			pending_product_id, updated_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, `+s.dialect.now+`)
+		ON CONFLICT (user_token) DO UPDATE SET
+			product_id = excluded.product_id,
+			original_transaction_id = excluded.original_transaction_id,
+			expires_at = excluded.expires_at,
+			is_active = excluded.is_active,
+			grace_period_expires_at = excluded.grace_period_expires_at,
+			in_billing_retry = excluded.in_billing_retry,
+			revoked_at = excluded.revoked_at,
+			environment = excluded.environment,
+			auto_renew_enabled = excluded.auto_renew_enabled,
+			expiration_intent = excluded.expiration_intent,
+			auto_renew_product_id = excluded.auto_renew_product_id,
+			renewal_price = excluded.renewal_price,
+			renewal_currency = excluded.renewal_currency,
+			original_purchase_date = excluded.original_purchase_date,
+			ownership_type = excluded.ownership_type,
+			subscription_group_id = excluded.subscription_group_id,
+			offer_type = excluded.offer_type,
+			offer_id = excluded.offer_id,
+			pending_product_id = excluded.pending_product_id,
+			updated_at = excluded.updated_at`),
+		status.UserToken,
+		status.ProductID,
+		status.OriginalTransactionID,
+		status.ExpiresAt.UTC(),
+		status.IsActive,
+		status.GracePeriodExpiresAt.UTC(),
+		status.InBillingRetry,
+		status.RevokedAt.UTC(),
+		status.Environment,
+		status.AutoRenewEnabled,
+		status.ExpirationIntent,
+		status.AutoRenewProductID,
+		status.RenewalPrice,
+		status.RenewalCurrency,
+		status.OriginalPurchaseDate.UTC(),
+		status.OwnershipType,
+		status.SubscriptionGroupID,
+		status.OfferType,
+		status.OfferID,
+		status.PendingProductID,
+	)
+	if err != nil {
+		return fmt.Errorf("set subscription status: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListExpiredActive(ctx context.Context, cutoff time.Time, limit int) ([]SubscriptionStatus, error) {
+	query := `
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE is_active = ? AND expires_at < ? AND grace_period_expires_at < ?
+		ORDER BY expires_at, user_token`
+	args := []any{true, cutoff.UTC(), cutoff.UTC()}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("list expired subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	list := []SubscriptionStatus{}
+	for rows.Next() {
+		status, err := scanSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan subscription: %w", err)
+		}
+		list = append(list, *status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list expired subscriptions: %w", err)
+	}
+
+	return list, nil
+}
+
+func (s *sqlStorage) DeactivateSubscription(ctx context.Context, expected *SubscriptionStatus) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		UPDATE subscriptions
+		SET is_active = ?, updated_at = `+s.dialect.now+`
+		WHERE user_token = ? AND is_active = ? AND expires_at = ? AND grace_period_expires_at = ?`),
+		false,
+		expected.UserToken,
+		true,
+		expected.ExpiresAt.UTC(),
+		expected.GracePeriodExpiresAt.UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("deactivate subscription: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("deactivate subscription: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (s *sqlStorage) Close() {
+	s.db.Close()
+}
+
+func (s *sqlStorage) AppendEvent(ctx context.Context, event *SubscriptionEvent) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO subscription_events (
+			id, user_token, source, type, subtype, transaction_id, original_transaction_id,
+			product_id, price, currency, expires_at, occurred_at, recorded_at, raw_payload, archive_id,
+			transaction_type, transaction_reason, ownership_type, environment, storefront,
+			purchase_date, offer_type, offer_id, offer_discount_type, is_upgraded
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`),
+		event.ID,
+		event.UserToken,
+		event.Source,
+		event.Type,
+		event.Subtype,
+		event.TransactionID,
+		event.OriginalTransactionID,
+		event.ProductID,
+		event.Price,
+		event.Currency,
+		event.ExpiresAt.UTC(),
+		event.OccurredAt.UTC(),
+		event.RecordedAt.UTC(),
+		event.RawPayload,
+		event.ArchiveID,
+		event.TransactionType,
+		event.TransactionReason,
+		event.OwnershipType,
+		event.Environment,
+		event.Storefront,
+		event.PurchaseDate.UTC(),
+		event.OfferType,
+		event.OfferID,
+		event.OfferDiscountType,
+		event.IsUpgraded,
+	)
+	if err != nil {
+		return fmt.Errorf("append event: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListEvents(ctx context.Context, userToken string) ([]SubscriptionEvent, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT id, user_token, source, type, subtype, transaction_id, original_transaction_id,
+			product_id, price, currency, expires_at, occurred_at, recorded_at, raw_payload, archive_id,
+			transaction_type, transaction_reason, ownership_type, environment, storefront,
+			purchase_date, offer_type, offer_id, offer_discount_type, is_upgraded
+		FROM subscription_events
+		WHERE user_token = ?
+		ORDER BY occurred_at, recorded_at`), userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []SubscriptionEvent{}
+	for rows.Next() {
+		var (
+			event SubscriptionEvent
+			price sql.NullInt64
+		)
+		if err := rows.Scan(
+			&event.ID,
+			&event.UserToken,
+			&event.Source,
+			&event.Type,
+			&event.Subtype,
+			&event.TransactionID,
+			&event.OriginalTransactionID,
+			&event.ProductID,
+			&price,
+			&event.Currency,
+			&event.ExpiresAt,
+			&event.OccurredAt,
+			&event.RecordedAt,
+			&event.RawPayload,
+			&event.ArchiveID,
+			&event.TransactionType,
+			&event.TransactionReason,
+			&event.OwnershipType,
+			&event.Environment,
+			&event.Storefront,
+			&event.PurchaseDate,
+			&event.OfferType,
+			&event.OfferID,
+			&event.OfferDiscountType,
+			&event.IsUpgraded,
+		); err != nil {
+			return nil, fmt.Errorf("scan event: %w", err)
+		}
+		if price.Valid {
+			event.Price = &price.Int64
+		}
+		event.ExpiresAt = event.ExpiresAt.UTC()
+		event.OccurredAt = event.OccurredAt.UTC()
+		event.RecordedAt = event.RecordedAt.UTC()
+		event.PurchaseDate = event.PurchaseDate.UTC()
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+
+	return events, nil
+}
+
+func (s *sqlStorage) ListEventUsers(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT user_token
+		FROM subscription_events
+		ORDER BY user_token`)
+	if err != nil {
+		return nil, fmt.Errorf("list event users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, fmt.Errorf("scan event user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list event users: %w", err)
+	}
+
+	return users, nil
+}
+
+func (s *sqlStorage) StoreRequest(ctx context.Context, req *ArchivedRequest) error {
+	headers, err := json.Marshal(req.Headers)
+	if err != nil {
+		return fmt.Errorf("marshal headers: %w", err)
+	}
+	body, err := gzipBytes(req.Body)
+	if err != nil {
+		return fmt.Errorf("compress body: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO request_archive (id, endpoint, received_at, headers, body_gzip, status_code, outcome, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`),
+		req.ID,
+		req.Endpoint,
+		req.ReceivedAt.UTC(),
+		string(headers),
+		body,
+		req.StatusCode,
+		req.Outcome,
+		req.Duration.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("store request: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetRequest(ctx context.Context, id string) (*ArchivedRequest, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+		SELECT id, endpoint, received_at, headers, body_gzip, status_code, outcome, duration_ms
+		FROM request_archive
+		WHERE id = ?`), id)
+
+	var (
+		req        ArchivedRequest
+		headers    string
+		body       []byte
+		durationMS int64
+	)
+	if err := row.Scan(
+		&req.ID,
+		&req.Endpoint,
+		&req.ReceivedAt,
+		&headers,
+		&body,
+		&req.StatusCode,
+		&req.Outcome,
+		&durationMS,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrArchivedRequestNotFound
+		}
+		return nil, fmt.Errorf("get request: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(headers), &req.Headers); err != nil {
+		return nil, fmt.Errorf("unmarshal headers: %w", err)
+	}
+	raw, err := gunzipBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("decompress body: %w", err)
+	}
+	req.Body = raw
+	req.ReceivedAt = req.ReceivedAt.UTC()
+	req.Duration = time.Duration(durationMS) * time.Millisecond
+
+	return &req, nil
+}
+
+func (s *sqlStorage) PruneRequests(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		DELETE FROM request_archive
+		WHERE received_at < ?`), before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("prune requests: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("prune requests: %w", err)
+	}
+	return int(n), nil
+}
+
+func (s *sqlStorage) SaveDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO dead_letters (id, source, payload, error, attempts, first_failed_at, last_failed_at, archive_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			source = excluded.source,
+			payload = excluded.payload,
+			error = excluded.error,
+			attempts = excluded.attempts,
+			first_failed_at = excluded.first_failed_at,
+			last_failed_at = excluded.last_failed_at,
+			archive_id = excluded.archive_id`),
+		dl.ID,
+		dl.Source,
+		dl.Payload,
+		dl.Error,
+		dl.Attempts,
+		dl.FirstFailedAt.UTC(),
+		dl.LastFailedAt.UTC(),
+		dl.ArchiveID,
+	)
+	if err != nil {
+		return fmt.Errorf("save dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	rows, err := s.queryDeadLetters(ctx, `WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return &rows[0], nil
+}
+
+func (s *sqlStorage) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	return s.queryDeadLetters(ctx, `ORDER BY first_failed_at, id`)
+}
+
+func (s *sqlStorage) DeleteDeadLetter(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM dead_letters WHERE id = ?`), id)
+	if err != nil {
+		return fmt.Errorf("delete dead letter: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete dead letter: %w", err)
+	}
+	if n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func (s *sqlStorage) queryDeadLetters(ctx context.Context, clause string, args ...any) ([]DeadLetter, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT id, source, payload, error, attempts, first_failed_at, last_failed_at, archive_id
+		FROM dead_letters `+clause), args...)
+	if err != nil {
+		return nil, fmt.Errorf("query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	list := []DeadLetter{}
+	for rows.Next() {
+		var dl DeadLetter
+		if err := rows.Scan(
+			&dl.ID,
+			&dl.Source,
+			&dl.Payload,
+			&dl.Error,
+			&dl.Attempts,
+			&dl.FirstFailedAt,
+			&dl.LastFailedAt,
+			&dl.ArchiveID,
+		); err != nil {
+			return nil, fmt.Errorf("scan dead letter: %w", err)
+		}
+		dl.FirstFailedAt = dl.FirstFailedAt.UTC()
+		dl.LastFailedAt = dl.LastFailedAt.UTC()
+		list = append(list, dl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query dead letters: %w", err)
+	}
+
+	return list, nil
+}
+
+func (s *sqlStorage) EnqueueNotification(ctx context.Context, n *QueuedNotification) error {
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+		INSERT INTO notification_queue (source, partition_key, payload, archive_id, enqueued_at, lease_until)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING seq`),
+		n.Source,
+		n.PartitionKey,
+		n.Payload,
+		n.ArchiveID,
+		n.EnqueuedAt.UTC(),
+		n.LeaseUntil.UTC(),
+	).Scan(&n.Seq)
+	if err != nil {
+		return fmt.Errorf("enqueue notification: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) PendingNotifications(ctx context.Context) ([]QueuedNotification, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+notificationColumns+`
+		FROM notification_queue
+		ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("pending notifications: %w", err)
+	}
+	return scanNotifications(rows)
+}
+
+// ClaimNotifications moves the lease of the claimed rows in one statement.
+// Postgres skips rows another instance is claiming at the same time; SQLite
+// runs one writer at a time anyway.
+func (s *sqlStorage) ClaimNotifications(ctx context.Context, now, until time.Time, limit int) ([]QueuedNotification, error) {
+	claim := `
+			SELECT seq FROM notification_queue
+			WHERE lease_until <= ?
+			ORDER BY seq`
+	args := []any{until.UTC(), now.UTC()}
+	if limit > 0 {
+		claim += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	claim += s.dialect.skipLocked
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		UPDATE notification_queue SET lease_until = ?
+		WHERE seq IN (`+claim+`)
+		RETURNING `+notificationColumns), args...)
+	if err != nil {
+		return nil, fmt.Errorf("claim notifications: %w", err)
+	}
+	list, err := scanNotifications(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery.
+	sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+	return list, nil
+}
+
+// notificationColumns is the column list read by scanNotifications.
+const notificationColumns = `seq, source, partition_key, payload, archive_id, enqueued_at, lease_until`
+
+func scanNotifications(rows *sql.Rows) ([]QueuedNotification, error) {
+	defer rows.Close()
+
+	list := []QueuedNotification{}
+	for rows.Next() {
+		var n QueuedNotification
+		if err := rows.Scan(&n.Seq, &n.Source, &n.PartitionKey, &n.Payload, &n.ArchiveID, &n.EnqueuedAt, &n.LeaseUntil); err != nil {
+			return nil, fmt.Errorf("scan notification: %w", err)
+		}
+		n.EnqueuedAt = n.EnqueuedAt.UTC()
+		n.LeaseUntil = n.LeaseUntil.UTC()
+		list = append(list, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scan notifications: %w", err)
+	}
+	return list, nil
+}
+
+func (s *sqlStorage) AckNotification(ctx context.Context, seq int64) error {
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM notification_queue WHERE seq = ?`), seq); err != nil {
+		return fmt.Errorf("ack notification: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) SavePurchase(ctx context.Context, p *Purchase) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO purchases (
+			transaction_id, original_transaction_id, user_token, product_id, product_type,
+			purchased_at, expires_at, revoked_at, environment, ownership_type
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (transaction_id) DO UPDATE SET
+			original_transaction_id = excluded.original_transaction_id,
+			user_token = excluded.user_token,
+			product_id = excluded.product_id,
+			product_type = excluded.product_type,
+			purchased_at = excluded.purchased_at,
+			expires_at = excluded.expires_at,
+			revoked_at = excluded.revoked_at,
+			environment = excluded.environment,
+			ownership_type = excluded.ownership_type`),
+		p.TransactionID,
+		p.OriginalTransactionID,
+		p.UserToken,
+		p.ProductID,
+		p.ProductType,
+		p.PurchasedAt.UTC(),
+		p.ExpiresAt.UTC(),
+		p.RevokedAt.UTC(),
+		p.Environment,
+		p.OwnershipType,
+	)
+	if err != nil {
+		return fmt.Errorf("save purchase: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ClaimOriginalTransaction(ctx context.Context, originalTransactionID, userToken string) (string, error) {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO transaction_owners (original_transaction_id, user_token)
+		VALUES (?, ?)
+		ON CONFLICT (original_transaction_id) DO NOTHING`),
+		originalTransactionID, userToken,
+	)
+	if err != nil {
+		return "", fmt.Errorf("claim original transaction: %w", err)
+	}
+
+	var owner string
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+		SELECT user_token
+		FROM transaction_owners
+		WHERE original_transaction_id = ?`), originalTransactionID).Scan(&owner); err != nil {
+		return "", fmt.Errorf("claim original transaction: %w", err)
+	}
+	return owner, nil
+}
+
+func (s *sqlStorage) InsertPurchase(ctx context.Context, p *Purchase) (*Purchase, error) {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO purchases (
+			transaction_id, original_transaction_id, user_token, product_id, product_type,
+			purchased_at, expires_at, revoked_at, environment, ownership_type
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (transaction_id) DO NOTHING`),
+		p.TransactionID,
+		p.OriginalTransactionID,
+		p.UserToken,
+		p.ProductID,
+		p.ProductType,
+		p.PurchasedAt.UTC(),
+		p.ExpiresAt.UTC(),
+		p.RevokedAt.UTC(),
+		p.Environment,
+		p.OwnershipType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("insert purchase: %w", err)
+	}
+
+	stored, err := scanPurchase(s.db.QueryRowContext(ctx, s.dialect.rebind(`
+		SELECT `+purchaseColumns+`
+		FROM purchases
+		WHERE transaction_id = ?`), p.TransactionID))
+	if err != nil {
+		return nil, fmt.Errorf("insert purchase: %w", err)
+	}
+	return stored, nil
+}
+
+func (s *sqlStorage) ListPurchases(ctx context.Context, userToken string) ([]Purchase, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT `+purchaseColumns+`
+		FROM purchases
+		WHERE user_token = ?
+		ORDER BY purchased_at, transaction_id`), userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list purchases: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Purchase{}
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan purchase: %w", err)
+		}
+		list = append(list, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list purchases: %w", err)
+	}
+
+	return list, nil
+}
+
+// purchaseColumns is the column list read by scanPurchase.
+const purchaseColumns = `transaction_id, original_transaction_id, user_token, product_id, product_type,
+			purchased_at, expires_at, revoked_at, environment, ownership_type`
+
+func scanPurchase(row rowScanner) (*Purchase, error) {
+	var p Purchase
+	if err := row.Scan(
+		&p.TransactionID,
+		&p.OriginalTransactionID,
+		&p.UserToken,
+		&p.ProductID,
+		&p.ProductType,
+		&p.PurchasedAt,
+		&p.ExpiresAt,
+		&p.RevokedAt,
+		&p.Environment,
+		&p.OwnershipType,
+	); err != nil {
+		return nil, err
+	}
+	p.PurchasedAt = p.PurchasedAt.UTC()
+	p.ExpiresAt = p.ExpiresAt.UTC()
+	p.RevokedAt = p.RevokedAt.UTC()
+	return &p, nil
+}
+
+func (s *sqlStorage) AppendLedgerEntry(ctx context.Context, e *LedgerEntry) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("append ledger entry: %w", err)
+	}
+	defer tx.Rollback()
+
+	added, err := s.insertLedgerEntry(ctx, tx, e)
+	if err != nil || !added {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO ledger_balances (user_token, account, balance)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_token, account) DO UPDATE SET
+			balance = ledger_balances.balance + excluded.balance`),
+		e.UserToken, e.Account, e.Amount,
+	); err != nil {
+		return false, fmt.Errorf("update balance: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("append ledger entry: %w", err)
+	}
+	return true, nil
+}
+
+// DebitLedgerEntry relies on the conditional UPDATE of ledger_balances: it
+// locks the balance row, so concurrent debits cannot both pass the check.
+func (s *sqlStorage) DebitLedgerEntry(ctx context.Context, e *LedgerEntry) (*LedgerEntry, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("debit ledger entry: %w", err)
+	}
+	defer tx.Rollback()
+
+	added, err := s.insertLedgerEntry(ctx, tx, e)
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		stored, err := s.getLedgerEntry(ctx, tx, e.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !sameEntry(stored, e) {
+			return nil, ErrLedgerEntryConflict
+		}
+		return stored, nil
+	}
+
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(`
+		UPDATE ledger_balances
+		SET balance = balance + ?
+		WHERE user_token = ? AND account = ? AND balance + ? >= 0`),
+		e.Amount, e.UserToken, e.Account, e.Amount,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("update balance: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("update balance: %w", err)
+	}
+	if n == 0 {
+		return nil, ErrInsufficientBalance
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("debit ledger entry: %w", err)
+	}
+	stored := *e
+	return &stored, nil
+}
+
+func (s *sqlStorage) insertLedgerEntry(ctx context.Context, tx *sql.Tx, e *LedgerEntry) (bool, error) {
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO ledger_entries (id, user_token, account, amount, reason, transaction_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`),
+		e.ID,
+		e.UserToken,
+		e.Account,
+		e.Amount,
+		e.Reason,
+		e.TransactionID,
+		e.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("append ledger entry: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("append ledger entry: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *sqlStorage) GetLedgerEntry(ctx context.Context, id string) (*LedgerEntry, error) {
+	return s.getLedgerEntry(ctx, s.db, id)
+}
+
+// rowQuerier is either *sql.DB or *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlStorage) getLedgerEntry(ctx context.Context, q rowQuerier, id string) (*LedgerEntry, error) {
+	var e LedgerEntry
+	err := q.QueryRowContext(ctx, s.dialect.rebind(`
+		SELECT id, user_token, account, amount, reason, transaction_id, created_at
+		FROM ledger_entries
+		WHERE id = ?`), id).Scan(&e.ID, &e.UserToken, &e.Account, &e.Amount, &e.Reason, &e.TransactionID, &e.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrLedgerEntryNotFound
+		}
+		return nil, fmt.Errorf("get ledger entry: %w", err)
+	}
+	e.CreatedAt = e.CreatedAt.UTC()
+	return &e, nil
+}
+
+func (s *sqlStorage) ListLedgerEntries(ctx context.Context, userToken string) ([]LedgerEntry, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT id, user_token, account, amount, reason, transaction_id, created_at
+		FROM ledger_entries
+		WHERE user_token = ?
+		ORDER BY created_at, id`), userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list ledger entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.UserToken, &e.Account, &e.Amount, &e.Reason, &e.TransactionID, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan ledger entry: %w", err)
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list ledger entries: %w", err)
+	}
+
+	return entries, nil
+}
+
+func (s *sqlStorage) Balances(ctx context.Context, userToken string) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT account, balance
+		FROM ledger_balances
+		WHERE user_token = ?`), userToken)
+	if err != nil {
+		return nil, fmt.Errorf("balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances := make(map[string]int64)
+	for rows.Next() {
+		var (
+			account string
+			amount  int64
+		)
+		if err := rows.Scan(&account, &amount); err != nil {
+			return nil, fmt.Errorf("scan balance: %w", err)
+		}
+		balances[account] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("balances: %w", err)
+	}
+
+	return balances, nil
+}
+
+func (s *sqlStorage) RecordAPICall(ctx context.Context, call *APICall) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO api_calls (
+			id, operation, user_token, transaction_id, environment,
+			request, status_code, error, attempt, sent_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`),
+		call.ID,
+		call.Operation,
+		call.UserToken,
+		call.TransactionID,
+		call.Environment,
+		call.Request,
+		call.StatusCode,
+		call.Error,
+		call.Attempt,
+		call.SentAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("record api call: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListAPICalls(ctx context.Context, userToken string) ([]APICall, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT id, operation, user_token, transaction_id, environment,
+			request, status_code, error, attempt, sent_at
+		FROM api_calls
+		WHERE user_token = ?
+		ORDER BY sent_at, id`), userToken)
+	if err != nil {
+		return nil, fmt.Errorf("list api calls: %w", err)
+	}
+	defer rows.Close()
+
+	calls := []APICall{}
+	for rows.Next() {
+		var c APICall
+		if err := rows.Scan(
+			&c.ID,
+			&c.Operation,
+			&c.UserToken,
+			&c.TransactionID,
+			&c.Environment,
+			&c.Request,
+			&c.StatusCode,
+			&c.Error,
+			&c.Attempt,
+			&c.SentAt,
+		); err != nil {
+			return nil, fmt.Errorf("scan api call: %w", err)
+		}
+		c.SentAt = c.SentAt.UTC()
+		calls = append(calls, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list api calls: %w", err)
+	}
+	return calls, nil
+}
+
+func (s *sqlStorage) SaveRenewalExtension(ctx context.Context, e *RenewalExtension) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO renewal_extensions (
+			request_id, user_token, original_transaction_id, product_id, environment,
+			days, reason, status, error, effective_date,
+			succeeded_count, failed_count, requested_at, completed_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (request_id) DO UPDATE SET
+			user_token = excluded.user_token,
+			original_transaction_id = excluded.original_transaction_id,
+			product_id = excluded.product_id,
+			environment = excluded.environment,
+			days = excluded.days,
+			reason = excluded.reason,
+			status = excluded.status,
+			error = excluded.error,
+			effective_date = excluded.effective_date,
+			succeeded_count = excluded.succeeded_count,
+			failed_count = excluded.failed_count,
+			requested_at = excluded.requested_at,
+			completed_at = excluded.completed_at`),
+		e.RequestID,
+		e.UserToken,
+		e.OriginalTransactionID,
+		e.ProductID,
+		e.Environment,
+		e.Days,
+		e.Reason,
+		e.Status,
+		e.Error,
+		e.EffectiveDate.UTC(),
+		e.SucceededCount,
+		e.FailedCount,
+		e.RequestedAt.UTC(),
+		e.CompletedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("save renewal extension: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetRenewalExtension(ctx context.Context, requestID string) (*RenewalExtension, error) {
+	rows, err := s.queryRenewalExtensions(ctx, `WHERE request_id = ?`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrRenewalExtensionNotFound
+	}
+	return &rows[0], nil
+}
+
+func (s *sqlStorage) ListRenewalExtensions(ctx context.Context) ([]RenewalExtension, error) {
+	return s.queryRenewalExtensions(ctx, `ORDER BY requested_at DESC, request_id`)
+}
+
+func (s *sqlStorage) queryRenewalExtensions(ctx context.Context, clause string, args ...any) ([]RenewalExtension, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT request_id, user_token, original_transaction_id, product_id, environment,
+			days, reason, status, error, effective_date,
+			succeeded_count, failed_count, requested_at, completed_at
+		FROM renewal_extensions `+clause), args...)
+	if err != nil {
+		return nil, fmt.Errorf("query renewal extensions: %w", err)
+	}
+	defer rows.Close()
+
+	list := []RenewalExtension{}
+	for rows.Next() {
+		var e RenewalExtension
+		if err := rows.Scan(
+			&e.RequestID,
+			&e.UserToken,
+			&e.OriginalTransactionID,
+			&e.ProductID,
+			&e.Environment,
+			&e.Days,
+			&e.Reason,
+			&e.Status,
+			&e.Error,
+			&e.EffectiveDate,
+			&e.SucceededCount,
+			&e.FailedCount,
+			&e.RequestedAt,
+			&e.CompletedAt,
+		); err != nil {
+			return nil, fmt.Errorf("scan renewal extension: %w", err)
+		}
+		e.EffectiveDate = e.EffectiveDate.UTC()
+		e.RequestedAt = e.RequestedAt.UTC()
+		e.CompletedAt = e.CompletedAt.UTC()
+		list = append(list, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query renewal extensions: %w", err)
+	}
+	return list, nil
+}
+
+func (s *sqlStorage) RecordRefund(ctx context.Context, r *Refund) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO refunds (
+			id, user_token, product_id, transaction_id, original_transaction_id,
+			type, revocation_reason, price, currency, environment, occurred_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`),
+		r.ID,
+		r.UserToken,
+		r.ProductID,
+		r.TransactionID,
+		r.OriginalTransactionID,
+		r.Type,
+		r.RevocationReason,
+		r.Price,
+		r.Currency,
+		r.Environment,
+		r.OccurredAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("record refund: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListRefunds(ctx context.Context, userToken string) ([]Refund, error) {
+	return s.queryRefunds(ctx, `WHERE user_token = ? ORDER BY occurred_at, id`, userToken)
+}
+
+func (s *sqlStorage) ListProductRefunds(ctx context.Context, productID string) ([]Refund, error) {
+	return s.queryRefunds(ctx, `WHERE product_id = ? ORDER BY occurred_at, id`, productID)
+}
+
+func (s *sqlStorage) queryRefunds(ctx context.Context, clause string, args ...any) ([]Refund, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT id, user_token, product_id, transaction_id, original_transaction_id,
+			type, revocation_reason, price, currency, environment, occurred_at
+		FROM refunds `+clause), args...)
+	if err != nil {
+		return nil, fmt.Errorf("query refunds: %w", err)
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		var (
+			r      Refund
+			reason sql.NullInt64
+			price  sql.NullInt64
+		)
+		if err := rows.Scan(
+			&r.ID,
+			&r.UserToken,
+			&r.ProductID,
+			&r.TransactionID,
+			&r.OriginalTransactionID,
+			&r.Type,
+			&reason,
+			&price,
+			&r.Currency,
+			&r.Environment,
+			&r.OccurredAt,
+		); err != nil {
+			return nil, fmt.Errorf("scan refund: %w", err)
+		}
+		if reason.Valid {
+			v := int(reason.Int64)
+			r.RevocationReason = &v
+		}
+		if price.Valid {
+			r.Price = &price.Int64
+		}
+		r.OccurredAt = r.OccurredAt.UTC()
+		refunds = append(refunds, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query refunds: %w", err)
+	}
+	return refunds, nil
+}
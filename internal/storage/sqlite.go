@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteDialect = dialect{
+	name:          "sqlite",
+	timestampType: "TIMESTAMP",
+	now:           "CURRENT_TIMESTAMP",
+}
+
+// NewSQLiteStorage opens (or creates) the database file at path in WAL mode,
+// applies pending migrations and returns a Storage backed by it.
+func NewSQLiteStorage(ctx context.Context, path string) (Storage, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {
+			"journal_mode(WAL)",
+			"synchronous(NORMAL)",
+			"busy_timeout(5000)",
+			"foreign_keys(ON)",
+		},
+		"_txlock": {"immediate"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping sqlite: %w", err)
+	}
+	if err := migrate(ctx, db, sqliteDialect, "sqlite"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate sqlite: %w", err)
+	}
+
+	return &sqlStorage{
+		db:      db,
+		dialect: sqliteDialect,
+	}, nil
+}
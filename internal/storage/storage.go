@@ -5,15 +5,129 @@ import (
 	"time"
 )
 
+// SubscriptionStatus holds the latest known facts about a user's
+// subscription. IsActive is the state as of the last write; access decisions
+// are made at read time by the entitlement package from the other fields.
 type SubscriptionStatus struct {
-	ExpiresAt             time.Time
-	UserToken             string
-	ProductID             string
-	OriginalTransactionID string
-	IsActive              bool
+	ExpiresAt             time.Time `json:"expiresAt"`
+	UserToken             string    `json:"userToken"`
+	ProductID             string    `json:"productId"`
+	OriginalTransactionID string    `json:"originalTransactionId"`
+	IsActive              bool      `json:"isActive"`
+	// GracePeriodExpiresAt is set while Apple grants a billing grace period.
+	GracePeriodExpiresAt time.Time `json:"gracePeriodExpiresAt,omitzero"`
+	InBillingRetry       bool      `json:"inBillingRetry,omitempty"`
+	RevokedAt            time.Time `json:"revokedAt,omitzero"`
+	// Environment is "Production" or "Sandbox" when known.
+	Environment string `json:"environment,omitempty"`
+
+	// Renewal state, known only from App Store server notifications.
+	// AutoRenewEnabled is nil when unknown.
+	AutoRenewEnabled *bool `json:"autoRenewEnabled,omitempty"`
+	// ExpirationIntent is Apple's expirationIntent code, 0 when none.
+	ExpirationIntent   int    `json:"expirationIntent,omitempty"`
+	AutoRenewProductID string `json:"autoRenewProductId,omitempty"`
+	// PendingProductID is the product of the same subscription group the
+	// user switches to at the next renewal, after a downgrade or crossgrade.
+	PendingProductID string `json:"pendingProductId,omitempty"`
+	// RenewalPrice is in milliunits of RenewalCurrency.
+	RenewalPrice    *int64 `json:"renewalPrice,omitempty"`
+	RenewalCurrency string `json:"renewalCurrency,omitempty"`
+
+	// Details of the latest transaction.
+	OriginalPurchaseDate time.Time `json:"originalPurchaseDate,omitzero"`
+	// OwnershipType is "PURCHASED" or "FAMILY_SHARED".
+	OwnershipType       string `json:"ownershipType,omitempty"`
+	SubscriptionGroupID string `json:"subscriptionGroupId,omitempty"`
+	// OfferType is Apple's offerType code of the current period, 0 when the
+	// customer pays the regular price.
+	OfferType int    `json:"offerType,omitempty"`
+	OfferID   string `json:"offerId,omitempty"`
+}
+
+// clone returns a deep copy of s, so callers never share pointer fields with
+// a stored record.
+func (s *SubscriptionStatus) clone() *SubscriptionStatus {
+	c := *s
+	if s.AutoRenewEnabled != nil {
+		v := *s.AutoRenewEnabled
+		c.AutoRenewEnabled = &v
+	}
+	if s.RenewalPrice != nil {
+		v := *s.RenewalPrice
+		c.RenewalPrice = &v
+	}
+	return &c
+}
+
+// Equal reports whether s and o hold the same facts. Times are compared as
+// instants and pointer fields by value.
+func (s *SubscriptionStatus) Equal(o *SubscriptionStatus) bool {
+	if !s.ExpiresAt.Equal(o.ExpiresAt) ||
+		!s.GracePeriodExpiresAt.Equal(o.GracePeriodExpiresAt) ||
+		!s.RevokedAt.Equal(o.RevokedAt) ||
+		!s.OriginalPurchaseDate.Equal(o.OriginalPurchaseDate) ||
+		!equalPtr(s.AutoRenewEnabled, o.AutoRenewEnabled) ||
+		!equalPtr(s.RenewalPrice, o.RenewalPrice) {
+		return false
+	}
+	x, y := *s, *o
+	x.ExpiresAt, y.ExpiresAt = time.Time{}, time.Time{}
+	x.GracePeriodExpiresAt, y.GracePeriodExpiresAt = time.Time{}, time.Time{}
+	x.RevokedAt, y.RevokedAt = time.Time{}, time.Time{}
+	x.OriginalPurchaseDate, y.OriginalPurchaseDate = time.Time{}, time.Time{}
+	x.AutoRenewEnabled, y.AutoRenewEnabled = nil, nil
+	x.RenewalPrice, y.RenewalPrice = nil, nil
+	return x == y
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// OwnershipFamilyShared marks records the user has through Family Sharing.
+const OwnershipFamilyShared = "FAMILY_SHARED"
+
+// PreferredOver reports whether s, the stored record, should be kept instead
+// of next: s is the user's own running purchase and next is a family-shared
+// record of another original transaction, e.g. one the purchaser stops
+// sharing.
+func (s *SubscriptionStatus) PreferredOver(next *SubscriptionStatus, now time.Time) bool {
+	return next.OwnershipType == OwnershipFamilyShared &&
+		s.OwnershipType != OwnershipFamilyShared &&
+		s.OriginalTransactionID != next.OriginalTransactionID &&
+		s.RevokedAt.IsZero() &&
+		now.Before(s.AccessEndsAt())
+}
+
+// AccessEndsAt returns the later of ExpiresAt and GracePeriodExpiresAt.
+func (s *SubscriptionStatus) AccessEndsAt() time.Time {
+	if s.GracePeriodExpiresAt.After(s.ExpiresAt) {
+		return s.GracePeriodExpiresAt
+	}
+	return s.ExpiresAt
 }
 
 type Storage interface {
 	GetSubscriptionStatus(ctx context.Context, userToken string) (*SubscriptionStatus, error)
 	SetSubscriptionStatus(ctx context.Context, status *SubscriptionStatus) error
+	// ListExpiredActive returns up to limit records still marked active whose
+	// AccessEndsAt is before cutoff, earliest expiry first.
+	ListExpiredActive(ctx context.Context, cutoff time.Time, limit int) ([]SubscriptionStatus, error)
+	// DeactivateSubscription marks the record of expected.UserToken inactive
+	// only if it is still active with the same ExpiresAt and
+	// GracePeriodExpiresAt, and reports whether it changed. This lets several
+	// instances sweep the same records without clobbering a renewal written
+	// in between.
+	DeactivateSubscription(ctx context.Context, expected *SubscriptionStatus) (bool, error)
+	Close()
+}
+
+// ChangeNotifier is implemented by backends shared between several server
+// instances. Each received value is the user token of a modified record.
+type ChangeNotifier interface {
+	SubscribeChanges(ctx context.Context) (<-chan string, error)
 }
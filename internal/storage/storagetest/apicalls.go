@@ -0,0 +1,60 @@
+package storagetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// APICallLogFactory returns a ready to use APICallLog.
+type APICallLogFactory func(t *testing.T) storage.APICallLog
+
+// RunAPICallLog executes the conformance suite for storage.APICallLog.
+// Every factory call must return an empty log.
+func RunAPICallLog(t *testing.T, newLog APICallLogFactory) {
+	t.Run("Audit", func(t *testing.T) { testAPICallAudit(t, newLog(t)) })
+}
+
+func testAPICallAudit(t *testing.T, log storage.APICallLog) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	user := Token(t, "user")
+
+	retry := &storage.APICall{ID: Token(t, "call") + ":2", Operation: "consumption", UserToken: user, TransactionID: "2001",
+		Environment: "Sandbox", Request: `{"customerConsented":true}`, StatusCode: 200, Attempt: 2, SentAt: base.Add(time.Minute)}
+	failed := &storage.APICall{ID: Token(t, "call") + ":1", Operation: "consumption", UserToken: user, TransactionID: "2001",
+		Environment: "Sandbox", Request: `{"customerConsented":true}`, StatusCode: 503, Error: "unavailable", Attempt: 1, SentAt: base}
+	other := &storage.APICall{ID: Token(t, "other"), Operation: "consumption", UserToken: Token(t, "other"), Request: `{}`, SentAt: base}
+	for _, c := range []*storage.APICall{retry, failed, other} {
+		if err := log.RecordAPICall(ctx, c); err != nil {
+			t.Fatalf("record api call: %v", err)
+		}
+	}
+
+	// Recording the same ID again keeps the original entry.
+	changed := *failed
+	changed.Error = "changed"
+	if err := log.RecordAPICall(ctx, &changed); err != nil {
+		t.Fatalf("record duplicate api call: %v", err)
+	}
+
+	calls, err := log.ListAPICalls(ctx, user)
+	if err != nil {
+		t.Fatalf("list api calls: %v", err)
+	}
+	if len(calls) != 2 || calls[0].ID != failed.ID || calls[1].ID != retry.ID {
+		t.Fatalf("expected [%s %s], got %+v", failed.ID, retry.ID, calls)
+	}
+	got := calls[0]
+	if got.Error != "unavailable" || got.StatusCode != 503 || got.Attempt != 1 || got.Request != failed.Request ||
+		got.TransactionID != "2001" || got.Environment != "Sandbox" || !got.SentAt.Equal(base) {
+		t.Errorf("fields not preserved: %+v", got)
+	}
+
+	empty, err := log.ListAPICalls(ctx, Token(t, "nobody"))
+	if err != nil || len(empty) != 0 {
+		t.Errorf("expected no calls, got %+v (%v)", empty, err)
+	}
+}
@@ -0,0 +1,96 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// RequestArchiveFactory returns a ready to use RequestArchive.
+type RequestArchiveFactory func(t *testing.T) storage.RequestArchive
+
+// ArchiveID returns an archive ID for a request received at receivedAt that is
+// unique to the running test.
+type ArchiveID func(receivedAt time.Time) string
+
+// RunRequestArchive executes the conformance suite for storage.RequestArchive.
+// newID must produce IDs the archive accepts.
+func RunRequestArchive(t *testing.T, newArchive RequestArchiveFactory, newID ArchiveID) {
+	t.Run("RoundTrip", func(t *testing.T) { testArchiveRoundTrip(t, newArchive(t), newID) })
+	t.Run("NotFound", func(t *testing.T) { testArchiveNotFound(t, newArchive(t), newID) })
+	t.Run("Prune", func(t *testing.T) { testArchivePrune(t, newArchive(t), newID) })
+}
+
+func testArchiveRoundTrip(t *testing.T, a storage.RequestArchive, newID ArchiveID) {
+	ctx := context.Background()
+	receivedAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := &storage.ArchivedRequest{
+		ID:         newID(receivedAt),
+		Endpoint:   "/api/v1/notifications/apple/v2",
+		ReceivedAt: receivedAt,
+		Headers:    http.Header{"Content-Type": {"application/json"}, "X-Forwarded-For": {"1.2.3.4", "5.6.7.8"}},
+		Body:       bytes.Repeat([]byte(`{"signedPayload":"abc"}`), 100),
+		StatusCode: http.StatusInternalServerError,
+		Outcome:    "failed to process notification: boom",
+		Duration:   250 * time.Millisecond,
+	}
+	if err := a.StoreRequest(ctx, want); err != nil {
+		t.Fatalf("store request: %v", err)
+	}
+
+	got, err := a.GetRequest(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("get request: %v", err)
+	}
+	if got.ID != want.ID || got.Endpoint != want.Endpoint || !got.ReceivedAt.Equal(want.ReceivedAt) {
+		t.Errorf("identity not preserved: got %+v", got)
+	}
+	if !bytes.Equal(got.Body, want.Body) {
+		t.Errorf("body not preserved: got %q", got.Body)
+	}
+	if got.Headers.Get("Content-Type") != "application/json" || len(got.Headers.Values("X-Forwarded-For")) != 2 {
+		t.Errorf("headers not preserved: got %v", got.Headers)
+	}
+	if got.StatusCode != want.StatusCode || got.Outcome != want.Outcome || got.Duration != want.Duration {
+		t.Errorf("outcome not preserved: got %+v", got)
+	}
+}
+
+func testArchiveNotFound(t *testing.T, a storage.RequestArchive, newID ArchiveID) {
+	_, err := a.GetRequest(context.Background(), newID(time.Now()))
+	if !errors.Is(err, storage.ErrArchivedRequestNotFound) {
+		t.Errorf("expected %v, got %v", storage.ErrArchivedRequestNotFound, err)
+	}
+}
+
+func testArchivePrune(t *testing.T, a storage.RequestArchive, newID ArchiveID) {
+	ctx := context.Background()
+	old := &storage.ArchivedRequest{ID: newID(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)), ReceivedAt: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+	recent := &storage.ArchivedRequest{ID: newID(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)), ReceivedAt: time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)}
+	for _, req := range []*storage.ArchivedRequest{old, recent} {
+		req.Endpoint = "/api/v1/notifications/client/ios"
+		req.StatusCode = http.StatusOK
+		if err := a.StoreRequest(ctx, req); err != nil {
+			t.Fatalf("store request: %v", err)
+		}
+	}
+
+	pruned, err := a.PruneRequests(ctx, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if pruned < 1 {
+		t.Errorf("expected at least one pruned request, got %d", pruned)
+	}
+	if _, err := a.GetRequest(ctx, old.ID); !errors.Is(err, storage.ErrArchivedRequestNotFound) {
+		t.Errorf("old request should be pruned, got %v", err)
+	}
+	if _, err := a.GetRequest(ctx, recent.ID); err != nil {
+		t.Errorf("recent request should be kept, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// DeadLetterStoreFactory returns a ready to use DeadLetterStore.
+type DeadLetterStoreFactory func(t *testing.T) storage.DeadLetterStore
+
+// RunDeadLetterStore executes the conformance suite for storage.DeadLetterStore.
+// Every factory call must return an empty store.
+func RunDeadLetterStore(t *testing.T, newStore DeadLetterStoreFactory) {
+	t.Run("Lifecycle", func(t *testing.T) { testDeadLetterLifecycle(t, newStore(t)) })
+	t.Run("NotFound", func(t *testing.T) { testDeadLetterNotFound(t, newStore(t)) })
+}
+
+func testDeadLetterLifecycle(t *testing.T, st storage.DeadLetterStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	second := &storage.DeadLetter{ID: Token(t, "b"), Source: "apple_server", Payload: `{"b":1}`, Error: "parse", Attempts: 1, FirstFailedAt: base.Add(time.Minute), LastFailedAt: base.Add(time.Minute)}
+	first := &storage.DeadLetter{ID: Token(t, "a"), Source: "apple_server", Payload: `{"a":1}`, Error: "storage", Attempts: 1, FirstFailedAt: base, LastFailedAt: base, ArchiveID: "20300101-abc"}
+	for _, dl := range []*storage.DeadLetter{second, first} {
+		if err := st.SaveDeadLetter(ctx, dl); err != nil {
+			t.Fatalf("save dead letter: %v", err)
+		}
+	}
+
+	list, err := st.ListDeadLetters(ctx)
+	if err != nil {
+		t.Fatalf("list dead letters: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+		t.Fatalf("expected [%s %s], got %+v", first.ID, second.ID, list)
+	}
+	if list[0].ArchiveID != first.ArchiveID || list[0].Payload != first.Payload || !list[0].FirstFailedAt.Equal(base) {
+		t.Errorf("fields not preserved: %+v", list[0])
+	}
+
+	// Saving again replaces the entry.
+	first.Attempts = 2
+	first.Error = "storage again"
+	first.LastFailedAt = base.Add(time.Hour)
+	if err := st.SaveDeadLetter(ctx, first); err != nil {
+		t.Fatalf("update dead letter: %v", err)
+	}
+	got, err := st.GetDeadLetter(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("get dead letter: %v", err)
+	}
+	if got.Attempts != 2 || got.Error != "storage again" || !got.LastFailedAt.Equal(first.LastFailedAt) {
+		t.Errorf("update not applied: %+v", got)
+	}
+
+	if err := st.DeleteDeadLetter(ctx, first.ID); err != nil {
+		t.Fatalf("delete dead letter: %v", err)
+	}
+	if _, err := st.GetDeadLetter(ctx, first.ID); !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		t.Errorf("deleted entry still present: %v", err)
+	}
+}
+
+func testDeadLetterNotFound(t *testing.T, st storage.DeadLetterStore) {
+	ctx := context.Background()
+	if _, err := st.GetDeadLetter(ctx, Token(t, "missing")); !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		t.Errorf("get: expected %v, got %v", storage.ErrDeadLetterNotFound, err)
+	}
+	if err := st.DeleteDeadLetter(ctx, Token(t, "missing")); !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		t.Errorf("delete: expected %v, got %v", storage.ErrDeadLetterNotFound, err)
+	}
+}
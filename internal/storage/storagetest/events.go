@@ -0,0 +1,145 @@
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// EventStoreFactory returns a ready to use EventStore.
+type EventStoreFactory func(t *testing.T) storage.EventStore
+
+// RunEventStore executes the conformance suite for storage.EventStore.
+func RunEventStore(t *testing.T, newStore EventStoreFactory) {
+	t.Run("EmptyTimeline", func(t *testing.T) { testEmptyTimeline(t, newStore(t)) })
+	t.Run("Ordering", func(t *testing.T) { testEventOrdering(t, newStore(t)) })
+	t.Run("DuplicateID", func(t *testing.T) { testDuplicateEvent(t, newStore(t)) })
+	t.Run("ListUsers", func(t *testing.T) { testListEventUsers(t, newStore(t)) })
+}
+
+func testEmptyTimeline(t *testing.T, st storage.EventStore) {
+	events, err := st.ListEvents(context.Background(), Token(t, "nobody"))
+	if err != nil {
+		t.Fatalf("list events: %v", err)
+	}
+	if events == nil || len(events) != 0 {
+		t.Errorf("expected empty non-nil timeline, got %#v", events)
+	}
+}
+
+func testEventOrdering(t *testing.T, st storage.EventStore) {
+	ctx := context.Background()
+	token := Token(t, "user")
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	price := int64(9990)
+
+	// Appended out of order on purpose; the timeline is ordered by OccurredAt.
+	appended := []storage.SubscriptionEvent{
+		{ID: Token(t, "renew"), Type: "DID_RENEW", OccurredAt: base.Add(2 * time.Hour)},
+		{
+			ID: Token(t, "buy"), Type: "SUBSCRIBED", Subtype: "INITIAL_BUY", Price: &price, Currency: "USD", OccurredAt: base,
+			TransactionType: "Auto-Renewable Subscription", TransactionReason: "PURCHASE", OwnershipType: "PURCHASED",
+			Environment: "Production", Storefront: "USA", PurchaseDate: base.Add(-time.Minute),
+			OfferType: 1, OfferID: "intro", OfferDiscountType: "FREE_TRIAL", IsUpgraded: true,
+		},
+		{ID: Token(t, "refund"), Type: "REFUND", OccurredAt: base.Add(3 * time.Hour)},
+	}
+	for i := range appended {
+		appended[i].UserToken = token
+		appended[i].Source = storage.EventSourceAppleServer
+		appended[i].RecordedAt = base.Add(4 * time.Hour)
+		appended[i].RawPayload = `{"signedPayload":"` + appended[i].ID + `"}`
+		if err := st.AppendEvent(ctx, &appended[i]); err != nil {
+			t.Fatalf("append event %s: %v", appended[i].Type, err)
+		}
+	}
+	// An event of another user must not leak into the timeline.
+	other := storage.SubscriptionEvent{ID: Token(t, "other"), UserToken: Token(t, "other"), Type: "SUBSCRIBED", OccurredAt: base}
+	if err := st.AppendEvent(ctx, &other); err != nil {
+		t.Fatalf("append other event: %v", err)
+	}
+
+	events, err := st.ListEvents(ctx, token)
+	if err != nil {
+		t.Fatalf("list events: %v", err)
+	}
+	wantTypes := []string{"SUBSCRIBED", "DID_RENEW", "REFUND"}
+	if len(events) != len(wantTypes) {
+		t.Fatalf("expected %d events, got %d: %+v", len(wantTypes), len(events), events)
+	}
+	for i, want := range wantTypes {
+		if events[i].Type != want {
+			t.Errorf("event %d: expected type %s, got %s", i, want, events[i].Type)
+		}
+	}
+
+	first := events[0]
+	if first.Subtype != "INITIAL_BUY" || first.Currency != "USD" || first.Price == nil || *first.Price != price {
+		t.Errorf("event fields not preserved: %+v", first)
+	}
+	if !first.OccurredAt.Equal(base) || first.RawPayload != appended[1].RawPayload {
+		t.Errorf("event timestamps or payload not preserved: %+v", first)
+	}
+	buy := appended[1]
+	if first.TransactionType != buy.TransactionType || first.TransactionReason != buy.TransactionReason ||
+		first.OwnershipType != buy.OwnershipType || first.Environment != buy.Environment ||
+		first.Storefront != buy.Storefront || !first.PurchaseDate.Equal(buy.PurchaseDate) ||
+		first.OfferType != buy.OfferType || first.OfferID != buy.OfferID ||
+		first.OfferDiscountType != buy.OfferDiscountType || !first.IsUpgraded {
+		t.Errorf("transaction details not preserved: %+v", first)
+	}
+}
+
+func testDuplicateEvent(t *testing.T, st storage.EventStore) {
+	ctx := context.Background()
+	event := &storage.SubscriptionEvent{
+		ID:         Token(t, "event"),
+		UserToken:  Token(t, "user"),
+		Type:       "DID_RENEW",
+		OccurredAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < 2; i++ {
+		if err := st.AppendEvent(ctx, event); err != nil {
+			t.Fatalf("append event #%d: %v", i+1, err)
+		}
+	}
+
+	events, err := st.ListEvents(ctx, event.UserToken)
+	if err != nil {
+		t.Fatalf("list events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Errorf("expected duplicate append to be ignored, got %d events", len(events))
+	}
+}
+
+func testListEventUsers(t *testing.T, st storage.EventStore) {
+	ctx := context.Background()
+	a, b := Token(t, "a"), Token(t, "b")
+	for i, user := range []string{a, b, a} {
+		event := &storage.SubscriptionEvent{
+			ID:         Token(t, fmt.Sprintf("event%d", i)),
+			UserToken:  user,
+			Type:       "DID_RENEW",
+			OccurredAt: time.Date(2030, 1, 1, i, 0, 0, 0, time.UTC),
+		}
+		if err := st.AppendEvent(ctx, event); err != nil {
+			t.Fatalf("append event: %v", err)
+		}
+	}
+
+	users, err := st.ListEventUsers(ctx)
+	if err != nil {
+		t.Fatalf("list event users: %v", err)
+	}
+	seen := map[string]int{}
+	for _, user := range users {
+		seen[user]++
+	}
+	if seen[a] != 1 || seen[b] != 1 {
+		t.Errorf("expected %s and %s exactly once, got %v", a, b, users)
+	}
+}
@@ -0,0 +1,80 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// ExtensionStoreFactory returns a ready to use ExtensionStore.
+type ExtensionStoreFactory func(t *testing.T) storage.ExtensionStore
+
+// RunExtensionStore executes the conformance suite for
+// storage.ExtensionStore. Every factory call must return an empty store.
+func RunExtensionStore(t *testing.T, newStore ExtensionStoreFactory) {
+	t.Run("SaveGet", func(t *testing.T) { testExtensionSaveGet(t, newStore(t)) })
+	t.Run("List", func(t *testing.T) { testExtensionList(t, newStore(t)) })
+}
+
+func testExtensionSaveGet(t *testing.T, st storage.ExtensionStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := Token(t, "request")
+
+	if _, err := st.GetRenewalExtension(ctx, id); !errors.Is(err, storage.ErrRenewalExtensionNotFound) {
+		t.Fatalf("expected ErrRenewalExtensionNotFound, got %v", err)
+	}
+
+	mass := &storage.RenewalExtension{RequestID: id, ProductID: "com.test.monthly", Environment: "Sandbox",
+		Days: 7, Reason: 3, Status: storage.ExtensionPending, RequestedAt: base}
+	if err := st.SaveRenewalExtension(ctx, mass); err != nil {
+		t.Fatalf("save renewal extension: %v", err)
+	}
+
+	// Saving again replaces the request.
+	mass.Status = storage.ExtensionComplete
+	mass.SucceededCount, mass.FailedCount = 120, 3
+	mass.CompletedAt = base.Add(time.Hour)
+	if err := st.SaveRenewalExtension(ctx, mass); err != nil {
+		t.Fatalf("update renewal extension: %v", err)
+	}
+
+	got, err := st.GetRenewalExtension(ctx, id)
+	if err != nil {
+		t.Fatalf("get renewal extension: %v", err)
+	}
+	if got.Status != storage.ExtensionComplete || got.SucceededCount != 120 || got.FailedCount != 3 ||
+		got.ProductID != "com.test.monthly" || got.Environment != "Sandbox" || got.Days != 7 || got.Reason != 3 ||
+		!got.RequestedAt.Equal(base) || !got.CompletedAt.Equal(base.Add(time.Hour)) || !got.EffectiveDate.IsZero() {
+		t.Errorf("fields not preserved: %+v", got)
+	}
+}
+
+func testExtensionList(t *testing.T, st storage.ExtensionStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	older := &storage.RenewalExtension{RequestID: Token(t, "older"), UserToken: Token(t, "user"), OriginalTransactionID: "1000",
+		Days: 3, Status: storage.ExtensionSucceeded, EffectiveDate: base.Add(30 * 24 * time.Hour), RequestedAt: base}
+	newer := &storage.RenewalExtension{RequestID: Token(t, "newer"), UserToken: Token(t, "user"), OriginalTransactionID: "1000",
+		Days: 3, Status: storage.ExtensionFailed, Error: "rejected", RequestedAt: base.Add(time.Minute)}
+	for _, e := range []*storage.RenewalExtension{older, newer} {
+		if err := st.SaveRenewalExtension(ctx, e); err != nil {
+			t.Fatalf("save renewal extension: %v", err)
+		}
+	}
+
+	list, err := st.ListRenewalExtensions(ctx)
+	if err != nil {
+		t.Fatalf("list renewal extensions: %v", err)
+	}
+	if len(list) != 2 || list[0].RequestID != newer.RequestID || list[1].RequestID != older.RequestID {
+		t.Fatalf("expected [%s %s], got %+v", newer.RequestID, older.RequestID, list)
+	}
+	if list[0].Error != "rejected" || !list[1].EffectiveDate.Equal(older.EffectiveDate) || list[1].UserToken != older.UserToken {
+		t.Errorf("fields not preserved: %+v", list)
+	}
+}
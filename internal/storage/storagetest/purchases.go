@@ -0,0 +1,278 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// PurchaseStoreFactory returns a ready to use PurchaseStore.
+type PurchaseStoreFactory func(t *testing.T) storage.PurchaseStore
+
+// RunPurchaseStore executes the conformance suite for storage.PurchaseStore.
+// Every factory call must return an empty store.
+func RunPurchaseStore(t *testing.T, newStore PurchaseStoreFactory) {
+	t.Run("Purchases", func(t *testing.T) { testPurchases(t, newStore(t)) })
+	t.Run("InsertPurchase", func(t *testing.T) { testInsertPurchase(t, newStore(t)) })
+	t.Run("ClaimOriginalTransaction", func(t *testing.T) { testClaimOriginalTransaction(t, newStore(t)) })
+	t.Run("Ledger", func(t *testing.T) { testLedger(t, newStore(t)) })
+	t.Run("Debit", func(t *testing.T) { testDebit(t, newStore(t)) })
+}
+
+func testPurchases(t *testing.T, s storage.PurchaseStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	lifetime := &storage.Purchase{
+		TransactionID:         "tx-1",
+		OriginalTransactionID: "tx-1",
+		UserToken:             "user-a",
+		ProductID:             "com.example.lifetime",
+		ProductType:           storage.ProductTypeNonConsumable,
+		PurchasedAt:           base,
+		Environment:           "Production",
+		OwnershipType:         storage.OwnershipFamilyShared,
+	}
+	season := &storage.Purchase{
+		TransactionID:         "tx-2",
+		OriginalTransactionID: "tx-2",
+		UserToken:             "user-a",
+		ProductID:             "com.example.season",
+		ProductType:           storage.ProductTypeNonRenewing,
+		PurchasedAt:           base.Add(time.Hour),
+		ExpiresAt:             base.Add(time.Hour + 30*24*time.Hour),
+	}
+	other := &storage.Purchase{
+		TransactionID: "tx-3",
+		UserToken:     "user-b",
+		ProductID:     "com.example.lifetime",
+		ProductType:   storage.ProductTypeNonConsumable,
+		PurchasedAt:   base,
+	}
+	for _, p := range []*storage.Purchase{season, lifetime, other} {
+		if err := s.SavePurchase(ctx, p); err != nil {
+			t.Fatalf("save purchase: %v", err)
+		}
+	}
+
+	// A refund arrives for the same transaction.
+	revoked := *lifetime
+	revoked.RevokedAt = base.Add(48 * time.Hour)
+	if err := s.SavePurchase(ctx, &revoked); err != nil {
+		t.Fatalf("save revoked purchase: %v", err)
+	}
+
+	list, err := s.ListPurchases(ctx, "user-a")
+	if err != nil {
+		t.Fatalf("list purchases: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 purchases, got %d", len(list))
+	}
+	if got := list[0]; got.TransactionID != "tx-1" || got.ProductType != storage.ProductTypeNonConsumable ||
+		!got.PurchasedAt.Equal(base) || !got.ExpiresAt.IsZero() || !got.RevokedAt.Equal(revoked.RevokedAt) ||
+		got.Environment != "Production" || got.OwnershipType != storage.OwnershipFamilyShared {
+		t.Errorf("purchases[0] = %+v", got)
+	}
+	if got := list[1]; got.TransactionID != "tx-2" || !got.ExpiresAt.Equal(season.ExpiresAt) || !got.RevokedAt.IsZero() {
+		t.Errorf("purchases[1] = %+v", got)
+	}
+
+	list, err = s.ListPurchases(ctx, "nobody")
+	if err != nil {
+		t.Fatalf("list purchases: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected no purchases, got %+v", list)
+	}
+}
+
+func testInsertPurchase(t *testing.T, s storage.PurchaseStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	first := &storage.Purchase{
+		TransactionID: "legacy:1",
+		UserToken:     "user-a",
+		ProductID:     "com.example.legacy",
+		ProductType:   storage.ProductTypeNonConsumable,
+		PurchasedAt:   base,
+	}
+	stored, err := s.InsertPurchase(ctx, first)
+	if err != nil {
+		t.Fatalf("insert purchase: %v", err)
+	}
+	if stored.UserToken != "user-a" || !stored.PurchasedAt.Equal(base) {
+		t.Errorf("inserted purchase = %+v", stored)
+	}
+
+	// A second insert of the same transaction keeps the first.
+	second := *first
+	second.UserToken = "user-b"
+	second.PurchasedAt = base.Add(time.Hour)
+	stored, err = s.InsertPurchase(ctx, &second)
+	if err != nil {
+		t.Fatalf("insert purchase: %v", err)
+	}
+	if stored.UserToken != "user-a" || !stored.PurchasedAt.Equal(base) {
+		t.Errorf("expected the first purchase, got %+v", stored)
+	}
+	if list, _ := s.ListPurchases(ctx, "user-b"); len(list) != 0 {
+		t.Errorf("expected no purchases for user-b, got %+v", list)
+	}
+}
+
+func testClaimOriginalTransaction(t *testing.T, s storage.PurchaseStore) {
+	ctx := context.Background()
+
+	for _, user := range []string{"user-a", "user-b", "user-a"} {
+		owner, err := s.ClaimOriginalTransaction(ctx, "1000", user)
+		if err != nil {
+			t.Fatalf("claim original transaction: %v", err)
+		}
+		if owner != "user-a" {
+			t.Errorf("claim by %s: expected owner user-a, got %q", user, owner)
+		}
+	}
+	if owner, err := s.ClaimOriginalTransaction(ctx, "2000", "user-b"); err != nil || owner != "user-b" {
+		t.Errorf("expected user-b to own another transaction, got %q (%v)", owner, err)
+	}
+}
+
+func testLedger(t *testing.T, s storage.PurchaseStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entries := []*storage.LedgerEntry{
+		{ID: "apple:1", UserToken: "user-a", Account: "com.example.coins", Amount: 3, Reason: storage.LedgerReasonPurchase, TransactionID: "1", CreatedAt: base},
+		{ID: "apple:2", UserToken: "user-a", Account: "com.example.coins", Amount: 1, Reason: storage.LedgerReasonPurchase, TransactionID: "2", CreatedAt: base.Add(time.Minute)},
+		{ID: "apple:3", UserToken: "user-a", Account: "com.example.hints", Amount: 5, Reason: storage.LedgerReasonPurchase, TransactionID: "3", CreatedAt: base.Add(2 * time.Minute)},
+		{ID: "apple:4", UserToken: "user-b", Account: "com.example.coins", Amount: 7, Reason: storage.LedgerReasonPurchase, TransactionID: "4", CreatedAt: base},
+	}
+	for _, e := range entries {
+		added, err := s.AppendLedgerEntry(ctx, e)
+		if err != nil {
+			t.Fatalf("append ledger entry: %v", err)
+		}
+		if !added {
+			t.Fatalf("entry %s not added", e.ID)
+		}
+	}
+
+	// A redelivered transaction is credited once.
+	dup := *entries[0]
+	dup.Amount = 100
+	added, err := s.AppendLedgerEntry(ctx, &dup)
+	if err != nil {
+		t.Fatalf("append duplicate entry: %v", err)
+	}
+	if added {
+		t.Error("duplicate entry was added")
+	}
+
+	balances, err := s.Balances(ctx, "user-a")
+	if err != nil {
+		t.Fatalf("balances: %v", err)
+	}
+	if len(balances) != 2 || balances["com.example.coins"] != 4 || balances["com.example.hints"] != 5 {
+		t.Errorf("unexpected balances: %v", balances)
+	}
+
+	list, err := s.ListLedgerEntries(ctx, "user-a")
+	if err != nil {
+		t.Fatalf("list ledger entries: %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(list))
+	}
+	if got := list[0]; got.ID != "apple:1" || got.Amount != 3 || got.Reason != storage.LedgerReasonPurchase ||
+		got.TransactionID != "1" || !got.CreatedAt.Equal(base) {
+		t.Errorf("entries[0] = %+v", got)
+	}
+
+	balances, err = s.Balances(ctx, "nobody")
+	if err != nil {
+		t.Fatalf("balances: %v", err)
+	}
+	if len(balances) != 0 {
+		t.Errorf("expected no balances, got %v", balances)
+	}
+}
+
+func testDebit(t *testing.T, s storage.PurchaseStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	credit := &storage.LedgerEntry{ID: "apple:1", UserToken: "user-a", Account: "credits", Amount: 100, Reason: storage.LedgerReasonPurchase, TransactionID: "1", CreatedAt: base}
+	if _, err := s.AppendLedgerEntry(ctx, credit); err != nil {
+		t.Fatalf("append ledger entry: %v", err)
+	}
+
+	debit := &storage.LedgerEntry{ID: "debit:k1", UserToken: "user-a", Account: "credits", Amount: -60, Reason: storage.LedgerReasonDebit, CreatedAt: base.Add(time.Minute)}
+	stored, err := s.DebitLedgerEntry(ctx, debit)
+	if err != nil {
+		t.Fatalf("debit: %v", err)
+	}
+	if stored.ID != "debit:k1" || stored.Amount != -60 {
+		t.Errorf("unexpected debit entry: %+v", stored)
+	}
+
+	// Retrying with the same key does not debit twice.
+	retry := *debit
+	retry.CreatedAt = base.Add(time.Hour)
+	stored, err = s.DebitLedgerEntry(ctx, &retry)
+	if err != nil {
+		t.Fatalf("repeated debit: %v", err)
+	}
+	if !stored.CreatedAt.Equal(debit.CreatedAt) {
+		t.Errorf("repeated debit should return the stored entry, got %+v", stored)
+	}
+
+	changed := *debit
+	changed.Amount = -10
+	if _, err := s.DebitLedgerEntry(ctx, &changed); !errors.Is(err, storage.ErrLedgerEntryConflict) {
+		t.Errorf("expected ErrLedgerEntryConflict, got %v", err)
+	}
+
+	over := &storage.LedgerEntry{ID: "debit:k2", UserToken: "user-a", Account: "credits", Amount: -41, Reason: storage.LedgerReasonDebit, CreatedAt: base.Add(2 * time.Minute)}
+	if _, err := s.DebitLedgerEntry(ctx, over); !errors.Is(err, storage.ErrInsufficientBalance) {
+		t.Errorf("expected ErrInsufficientBalance, got %v", err)
+	}
+	// A rejected debit does not consume its key.
+	over.Amount = -40
+	if _, err := s.DebitLedgerEntry(ctx, over); err != nil {
+		t.Errorf("debit of the whole balance: %v", err)
+	}
+
+	none := &storage.LedgerEntry{ID: "debit:k3", UserToken: "user-b", Account: "credits", Amount: -1, Reason: storage.LedgerReasonDebit, CreatedAt: base}
+	if _, err := s.DebitLedgerEntry(ctx, none); !errors.Is(err, storage.ErrInsufficientBalance) {
+		t.Errorf("expected ErrInsufficientBalance without a balance, got %v", err)
+	}
+
+	// Clawbacks are appended unconditionally and may leave a negative balance.
+	clawback := &storage.LedgerEntry{ID: "apple:1:clawback", UserToken: "user-a", Account: "credits", Amount: -100, Reason: storage.LedgerReasonClawback, TransactionID: "1", CreatedAt: base.Add(time.Hour)}
+	if _, err := s.AppendLedgerEntry(ctx, clawback); err != nil {
+		t.Fatalf("append clawback: %v", err)
+	}
+	balances, err := s.Balances(ctx, "user-a")
+	if err != nil {
+		t.Fatalf("balances: %v", err)
+	}
+	if balances["credits"] != -100 {
+		t.Errorf("expected balance -100, got %d", balances["credits"])
+	}
+
+	got, err := s.GetLedgerEntry(ctx, "apple:1")
+	if err != nil {
+		t.Fatalf("get ledger entry: %v", err)
+	}
+	if got.Amount != 100 || got.TransactionID != "1" || !got.CreatedAt.Equal(base) {
+		t.Errorf("unexpected entry: %+v", got)
+	}
+	if _, err := s.GetLedgerEntry(ctx, "missing"); !errors.Is(err, storage.ErrLedgerEntryNotFound) {
+		t.Errorf("expected ErrLedgerEntryNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package storagetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// NotificationQueueFactory returns a ready to use NotificationQueue.
+type NotificationQueueFactory func(t *testing.T) storage.NotificationQueue
+
+// RunNotificationQueue executes the conformance suite for
+// storage.NotificationQueue. Every factory call must return an empty queue.
+func RunNotificationQueue(t *testing.T, newQueue NotificationQueueFactory) {
+	t.Run("Lifecycle", func(t *testing.T) { testNotificationQueueLifecycle(t, newQueue(t)) })
+	t.Run("Claim", func(t *testing.T) { testNotificationClaim(t, newQueue(t)) })
+}
+
+func testNotificationQueueLifecycle(t *testing.T, q storage.NotificationQueue) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	items := []*storage.QueuedNotification{
+		{Source: "apple_server", PartitionKey: "user-a", Payload: `{"n":1}`, ArchiveID: "20300101-abc", EnqueuedAt: base},
+		{Source: "apple_server", PartitionKey: "user-b", Payload: `{"n":2}`, EnqueuedAt: base.Add(time.Second)},
+		{Source: "apple_server", PartitionKey: "user-a", Payload: `{"n":3}`, EnqueuedAt: base.Add(2 * time.Second)},
+	}
+	for i, n := range items {
+		if err := q.EnqueueNotification(ctx, n); err != nil {
+			t.Fatalf("enqueue notification: %v", err)
+		}
+		if i > 0 && n.Seq <= items[i-1].Seq {
+			t.Fatalf("seq %d not greater than previous %d", n.Seq, items[i-1].Seq)
+		}
+	}
+
+	pending, err := q.PendingNotifications(ctx)
+	if err != nil {
+		t.Fatalf("pending notifications: %v", err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("expected 3 pending, got %d", len(pending))
+	}
+	for i, n := range pending {
+		if n.Seq != items[i].Seq || n.Payload != items[i].Payload || n.PartitionKey != items[i].PartitionKey {
+			t.Errorf("pending[%d] = %+v, want %+v", i, n, *items[i])
+		}
+	}
+	if pending[0].ArchiveID != "20300101-abc" || !pending[0].EnqueuedAt.Equal(base) {
+		t.Errorf("fields not preserved: %+v", pending[0])
+	}
+
+	if err := q.AckNotification(ctx, items[1].Seq); err != nil {
+		t.Fatalf("ack notification: %v", err)
+	}
+	// Acknowledging twice is harmless.
+	if err := q.AckNotification(ctx, items[1].Seq); err != nil {
+		t.Fatalf("repeated ack: %v", err)
+	}
+
+	pending, err = q.PendingNotifications(ctx)
+	if err != nil {
+		t.Fatalf("pending notifications: %v", err)
+	}
+	if len(pending) != 2 || pending[0].Seq != items[0].Seq || pending[1].Seq != items[2].Seq {
+		t.Fatalf("unexpected pending after ack: %+v", pending)
+	}
+}
+
+func testNotificationClaim(t *testing.T, q storage.NotificationQueue) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The first is leased by the instance that accepted it, the others are
+	// free or their lease has run out.
+	items := []*storage.QueuedNotification{
+		{Source: "apple_server", PartitionKey: "user-a", Payload: "held", EnqueuedAt: now, LeaseUntil: now.Add(time.Minute)},
+		{Source: "apple_server", PartitionKey: "user-b", Payload: "free", EnqueuedAt: now},
+		{Source: "apple_server", PartitionKey: "user-c", Payload: "lapsed", EnqueuedAt: now, LeaseUntil: now.Add(-time.Minute)},
+		{Source: "apple_server", PartitionKey: "user-d", Payload: "last", EnqueuedAt: now},
+	}
+	for _, n := range items {
+		if err := q.EnqueueNotification(ctx, n); err != nil {
+			t.Fatalf("enqueue notification: %v", err)
+		}
+	}
+
+	until := now.Add(5 * time.Minute)
+	claimed, err := q.ClaimNotifications(ctx, now, until, 2)
+	if err != nil {
+		t.Fatalf("claim notifications: %v", err)
+	}
+	if len(claimed) != 2 || claimed[0].Seq != items[1].Seq || claimed[1].Seq != items[2].Seq {
+		t.Fatalf("expected free and lapsed notifications, got %+v", claimed)
+	}
+	if !claimed[0].LeaseUntil.Equal(until) || claimed[1].Payload != "lapsed" {
+		t.Errorf("claimed fields not set: %+v", claimed)
+	}
+
+	// Another instance only gets what is left.
+	claimed, err = q.ClaimNotifications(ctx, now, until, 0)
+	if err != nil {
+		t.Fatalf("claim notifications: %v", err)
+	}
+	if len(claimed) != 1 || claimed[0].Seq != items[3].Seq {
+		t.Fatalf("expected only the last notification, got %+v", claimed)
+	}
+	if claimed, _ := q.ClaimNotifications(ctx, now, until, 0); len(claimed) != 0 {
+		t.Fatalf("expected nothing left to claim, got %+v", claimed)
+	}
+
+	// Once the leases end everything unacknowledged is claimed again.
+	if err := q.AckNotification(ctx, items[1].Seq); err != nil {
+		t.Fatalf("ack notification: %v", err)
+	}
+	claimed, err = q.ClaimNotifications(ctx, until, until.Add(5*time.Minute), 0)
+	if err != nil {
+		t.Fatalf("claim notifications: %v", err)
+	}
+	if len(claimed) != 3 || claimed[0].Seq != items[0].Seq || claimed[1].Seq != items[2].Seq || claimed[2].Seq != items[3].Seq {
+		t.Fatalf("expected the expired leases, got %+v", claimed)
+	}
+}
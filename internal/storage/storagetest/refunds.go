@@ -0,0 +1,77 @@
+package storagetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// RefundStoreFactory returns a ready to use RefundStore.
+type RefundStoreFactory func(t *testing.T) storage.RefundStore
+
+// RunRefundStore executes the conformance suite for storage.RefundStore.
+// Every factory call must return an empty store.
+func RunRefundStore(t *testing.T, newStore RefundStoreFactory) {
+	t.Run("History", func(t *testing.T) { testRefundHistory(t, newStore(t)) })
+}
+
+func testRefundHistory(t *testing.T, st storage.RefundStore) {
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	user := Token(t, "user")
+	product := Token(t, "product")
+	price := int64(9990)
+	reason := 1
+
+	reversed := &storage.Refund{ID: Token(t, "reversed"), UserToken: user, ProductID: product, TransactionID: "3001",
+		OriginalTransactionID: "3000", Type: storage.RefundReversed, OccurredAt: base.Add(time.Hour)}
+	granted := &storage.Refund{ID: Token(t, "granted"), UserToken: user, ProductID: product, TransactionID: "3001",
+		OriginalTransactionID: "3000", Type: storage.RefundGranted, RevocationReason: &reason, Price: &price, Currency: "USD",
+		Environment: "Sandbox", OccurredAt: base}
+	other := &storage.Refund{ID: Token(t, "other"), UserToken: Token(t, "other"), ProductID: product, TransactionID: "4001",
+		Type: storage.RefundDeclined, OccurredAt: base.Add(2 * time.Hour)}
+	for _, r := range []*storage.Refund{reversed, granted, other} {
+		if err := st.RecordRefund(ctx, r); err != nil {
+			t.Fatalf("record refund: %v", err)
+		}
+	}
+
+	// Recording the same ID again keeps the original entry.
+	changed := *granted
+	changed.Type = storage.RefundDeclined
+	if err := st.RecordRefund(ctx, &changed); err != nil {
+		t.Fatalf("record duplicate refund: %v", err)
+	}
+
+	refunds, err := st.ListRefunds(ctx, user)
+	if err != nil {
+		t.Fatalf("list refunds: %v", err)
+	}
+	if len(refunds) != 2 || refunds[0].ID != granted.ID || refunds[1].ID != reversed.ID {
+		t.Fatalf("expected [%s %s], got %+v", granted.ID, reversed.ID, refunds)
+	}
+	got := refunds[0]
+	if got.Type != storage.RefundGranted || got.RevocationReason == nil || *got.RevocationReason != 1 ||
+		got.Price == nil || *got.Price != price || got.Currency != "USD" || got.Environment != "Sandbox" ||
+		got.OriginalTransactionID != "3000" || !got.OccurredAt.Equal(base) {
+		t.Errorf("fields not preserved: %+v", got)
+	}
+	if refunds[1].RevocationReason != nil || refunds[1].Price != nil {
+		t.Errorf("expected no reason and price, got %+v", refunds[1])
+	}
+
+	byProduct, err := st.ListProductRefunds(ctx, product)
+	if err != nil {
+		t.Fatalf("list product refunds: %v", err)
+	}
+	if len(byProduct) != 3 || byProduct[2].ID != other.ID {
+		t.Errorf("expected 3 refunds ending with %s, got %+v", other.ID, byProduct)
+	}
+
+	empty, err := st.ListRefunds(ctx, Token(t, "nobody"))
+	if err != nil || len(empty) != 0 {
+		t.Errorf("expected no refunds, got %+v (%v)", empty, err)
+	}
+}
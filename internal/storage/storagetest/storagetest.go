@@ -0,0 +1,390 @@
+// Package storagetest provides a conformance suite that every storage.Storage
+// implementation is expected to pass.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// Factory returns a ready to use Storage. Backends that keep state between
+// calls (databases) must make sure tokens from different tests do not collide;
+// the suite itself always uses unique user tokens.
+type Factory func(t *testing.T) storage.Storage
+
+// Run executes the whole conformance suite against storages built by newStorage.
+func Run(t *testing.T, newStorage Factory) {
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, newStorage(t)) })
+	t.Run("SetAndGet", func(t *testing.T) { testSetAndGet(t, newStorage(t)) })
+	t.Run("Facts", func(t *testing.T) { testFacts(t, newStorage(t)) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, newStorage(t)) })
+	t.Run("IndependentUsers", func(t *testing.T) { testIndependentUsers(t, newStorage(t)) })
+	t.Run("CopyIsolation", func(t *testing.T) { testCopyIsolation(t, newStorage(t)) })
+	t.Run("CanceledContext", func(t *testing.T) { testCanceledContext(t, newStorage(t)) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newStorage(t)) })
+	t.Run("ExpiredActive", func(t *testing.T) { testExpiredActive(t, newStorage(t)) })
+	t.Run("DeactivateSubscription", func(t *testing.T) { testDeactivateSubscription(t, newStorage(t)) })
+}
+
+// Token returns a user token unique to the running test.
+func Token(t *testing.T, suffix string) string {
+	return fmt.Sprintf("%s/%s/%d", t.Name(), suffix, time.Now().UnixNano())
+}
+
+func testNotFound(t *testing.T, st storage.Storage) {
+	_, err := st.GetSubscriptionStatus(context.Background(), Token(t, "missing"))
+	if !errors.Is(err, storage.ErrSubscriptionNotFound) {
+		t.Errorf("expected %v, got %v", storage.ErrSubscriptionNotFound, err)
+	}
+}
+
+func testSetAndGet(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	want := &storage.SubscriptionStatus{
+		ExpiresAt:             time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		UserToken:             Token(t, "user"),
+		ProductID:             "com.test.product",
+		OriginalTransactionID: "1000000123456789",
+		IsActive:              true,
+	}
+	if err := st.SetSubscriptionStatus(ctx, want); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+
+	got, err := st.GetSubscriptionStatus(ctx, want.UserToken)
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	assertEqual(t, want, got)
+}
+
+func testFacts(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	want := &storage.SubscriptionStatus{
+		ExpiresAt:             time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		UserToken:             Token(t, "user"),
+		ProductID:             "com.test.product",
+		OriginalTransactionID: "1000000123456789",
+		GracePeriodExpiresAt:  time.Date(2030, 1, 18, 3, 4, 5, 0, time.UTC),
+		InBillingRetry:        true,
+		RevokedAt:             time.Date(2030, 1, 3, 0, 0, 0, 0, time.UTC),
+		Environment:           "Sandbox",
+		AutoRenewEnabled:      new(bool),
+		ExpirationIntent:      2,
+		AutoRenewProductID:    "com.test.product.yearly",
+		PendingProductID:      "com.test.product.yearly",
+		RenewalPrice:          new(int64),
+		RenewalCurrency:       "EUR",
+		OriginalPurchaseDate:  time.Date(2029, 6, 1, 10, 0, 0, 0, time.UTC),
+		OwnershipType:         "FAMILY_SHARED",
+		SubscriptionGroupID:   "21000000",
+		OfferType:             1,
+		OfferID:               "intro-week",
+	}
+	*want.RenewalPrice = 49990
+	if err := st.SetSubscriptionStatus(ctx, want); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+
+	got, err := st.GetSubscriptionStatus(ctx, want.UserToken)
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	assertEqual(t, want, got)
+}
+
+func testOverwrite(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	token := Token(t, "user")
+	first := &storage.SubscriptionStatus{UserToken: token, ProductID: "first", IsActive: true}
+	second := &storage.SubscriptionStatus{UserToken: token, ProductID: "second"}
+
+	if err := st.SetSubscriptionStatus(ctx, first); err != nil {
+		t.Fatalf("set first status: %v", err)
+	}
+	if err := st.SetSubscriptionStatus(ctx, second); err != nil {
+		t.Fatalf("set second status: %v", err)
+	}
+
+	got, err := st.GetSubscriptionStatus(ctx, token)
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	assertEqual(t, second, got)
+}
+
+func testIndependentUsers(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	a := &storage.SubscriptionStatus{UserToken: Token(t, "a"), ProductID: "a", IsActive: true}
+	b := &storage.SubscriptionStatus{UserToken: Token(t, "b"), ProductID: "b"}
+
+	for _, s := range []*storage.SubscriptionStatus{a, b} {
+		if err := st.SetSubscriptionStatus(ctx, s); err != nil {
+			t.Fatalf("set status %s: %v", s.UserToken, err)
+		}
+	}
+	for _, want := range []*storage.SubscriptionStatus{a, b} {
+		got, err := st.GetSubscriptionStatus(ctx, want.UserToken)
+		if err != nil {
+			t.Fatalf("get status %s: %v", want.UserToken, err)
+		}
+		assertEqual(t, want, got)
+	}
+}
+
+// testCopyIsolation checks that neither the status passed to Set nor the one
+// returned from Get aliases the stored record.
+func testCopyIsolation(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	token := Token(t, "user")
+	price := int64(9990)
+	input := &storage.SubscriptionStatus{UserToken: token, ProductID: "original", IsActive: true, RenewalPrice: &price}
+	wantPrice := price
+	want := *input
+	want.RenewalPrice = &wantPrice
+
+	if err := st.SetSubscriptionStatus(ctx, input); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+	input.ProductID = "mutated input"
+	input.IsActive = false
+	price = 1
+
+	got, err := st.GetSubscriptionStatus(ctx, token)
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	assertEqual(t, &want, got)
+
+	got.ProductID = "mutated output"
+	got.ExpiresAt = time.Now()
+	*got.RenewalPrice = 2
+
+	again, err := st.GetSubscriptionStatus(ctx, token)
+	if err != nil {
+		t.Fatalf("get status again: %v", err)
+	}
+	assertEqual(t, &want, again)
+}
+
+func testCanceledContext(t *testing.T, st storage.Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	token := Token(t, "user")
+	err := st.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: token, IsActive: true})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("set with canceled context: expected %v, got %v", context.Canceled, err)
+	}
+
+	_, err = st.GetSubscriptionStatus(ctx, token)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("get with canceled context: expected %v, got %v", context.Canceled, err)
+	}
+
+	// A canceled write must not have been persisted.
+	_, err = st.GetSubscriptionStatus(context.Background(), token)
+	if !errors.Is(err, storage.ErrSubscriptionNotFound) {
+		t.Errorf("canceled write was persisted: got %v", err)
+	}
+}
+
+// testConcurrent hammers a small set of users from parallel readers and
+// writers. It is most useful under -race.
+func testConcurrent(t *testing.T, st storage.Storage) {
+	const (
+		users      = 4
+		goroutines = 8
+		iterations = 25
+	)
+	ctx := context.Background()
+
+	tokens := make([]string, users)
+	for i := range tokens {
+		tokens[i] = Token(t, fmt.Sprintf("user%d", i))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*iterations*2)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				token := tokens[(g+i)%users]
+				status := &storage.SubscriptionStatus{
+					UserToken: token,
+					ProductID: fmt.Sprintf("product-%d-%d", g, i),
+					IsActive:  i%2 == 0,
+				}
+				if err := st.SetSubscriptionStatus(ctx, status); err != nil {
+					errs <- fmt.Errorf("set %s: %w", token, err)
+				}
+				got, err := st.GetSubscriptionStatus(ctx, token)
+				if err != nil {
+					errs <- fmt.Errorf("get %s: %w", token, err)
+					continue
+				}
+				if got.UserToken != token {
+					errs <- fmt.Errorf("get %s returned record for %s", token, got.UserToken)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testExpiredActive(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	// Dates well before anything else the suite writes, so records of other
+	// tests sharing the backend never fall into the window.
+	base := time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := base.Add(time.Hour)
+
+	records := map[string]*storage.SubscriptionStatus{
+		"late":     {UserToken: Token(t, "late"), ExpiresAt: base.Add(30 * time.Minute), IsActive: true},
+		"early":    {UserToken: Token(t, "early"), ExpiresAt: base.Add(10 * time.Minute), IsActive: true},
+		"inactive": {UserToken: Token(t, "inactive"), ExpiresAt: base, IsActive: false},
+		"future":   {UserToken: Token(t, "future"), ExpiresAt: cutoff, IsActive: true},
+		"grace":    {UserToken: Token(t, "grace"), ExpiresAt: base, GracePeriodExpiresAt: cutoff.Add(time.Hour), IsActive: true},
+	}
+	for _, status := range records {
+		if err := st.SetSubscriptionStatus(ctx, status); err != nil {
+			t.Fatalf("set status: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, status := range records {
+			st.DeactivateSubscription(context.Background(), status)
+		}
+	})
+
+	mine := func(list []storage.SubscriptionStatus) []string {
+		var tokens []string
+		for _, status := range list {
+			for _, r := range records {
+				if status.UserToken == r.UserToken {
+					tokens = append(tokens, status.UserToken)
+				}
+			}
+		}
+		return tokens
+	}
+
+	list, err := st.ListExpiredActive(ctx, cutoff, 0)
+	if err != nil {
+		t.Fatalf("list expired: %v", err)
+	}
+	got := mine(list)
+	if len(got) != 2 || got[0] != records["early"].UserToken || got[1] != records["late"].UserToken {
+		t.Fatalf("expected [early late], got %v", got)
+	}
+	for _, status := range list {
+		if status.UserToken == records["early"].UserToken {
+			assertEqual(t, records["early"], &status)
+		}
+	}
+
+	list, err = st.ListExpiredActive(ctx, cutoff, 1)
+	if err != nil {
+		t.Fatalf("list expired with limit: %v", err)
+	}
+	if len(list) != 1 {
+		t.Errorf("expected 1 record with limit 1, got %d", len(list))
+	}
+}
+
+func testDeactivateSubscription(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	expiresAt := time.Date(1990, 2, 1, 0, 0, 0, 0, time.UTC)
+	status := &storage.SubscriptionStatus{
+		UserToken:            Token(t, "user"),
+		ProductID:            "com.test.product",
+		ExpiresAt:            expiresAt,
+		GracePeriodExpiresAt: expiresAt.Add(24 * time.Hour),
+		IsActive:             true,
+	}
+	if err := st.SetSubscriptionStatus(ctx, status); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+
+	// A stale expiry or grace period (the record was renewed meanwhile) must
+	// not match.
+	stale := *status
+	stale.ExpiresAt = expiresAt.Add(-time.Hour)
+	noGrace := *status
+	noGrace.GracePeriodExpiresAt = time.Time{}
+	for _, expected := range []*storage.SubscriptionStatus{&stale, &noGrace} {
+		changed, err := st.DeactivateSubscription(ctx, expected)
+		if err != nil {
+			t.Fatalf("deactivate with stale facts: %v", err)
+		}
+		if changed {
+			t.Errorf("deactivated a record with different facts: %+v", expected)
+		}
+	}
+
+	changed, err := st.DeactivateSubscription(ctx, status)
+	if err != nil {
+		t.Fatalf("deactivate: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected the record to be deactivated")
+	}
+	got, err := st.GetSubscriptionStatus(ctx, status.UserToken)
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	want := *status
+	want.IsActive = false
+	assertEqual(t, &want, got)
+
+	// The second sweeper loses.
+	changed, err = st.DeactivateSubscription(ctx, status)
+	if err != nil {
+		t.Fatalf("repeated deactivate: %v", err)
+	}
+	if changed {
+		t.Error("deactivated an already inactive record")
+	}
+
+	missing := *status
+	missing.UserToken = Token(t, "missing")
+	changed, err = st.DeactivateSubscription(ctx, &missing)
+	if err != nil || changed {
+		t.Errorf("deactivate missing record: changed=%v err=%v", changed, err)
+	}
+}
+
+func assertEqual(t *testing.T, want, got *storage.SubscriptionStatus) {
+	t.Helper()
+	if got == nil {
+		t.Fatalf("expected %+v, got nil", want)
+	}
+	if !got.Equal(want) {
+		t.Errorf("expected %s, got %s", describe(want), describe(got))
+	}
+}
+
+// describe formats s with pointer fields dereferenced.
+func describe(s *storage.SubscriptionStatus) string {
+	return fmt.Sprintf("%+v (autoRenewEnabled=%s renewalPrice=%s)", *s, fmtPtr(s.AutoRenewEnabled), fmtPtr(s.RenewalPrice))
+}
+
+func fmtPtr[T any](v *T) string {
+	if v == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*v)
+}
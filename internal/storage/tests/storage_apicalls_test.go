@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryAPICallLog_Conformance прогоняет общий набор тестов журнала запросов к Apple в памяти
+func TestMemoryAPICallLog_Conformance(t *testing.T) {
+	storagetest.RunAPICallLog(t, func(t *testing.T) storage.APICallLog {
+		return storage.NewMemoryAPICallLog()
+	})
+}
+
+// TestSQLiteAPICallLog_Conformance прогоняет общий набор тестов журнала запросов к Apple в SQLite
+func TestSQLiteAPICallLog_Conformance(t *testing.T) {
+	storagetest.RunAPICallLog(t, func(t *testing.T) storage.APICallLog {
+		s, ok := newSQLiteStorage(t).(storage.APICallLog)
+		if !ok {
+			t.Fatal("SQLite-хранилище не реализует storage.APICallLog")
+		}
+		return s
+	})
+}
+
+// TestRedisAPICallLog_Conformance прогоняет общий набор тестов журнала запросов к Apple в Redis
+func TestRedisAPICallLog_Conformance(t *testing.T) {
+	storagetest.RunAPICallLog(t, func(t *testing.T) storage.APICallLog {
+		s, ok := newRedisStorage(t).(storage.APICallLog)
+		if !ok {
+			t.Fatal("Redis-хранилище не реализует storage.APICallLog")
+		}
+		return s
+	})
+}
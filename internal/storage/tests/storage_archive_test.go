@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// archiveID строит уникальный идентификатор в формате архива
+func archiveID(receivedAt time.Time) string {
+	return fmt.Sprintf("%s-%d", receivedAt.UTC().Format("20060102"), time.Now().UnixNano())
+}
+
+// TestMemoryRequestArchive_Conformance прогоняет общий набор тестов архива в памяти
+func TestMemoryRequestArchive_Conformance(t *testing.T) {
+	storagetest.RunRequestArchive(t, func(t *testing.T) storage.RequestArchive {
+		return storage.NewMemoryRequestArchive()
+	}, archiveID)
+}
+
+// TestSQLiteRequestArchive_Conformance прогоняет общий набор тестов архива в SQLite
+func TestSQLiteRequestArchive_Conformance(t *testing.T) {
+	storagetest.RunRequestArchive(t, func(t *testing.T) storage.RequestArchive {
+		return asRequestArchive(t, newSQLiteStorage(t))
+	}, archiveID)
+}
+
+// TestRedisRequestArchive_Conformance прогоняет общий набор тестов архива в Redis
+func TestRedisRequestArchive_Conformance(t *testing.T) {
+	storagetest.RunRequestArchive(t, func(t *testing.T) storage.RequestArchive {
+		return asRequestArchive(t, newRedisStorage(t))
+	}, archiveID)
+}
+
+// TestPostgresRequestArchive_Conformance прогоняет общий набор тестов архива в Postgres
+func TestPostgresRequestArchive_Conformance(t *testing.T) {
+	storagetest.RunRequestArchive(t, func(t *testing.T) storage.RequestArchive {
+		return asRequestArchive(t, newPostgresStorage(t))
+	}, archiveID)
+}
+
+func asRequestArchive(t *testing.T, st storage.Storage) storage.RequestArchive {
+	t.Helper()
+
+	a, ok := st.(storage.RequestArchive)
+	if !ok {
+		t.Fatalf("%T не реализует storage.RequestArchive", st)
+	}
+	return a
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// fakeClock позволяет управлять временем кэша в тестах
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// TestCachedStorage_Conformance прогоняет общий набор тестов для кэша поверх memoryStorage
+func TestCachedStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewCachedStorage(storage.NewMemoryStorage(), storage.CacheOptions{
+			MaxEntries: 16,
+			TTL:        time.Minute,
+		})
+	})
+}
+
+// TestCachedStorage_HitsAndMisses проверяет счетчики попаданий и промахов
+func TestCachedStorage_HitsAndMisses(t *testing.T) {
+	ctx := context.Background()
+	cache := storage.NewCachedStorage(storage.NewMemoryStorage(), storage.CacheOptions{
+		MaxEntries: 16,
+		TTL:        time.Minute,
+	})
+	defer cache.Close()
+
+	if err := cache.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "user123"}); err != nil {
+		t.Fatalf("Ошибка при сохранении статуса: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetSubscriptionStatus(ctx, "user123"); err != nil {
+			t.Fatalf("Ошибка при получении статуса: %v", err)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Misses != 1 || stats.Hits != 2 {
+		t.Errorf("Ожидался 1 промах и 2 попадания, получено %+v", stats)
+	}
+}
+
+// TestCachedStorage_ActiveNotServedPastExpiry проверяет, что TTL ограничен ExpiresAt
+func TestCachedStorage_ActiveNotServedPastExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	backend := storage.NewMemoryStorage()
+	cache := storage.NewCachedStorage(backend, storage.CacheOptions{
+		MaxEntries: 16,
+		TTL:        time.Hour,
+		Now:        clock.Now,
+	})
+	defer cache.Close()
+
+	status := &storage.SubscriptionStatus{
+		UserToken: "user123",
+		ExpiresAt: clock.now.Add(time.Minute),
+		IsActive:  true,
+	}
+	if err := backend.SetSubscriptionStatus(ctx, status); err != nil {
+		t.Fatalf("Ошибка при сохранении статуса: %v", err)
+	}
+	if _, err := cache.GetSubscriptionStatus(ctx, "user123"); err != nil {
+		t.Fatalf("Ошибка при получении статуса: %v", err)
+	}
+
+	// Хранилище узнает об истечении подписки, но кэш об этом не уведомлен
+	status.IsActive = false
+	if err := backend.SetSubscriptionStatus(ctx, status); err != nil {
+		t.Fatalf("Ошибка при обновлении статуса: %v", err)
+	}
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	got, err := cache.GetSubscriptionStatus(ctx, "user123")
+	if err != nil {
+		t.Fatalf("Ошибка при получении статуса: %v", err)
+	}
+	if got.IsActive {
+		t.Error("Кэш вернул активную подписку после ExpiresAt")
+	}
+	if stats := cache.Stats(); stats.Hits != 0 {
+		t.Errorf("Ожидалось 0 попаданий, получено %+v", stats)
+	}
+}
+
+// TestCachedStorage_Eviction проверяет вытеснение по LRU
+func TestCachedStorage_Eviction(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewMemoryStorage()
+	cache := storage.NewCachedStorage(backend, storage.CacheOptions{
+		MaxEntries: 2,
+		TTL:        time.Minute,
+	})
+	defer cache.Close()
+
+	for _, token := range []string{"a", "b", "c"} {
+		if err := backend.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: token}); err != nil {
+			t.Fatalf("Ошибка при сохранении статуса: %v", err)
+		}
+	}
+	// a, b, снова a (a становится самым свежим), затем c вытесняет b
+	for _, token := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := cache.GetSubscriptionStatus(ctx, token); err != nil {
+			t.Fatalf("Ошибка при получении статуса: %v", err)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Evictions != 2 {
+		t.Errorf("Ожидалось 2 попадания, 4 промаха и 2 вытеснения, получено %+v", stats)
+	}
+}
+
+// TestCachedStorage_RemoteInvalidation проверяет сброс кэша при записи другим экземпляром
+func TestCachedStorage_RemoteInvalidation(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	writer := newRedisStorageAt(t, server.Addr())
+	cache := storage.NewCachedStorage(newRedisStorageAt(t, server.Addr()), storage.CacheOptions{
+		MaxEntries: 16,
+		TTL:        time.Hour,
+	})
+	defer cache.Close()
+
+	if err := writer.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "user123", ProductID: "old"}); err != nil {
+		t.Fatalf("Ошибка при сохранении статуса: %v", err)
+	}
+	if _, err := cache.GetSubscriptionStatus(ctx, "user123"); err != nil {
+		t.Fatalf("Ошибка при получении статуса: %v", err)
+	}
+	if err := writer.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "user123", ProductID: "new"}); err != nil {
+		t.Fatalf("Ошибка при обновлении статуса: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		got, err := cache.GetSubscriptionStatus(ctx, "user123")
+		if err != nil {
+			t.Fatalf("Ошибка при получении статуса: %v", err)
+		}
+		if got.ProductID == "new" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Кэш не был сброшен после записи другим экземпляром")
+}
+
+// closingNotifier выдает каналы изменений, которые тест может закрыть
+type closingNotifier struct {
+	storage.Storage
+	subscribed chan chan string
+}
+
+func (n *closingNotifier) SubscribeChanges(ctx context.Context) (<-chan string, error) {
+	changes := make(chan string)
+	n.subscribed <- changes
+	return changes, nil
+}
+
+// TestCachedStorage_Resubscribe проверяет обход кэша после потери подписки и повторную подписку
+func TestCachedStorage_Resubscribe(t *testing.T) {
+	ctx := context.Background()
+	backend := &closingNotifier{Storage: storage.NewMemoryStorage(), subscribed: make(chan chan string, 1)}
+	cache := storage.NewCachedStorage(backend, storage.CacheOptions{
+		MaxEntries:       16,
+		TTL:              time.Hour,
+		ResubscribeEvery: 10 * time.Millisecond,
+	})
+	defer cache.Close()
+
+	set := func(product string) {
+		t.Helper()
+		if err := backend.SetSubscriptionStatus(ctx, &storage.SubscriptionStatus{UserToken: "user123", ProductID: product}); err != nil {
+			t.Fatalf("Ошибка при сохранении статуса: %v", err)
+		}
+	}
+	get := func() string {
+		t.Helper()
+		got, err := cache.GetSubscriptionStatus(ctx, "user123")
+		if err != nil {
+			t.Fatalf("Ошибка при получении статуса: %v", err)
+		}
+		return got.ProductID
+	}
+	// eventually ждет, пока кэш вернет product
+	eventually := func(product string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for get() != product {
+			if time.Now().After(deadline) {
+				t.Fatalf("Кэш не вернул %q", product)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	set("old")
+	changes := <-backend.subscribed
+	eventually("old")
+
+	// Подписка закрыта: запись без уведомления видна сразу после обхода кэша
+	close(changes)
+	set("new")
+	eventually("new")
+
+	// После повторной подписки кэш снова работает
+	<-backend.subscribed
+	eventually("new")
+	before := cache.Stats().Hits
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.Stats().Hits == before {
+		if time.Now().After(deadline) {
+			t.Fatal("Кэш не включился после повторной подписки")
+		}
+		get()
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryStorage_Conformance прогоняет общий набор тестов для memoryStorage
+func TestMemoryStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+// TestSQLiteStorage_Conformance прогоняет общий набор тестов для SQLite
+func TestSQLiteStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, newSQLiteStorage)
+}
+
+// TestPostgresStorage_Conformance прогоняет общий набор тестов для Postgres
+func TestPostgresStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, newPostgresStorage)
+}
+
+// newSQLiteStorage создает базу SQLite во временной директории теста
+func newSQLiteStorage(t *testing.T) storage.Storage {
+	t.Helper()
+
+	st, err := storage.NewSQLiteStorage(context.Background(), filepath.Join(t.TempDir(), "subscriptions.db"))
+	if err != nil {
+		t.Fatalf("Не удалось открыть SQLite: %v", err)
+	}
+	t.Cleanup(st.Close)
+	return st
+}
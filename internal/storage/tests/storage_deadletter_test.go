@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryDeadLetterStore_Conformance прогоняет общий набор тестов очереди ошибок в памяти
+func TestMemoryDeadLetterStore_Conformance(t *testing.T) {
+	storagetest.RunDeadLetterStore(t, func(t *testing.T) storage.DeadLetterStore {
+		return storage.NewMemoryDeadLetterStore()
+	})
+}
+
+// TestSQLiteDeadLetterStore_Conformance прогоняет общий набор тестов очереди ошибок в SQLite
+func TestSQLiteDeadLetterStore_Conformance(t *testing.T) {
+	storagetest.RunDeadLetterStore(t, func(t *testing.T) storage.DeadLetterStore {
+		return asDeadLetterStore(t, newSQLiteStorage(t))
+	})
+}
+
+// TestRedisDeadLetterStore_Conformance прогоняет общий набор тестов очереди ошибок в Redis
+func TestRedisDeadLetterStore_Conformance(t *testing.T) {
+	storagetest.RunDeadLetterStore(t, func(t *testing.T) storage.DeadLetterStore {
+		return asDeadLetterStore(t, newRedisStorage(t))
+	})
+}
+
+func asDeadLetterStore(t *testing.T, st storage.Storage) storage.DeadLetterStore {
+	t.Helper()
+
+	dl, ok := st.(storage.DeadLetterStore)
+	if !ok {
+		t.Fatalf("%T не реализует storage.DeadLetterStore", st)
+	}
+	return dl
+}
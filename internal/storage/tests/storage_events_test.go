@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryEventStore_Conformance прогоняет общий набор тестов журнала событий в памяти
+func TestMemoryEventStore_Conformance(t *testing.T) {
+	storagetest.RunEventStore(t, func(t *testing.T) storage.EventStore {
+		return storage.NewMemoryEventStore()
+	})
+}
+
+// TestSQLiteEventStore_Conformance прогоняет общий набор тестов журнала событий в SQLite
+func TestSQLiteEventStore_Conformance(t *testing.T) {
+	storagetest.RunEventStore(t, func(t *testing.T) storage.EventStore {
+		return asEventStore(t, newSQLiteStorage(t))
+	})
+}
+
+// TestRedisEventStore_Conformance прогоняет общий набор тестов журнала событий в Redis
+func TestRedisEventStore_Conformance(t *testing.T) {
+	storagetest.RunEventStore(t, func(t *testing.T) storage.EventStore {
+		return asEventStore(t, newRedisStorage(t))
+	})
+}
+
+// TestPostgresEventStore_Conformance прогоняет общий набор тестов журнала событий в Postgres
+func TestPostgresEventStore_Conformance(t *testing.T) {
+	storagetest.RunEventStore(t, func(t *testing.T) storage.EventStore {
+		return asEventStore(t, newPostgresStorage(t))
+	})
+}
+
+func asEventStore(t *testing.T, st storage.Storage) storage.EventStore {
+	t.Helper()
+
+	events, ok := st.(storage.EventStore)
+	if !ok {
+		t.Fatalf("%T не реализует storage.EventStore", st)
+	}
+	return events
+}
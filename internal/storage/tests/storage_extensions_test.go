@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryExtensionStore_Conformance прогоняет общий набор тестов продлений подписок в памяти
+func TestMemoryExtensionStore_Conformance(t *testing.T) {
+	storagetest.RunExtensionStore(t, func(t *testing.T) storage.ExtensionStore {
+		return storage.NewMemoryExtensionStore()
+	})
+}
+
+// TestSQLiteExtensionStore_Conformance прогоняет общий набор тестов продлений подписок в SQLite
+func TestSQLiteExtensionStore_Conformance(t *testing.T) {
+	storagetest.RunExtensionStore(t, func(t *testing.T) storage.ExtensionStore {
+		s, ok := newSQLiteStorage(t).(storage.ExtensionStore)
+		if !ok {
+			t.Fatal("SQLite-хранилище не реализует storage.ExtensionStore")
+		}
+		return s
+	})
+}
+
+// TestRedisExtensionStore_Conformance прогоняет общий набор тестов продлений подписок в Redis
+func TestRedisExtensionStore_Conformance(t *testing.T) {
+	storagetest.RunExtensionStore(t, func(t *testing.T) storage.ExtensionStore {
+		s, ok := newRedisStorage(t).(storage.ExtensionStore)
+		if !ok {
+			t.Fatal("Redis-хранилище не реализует storage.ExtensionStore")
+		}
+		return s
+	})
+}
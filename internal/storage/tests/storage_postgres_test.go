@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// newPostgresStorage подключается к базе из POSTGRES_TEST_DSN. Локально без нее
+// тест пропускается, в CI база обязательна
+func newPostgresStorage(t *testing.T) storage.Storage {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("POSTGRES_TEST_DSN не задан в CI, интеграционные тесты Postgres не запущены")
+		}
+		t.Skip("POSTGRES_TEST_DSN не задан, пропускаем интеграционные тесты Postgres")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	st, err := storage.NewPostgresStorage(ctx, dsn, storage.PostgresOptions{MaxOpenConns: 4})
+	if err != nil {
+		t.Fatalf("Не удалось подключиться к Postgres: %v", err)
+	}
+	t.Cleanup(st.Close)
+	return st
+}
+
+// TestPostgresStorage_MigrationsIdempotent проверяет повторный запуск миграций
+func TestPostgresStorage_MigrationsIdempotent(t *testing.T) {
+	newPostgresStorage(t)
+	newPostgresStorage(t)
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryPurchaseStore_Conformance прогоняет общий набор тестов покупок в памяти
+func TestMemoryPurchaseStore_Conformance(t *testing.T) {
+	storagetest.RunPurchaseStore(t, func(t *testing.T) storage.PurchaseStore {
+		return storage.NewMemoryPurchaseStore()
+	})
+}
+
+// TestSQLitePurchaseStore_Conformance прогоняет общий набор тестов покупок в SQLite
+func TestSQLitePurchaseStore_Conformance(t *testing.T) {
+	storagetest.RunPurchaseStore(t, func(t *testing.T) storage.PurchaseStore {
+		s, ok := newSQLiteStorage(t).(storage.PurchaseStore)
+		if !ok {
+			t.Fatal("SQLite-хранилище не реализует storage.PurchaseStore")
+		}
+		return s
+	})
+}
+
+// TestRedisPurchaseStore_Conformance прогоняет общий набор тестов покупок в Redis
+func TestRedisPurchaseStore_Conformance(t *testing.T) {
+	storagetest.RunPurchaseStore(t, func(t *testing.T) storage.PurchaseStore {
+		s, ok := newRedisStorage(t).(storage.PurchaseStore)
+		if !ok {
+			t.Fatal("Redis-хранилище не реализует storage.PurchaseStore")
+		}
+		return s
+	})
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryNotificationQueue_Conformance прогоняет общий набор тестов очереди уведомлений в памяти
+func TestMemoryNotificationQueue_Conformance(t *testing.T) {
+	storagetest.RunNotificationQueue(t, func(t *testing.T) storage.NotificationQueue {
+		return storage.NewMemoryNotificationQueue()
+	})
+}
+
+// TestSQLiteNotificationQueue_Conformance прогоняет общий набор тестов очереди уведомлений в SQLite
+func TestSQLiteNotificationQueue_Conformance(t *testing.T) {
+	storagetest.RunNotificationQueue(t, func(t *testing.T) storage.NotificationQueue {
+		q, ok := newSQLiteStorage(t).(storage.NotificationQueue)
+		if !ok {
+			t.Fatal("SQLite-хранилище не реализует storage.NotificationQueue")
+		}
+		return q
+	})
+}
+
+// TestRedisNotificationQueue_Conformance прогоняет общий набор тестов очереди уведомлений в Redis
+func TestRedisNotificationQueue_Conformance(t *testing.T) {
+	storagetest.RunNotificationQueue(t, func(t *testing.T) storage.NotificationQueue {
+		q, ok := newRedisStorage(t).(storage.NotificationQueue)
+		if !ok {
+			t.Fatal("Redis-хранилище не реализует storage.NotificationQueue")
+		}
+		return q
+	})
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// newRedisStorage поднимает miniredis и подключает к нему хранилище
+func newRedisStorage(t *testing.T) storage.Storage {
+	t.Helper()
+	return newRedisStorageAt(t, miniredis.RunT(t).Addr())
+}
+
+func newRedisStorageAt(t *testing.T, addr string) storage.Storage {
+	t.Helper()
+
+	st, err := storage.NewRedisStorage(context.Background(), storage.RedisOptions{Addr: addr})
+	if err != nil {
+		t.Fatalf("Не удалось подключиться к Redis: %v", err)
+	}
+	t.Cleanup(st.Close)
+	return st
+}
+
+// TestRedisStorage_Conformance прогоняет общий набор тестов для Redis
+func TestRedisStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, newRedisStorage)
+}
+
+// TestRedisStorage_ChangeNotifications проверяет, что запись одним экземпляром видна другому
+func TestRedisStorage_ChangeNotifications(t *testing.T) {
+	server := miniredis.RunT(t)
+	writer := newRedisStorageAt(t, server.Addr())
+	reader := newRedisStorageAt(t, server.Addr())
+
+	notifier, ok := reader.(storage.ChangeNotifier)
+	if !ok {
+		t.Fatal("Redis-хранилище должно реализовывать storage.ChangeNotifier")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes, err := notifier.SubscribeChanges(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка подписки на изменения: %v", err)
+	}
+
+	status := &storage.SubscriptionStatus{UserToken: "user123", ProductID: "com.test.product", IsActive: true}
+	if err := writer.SetSubscriptionStatus(context.Background(), status); err != nil {
+		t.Fatalf("Ошибка при сохранении статуса: %v", err)
+	}
+
+	select {
+	case token := <-changes:
+		if token != "user123" {
+			t.Errorf("Ожидалось уведомление для user123, получено %s", token)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Уведомление об изменении не получено")
+	}
+
+	cancel()
+	select {
+	case _, open := <-changes:
+		if open {
+			t.Error("Канал изменений должен закрываться после отмены контекста")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Канал изменений не закрылся после отмены контекста")
+	}
+}
+
+// TestRedisStorage_OriginalTransactionIndex проверяет обновление вторичного индекса
+func TestRedisStorage_OriginalTransactionIndex(t *testing.T) {
+	st := newRedisStorage(t)
+	ctx := context.Background()
+
+	index, ok := st.(interface {
+		UserTokensByOriginalTransactionID(ctx context.Context, originalTransactionID string) ([]string, error)
+	})
+	if !ok {
+		t.Fatal("Redis-хранилище должно поддерживать поиск по OriginalTransactionID")
+	}
+
+	for _, status := range []*storage.SubscriptionStatus{
+		{UserToken: "a", OriginalTransactionID: "100"},
+		{UserToken: "b", OriginalTransactionID: "100"},
+		{UserToken: "c", OriginalTransactionID: "200"},
+		// Пользователь b переходит на другую транзакцию и должен пропасть из индекса 100
+		{UserToken: "b", OriginalTransactionID: "200"},
+	} {
+		if err := st.SetSubscriptionStatus(ctx, status); err != nil {
+			t.Fatalf("Ошибка при сохранении статуса: %v", err)
+		}
+	}
+
+	check := func(otx string, want []string) {
+		got, err := index.UserTokensByOriginalTransactionID(ctx, otx)
+		if err != nil {
+			t.Fatalf("Ошибка поиска по индексу: %v", err)
+		}
+		sort.Strings(got)
+		if len(got) != len(want) {
+			t.Fatalf("Индекс %s: ожидалось %v, получено %v", otx, want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Индекс %s: ожидалось %v, получено %v", otx, want, got)
+			}
+		}
+	}
+	check("100", []string{"a"})
+	check("200", []string{"b", "c"})
+}
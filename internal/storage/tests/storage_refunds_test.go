@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+
+	"subscription-server/internal/storage"
+	"subscription-server/internal/storage/storagetest"
+)
+
+// TestMemoryRefundStore_Conformance прогоняет общий набор тестов истории возвратов в памяти
+func TestMemoryRefundStore_Conformance(t *testing.T) {
+	storagetest.RunRefundStore(t, func(t *testing.T) storage.RefundStore {
+		return storage.NewMemoryRefundStore()
+	})
+}
+
+// TestSQLiteRefundStore_Conformance прогоняет общий набор тестов истории возвратов в SQLite
+func TestSQLiteRefundStore_Conformance(t *testing.T) {
+	storagetest.RunRefundStore(t, func(t *testing.T) storage.RefundStore {
+		s, ok := newSQLiteStorage(t).(storage.RefundStore)
+		if !ok {
+			t.Fatal("SQLite-хранилище не реализует storage.RefundStore")
+		}
+		return s
+	})
+}
+
+// TestRedisRefundStore_Conformance прогоняет общий набор тестов истории возвратов в Redis
+func TestRedisRefundStore_Conformance(t *testing.T) {
+	storagetest.RunRefundStore(t, func(t *testing.T) storage.RefundStore {
+		s, ok := newRedisStorage(t).(storage.RefundStore)
+		if !ok {
+			t.Fatal("Redis-хранилище не реализует storage.RefundStore")
+		}
+		return s
+	})
+}
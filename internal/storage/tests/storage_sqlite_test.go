@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"subscription-server/internal/storage"
+)
+
+// TestSQLiteStorage_Persistence проверяет, что данные переживают переоткрытие базы
+func TestSQLiteStorage_Persistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "subscriptions.db")
+
+	st, err := storage.NewSQLiteStorage(ctx, path)
+	if err != nil {
+		t.Fatalf("Не удалось открыть SQLite: %v", err)
+	}
+	want := &storage.SubscriptionStatus{
+		ExpiresAt:             time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		UserToken:             "user123",
+		ProductID:             "com.test.product",
+		OriginalTransactionID: "123456",
+		IsActive:              true,
+	}
+	if err := st.SetSubscriptionStatus(ctx, want); err != nil {
+		t.Fatalf("Ошибка при сохранении статуса: %v", err)
+	}
+	st.Close()
+
+	// Повторное открытие также повторно запускает миграции
+	reopened, err := storage.NewSQLiteStorage(ctx, path)
+	if err != nil {
+		t.Fatalf("Не удалось переоткрыть SQLite: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.GetSubscriptionStatus(ctx, "user123")
+	if err != nil {
+		t.Fatalf("Ошибка при получении статуса: %v", err)
+	}
+	if !got.ExpiresAt.Equal(want.ExpiresAt) || got.ProductID != want.ProductID || !got.IsActive {
+		t.Errorf("Некорректный статус после переоткрытия: %+v", got)
+	}
+}
+
+// TestSQLiteStorage_WALMode проверяет, что база переведена в режим WAL
+func TestSQLiteStorage_WALMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.db")
+
+	st, err := storage.NewSQLiteStorage(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Не удалось открыть SQLite: %v", err)
+	}
+	defer st.Close()
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось открыть файл базы: %v", err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatalf("Не удалось прочитать journal_mode: %v", err)
+	}
+	if mode != "wal" {
+		t.Errorf("Ожидался journal_mode wal, получен %s", mode)
+	}
+}
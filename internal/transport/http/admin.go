@@ -0,0 +1,169 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"subscription-server/internal/deadletter"
+	"subscription-server/internal/deps"
+	"subscription-server/internal/projection"
+	"subscription-server/internal/storage"
+)
+
+// requireAdmin only lets through requests carrying the configured admin token
+// as a bearer token. Without a configured token every request is rejected.
+func requireAdmin(d *deps.Deps, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if d.AdminToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(d.AdminToken)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleUserEvents(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	userToken := r.URL.Query().Get("userToken")
+	if userToken == "" {
+		http.Error(w, "missing userToken", http.StatusBadRequest)
+		return
+	}
+
+	events, err := d.Events.ListEvents(r.Context(), userToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"userToken": userToken,
+		"events":    events,
+	})
+}
+
+func handleAPICalls(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	userToken := r.URL.Query().Get("userToken")
+	if userToken == "" {
+		http.Error(w, "missing userToken", http.StatusBadRequest)
+		return
+	}
+
+	calls, err := d.APICalls.ListAPICalls(r.Context(), userToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list api calls: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"userToken": userToken,
+		"calls":     calls,
+	})
+}
+
+func handleRebuild(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	dryRun := true
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid dryRun", http.StatusBadRequest)
+			return
+		}
+		dryRun = parsed
+	}
+
+	report, err := d.Projection.Rebuild(r.Context(), projection.Options{DryRun: dryRun})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to rebuild: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, report)
+}
+
+func handleArchivedRequest(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	if d.Archive == nil {
+		http.Error(w, "request archive is disabled", http.StatusNotFound)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	req, err := d.Archive.GetRequest(r.Context(), id)
+	if errors.Is(err, storage.ErrArchivedRequestNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get archived request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, req)
+}
+
+func handleDeadLetters(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		list, err := d.DeadLetters.List(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list dead letters: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{"deadLetters": list})
+		return
+	}
+
+	dl, err := d.DeadLetters.Get(r.Context(), id)
+	if errors.Is(err, storage.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get dead letter: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, dl)
+}
+
+func handleRetryDeadLetters(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if all, _ := strconv.ParseBool(query.Get("all")); all {
+		results, err := d.DeadLetters.RetryAll(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to retry dead letters: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{"results": results})
+		return
+	}
+
+	id := query.Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	err := d.DeadLetters.Retry(r.Context(), id)
+	if errors.Is(err, storage.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, map[string]any{"results": []deadletter.RetryResult{{ID: id}}})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"subscription-server/internal/credits"
+	"subscription-server/internal/deps"
+	"subscription-server/internal/storage"
+)
+
+func handleCredits(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	userToken := r.URL.Query().Get("userToken")
+	if userToken == "" {
+		http.Error(w, "missing userToken", http.StatusBadRequest)
+		return
+	}
+
+	balance, err := d.Credits.Balance(r.Context(), userToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get balance: %v", err), http.StatusInternalServerError)
+		return
+	}
+	history, err := d.Credits.History(r.Context(), userToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"balance": balance,
+		"entries": history,
+	})
+}
+
+func handleDebitCredits(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	var req credits.DebitRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := d.Credits.Debit(r.Context(), req)
+	switch {
+	case errors.Is(err, credits.ErrInvalidDebit):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, storage.ErrLedgerEntryConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, storage.ErrInsufficientBalance):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to debit credits: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	balance, err := d.Credits.Balance(r.Context(), req.UserToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get balance: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"entry":   entry,
+		"balance": balance,
+	})
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"subscription-server/internal/appstoreapi"
+	"subscription-server/internal/deps"
+	"subscription-server/internal/extensions"
+	"subscription-server/internal/storage"
+)
+
+func handleRenewalExtensions(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	if !extensionsConfigured(d, w) {
+		return
+	}
+
+	if id := r.URL.Query().Get("requestId"); id != "" {
+		ext, err := d.Extensions.Get(r.Context(), id)
+		if err != nil {
+			writeExtensionError(w, err)
+			return
+		}
+		writeJSON(w, ext)
+		return
+	}
+
+	list, err := d.Extensions.List(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list renewal extensions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{"extensions": list})
+}
+
+func handleExtendRenewal(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	var req extensions.Request
+	if !extensionsConfigured(d, w) || !decodeExtensionRequest(w, r, &req) {
+		return
+	}
+
+	ext, err := d.Extensions.Extend(r.Context(), req)
+	if err != nil {
+		writeExtensionError(w, err)
+		return
+	}
+	writeJSON(w, ext)
+}
+
+func handleMassExtendRenewal(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	var req extensions.MassRequest
+	if !extensionsConfigured(d, w) || !decodeExtensionRequest(w, r, &req) {
+		return
+	}
+
+	ext, err := d.Extensions.ExtendAll(r.Context(), req)
+	if err != nil {
+		writeExtensionError(w, err)
+		return
+	}
+	writeJSON(w, ext)
+}
+
+func extensionsConfigured(d *deps.Deps, w http.ResponseWriter) bool {
+	if d.Extensions == nil {
+		http.Error(w, "App Store Server API is not configured", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func decodeExtensionRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeExtensionError(w http.ResponseWriter, err error) {
+	var apiErr *appstoreapi.Error
+	switch {
+	case errors.Is(err, extensions.ErrInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, extensions.ErrNoSubscription), errors.Is(err, storage.ErrRenewalExtensionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &apiErr):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, fmt.Sprintf("failed to extend renewal date: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"subscription-server/internal/deps"
+	"subscription-server/internal/offers"
+)
+
+func handleOfferSignature(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeOfferRequest(d, w, r)
+	if !ok {
+		return
+	}
+
+	sig, err := d.Offers.Sign(r.Context(), req)
+	if err != nil {
+		writeOfferError(w, err)
+		return
+	}
+	writeJSON(w, sig)
+}
+
+// handleOfferToken answers with the StoreKit 2 token sign makes for the
+// request.
+func handleOfferToken(d *deps.Deps, w http.ResponseWriter, r *http.Request,
+	sign func(offers.Signer, context.Context, offers.Request) (*offers.SignedToken, error)) {
+	req, ok := decodeOfferRequest(d, w, r)
+	if !ok {
+		return
+	}
+
+	token, err := sign(d.Offers, r.Context(), req)
+	if err != nil {
+		writeOfferError(w, err)
+		return
+	}
+	writeJSON(w, token)
+}
+
+func decodeOfferRequest(d *deps.Deps, w http.ResponseWriter, r *http.Request) (offers.Request, bool) {
+	var req offers.Request
+	if d.Offers == nil {
+		http.Error(w, "offer signing is not configured", http.StatusServiceUnavailable)
+		return req, false
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func writeOfferError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, offers.ErrInvalidRequest), errors.Is(err, offers.ErrUnknownBundle):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, offers.ErrNotEligible):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, offers.ErrNoIssuer), errors.Is(err, offers.ErrNoCustomers):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, fmt.Sprintf("failed to sign offer: %v", err), http.StatusInternalServerError)
+	}
+}
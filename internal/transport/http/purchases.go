@@ -0,0 +1,50 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"subscription-server/internal/deps"
+	"time"
+)
+
+// clientPurchase is what the app learns about a purchase that grants access.
+// Transaction IDs and purchases that no longer grant access stay on the
+// server, since anyone who knows a user token may ask.
+type clientPurchase struct {
+	ProductID   string    `json:"productId"`
+	ProductType string    `json:"productType"`
+	ExpiresAt   time.Time `json:"expiresAt,omitzero"`
+}
+
+// handleClientPurchases returns the one-off purchases of a user that are
+// active under the entitlement policy, and their consumable balances.
+func handleClientPurchases(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	userToken := r.URL.Query().Get("userToken")
+	if userToken == "" {
+		http.Error(w, "userToken is required", http.StatusBadRequest)
+		return
+	}
+
+	purchases, err := d.Purchases.ListPurchases(r.Context(), userToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list purchases: %v", err), http.StatusInternalServerError)
+		return
+	}
+	balances, err := d.Purchases.Balances(r.Context(), userToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get balances: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	active := []clientPurchase{}
+	for _, p := range d.Entitlements.ResolvePurchases(purchases, time.Now().UTC()) {
+		if p.IsActive {
+			active = append(active, clientPurchase{ProductID: p.ProductID, ProductType: p.ProductType, ExpiresAt: p.ExpiresAt})
+		}
+	}
+	writeJSON(w, map[string]any{
+		"userToken": userToken,
+		"purchases": active,
+		"balances":  balances,
+	})
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"subscription-server/internal/deps"
+)
+
+func handleRefunds(d *deps.Deps, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userToken, productID := query.Get("userToken"), query.Get("productId")
+
+	switch {
+	case userToken != "" && productID == "":
+		summary, err := d.Refunds.User(r.Context(), userToken)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get refunds: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, summary)
+	case productID != "" && userToken == "":
+		summary, err := d.Refunds.Product(r.Context(), productID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get refunds: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, summary)
+	default:
+		http.Error(w, "pass either userToken or productId", http.StatusBadRequest)
+	}
+}
@@ -3,7 +3,10 @@ package http
 import (
 	"encoding/json"
 	"net/http"
+	"subscription-server/internal/archive"
+	"subscription-server/internal/contracts"
 	"subscription-server/internal/deps"
+	"subscription-server/internal/offers"
 )
 
 func NewRouter(d *deps.Deps) http.Handler {
@@ -20,41 +23,63 @@ func NewRouter(d *deps.Deps) http.Handler {
 		json.NewEncoder(w).Encode(response)
 	})
 
-	mux.HandleFunc("/api/v1/notifications/apple/v2", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/notifications/apple/v2", archived(d, "/api/v1/notifications/apple/v2", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		// Handle Apple Store Connect notifications (Server-to-Server)
 		d.AppleService.HandleProviderNotification(w, r)
-	})
+	}))
 
-	mux.HandleFunc("/api/v1/notifications/google", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/notifications/google", archived(d, "/api/v1/notifications/google", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		// Handle Google Play notifications (Server-to-Server)
 		d.GoogleService.HandleProviderNotification(w, r)
-	})
+	}))
 
-	mux.HandleFunc("/api/v1/notifications/client/ios", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/notifications/client/ios", archived(d, "/api/v1/notifications/client/ios", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		// Handle iOS Client notifications
 		d.AppleService.HandleClientNotification(w, r)
-	})
+	}))
 
-	mux.HandleFunc("/api/v1/notifications/client/android", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/notifications/client/android", archived(d, "/api/v1/notifications/client/android", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		// Handle Android Client notifications
 		d.GoogleService.HandleClientNotification(w, r)
-	})
+	}))
+
+	if receipts, ok := d.AppleService.(contracts.ReceiptService); ok {
+		mux.HandleFunc("/api/v1/notifications/client/ios/receipt", archived(d, "/api/v1/notifications/client/ios/receipt", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// Handle StoreKit 1 app receipts of older app versions
+			receipts.HandleClientReceipt(w, r)
+		}))
+	}
+
+	if appTransactions, ok := d.AppleService.(contracts.AppTransactionService); ok {
+		mux.HandleFunc("/api/v1/requests/client/ios/app-transaction", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// Grant the legacy purchaser entitlement for a verified app transaction
+			appTransactions.HandleAppTransaction(w, r)
+		})
+	}
 
 	mux.HandleFunc("/api/v1/requests/client/ios/status", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -74,5 +99,157 @@ func NewRouter(d *deps.Deps) http.Handler {
 		d.GoogleService.HandleClientRequest(w, r)
 	})
 
+	mux.HandleFunc("/api/v1/requests/client/ios/offer-signature", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Sign a promotional offer for an eligible user
+		handleOfferSignature(d, w, r)
+	})
+
+	mux.HandleFunc("/api/v1/requests/client/ios/promotional-offer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Sign a promotional offer as a StoreKit 2 token
+		handleOfferToken(d, w, r, offers.Signer.SignPromotionalOffer)
+	})
+
+	mux.HandleFunc("/api/v1/requests/client/ios/intro-eligibility", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Sign the introductory offer eligibility of a user
+		handleOfferToken(d, w, r, offers.Signer.SignIntroEligibility)
+	})
+
+	mux.HandleFunc("/api/v1/requests/client/purchases", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// One-off purchases and consumable balances of a user
+		handleClientPurchases(d, w, r)
+	})
+
+	mux.HandleFunc("/api/v1/admin/events", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Subscription timeline of a single user
+		handleUserEvents(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/api-calls", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// App Store Server API requests made for a single user
+		handleAPICalls(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/archive", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Archived inbound notification by ID
+		handleArchivedRequest(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/deadletters", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// List dead letters, or inspect one by ID
+		handleDeadLetters(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/deadletters/retry", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Reprocess one or all dead letters
+		handleRetryDeadLetters(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/credits", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Credit balance and movements of a user
+		handleCredits(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/credits/debit", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Spend credits on behalf of the backend
+		handleDebitCredits(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/refunds", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Refund history and abuse signals of a user or product
+		handleRefunds(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/renewal-extensions", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Renewal extension requests and their outcome
+		handleRenewalExtensions(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/renewal-extensions/extend", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Extend the renewal date of one user's subscription
+		handleExtendRenewal(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/renewal-extensions/mass", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Extend the renewal date of every active subscriber of a product
+		handleMassExtendRenewal(d, w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/admin/rebuild", requireAdmin(d, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Rebuild subscription statuses from the event history
+		handleRebuild(d, w, r)
+	}))
+
 	return mux
 }
+
+// archived stores every request to endpoint in the configured archive.
+func archived(d *deps.Deps, endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	if d.Archive == nil {
+		return next
+	}
+	return archive.Middleware(d.Archive, d.Logger, endpoint, next)
+}